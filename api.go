@@ -63,7 +63,21 @@ func LastOperation(p martini.Params, req *http.Request, r render.Render, brokerD
 // BindInstance processes all requests for binding a service instance to an application.
 // URL: /v2/service_instances/:instance_id/service_bindings/:binding_id
 func BindInstance(p martini.Params, req *http.Request, r render.Render, brokerDb *gorm.DB, s *config.Settings, c *catalog.Catalog, q *taskqueue.QueueManager) {
-	resp := bindInstance(req, c, brokerDb, p["instance_id"], s, q)
+	resp := bindInstance(req, c, brokerDb, p["instance_id"], p["id"], s, q)
+	r.JSON(resp.GetStatusCode(), resp)
+}
+
+// BindingLastOperation processes all requests for polling the status of a service binding.
+// URL: /v2/service_instances/:instance_id/service_bindings/:binding_id/last_operation
+func BindingLastOperation(p martini.Params, req *http.Request, r render.Render, brokerDb *gorm.DB, s *config.Settings, c *catalog.Catalog, q *taskqueue.QueueManager) {
+	resp := bindingLastOperation(req, c, brokerDb, p["instance_id"], p["id"], s, q)
+	r.JSON(resp.GetStatusCode(), resp)
+}
+
+// UnbindInstance processes all requests for unbinding a service instance from an application.
+// URL: /v2/service_instances/:instance_id/service_bindings/:binding_id
+func UnbindInstance(p martini.Params, req *http.Request, r render.Render, brokerDb *gorm.DB, s *config.Settings, c *catalog.Catalog, q *taskqueue.QueueManager) {
+	resp := unbindInstance(req, c, brokerDb, p["instance_id"], p["id"], s, q)
 	r.JSON(resp.GetStatusCode(), resp)
 }
 
@@ -73,3 +87,17 @@ func DeleteInstance(p martini.Params, req *http.Request, r render.Render, broker
 	resp := deleteInstance(req, c, brokerDb, p["instance_id"], s, q)
 	r.JSON(resp.GetStatusCode(), resp)
 }
+
+// FetchInstance processes all requests for fetching an existing service instance.
+// URL: /v2/service_instances/:instance_id
+func FetchInstance(p martini.Params, req *http.Request, r render.Render, brokerDb *gorm.DB, s *config.Settings, c *catalog.Catalog, q *taskqueue.QueueManager) {
+	resp := fetchInstance(req, c, brokerDb, p["instance_id"], s, q)
+	r.JSON(resp.GetStatusCode(), resp)
+}
+
+// FetchBinding processes all requests for fetching an existing service binding.
+// URL: /v2/service_instances/:instance_id/service_bindings/:binding_id
+func FetchBinding(p martini.Params, req *http.Request, r render.Render, brokerDb *gorm.DB, s *config.Settings, c *catalog.Catalog, q *taskqueue.QueueManager) {
+	resp := fetchBinding(req, c, brokerDb, p["instance_id"], p["id"], s, q)
+	r.JSON(resp.GetStatusCode(), resp)
+}
@@ -0,0 +1,145 @@
+package awssecrets
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+
+	"github.com/18F/aws-broker/config"
+)
+
+// secretNamePrefix is the prefix of the names of the secrets created by the broker.
+const secretNamePrefix = "cg-aws-broker"
+
+// SecretARNKey is the key of the ARN of the secret in the credentials returned
+// to bindings.
+const SecretARNKey = "secret_arn"
+
+// CredentialsStore stores the credentials issued to bindings outside of the
+// broker database.
+type CredentialsStore interface {
+	// PutCredentials creates or updates the secret with the given name, and
+	// returns its ARN.
+	PutCredentials(name string, credentials map[string]string, tags map[string]string) (string, error)
+	// DeleteCredentials deletes the secret with the given name or ARN, if it
+	// exists.
+	DeleteCredentials(secretID string) error
+}
+
+// NewCredentialsStore returns the store of the credentials issued by the
+// broker, or nil if credentials are not stored in Secrets Manager.
+func NewCredentialsStore(settings *config.Settings) CredentialsStore {
+	if !settings.SecretsManagerCredentials {
+		return nil
+	}
+	return NewSecretsManagerStore(secretsmanager.New(session.Must(session.NewSession()), aws.NewConfig().WithRegion(settings.Region)))
+}
+
+// CredentialsSecretName returns the name of the secret holding the credentials
+// of an instance, or of one of its bindings when a binding ID is given.
+func CredentialsSecretName(serviceName string, instanceGUID string, bindingID string) string {
+	parts := []string{secretNamePrefix, serviceName, instanceGUID}
+	if bindingID != "" {
+		parts = append(parts, bindingID)
+	}
+	return strings.Join(parts, "/")
+}
+
+// StoreCredentials writes the credentials to the secret with the given name and
+// adds the ARN of the secret to them. It does nothing without a store.
+func StoreCredentials(store CredentialsStore, name string, credentials map[string]string, tags map[string]string) error {
+	if store == nil {
+		return nil
+	}
+	arn, err := store.PutCredentials(name, credentials, tags)
+	if err != nil {
+		return fmt.Errorf("could not store credentials in secret %s: %s", name, err)
+	}
+	credentials[SecretARNKey] = arn
+	return nil
+}
+
+// SecretsManagerStore stores credentials as JSON objects in Secrets Manager.
+type SecretsManagerStore struct {
+	secretsmanager secretsmanageriface.SecretsManagerAPI
+}
+
+// NewSecretsManagerStore returns a store using the given Secrets Manager client.
+func NewSecretsManagerStore(secretsmanager secretsmanageriface.SecretsManagerAPI) *SecretsManagerStore {
+	return &SecretsManagerStore{secretsmanager: secretsmanager}
+}
+
+func (s *SecretsManagerStore) PutCredentials(name string, credentials map[string]string, tags map[string]string) (string, error) {
+	secretString, err := json.Marshal(credentials)
+	if err != nil {
+		return "", err
+	}
+
+	createOutput, err := s.secretsmanager.CreateSecret(&secretsmanager.CreateSecretInput{
+		Name:         aws.String(name),
+		Description:  aws.String("Credentials issued by the AWS broker"),
+		SecretString: aws.String(string(secretString)),
+		Tags:         ConvertTagsMapToSecretsManagerTags(tags),
+	})
+	if err == nil {
+		return aws.StringValue(createOutput.ARN), nil
+	}
+	if awsErr, ok := err.(awserr.Error); !ok || awsErr.Code() != secretsmanager.ErrCodeResourceExistsException {
+		return "", err
+	}
+
+	// The secret exists already, e.g. because the credentials were rotated.
+	putOutput, err := s.secretsmanager.PutSecretValue(&secretsmanager.PutSecretValueInput{
+		SecretId:     aws.String(name),
+		SecretString: aws.String(string(secretString)),
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(tags) > 0 {
+		_, err = s.secretsmanager.TagResource(&secretsmanager.TagResourceInput{
+			SecretId: aws.String(name),
+			Tags:     ConvertTagsMapToSecretsManagerTags(tags),
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	return aws.StringValue(putOutput.ARN), nil
+}
+
+func (s *SecretsManagerStore) DeleteCredentials(secretID string) error {
+	// The credentials are revoked along with the secret, so there is nothing
+	// to recover it for.
+	_, err := s.secretsmanager.DeleteSecret(&secretsmanager.DeleteSecretInput{
+		SecretId:                   aws.String(secretID),
+		ForceDeleteWithoutRecovery: aws.Bool(true),
+	})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == secretsmanager.ErrCodeResourceNotFoundException {
+		return nil
+	}
+	return err
+}
+
+// ConvertTagsMapToSecretsManagerTags converts tags to Secrets Manager tags,
+// sorted by key.
+func ConvertTagsMapToSecretsManagerTags(tags map[string]string) []*secretsmanager.Tag {
+	var secretsManagerTags []*secretsmanager.Tag
+	for key, value := range tags {
+		secretsManagerTags = append(secretsManagerTags, &secretsmanager.Tag{
+			Key:   aws.String(key),
+			Value: aws.String(value),
+		})
+	}
+	sort.Slice(secretsManagerTags, func(i, j int) bool {
+		return aws.StringValue(secretsManagerTags[i].Key) < aws.StringValue(secretsManagerTags[j].Key)
+	})
+	return secretsManagerTags
+}
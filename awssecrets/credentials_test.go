@@ -0,0 +1,164 @@
+package awssecrets
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/go-test/deep"
+)
+
+// fakeSecretsManager keeps secrets in memory by name.
+type fakeSecretsManager struct {
+	secretsmanageriface.SecretsManagerAPI
+
+	secrets map[string]string
+	tags    map[string][]*secretsmanager.Tag
+}
+
+func newFakeSecretsManager() *fakeSecretsManager {
+	return &fakeSecretsManager{
+		secrets: map[string]string{},
+		tags:    map[string][]*secretsmanager.Tag{},
+	}
+}
+
+func (f *fakeSecretsManager) arn(name string) *string {
+	return aws.String("arn:aws:secretsmanager:us-gov-west-1:123456789012:secret:" + name)
+}
+
+// secretName returns the name of a secret identified by its name or ARN.
+func (f *fakeSecretsManager) secretName(secretID *string) string {
+	return strings.TrimPrefix(aws.StringValue(secretID), aws.StringValue(f.arn("")))
+}
+
+func (f *fakeSecretsManager) CreateSecret(input *secretsmanager.CreateSecretInput) (*secretsmanager.CreateSecretOutput, error) {
+	name := aws.StringValue(input.Name)
+	if _, ok := f.secrets[name]; ok {
+		return nil, awserr.New(secretsmanager.ErrCodeResourceExistsException, "secret exists", nil)
+	}
+	f.secrets[name] = aws.StringValue(input.SecretString)
+	f.tags[name] = input.Tags
+	return &secretsmanager.CreateSecretOutput{ARN: f.arn(name), Name: input.Name}, nil
+}
+
+func (f *fakeSecretsManager) PutSecretValue(input *secretsmanager.PutSecretValueInput) (*secretsmanager.PutSecretValueOutput, error) {
+	name := aws.StringValue(input.SecretId)
+	if _, ok := f.secrets[name]; !ok {
+		return nil, awserr.New(secretsmanager.ErrCodeResourceNotFoundException, "secret not found", nil)
+	}
+	f.secrets[name] = aws.StringValue(input.SecretString)
+	return &secretsmanager.PutSecretValueOutput{ARN: f.arn(name), Name: input.SecretId}, nil
+}
+
+func (f *fakeSecretsManager) TagResource(input *secretsmanager.TagResourceInput) (*secretsmanager.TagResourceOutput, error) {
+	f.tags[aws.StringValue(input.SecretId)] = input.Tags
+	return &secretsmanager.TagResourceOutput{}, nil
+}
+
+func (f *fakeSecretsManager) DeleteSecret(input *secretsmanager.DeleteSecretInput) (*secretsmanager.DeleteSecretOutput, error) {
+	name := f.secretName(input.SecretId)
+	if _, ok := f.secrets[name]; !ok {
+		return nil, awserr.New(secretsmanager.ErrCodeResourceNotFoundException, "secret not found", nil)
+	}
+	if !aws.BoolValue(input.ForceDeleteWithoutRecovery) {
+		return nil, awserr.New(secretsmanager.ErrCodeInvalidParameterException, "expected a deletion without recovery", nil)
+	}
+	delete(f.secrets, name)
+	delete(f.tags, name)
+	return &secretsmanager.DeleteSecretOutput{ARN: f.arn(name), Name: input.SecretId}, nil
+}
+
+func TestCredentialsSecretName(t *testing.T) {
+	testCases := map[string]struct {
+		bindingID    string
+		expectedName string
+	}{
+		"instance": {
+			expectedName: "cg-aws-broker/rds/instance-guid",
+		},
+		"binding": {
+			bindingID:    "binding-id",
+			expectedName: "cg-aws-broker/rds/instance-guid/binding-id",
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			secretName := CredentialsSecretName("rds", "instance-guid", test.bindingID)
+			if secretName != test.expectedName {
+				t.Errorf("expected %s, got %s", test.expectedName, secretName)
+			}
+		})
+	}
+}
+
+func TestStoreCredentials(t *testing.T) {
+	client := newFakeSecretsManager()
+	store := NewSecretsManagerStore(client)
+	name := CredentialsSecretName("rds", "instance-guid", "binding-id")
+
+	credentials := map[string]string{"username": "user", "password": "first"}
+	if err := StoreCredentials(store, name, credentials, map[string]string{"Instance GUID": "instance-guid"}); err != nil {
+		t.Fatal(err)
+	}
+	arn := aws.StringValue(client.arn(name))
+	if credentials[SecretARNKey] != arn {
+		t.Errorf("expected the secret ARN in the credentials, got %s", credentials[SecretARNKey])
+	}
+	stored := map[string]string{}
+	if err := json.Unmarshal([]byte(client.secrets[name]), &stored); err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(stored, map[string]string{"username": "user", "password": "first"}); diff != nil {
+		t.Error(diff)
+	}
+
+	// Storing rotated credentials updates the existing secret.
+	rotated := map[string]string{"username": "user", "password": "second"}
+	if err := StoreCredentials(store, name, rotated, map[string]string{"Instance GUID": "instance-guid", "Space GUID": "space-guid"}); err != nil {
+		t.Fatal(err)
+	}
+	if rotated[SecretARNKey] != arn {
+		t.Errorf("expected the ARN of the existing secret, got %s", rotated[SecretARNKey])
+	}
+	stored = map[string]string{}
+	if err := json.Unmarshal([]byte(client.secrets[name]), &stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored["password"] != "second" {
+		t.Errorf("expected the rotated password to be stored, got %s", stored["password"])
+	}
+	expectedTags := []*secretsmanager.Tag{
+		{Key: aws.String("Instance GUID"), Value: aws.String("instance-guid")},
+		{Key: aws.String("Space GUID"), Value: aws.String("space-guid")},
+	}
+	if diff := deep.Equal(client.tags[name], expectedTags); diff != nil {
+		t.Error(diff)
+	}
+
+	if err := store.DeleteCredentials(arn); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.secrets) != 0 {
+		t.Errorf("expected the secret to be deleted, got %v", client.secrets)
+	}
+	// Deleting a secret that is gone already is not an error.
+	if err := store.DeleteCredentials(arn); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStoreCredentialsWithoutStore(t *testing.T) {
+	credentials := map[string]string{"username": "user"}
+	if err := StoreCredentials(nil, "name", credentials, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := credentials[SecretARNKey]; ok {
+		t.Error("expected no secret ARN without a store")
+	}
+}
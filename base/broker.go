@@ -44,9 +44,28 @@ type Broker interface {
 	// LastOperation uses the catalog and parsed request to get an instance status for the particular type of service.
 	LastOperation(*catalog.Catalog, string, Instance, string) response.Response
 	// BindInstance takes the existing instance and binds it to an app.
-	BindInstance(*catalog.Catalog, string, request.Request, Instance) response.Response
+	BindInstance(*catalog.Catalog, string, string, request.Request, Instance) response.Response
+	// UnbindInstance revokes the binding of the existing instance to an app.
+	UnbindInstance(*catalog.Catalog, string, string, Instance) response.Response
 	// DeleteInstance deletes the existing instance.
 	DeleteInstance(*catalog.Catalog, string, Instance) response.Response
+	// FetchInstance returns the plan and the parameters applied to the existing instance.
+	FetchInstance(*catalog.Catalog, string, Instance) response.Response
+	// FetchBinding returns the credentials of an existing binding of the instance.
+	FetchBinding(*catalog.Catalog, string, string, Instance) response.Response
 	// Supports Async operation
 	AsyncOperationRequired(*catalog.Catalog, Instance, Operation) bool
 }
+
+// AsyncBindingBroker is implemented by the brokers that bind instances asynchronously.
+type AsyncBindingBroker interface {
+	// BindingLastOperation gets the status of the binding of the existing instance.
+	BindingLastOperation(*catalog.Catalog, string, string, Instance, string) response.Response
+}
+
+// OrphanMitigationBroker is implemented by the brokers that record the AWS
+// resources they create while provisioning instances.
+type OrphanMitigationBroker interface {
+	// CleanupProvision tears down the recorded resources of an instance that was not provisioned.
+	CleanupProvision(*catalog.Catalog, string, ProvisionedResources) response.Response
+}
@@ -57,6 +57,9 @@ type Instance struct {
 
 	State InstanceState
 
+	// Provisioned lists the AWS resources created by the current request.
+	Provisioned ProvisionedResources `sql:"-" json:"-"`
+
 	CreatedAt time.Time
 	UpdatedAt time.Time
 }
@@ -0,0 +1,88 @@
+package base
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ProvisionedResource records an AWS resource created while provisioning an
+// instance. The records of an instance are kept until the broker has saved the
+// instance, so that the resources of a provisioning that failed halfway can be
+// torn down, right away or when the platform deletes the instance to mitigate
+// orphans.
+type ProvisionedResource struct {
+	ID           uint   `gorm:"primary_key"`
+	InstanceUuid string `sql:"size(255)"`
+	ServiceID    string `sql:"size(255)"`
+	PlanID       string `sql:"size(255)"`
+
+	// Type is a broker specific kind of resource, e.g. "db-instance".
+	Type       string `sql:"size(255)"`
+	Identifier string `sql:"size(2048)"`
+	// Parent identifies the resource the resource belongs to, e.g. the IAM
+	// user of an access key, if it cannot be deleted on its own.
+	Parent string `sql:"size(255)"`
+
+	CreatedAt time.Time
+}
+
+// ProvisionedResources lists the resources created while provisioning an
+// instance, in the order they were created.
+type ProvisionedResources []ProvisionedResource
+
+// Add records a resource that was just created.
+func (r *ProvisionedResources) Add(resourceType string, identifier string, parent string) {
+	*r = append(*r, ProvisionedResource{Type: resourceType, Identifier: identifier, Parent: parent})
+}
+
+// Teardown deletes the resources with deleteResource, newest first so that
+// resources are deleted before those they depend on. It returns the resources
+// that could not be deleted along with the errors deleting them.
+func (r ProvisionedResources) Teardown(deleteResource func(ProvisionedResource) error) (ProvisionedResources, error) {
+	var remaining ProvisionedResources
+	var problems []string
+	for i := len(r) - 1; i >= 0; i-- {
+		if err := deleteResource(r[i]); err != nil {
+			// keep the order of creation for the next teardown
+			remaining = append(ProvisionedResources{r[i]}, remaining...)
+			problems = append(problems, fmt.Sprintf("%s %s: %s", r[i].Type, r[i].Identifier, err))
+		}
+	}
+	if len(problems) > 0 {
+		return remaining, errors.New("unable to delete " + strings.Join(problems, "; "))
+	}
+	return nil, nil
+}
+
+// SaveProvisionedResources replaces the recorded resources of an instance.
+func SaveProvisionedResources(brokerDb *gorm.DB, id string, serviceID string, planID string, resources ProvisionedResources) error {
+	if err := ForgetProvisionedResources(brokerDb, id); err != nil {
+		return err
+	}
+	for _, resource := range resources {
+		resource.ID = 0
+		resource.InstanceUuid = id
+		resource.ServiceID = serviceID
+		resource.PlanID = planID
+		if err := brokerDb.Create(&resource).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FindProvisionedResources returns the recorded resources of an instance in the order they were created.
+func FindProvisionedResources(brokerDb *gorm.DB, id string) (ProvisionedResources, error) {
+	var resources ProvisionedResources
+	err := brokerDb.Where("instance_uuid = ?", id).Order("id").Find(&resources).Error
+	return resources, err
+}
+
+// ForgetProvisionedResources removes the recorded resources of an instance.
+func ForgetProvisionedResources(brokerDb *gorm.DB, id string) error {
+	return brokerDb.Unscoped().Where("instance_uuid = ?", id).Delete(ProvisionedResource{}).Error
+}
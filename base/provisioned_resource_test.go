@@ -0,0 +1,54 @@
+package base
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func TestTeardown(t *testing.T) {
+	var resources ProvisionedResources
+	resources.Add("user", "a-user", "")
+	resources.Add("key", "a-key", "a-user")
+	resources.Add("domain", "a-domain", "")
+
+	testCases := map[string]struct {
+		failing           string
+		expectedDeleted   []string
+		expectedRemaining ProvisionedResources
+		expectErr         bool
+	}{
+		"success": {
+			expectedDeleted: []string{"a-domain", "a-key", "a-user"},
+		},
+		"failure": {
+			failing:           "a-key",
+			expectedDeleted:   []string{"a-domain", "a-key", "a-user"},
+			expectedRemaining: ProvisionedResources{resources[1]},
+			expectErr:         true,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var deleted []string
+			remaining, err := resources.Teardown(func(r ProvisionedResource) error {
+				deleted = append(deleted, r.Identifier)
+				if r.Identifier == test.failing {
+					return errors.New("fail")
+				}
+				return nil
+			})
+			if test.expectErr != (err != nil) {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if diff := deep.Equal(deleted, test.expectedDeleted); diff != nil {
+				t.Error(diff)
+			}
+			if diff := deep.Equal(remaining, test.expectedRemaining); diff != nil {
+				t.Error(diff)
+			}
+		})
+	}
+}
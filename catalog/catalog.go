@@ -50,6 +50,8 @@ type Plan struct {
 	Metadata       PlanMetadata `yaml:"metadata" json:"metadata" validate:"required"`
 	Free           bool         `yaml:"free" json:"free"`
 	PlanUpdateable bool         `yaml:"plan_updateable" json:"plan_updateable"`
+	// Schemas are generated by the brokers rather than read from the catalog.yaml file.
+	Schemas *Schemas `yaml:"-" json:"schemas,omitempty"`
 }
 
 var (
@@ -94,6 +96,14 @@ type RDSPlan struct {
 	SubnetGroup           string            `yaml:"subnetGroup" json:"-" validate:"required"`
 	SecurityGroup         string            `yaml:"securityGroup" json:"-" validate:"required"`
 	ApprovedMajorVersions []string          `yaml:"approvedMajorVersions" json:"-"`
+	// AllowedParameters lists the database parameters of the engine that
+	// users may set on instances of the plan.
+	AllowedParameters []string `yaml:"allowedParameters" json:"-"`
+	// Replica plans can only be used to create read replicas of existing instances.
+	Replica bool `yaml:"replica" json:"-"`
+	// ReaderInstances is the number of reader instances of the clusters
+	// created by plans with the aurora adapter, next to their writer.
+	ReaderInstances int64 `yaml:"readerInstances" json:"-"`
 }
 
 // CheckVersion verifies that a specific version chosen by the user for a new
@@ -115,6 +125,17 @@ func (p RDSPlan) CheckVersion(version string) bool {
 	return false
 }
 
+// CheckParameter verifies that users may set a database parameter on
+// instances of the plan.
+func (p RDSPlan) CheckParameter(name string) bool {
+	for _, allowedParameter := range p.AllowedParameters {
+		if name == allowedParameter {
+			return true
+		}
+	}
+	return false
+}
+
 // RedisService describes the Redis Service. It contains the basic Service details as well as a list of Redis Plans
 type RedisService struct {
 	Service `yaml:",inline" validate:"required"`
@@ -250,6 +271,22 @@ type Service struct {
 	Bindable    bool            `yaml:"bindable" json:"bindable" validate:"required"`
 	Tags        []string        `yaml:"tags" json:"tags" validate:"required"`
 	Metadata    ServiceMetadata `yaml:"metadata" json:"metadata" validate:"required"`
+	// InstancesRetrievable and BindingsRetrievable enable fetching instances and bindings.
+	InstancesRetrievable bool `yaml:"instances_retrievable" json:"instances_retrievable"`
+	BindingsRetrievable  bool `yaml:"bindings_retrievable" json:"bindings_retrievable"`
+}
+
+// FetchService will look for a specific Service based on the service ID.
+func (c *Catalog) FetchService(serviceID string) (Service, response.Response) {
+	switch serviceID {
+	case c.RdsService.ID:
+		return c.RdsService.Service, nil
+	case c.RedisService.ID:
+		return c.RedisService.Service, nil
+	case c.ElasticsearchService.ID:
+		return c.ElasticsearchService.Service, nil
+	}
+	return Service{}, response.NewErrorResponse(http.StatusNotFound, ErrNoServiceFound.Error())
 }
 
 // GetServices returns the list of all the Services. In order to do this, it uses reflection to look for all the
@@ -44,6 +44,24 @@ func TestFetchPlan(t *testing.T) {
 	}
 }
 
+func TestFetchService(t *testing.T) {
+	wd := checkedGetwd(t)
+	path := filepath.Join(wd, "..")
+	catalog := InitCatalog(path)
+
+	service, err := catalog.FetchService(catalog.RedisService.ID)
+	if err != nil {
+		t.Fatal("Could not fetch service " + catalog.RedisService.ID)
+	}
+	if service.Name != catalog.RedisService.Name {
+		t.Errorf("Fetched service %s instead of %s", service.Name, catalog.RedisService.Name)
+	}
+
+	if _, err := catalog.FetchService("unknown-service"); err == nil {
+		t.Error("Should not fetch an unknown service")
+	}
+}
+
 func TestRDSPGCheckVersion(t *testing.T) {
 	wd := checkedGetwd(t)
 	path := filepath.Join(wd, "..")
@@ -115,3 +133,33 @@ func TestRDSCheckVersionEmpty(t *testing.T) {
 		t.Error("Empty RDS version check failed.")
 	}
 }
+
+func TestFetchPlanSchemas(t *testing.T) {
+	wd := checkedGetwd(t)
+	path := filepath.Join(wd, "..")
+	catalog := InitCatalog(path)
+
+	schemas, err := catalog.FetchPlanSchemas(catalog.RdsService.ID, rdsPGTestPlanID)
+	if err != nil {
+		t.Fatal("Could not fetch schemas of plan " + rdsPGTestPlanID)
+	}
+	if schemas != nil {
+		t.Error("Plans should have no schemas until the brokers set them")
+	}
+
+	catalog.SetSchemas(catalog.RdsService.ID, &Schemas{})
+	schemas, err = catalog.FetchPlanSchemas(catalog.RdsService.ID, rdsPGTestPlanID)
+	if err != nil {
+		t.Fatal("Could not fetch schemas of plan " + rdsPGTestPlanID)
+	}
+	if schemas == nil {
+		t.Error("Plans should have the schemas set for their service")
+	}
+
+	if _, err := catalog.FetchPlanSchemas(catalog.RdsService.ID, "unknown-plan"); err == nil {
+		t.Error("Fetching the schemas of an unknown plan should fail")
+	}
+	if _, err := catalog.FetchPlanSchemas("unknown-service", rdsPGTestPlanID); err == nil {
+		t.Error("Fetching the schemas of an unknown service should fail")
+	}
+}
@@ -0,0 +1,89 @@
+package catalog
+
+import (
+	"net/http"
+
+	"github.com/18F/aws-broker/helpers/response"
+	"github.com/18F/aws-broker/helpers/schema"
+)
+
+// Schemas describes the parameters accepted when creating and updating service
+// instances and creating bindings of a plan, as listed in the OSB API:
+// https://github.com/openservicebrokerapi/servicebroker/blob/v2.16/spec.md#schemas-object
+type Schemas struct {
+	ServiceInstance ServiceInstanceSchema `json:"service_instance"`
+	ServiceBinding  ServiceBindingSchema  `json:"service_binding"`
+}
+
+// ServiceInstanceSchema contains the schemas of the parameters of service instances.
+type ServiceInstanceSchema struct {
+	Create InputParametersSchema `json:"create"`
+	Update InputParametersSchema `json:"update"`
+}
+
+// ServiceBindingSchema contains the schema of the parameters of service bindings.
+type ServiceBindingSchema struct {
+	Create InputParametersSchema `json:"create"`
+}
+
+// InputParametersSchema holds the schema of the parameters of a request, if it accepts any.
+type InputParametersSchema struct {
+	Parameters *schema.Schema `json:"parameters,omitempty"`
+}
+
+// SetSchemas sets the parameter schemas of every plan of a service. They are
+// generated by the brokers, from the structs their parameters are decoded into.
+func (c *Catalog) SetSchemas(serviceID string, schemas *Schemas) {
+	switch serviceID {
+	case c.RdsService.ID:
+		for i := range c.RdsService.Plans {
+			c.RdsService.Plans[i].Schemas = schemas
+		}
+	case c.RedisService.ID:
+		for i := range c.RedisService.Plans {
+			c.RedisService.Plans[i].Schemas = schemas
+		}
+	case c.ElasticsearchService.ID:
+		for i := range c.ElasticsearchService.Plans {
+			c.ElasticsearchService.Plans[i].Schemas = schemas
+		}
+	}
+}
+
+// FetchPlanSchemas will look for the parameter schemas of a plan based on the
+// service and plan IDs. Plans without schemas accept any parameters.
+func (c *Catalog) FetchPlanSchemas(serviceID string, planID string) (*Schemas, response.Response) {
+	var plan Plan
+	var resp response.Response
+	switch serviceID {
+	case c.RdsService.ID:
+		var rdsPlan RDSPlan
+		rdsPlan, resp = c.RdsService.FetchPlan(planID)
+		plan = rdsPlan.Plan
+	case c.RedisService.ID:
+		var redisPlan RedisPlan
+		redisPlan, resp = c.RedisService.FetchPlan(planID)
+		plan = redisPlan.Plan
+	case c.ElasticsearchService.ID:
+		var elasticsearchPlan ElasticsearchPlan
+		elasticsearchPlan, resp = c.ElasticsearchService.FetchPlan(planID)
+		plan = elasticsearchPlan.Plan
+	default:
+		return nil, response.NewErrorResponse(http.StatusNotFound, ErrNoServiceFound.Error())
+	}
+	if resp != nil {
+		return nil, resp
+	}
+	return plan.Schemas, nil
+}
+
+// ValidateParameters checks the raw parameters of a request against a parameter schema.
+func (s InputParametersSchema) ValidateParameters(raw []byte) response.Response {
+	if s.Parameters == nil {
+		return nil
+	}
+	if err := s.Parameters.Validate(raw); err != nil {
+		return response.NewErrorResponse(http.StatusBadRequest, "Invalid parameters. Error: "+err.Error())
+	}
+	return nil
+}
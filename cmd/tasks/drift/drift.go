@@ -0,0 +1,103 @@
+package drift
+
+import (
+	"sort"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// Difference is a field of a resource whose value in AWS differs from the
+// value recorded in the broker database.
+type Difference struct {
+	Service      string      `json:"service"`
+	InstanceGUID string      `json:"instance_guid"`
+	Resource     string      `json:"resource"`
+	Field        string      `json:"field"`
+	Broker       interface{} `json:"broker"`
+	AWS          interface{} `json:"aws"`
+	// Fixed is true when the AWS resource was updated to match the broker.
+	Fixed bool `json:"fixed"`
+}
+
+// Resource identifies an AWS resource.
+type Resource struct {
+	Service      string `json:"service"`
+	Type         string `json:"type"`
+	Identifier   string `json:"identifier"`
+	InstanceGUID string `json:"instance_guid,omitempty"`
+}
+
+// Report lists the drift between the broker database and AWS.
+type Report struct {
+	Differences []Difference `json:"differences"`
+	// Missing lists the resources of database rows that do not exist in AWS.
+	Missing []Resource `json:"missing"`
+	// Orphans lists the resources named with a broker prefix that have no
+	// database row.
+	Orphans []Resource `json:"orphans"`
+}
+
+// NewReport returns an empty report, which marshals to empty lists rather than nulls.
+func NewReport() *Report {
+	return &Report{
+		Differences: []Difference{},
+		Missing:     []Resource{},
+		Orphans:     []Resource{},
+	}
+}
+
+// AddDifference records a difference and returns it so that it can be marked as fixed.
+func (r *Report) AddDifference(d Difference) *Difference {
+	r.Differences = append(r.Differences, d)
+	return &r.Differences[len(r.Differences)-1]
+}
+
+// VersionMatches reports whether the engine version in AWS is the version
+// recorded by the broker, or a minor version of it, since minor versions may be
+// upgraded automatically. An empty recorded version uses the engine's default
+// and matches any version.
+func VersionMatches(brokerVersion string, awsVersion string) bool {
+	if brokerVersion == "" || brokerVersion == awsVersion {
+		return true
+	}
+	return strings.HasPrefix(awsVersion, brokerVersion+".")
+}
+
+// SameSet reports whether two lists have the same values, in any order.
+func SameSet(a []string, b []string) bool {
+	a, b = Sorted(a), Sorted(b)
+	return slices.Equal(a, b)
+}
+
+// Sorted returns a sorted copy of values without empty values.
+func Sorted(values []string) []string {
+	sorted := []string{}
+	for _, v := range values {
+		if v != "" {
+			sorted = append(sorted, v)
+		}
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// TagDifferences returns the generated tags that are missing from, or have a
+// different value in, the tags of a resource, along with the values of those
+// tags on the resource.
+func TagDifferences(generated map[string]string, actual map[string]string) (map[string]string, map[string]string) {
+	expected := map[string]string{}
+	found := map[string]string{}
+	for key, value := range generated {
+		if key == "Created at" || key == "Updated at" {
+			continue
+		}
+		if actualValue, ok := actual[key]; !ok || actualValue != value {
+			expected[key] = value
+			if ok {
+				found[key] = actualValue
+			}
+		}
+	}
+	return expected, found
+}
@@ -0,0 +1,76 @@
+package drift
+
+import (
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func TestVersionMatches(t *testing.T) {
+	testCases := map[string]struct {
+		brokerVersion string
+		awsVersion    string
+		expected      bool
+	}{
+		"default version": {
+			awsVersion: "15.4",
+			expected:   true,
+		},
+		"same version": {
+			brokerVersion: "OpenSearch_2.3",
+			awsVersion:    "OpenSearch_2.3",
+			expected:      true,
+		},
+		"minor version": {
+			brokerVersion: "15",
+			awsVersion:    "15.4",
+			expected:      true,
+		},
+		"other major version": {
+			brokerVersion: "1",
+			awsVersion:    "15.4",
+		},
+		"older version": {
+			brokerVersion: "15",
+			awsVersion:    "14.9",
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if VersionMatches(test.brokerVersion, test.awsVersion) != test.expected {
+				t.Errorf("expected %t", test.expected)
+			}
+		})
+	}
+}
+
+func TestSameSet(t *testing.T) {
+	if !SameSet([]string{"b", "a", ""}, []string{"a", "b"}) {
+		t.Error("expected lists in any order, ignoring empty values, to be the same")
+	}
+	if SameSet([]string{"a"}, []string{"a", "b"}) {
+		t.Error("expected lists with different values to differ")
+	}
+}
+
+func TestTagDifferences(t *testing.T) {
+	generated := map[string]string{
+		"client":     "the-client",
+		"broker":     "AWS broker",
+		"Created at": "now",
+		"space":      "a-space",
+	}
+	actual := map[string]string{
+		"client": "the-client",
+		"broker": "another broker",
+	}
+
+	expected, found := TagDifferences(generated, actual)
+	if diff := deep.Equal(expected, map[string]string{"broker": "AWS broker", "space": "a-space"}); diff != nil {
+		t.Error(diff)
+	}
+	if diff := deep.Equal(found, map[string]string{"broker": "another broker"}); diff != nil {
+		t.Error(diff)
+	}
+}
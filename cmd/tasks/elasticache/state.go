@@ -0,0 +1,206 @@
+package elasticache
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/18F/aws-broker/catalog"
+	"github.com/18F/aws-broker/services/redis"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/elasticache"
+	"github.com/aws/aws-sdk-go/service/elasticache/elasticacheiface"
+	brokertags "github.com/cloud-gov/go-broker-tags"
+	"github.com/jinzhu/gorm"
+
+	"github.com/cloud-gov/aws-broker/cmd/tasks/drift"
+	"github.com/cloud-gov/aws-broker/cmd/tasks/tags"
+)
+
+const serviceName = "redis"
+
+// ReconcileElasticacheState adds the drift between the clusters recorded by the
+// broker and their AWS replication groups to report. The broker names clusters
+// with clusterPrefix. With fix, the snapshot retention and tags of the
+// replication groups are updated to match the broker.
+func ReconcileElasticacheState(catalog *catalog.Catalog, db *gorm.DB, elasticacheClient elasticacheiface.ElastiCacheAPI, tagManager brokertags.TagManager, clusterPrefix string, fix bool, report *drift.Report) error {
+	rows, err := db.Model(&redis.RedisInstance{}).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	knownClusters := map[string]bool{}
+	knownParameterGroups := map[string]bool{}
+	for rows.Next() {
+		var redisInstance redis.RedisInstance
+		db.ScanRows(rows, &redisInstance)
+		knownClusters[redisInstance.ClusterID] = true
+		knownParameterGroups[redisInstance.ParameterGroupName] = true
+
+		resp, err := elasticacheClient.DescribeReplicationGroups(&elasticache.DescribeReplicationGroupsInput{
+			ReplicationGroupId: aws.String(redisInstance.ClusterID),
+		})
+		if err != nil {
+			if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == elasticache.ErrCodeReplicationGroupNotFoundFault {
+				report.Missing = append(report.Missing, drift.Resource{
+					Service:      serviceName,
+					Type:         "replication-group",
+					Identifier:   redisInstance.ClusterID,
+					InstanceGUID: redisInstance.Uuid,
+				})
+				continue
+			}
+			return fmt.Errorf("could not describe cluster %s: %s", redisInstance.ClusterID, err)
+		}
+
+		err = compareReplicationGroup(catalog, elasticacheClient, tagManager, redisInstance, resp.ReplicationGroups[0], fix, report)
+		if err != nil {
+			return err
+		}
+	}
+
+	return findElasticacheOrphans(elasticacheClient, clusterPrefix, knownClusters, knownParameterGroups, report)
+}
+
+func compareReplicationGroup(catalog *catalog.Catalog, elasticacheClient elasticacheiface.ElastiCacheAPI, tagManager brokertags.TagManager, redisInstance redis.RedisInstance, group *elasticache.ReplicationGroup, fix bool, report *drift.Report) error {
+	difference := func(field string, brokerValue interface{}, awsValue interface{}) *drift.Difference {
+		return report.AddDifference(drift.Difference{
+			Service:      serviceName,
+			InstanceGUID: redisInstance.Uuid,
+			Resource:     redisInstance.ClusterID,
+			Field:        field,
+			Broker:       brokerValue,
+			AWS:          awsValue,
+		})
+	}
+
+	plan, _ := catalog.RedisService.FetchPlan(redisInstance.PlanID)
+	if plan.Name == "" {
+		return fmt.Errorf("error getting plan %s for cluster %s", redisInstance.PlanID, redisInstance.ClusterID)
+	}
+
+	if nodeType := aws.StringValue(group.CacheNodeType); redisInstance.CacheNodeType != "" && redisInstance.CacheNodeType != nodeType {
+		difference("instance_class", redisInstance.CacheNodeType, nodeType)
+	}
+
+	// The engine version is only reported by the clusters of the group.
+	if len(group.MemberClusters) > 0 {
+		resp, err := elasticacheClient.DescribeCacheClusters(&elasticache.DescribeCacheClustersInput{
+			CacheClusterId: group.MemberClusters[0],
+		})
+		if err != nil {
+			return fmt.Errorf("could not describe cache cluster %s: %s", aws.StringValue(group.MemberClusters[0]), err)
+		}
+		if len(resp.CacheClusters) > 0 {
+			version := aws.StringValue(resp.CacheClusters[0].EngineVersion)
+			if !drift.VersionMatches(redisInstance.EngineVersion, version) {
+				difference("engine_version", redisInstance.EngineVersion, version)
+			}
+		}
+	}
+
+	// Rows created before the retention was recorded have no retention.
+	if retention := aws.Int64Value(group.SnapshotRetentionLimit); redisInstance.SnapshotRetentionLimit > 0 && int64(redisInstance.SnapshotRetentionLimit) != retention {
+		d := difference("backup_retention_period", redisInstance.SnapshotRetentionLimit, retention)
+		if fix {
+			_, err := elasticacheClient.ModifyReplicationGroup(&elasticache.ModifyReplicationGroupInput{
+				ReplicationGroupId:     aws.String(redisInstance.ClusterID),
+				SnapshotRetentionLimit: aws.Int64(int64(redisInstance.SnapshotRetentionLimit)),
+				ApplyImmediately:       aws.Bool(true),
+			})
+			if err != nil {
+				return fmt.Errorf("could not update snapshot retention for cluster %s: %s", redisInstance.ClusterID, err)
+			}
+			d.Fixed = true
+		}
+	}
+
+	var logGroups []string
+	for _, config := range group.LogDeliveryConfigurations {
+		if config.DestinationDetails != nil && config.DestinationDetails.CloudWatchLogsDetails != nil {
+			logGroups = append(logGroups, aws.StringValue(config.DestinationDetails.CloudWatchLogsDetails.LogGroup))
+		}
+	}
+	expectedLogGroups := []string{redisInstance.EngineLogsGroupName, redisInstance.SlowLogsGroupName}
+	if !drift.SameSet(expectedLogGroups, logGroups) {
+		difference("log_exports", drift.Sorted(expectedLogGroups), drift.Sorted(logGroups))
+	}
+
+	generatedTags, err := tags.GenerateTags(
+		tagManager,
+		catalog.RedisService.Name,
+		plan.Name,
+		brokertags.ResourceGUIDs{
+			InstanceGUID:     redisInstance.Uuid,
+			SpaceGUID:        redisInstance.SpaceGUID,
+			OrganizationGUID: redisInstance.OrganizationGUID,
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("error generating new tags for cluster %s: %s", redisInstance.ClusterID, err)
+	}
+	groupArn := aws.StringValue(group.ARN)
+	existingTags, err := getElasticacheResourceTags(elasticacheClient, groupArn)
+	if err != nil {
+		return err
+	}
+	actualTags := map[string]string{}
+	for _, tag := range existingTags {
+		actualTags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	if expected, found := drift.TagDifferences(generatedTags, actualTags); len(expected) > 0 {
+		d := difference("tags", expected, found)
+		if fix {
+			_, err := elasticacheClient.AddTagsToResource(&elasticache.AddTagsToResourceInput{
+				ResourceName: aws.String(groupArn),
+				Tags:         redis.ConvertTagsToElasticacheTags(generatedTags),
+			})
+			if err != nil {
+				return fmt.Errorf("error adding new tags for cluster %s: %s", redisInstance.ClusterID, err)
+			}
+			d.Fixed = true
+		}
+	}
+
+	return nil
+}
+
+// findElasticacheOrphans adds the replication groups and parameter groups named
+// with the broker's prefixes that no database row refers to to report.
+func findElasticacheOrphans(elasticacheClient elasticacheiface.ElastiCacheAPI, clusterPrefix string, knownClusters map[string]bool, knownParameterGroups map[string]bool, report *drift.Report) error {
+	err := elasticacheClient.DescribeReplicationGroupsPages(&elasticache.DescribeReplicationGroupsInput{}, func(page *elasticache.DescribeReplicationGroupsOutput, lastPage bool) bool {
+		for _, group := range page.ReplicationGroups {
+			id := aws.StringValue(group.ReplicationGroupId)
+			if strings.HasPrefix(id, clusterPrefix) && !knownClusters[id] {
+				report.Orphans = append(report.Orphans, drift.Resource{
+					Service:    serviceName,
+					Type:       "replication-group",
+					Identifier: id,
+				})
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("could not list replication groups: %s", err)
+	}
+
+	err = elasticacheClient.DescribeCacheParameterGroupsPages(&elasticache.DescribeCacheParameterGroupsInput{}, func(page *elasticache.DescribeCacheParameterGroupsOutput, lastPage bool) bool {
+		for _, group := range page.CacheParameterGroups {
+			name := aws.StringValue(group.CacheParameterGroupName)
+			if strings.HasPrefix(name, redis.PgroupPrefix) && !knownParameterGroups[name] {
+				report.Orphans = append(report.Orphans, drift.Resource{
+					Service:    serviceName,
+					Type:       "cache-parameter-group",
+					Identifier: name,
+				})
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("could not list parameter groups: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package encryption
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/18F/aws-broker/config"
+	"github.com/18F/aws-broker/services/elasticsearch"
+	"github.com/18F/aws-broker/services/rds"
+	"github.com/18F/aws-broker/services/redis"
+	"github.com/jinzhu/gorm"
+)
+
+// encryptedRecord is a row whose secrets are encrypted with the broker's key.
+type encryptedRecord interface {
+	RotateEncryptionKey(settings *config.Settings) (bool, error)
+}
+
+// RotateEncryptionKey re-encrypts the passwords of every RDS, Redis and
+// OpenSearch instance, and of every RDS binding, with the current encryption
+// key. The rows are updated in a single transaction, so either all of them are
+// re-encrypted or none are.
+func RotateEncryptionKey(db *gorm.DB, settings *config.Settings) error {
+	tx := db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	count, err := rotateRecords(tx, settings)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return fmt.Errorf("could not commit the re-encrypted rows: %s", err)
+	}
+	log.Printf("re-encrypted %d rows with key %s", count, settings.CurrentEncryptionKeyID())
+	return nil
+}
+
+func rotateRecords(tx *gorm.DB, settings *config.Settings) (int, error) {
+	var rdsInstances []rds.RDSInstance
+	var rdsBindings []rds.RDSBinding
+	var redisInstances []redis.RedisInstance
+	var elasticsearchInstances []elasticsearch.ElasticsearchInstance
+	for _, rows := range []interface{}{&rdsInstances, &rdsBindings, &redisInstances, &elasticsearchInstances} {
+		if err := tx.Find(rows).Error; err != nil {
+			return 0, err
+		}
+	}
+
+	var records []encryptedRecord
+	for i := range rdsInstances {
+		records = append(records, &rdsInstances[i])
+	}
+	for i := range rdsBindings {
+		records = append(records, &rdsBindings[i])
+	}
+	for i := range redisInstances {
+		records = append(records, &redisInstances[i])
+	}
+	for i := range elasticsearchInstances {
+		records = append(records, &elasticsearchInstances[i])
+	}
+
+	count := 0
+	for _, record := range records {
+		rotated, err := record.RotateEncryptionKey(settings)
+		if err != nil {
+			return count, fmt.Errorf("could not re-encrypt %s: %s", describe(record), err)
+		}
+		if !rotated {
+			continue
+		}
+		if err := tx.Save(record).Error; err != nil {
+			return count, fmt.Errorf("could not save %s: %s", describe(record), err)
+		}
+		count++
+	}
+	return count, nil
+}
+
+// describe names a record in errors.
+func describe(record encryptedRecord) string {
+	switch r := record.(type) {
+	case *rds.RDSInstance:
+		return "database " + r.Database
+	case *rds.RDSBinding:
+		return "database binding " + r.BindingID
+	case *redis.RedisInstance:
+		return "cluster " + r.ClusterID
+	case *elasticsearch.ElasticsearchInstance:
+		return "domain " + r.Domain
+	}
+	return fmt.Sprintf("%T", record)
+}
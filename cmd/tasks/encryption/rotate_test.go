@@ -0,0 +1,143 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"encoding/base64"
+	"testing"
+
+	"github.com/18F/aws-broker/base"
+	"github.com/18F/aws-broker/common"
+	"github.com/18F/aws-broker/config"
+	"github.com/18F/aws-broker/helpers"
+	"github.com/18F/aws-broker/services/elasticsearch"
+	"github.com/18F/aws-broker/services/rds"
+	"github.com/18F/aws-broker/services/redis"
+	"github.com/jinzhu/gorm"
+)
+
+const oldKey = "12345678901234567890123456789012"
+const newKey = "abcdefghijklmnopqrstuvwxyzabcdef"
+
+func newTestDB(t *testing.T) *gorm.DB {
+	db, err := common.DBInit(&common.DBConfig{DbType: "sqlite3", DbName: ":memory:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every connection to an in-memory sqlite database gets its own database
+	db.DB().SetMaxOpenConns(1)
+	db.AutoMigrate(&rds.RDSInstance{}, &rds.RDSBinding{}, &redis.RedisInstance{}, &elasticsearch.ElasticsearchInstance{})
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// encrypt encrypts a password with the old key, like the broker did before
+// the rotation.
+func encrypt(t *testing.T, password string) (string, string) {
+	salt := helpers.GenerateSalt(aes.BlockSize)
+	iv, _ := base64.StdEncoding.DecodeString(salt)
+	encrypted, err := helpers.Encrypt(password, oldKey, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return salt, encrypted
+}
+
+// decrypt decrypts a password with the new key.
+func decrypt(t *testing.T, salt string, password string) string {
+	iv, _ := base64.StdEncoding.DecodeString(salt)
+	decrypted, err := helpers.Decrypt(password, newKey, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decrypted
+}
+
+func createRecords(t *testing.T, db *gorm.DB, keyID string) {
+	salt, password := encrypt(t, "rds-password")
+	db.Create(&rds.RDSInstance{Instance: base.Instance{Uuid: "rds-uuid"}, Database: "db", Salt: salt, Password: password, EncryptionKeyID: keyID})
+	salt, password = encrypt(t, "binding-password")
+	db.Create(&rds.RDSBinding{BindingID: "binding-id", InstanceUuid: "rds-uuid", Salt: salt, Password: password, EncryptionKeyID: keyID})
+	salt, password = encrypt(t, "redis-password")
+	db.Create(&redis.RedisInstance{Instance: base.Instance{Uuid: "redis-uuid"}, ClusterID: "cluster", Salt: salt, Password: password, EncryptionKeyID: keyID})
+	salt, password = encrypt(t, "opensearch-password")
+	db.Create(&elasticsearch.ElasticsearchInstance{Instance: base.Instance{Uuid: "opensearch-uuid"}, Domain: "domain", Salt: salt, Password: password, EncryptionKeyID: keyID})
+}
+
+func TestRotateEncryptionKey(t *testing.T) {
+	db := newTestDB(t)
+	createRecords(t, db, "old-key")
+
+	settings := &config.Settings{
+		EncryptionKey:   newKey,
+		EncryptionKeyID: "new-key",
+		DecryptionKeys:  map[string]string{"old-key": oldKey},
+	}
+	if err := RotateEncryptionKey(db, settings); err != nil {
+		t.Fatal(err)
+	}
+
+	var rdsInstance rds.RDSInstance
+	var rdsBinding rds.RDSBinding
+	var redisInstance redis.RedisInstance
+	var elasticsearchInstance elasticsearch.ElasticsearchInstance
+	db.First(&rdsInstance)
+	db.First(&rdsBinding)
+	db.First(&redisInstance)
+	db.First(&elasticsearchInstance)
+
+	testCases := map[string]struct {
+		keyID    string
+		salt     string
+		password string
+		expected string
+	}{
+		"rds instance":        {rdsInstance.EncryptionKeyID, rdsInstance.Salt, rdsInstance.Password, "rds-password"},
+		"rds binding":         {rdsBinding.EncryptionKeyID, rdsBinding.Salt, rdsBinding.Password, "binding-password"},
+		"redis instance":      {redisInstance.EncryptionKeyID, redisInstance.Salt, redisInstance.Password, "redis-password"},
+		"opensearch instance": {elasticsearchInstance.EncryptionKeyID, elasticsearchInstance.Salt, elasticsearchInstance.Password, "opensearch-password"},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if test.keyID != "new-key" {
+				t.Errorf("expected key ID new-key, got %s", test.keyID)
+			}
+			if password := decrypt(t, test.salt, test.password); password != test.expected {
+				t.Errorf("expected password %s, got %s", test.expected, password)
+			}
+		})
+	}
+
+	// rows already encrypted with the current key are left alone
+	if err := RotateEncryptionKey(db, settings); err != nil {
+		t.Fatal(err)
+	}
+	var unchanged rds.RDSInstance
+	db.First(&unchanged)
+	if unchanged.Password != rdsInstance.Password {
+		t.Error("expected a password encrypted with the current key to be left unchanged")
+	}
+}
+
+func TestRotateEncryptionKeyRollsBack(t *testing.T) {
+	db := newTestDB(t)
+	createRecords(t, db, "old-key")
+	// a row encrypted with a key the broker no longer has
+	salt, password := encrypt(t, "lost-password")
+	db.Create(&elasticsearch.ElasticsearchInstance{Instance: base.Instance{Uuid: "lost-uuid"}, Domain: "lost", Salt: salt, Password: password, EncryptionKeyID: "lost-key"})
+
+	settings := &config.Settings{
+		EncryptionKey:   newKey,
+		EncryptionKeyID: "new-key",
+		DecryptionKeys:  map[string]string{"old-key": oldKey},
+	}
+	if err := RotateEncryptionKey(db, settings); err == nil {
+		t.Fatal("expected an error for a row encrypted with an unknown key")
+	}
+
+	var count int
+	db.Model(&rds.RDSInstance{}).Where("encryption_key_id = ?", "new-key").Count(&count)
+	if count != 0 {
+		t.Error("expected no rows to be re-encrypted when one of them fails")
+	}
+}
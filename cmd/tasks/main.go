@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -15,7 +16,9 @@ import (
 	awsRds "github.com/aws/aws-sdk-go/service/rds"
 	brokertags "github.com/cloud-gov/go-broker-tags"
 
+	"github.com/cloud-gov/aws-broker/cmd/tasks/drift"
 	tasksElasticache "github.com/cloud-gov/aws-broker/cmd/tasks/elasticache"
+	"github.com/cloud-gov/aws-broker/cmd/tasks/encryption"
 	tasksOpensearch "github.com/cloud-gov/aws-broker/cmd/tasks/opensearch"
 	"github.com/cloud-gov/aws-broker/cmd/tasks/rds"
 	tasksRds "github.com/cloud-gov/aws-broker/cmd/tasks/rds"
@@ -43,15 +46,17 @@ func (s *serviceNames) Set(value string) error {
 var servicesToTag serviceNames
 
 func run() error {
-	actionPtr := flag.String("action", "", "Action to take. Accepted options: 'reconcile-tags', 'reconcile-log-groups'")
+	actionPtr := flag.String("action", "", "Action to take. Accepted options: 'reconcile-tags', 'reconcile-log-groups', 'reconcile-state', 'rotate-encryption-key'")
 	flag.Var(&servicesToTag, "service", "Specify AWS service whose instances should have tags updated. Accepted options: 'rds', 'elasticache', 'elasticsearch', 'opensearch'")
+	fixPtr := flag.Bool("fix", false, "With 'reconcile-state', update the backup retention and tags of AWS resources that differ from the broker database")
 	flag.Parse()
 
 	if *actionPtr == "" {
 		log.Fatal("--action flag is required")
 	}
 
-	if len(servicesToTag) == 0 {
+	// Rotating the encryption key covers the rows of every service.
+	if len(servicesToTag) == 0 && *actionPtr != "rotate-encryption-key" {
 		return errors.New("--service argument is required. Specify --service multiple times to update tags for multiple services")
 	}
 
@@ -75,15 +80,9 @@ func run() error {
 	}
 
 	if *actionPtr == "reconcile-tags" {
-		tagManager, err := brokertags.NewCFTagManager(
-			"AWS broker",
-			settings.Environment,
-			settings.CfApiUrl,
-			settings.CfApiClientId,
-			settings.CfApiClientSecret,
-		)
+		tagManager, err := newTagManager(settings)
 		if err != nil {
-			return fmt.Errorf("could not initialize tag manager: %s", err)
+			return err
 		}
 
 		path, _ := os.Getwd()
@@ -126,9 +125,70 @@ func run() error {
 		}
 	}
 
+	if *actionPtr == "rotate-encryption-key" {
+		err := encryption.RotateEncryptionKey(db, &settings)
+		if err != nil {
+			return err
+		}
+	}
+
+	if *actionPtr == "reconcile-state" {
+		tagManager, err := newTagManager(settings)
+		if err != nil {
+			return err
+		}
+
+		path, _ := os.Getwd()
+		c := catalog.InitCatalog(path)
+
+		report := drift.NewReport()
+
+		if slices.Contains(servicesToTag, "rds") {
+			rdsClient := awsRds.New(sess)
+			err := tasksRds.ReconcileRDSState(c, db, rdsClient, tagManager, settings.DbNamePrefix, *fixPtr, report)
+			if err != nil {
+				return err
+			}
+		}
+		if slices.Contains(servicesToTag, "elasticache") {
+			elasticacheClient := elasticache.New(sess)
+			err := tasksElasticache.ReconcileElasticacheState(c, db, elasticacheClient, tagManager, settings.DbShorthandPrefix+"-", *fixPtr, report)
+			if err != nil {
+				return err
+			}
+		}
+		if slices.Contains(servicesToTag, "elasticsearch") || slices.Contains(servicesToTag, "opensearch") {
+			opensearchClient := opensearchservice.New(sess)
+			err := tasksOpensearch.ReconcileOpensearchState(c, db, opensearchClient, tagManager, "cg-broker-"+settings.DbShorthandPrefix+"-", *fixPtr, report)
+			if err != nil {
+				return err
+			}
+		}
+
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(report); err != nil {
+			return fmt.Errorf("could not write report: %s", err)
+		}
+	}
+
 	return nil
 }
 
+func newTagManager(settings config.Settings) (brokertags.TagManager, error) {
+	tagManager, err := brokertags.NewCFTagManager(
+		"AWS broker",
+		settings.Environment,
+		settings.CfApiUrl,
+		settings.CfApiClientId,
+		settings.CfApiClientSecret,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not initialize tag manager: %s", err)
+	}
+	return tagManager, nil
+}
+
 func main() {
 	err := run()
 	if err != nil {
@@ -0,0 +1,172 @@
+package opensearch
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/18F/aws-broker/catalog"
+	"github.com/18F/aws-broker/services/elasticsearch"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/opensearchservice"
+	"github.com/aws/aws-sdk-go/service/opensearchservice/opensearchserviceiface"
+	brokertags "github.com/cloud-gov/go-broker-tags"
+	"github.com/jinzhu/gorm"
+
+	"github.com/cloud-gov/aws-broker/cmd/tasks/drift"
+	"github.com/cloud-gov/aws-broker/cmd/tasks/tags"
+)
+
+const serviceName = "elasticsearch"
+
+// ReconcileOpensearchState adds the drift between the domains recorded by the
+// broker and their AWS domains to report. The broker names domains with
+// domainPrefix. Domains have no backup retention to compare, and with fix only
+// their tags are updated to match the broker.
+func ReconcileOpensearchState(catalog *catalog.Catalog, db *gorm.DB, opensearchClient opensearchserviceiface.OpenSearchServiceAPI, tagManager brokertags.TagManager, domainPrefix string, fix bool, report *drift.Report) error {
+	rows, err := db.Model(&elasticsearch.ElasticsearchInstance{}).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	knownDomains := map[string]bool{}
+	for rows.Next() {
+		var elasticsearchInstance elasticsearch.ElasticsearchInstance
+		db.ScanRows(rows, &elasticsearchInstance)
+		knownDomains[elasticsearchInstance.Domain] = true
+
+		resp, err := opensearchClient.DescribeDomain(&opensearchservice.DescribeDomainInput{
+			DomainName: aws.String(elasticsearchInstance.Domain),
+		})
+		if err != nil {
+			if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == opensearchservice.ErrCodeResourceNotFoundException {
+				report.Missing = append(report.Missing, drift.Resource{
+					Service:      serviceName,
+					Type:         "opensearch-domain",
+					Identifier:   elasticsearchInstance.Domain,
+					InstanceGUID: elasticsearchInstance.Uuid,
+				})
+				continue
+			}
+			return fmt.Errorf("could not describe domain %s: %s", elasticsearchInstance.Domain, err)
+		}
+
+		err = compareDomain(catalog, opensearchClient, tagManager, elasticsearchInstance, resp.DomainStatus, fix, report)
+		if err != nil {
+			return err
+		}
+	}
+
+	return findOpensearchOrphans(opensearchClient, domainPrefix, knownDomains, report)
+}
+
+func compareDomain(catalog *catalog.Catalog, opensearchClient opensearchserviceiface.OpenSearchServiceAPI, tagManager brokertags.TagManager, elasticsearchInstance elasticsearch.ElasticsearchInstance, domain *opensearchservice.DomainStatus, fix bool, report *drift.Report) error {
+	difference := func(field string, brokerValue interface{}, awsValue interface{}) *drift.Difference {
+		return report.AddDifference(drift.Difference{
+			Service:      serviceName,
+			InstanceGUID: elasticsearchInstance.Uuid,
+			Resource:     elasticsearchInstance.Domain,
+			Field:        field,
+			Broker:       brokerValue,
+			AWS:          awsValue,
+		})
+	}
+
+	plan, _ := catalog.ElasticsearchService.FetchPlan(elasticsearchInstance.PlanID)
+	if plan.Name == "" {
+		return fmt.Errorf("error getting plan %s for domain %s", elasticsearchInstance.PlanID, elasticsearchInstance.Domain)
+	}
+
+	if domain.ClusterConfig != nil {
+		instanceType := aws.StringValue(domain.ClusterConfig.InstanceType)
+		if elasticsearchInstance.InstanceType != "" && elasticsearchInstance.InstanceType != instanceType {
+			difference("instance_class", elasticsearchInstance.InstanceType, instanceType)
+		}
+	}
+
+	if domain.EBSOptions != nil {
+		volumeSize := aws.Int64Value(domain.EBSOptions.VolumeSize)
+		if elasticsearchInstance.VolumeSize > 0 && int64(elasticsearchInstance.VolumeSize) != volumeSize {
+			difference("allocated_storage", elasticsearchInstance.VolumeSize, volumeSize)
+		}
+	}
+
+	if version := aws.StringValue(domain.EngineVersion); !drift.VersionMatches(elasticsearchInstance.ElasticsearchVersion, version) {
+		difference("engine_version", elasticsearchInstance.ElasticsearchVersion, version)
+	}
+
+	var logGroupArns []string
+	for _, option := range domain.LogPublishingOptions {
+		if aws.BoolValue(option.Enabled) {
+			logGroupArns = append(logGroupArns, aws.StringValue(option.CloudWatchLogsLogGroupArn))
+		}
+	}
+	expectedLogGroupArns := []string{
+		elasticsearchInstance.SearchSlowLogsGroupARN,
+		elasticsearchInstance.IndexSlowLogsGroupARN,
+		elasticsearchInstance.ErrorLogsGroupARN,
+		elasticsearchInstance.AuditLogsGroupARN,
+	}
+	if !drift.SameSet(expectedLogGroupArns, logGroupArns) {
+		difference("log_exports", drift.Sorted(expectedLogGroupArns), drift.Sorted(logGroupArns))
+	}
+
+	generatedTags, err := tags.GenerateTags(
+		tagManager,
+		catalog.ElasticsearchService.Name,
+		plan.Name,
+		brokertags.ResourceGUIDs{
+			InstanceGUID:     elasticsearchInstance.Uuid,
+			SpaceGUID:        elasticsearchInstance.SpaceGUID,
+			OrganizationGUID: elasticsearchInstance.OrganizationGUID,
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("error generating new tags for domain %s: %s", elasticsearchInstance.Domain, err)
+	}
+	domainArn := aws.StringValue(domain.ARN)
+	existingTags, err := getOpensearchResourceTags(opensearchClient, domainArn)
+	if err != nil {
+		return err
+	}
+	actualTags := map[string]string{}
+	for _, tag := range existingTags {
+		actualTags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	if expected, found := drift.TagDifferences(generatedTags, actualTags); len(expected) > 0 {
+		d := difference("tags", expected, found)
+		if fix {
+			_, err := opensearchClient.AddTags(&opensearchservice.AddTagsInput{
+				ARN:     aws.String(domainArn),
+				TagList: elasticsearch.ConvertTagsToOpensearchTags(generatedTags),
+			})
+			if err != nil {
+				return fmt.Errorf("error adding new tags for domain %s: %s", elasticsearchInstance.Domain, err)
+			}
+			d.Fixed = true
+		}
+	}
+
+	return nil
+}
+
+// findOpensearchOrphans adds the domains named with the broker's prefix that no
+// database row refers to to report.
+func findOpensearchOrphans(opensearchClient opensearchserviceiface.OpenSearchServiceAPI, domainPrefix string, knownDomains map[string]bool, report *drift.Report) error {
+	resp, err := opensearchClient.ListDomainNames(&opensearchservice.ListDomainNamesInput{})
+	if err != nil {
+		return fmt.Errorf("could not list domains: %s", err)
+	}
+	for _, domain := range resp.DomainNames {
+		name := aws.StringValue(domain.DomainName)
+		if strings.HasPrefix(name, domainPrefix) && !knownDomains[name] {
+			report.Orphans = append(report.Orphans, drift.Resource{
+				Service:    serviceName,
+				Type:       "opensearch-domain",
+				Identifier: name,
+			})
+		}
+	}
+	return nil
+}
@@ -20,6 +20,12 @@ func getLogGroupPrefix(prefixParts ...string) string {
 	return fmt.Sprintf("/aws/rds/instance/%s", strings.Join(prefixParts, "/"))
 }
 
+// getClusterLogGroupPrefix is the prefix of the log groups of Aurora clusters,
+// which export their logs per cluster rather than per instance.
+func getClusterLogGroupPrefix(prefixParts ...string) string {
+	return fmt.Sprintf("/aws/rds/cluster/%s", strings.Join(prefixParts, "/"))
+}
+
 func ReconcileRDSCloudwatchLogGroups(logsClient cloudwatchlogsiface.CloudWatchLogsAPI, rdsClient rdsiface.RDSAPI, dbNamePrefix string, db *gorm.DB) error {
 	resp, err := logs.DescribeLogGroups(logsClient, getLogGroupPrefix(dbNamePrefix))
 	if err != nil {
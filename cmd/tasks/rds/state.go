@@ -0,0 +1,314 @@
+package rds
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/18F/aws-broker/catalog"
+	"github.com/18F/aws-broker/services/rds"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	awsRds "github.com/aws/aws-sdk-go/service/rds"
+	"github.com/aws/aws-sdk-go/service/rds/rdsiface"
+	brokertags "github.com/cloud-gov/go-broker-tags"
+	"github.com/jinzhu/gorm"
+
+	"github.com/cloud-gov/aws-broker/cmd/tasks/drift"
+	"github.com/cloud-gov/aws-broker/cmd/tasks/tags"
+)
+
+const serviceName = "rds"
+
+// parameterGroupPrefix is the prefix of the parameter groups and cluster
+// parameter groups created by the broker.
+const parameterGroupPrefix = "cg-aws-broker-"
+
+// ReconcileRDSState adds the drift between the databases recorded by the broker
+// and their AWS instances, or Aurora clusters, to report. With fix, the backup
+// retention and tags of the instances and clusters are updated to match the
+// broker.
+func ReconcileRDSState(catalog *catalog.Catalog, db *gorm.DB, rdsClient rdsiface.RDSAPI, tagManager brokertags.TagManager, dbNamePrefix string, fix bool, report *drift.Report) error {
+	rows, err := db.Model(&rds.RDSInstance{}).Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	knownDatabases := map[string]bool{}
+	knownParameterGroups := map[string]bool{}
+	for rows.Next() {
+		var rdsInstance rds.RDSInstance
+		db.ScanRows(rows, &rdsInstance)
+		knownDatabases[rdsInstance.Database] = true
+		knownParameterGroups[rdsInstance.ParameterGroupName] = true
+
+		if rdsInstance.Adapter == "aurora" {
+			resp, err := rdsClient.DescribeDBClusters(&awsRds.DescribeDBClustersInput{
+				DBClusterIdentifier: aws.String(rdsInstance.Database),
+			})
+			if err != nil {
+				if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == awsRds.ErrCodeDBClusterNotFoundFault {
+					report.Missing = append(report.Missing, drift.Resource{
+						Service:      serviceName,
+						Type:         "db-cluster",
+						Identifier:   rdsInstance.Database,
+						InstanceGUID: rdsInstance.Uuid,
+					})
+					continue
+				}
+				return fmt.Errorf("could not describe database cluster %s: %s", rdsInstance.Database, err)
+			}
+
+			// The instances of the cluster are named after it, e.g. <database>-instance-1.
+			for _, member := range resp.DBClusters[0].DBClusterMembers {
+				knownDatabases[aws.StringValue(member.DBInstanceIdentifier)] = true
+			}
+
+			err = compareAuroraCluster(catalog, rdsClient, tagManager, rdsInstance, resp.DBClusters[0], fix, report)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		resp, err := rdsClient.DescribeDBInstances(&awsRds.DescribeDBInstancesInput{
+			DBInstanceIdentifier: aws.String(rdsInstance.Database),
+		})
+		if err != nil {
+			if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == awsRds.ErrCodeDBInstanceNotFoundFault {
+				report.Missing = append(report.Missing, drift.Resource{
+					Service:      serviceName,
+					Type:         "db-instance",
+					Identifier:   rdsInstance.Database,
+					InstanceGUID: rdsInstance.Uuid,
+				})
+				continue
+			}
+			return fmt.Errorf("could not describe database instance %s: %s", rdsInstance.Database, err)
+		}
+
+		err = compareRDSInstance(catalog, rdsClient, tagManager, rdsInstance, resp.DBInstances[0], fix, report)
+		if err != nil {
+			return err
+		}
+	}
+
+	return findRDSOrphans(rdsClient, dbNamePrefix, knownDatabases, knownParameterGroups, report)
+}
+
+func compareRDSInstance(catalog *catalog.Catalog, rdsClient rdsiface.RDSAPI, tagManager brokertags.TagManager, rdsInstance rds.RDSInstance, dbInstance *awsRds.DBInstance, fix bool, report *drift.Report) error {
+	difference := func(field string, brokerValue interface{}, awsValue interface{}) *drift.Difference {
+		return report.AddDifference(drift.Difference{
+			Service:      serviceName,
+			InstanceGUID: rdsInstance.Uuid,
+			Resource:     rdsInstance.Database,
+			Field:        field,
+			Broker:       brokerValue,
+			AWS:          awsValue,
+		})
+	}
+
+	plan, _ := catalog.RdsService.FetchPlan(rdsInstance.PlanID)
+	if plan.Name == "" {
+		return fmt.Errorf("error getting plan %s for database %s", rdsInstance.PlanID, rdsInstance.Database)
+	}
+
+	if instanceClass := aws.StringValue(dbInstance.DBInstanceClass); plan.InstanceClass != "" && plan.InstanceClass != instanceClass {
+		difference("instance_class", plan.InstanceClass, instanceClass)
+	}
+
+	if storage := aws.Int64Value(dbInstance.AllocatedStorage); rdsInstance.AllocatedStorage > 0 && rdsInstance.AllocatedStorage != storage {
+		difference("allocated_storage", rdsInstance.AllocatedStorage, storage)
+	}
+
+	if version := aws.StringValue(dbInstance.EngineVersion); !drift.VersionMatches(rdsInstance.DbVersion, version) {
+		difference("engine_version", rdsInstance.DbVersion, version)
+	}
+
+	// Rows created before the retention was recorded have no retention.
+	if retention := aws.Int64Value(dbInstance.BackupRetentionPeriod); rdsInstance.BackupRetentionPeriod > 0 && rdsInstance.BackupRetentionPeriod != retention {
+		d := difference("backup_retention_period", rdsInstance.BackupRetentionPeriod, retention)
+		if fix {
+			_, err := rdsClient.ModifyDBInstance(&awsRds.ModifyDBInstanceInput{
+				DBInstanceIdentifier:  aws.String(rdsInstance.Database),
+				BackupRetentionPeriod: aws.Int64(rdsInstance.BackupRetentionPeriod),
+				ApplyImmediately:      aws.Bool(true),
+			})
+			if err != nil {
+				return fmt.Errorf("could not update backup retention for database %s: %s", rdsInstance.Database, err)
+			}
+			d.Fixed = true
+		}
+	}
+
+	logExports := aws.StringValueSlice(dbInstance.EnabledCloudwatchLogsExports)
+	if !drift.SameSet(rdsInstance.EnabledCloudwatchLogGroupExports, logExports) {
+		difference("log_exports", drift.Sorted(rdsInstance.EnabledCloudwatchLogGroupExports), drift.Sorted(logExports))
+	}
+
+	return compareRDSTags(catalog, rdsClient, tagManager, rdsInstance, plan.Name, aws.StringValue(dbInstance.DBInstanceArn), fix, difference)
+}
+
+// compareAuroraCluster adds the drift between an Aurora cluster recorded by the
+// broker and the cluster in AWS to report. Storage is managed by Aurora, so the
+// number of instances of the cluster is compared instead.
+func compareAuroraCluster(catalog *catalog.Catalog, rdsClient rdsiface.RDSAPI, tagManager brokertags.TagManager, rdsInstance rds.RDSInstance, dbCluster *awsRds.DBCluster, fix bool, report *drift.Report) error {
+	difference := func(field string, brokerValue interface{}, awsValue interface{}) *drift.Difference {
+		return report.AddDifference(drift.Difference{
+			Service:      serviceName,
+			InstanceGUID: rdsInstance.Uuid,
+			Resource:     rdsInstance.Database,
+			Field:        field,
+			Broker:       brokerValue,
+			AWS:          awsValue,
+		})
+	}
+
+	plan, _ := catalog.RdsService.FetchPlan(rdsInstance.PlanID)
+	if plan.Name == "" {
+		return fmt.Errorf("error getting plan %s for database %s", rdsInstance.PlanID, rdsInstance.Database)
+	}
+
+	// The writer and the readers of the plan.
+	if instances := len(dbCluster.DBClusterMembers); int(plan.ReaderInstances)+1 != instances {
+		difference("instances", int(plan.ReaderInstances)+1, instances)
+	}
+
+	if version := aws.StringValue(dbCluster.EngineVersion); !drift.VersionMatches(rdsInstance.DbVersion, version) {
+		difference("engine_version", rdsInstance.DbVersion, version)
+	}
+
+	if retention := aws.Int64Value(dbCluster.BackupRetentionPeriod); rdsInstance.BackupRetentionPeriod > 0 && rdsInstance.BackupRetentionPeriod != retention {
+		d := difference("backup_retention_period", rdsInstance.BackupRetentionPeriod, retention)
+		if fix {
+			_, err := rdsClient.ModifyDBCluster(&awsRds.ModifyDBClusterInput{
+				DBClusterIdentifier:   aws.String(rdsInstance.Database),
+				BackupRetentionPeriod: aws.Int64(rdsInstance.BackupRetentionPeriod),
+				ApplyImmediately:      aws.Bool(true),
+			})
+			if err != nil {
+				return fmt.Errorf("could not update backup retention for database %s: %s", rdsInstance.Database, err)
+			}
+			d.Fixed = true
+		}
+	}
+
+	logExports := aws.StringValueSlice(dbCluster.EnabledCloudwatchLogsExports)
+	if !drift.SameSet(rdsInstance.EnabledCloudwatchLogGroupExports, logExports) {
+		difference("log_exports", drift.Sorted(rdsInstance.EnabledCloudwatchLogGroupExports), drift.Sorted(logExports))
+	}
+
+	return compareRDSTags(catalog, rdsClient, tagManager, rdsInstance, plan.Name, aws.StringValue(dbCluster.DBClusterArn), fix, difference)
+}
+
+// compareRDSTags adds the tags the broker generates for a database that are
+// missing from its instance or cluster to report. With fix, they are added.
+func compareRDSTags(catalog *catalog.Catalog, rdsClient rdsiface.RDSAPI, tagManager brokertags.TagManager, rdsInstance rds.RDSInstance, planName string, arn string, fix bool, difference func(string, interface{}, interface{}) *drift.Difference) error {
+	generatedTags, err := tags.GenerateTags(
+		tagManager,
+		catalog.RdsService.Name,
+		planName,
+		brokertags.ResourceGUIDs{
+			InstanceGUID:     rdsInstance.Uuid,
+			SpaceGUID:        rdsInstance.SpaceGUID,
+			OrganizationGUID: rdsInstance.OrganizationGUID,
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("error generating new tags for database %s: %s", rdsInstance.Database, err)
+	}
+	existingTags, err := getRDSResourceTags(rdsClient, arn)
+	if err != nil {
+		return err
+	}
+	actualTags := map[string]string{}
+	for _, tag := range existingTags {
+		actualTags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	if expected, found := drift.TagDifferences(generatedTags, actualTags); len(expected) > 0 {
+		d := difference("tags", expected, found)
+		if fix {
+			err := applyTagsToRDSResource(rdsClient, arn, rds.ConvertTagsToRDSTags(generatedTags))
+			if err != nil {
+				return fmt.Errorf("error adding new tags for database %s: %s", rdsInstance.Database, err)
+			}
+			d.Fixed = true
+		}
+	}
+
+	return nil
+}
+
+// findRDSOrphans adds the database instances, Aurora clusters, parameter
+// groups and cluster parameter groups named with the broker's prefixes that no
+// database row refers to to report.
+func findRDSOrphans(rdsClient rdsiface.RDSAPI, dbNamePrefix string, knownDatabases map[string]bool, knownParameterGroups map[string]bool, report *drift.Report) error {
+	err := rdsClient.DescribeDBInstancesPages(&awsRds.DescribeDBInstancesInput{}, func(page *awsRds.DescribeDBInstancesOutput, lastPage bool) bool {
+		for _, dbInstance := range page.DBInstances {
+			identifier := aws.StringValue(dbInstance.DBInstanceIdentifier)
+			if strings.HasPrefix(identifier, dbNamePrefix) && !knownDatabases[identifier] {
+				report.Orphans = append(report.Orphans, drift.Resource{
+					Service:    serviceName,
+					Type:       "db-instance",
+					Identifier: identifier,
+				})
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("could not list database instances: %s", err)
+	}
+
+	err = rdsClient.DescribeDBClustersPages(&awsRds.DescribeDBClustersInput{}, func(page *awsRds.DescribeDBClustersOutput, lastPage bool) bool {
+		for _, dbCluster := range page.DBClusters {
+			identifier := aws.StringValue(dbCluster.DBClusterIdentifier)
+			if strings.HasPrefix(identifier, dbNamePrefix) && !knownDatabases[identifier] {
+				report.Orphans = append(report.Orphans, drift.Resource{
+					Service:    serviceName,
+					Type:       "db-cluster",
+					Identifier: identifier,
+				})
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("could not list database clusters: %s", err)
+	}
+
+	err = rdsClient.DescribeDBParameterGroupsPages(&awsRds.DescribeDBParameterGroupsInput{}, func(page *awsRds.DescribeDBParameterGroupsOutput, lastPage bool) bool {
+		for _, group := range page.DBParameterGroups {
+			name := aws.StringValue(group.DBParameterGroupName)
+			if strings.HasPrefix(name, parameterGroupPrefix) && !knownParameterGroups[name] {
+				report.Orphans = append(report.Orphans, drift.Resource{
+					Service:    serviceName,
+					Type:       "db-parameter-group",
+					Identifier: name,
+				})
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("could not list parameter groups: %s", err)
+	}
+
+	err = rdsClient.DescribeDBClusterParameterGroupsPages(&awsRds.DescribeDBClusterParameterGroupsInput{}, func(page *awsRds.DescribeDBClusterParameterGroupsOutput, lastPage bool) bool {
+		for _, group := range page.DBClusterParameterGroups {
+			name := aws.StringValue(group.DBClusterParameterGroupName)
+			if strings.HasPrefix(name, parameterGroupPrefix) && !knownParameterGroups[name] {
+				report.Orphans = append(report.Orphans, drift.Resource{
+					Service:    serviceName,
+					Type:       "db-cluster-parameter-group",
+					Identifier: name,
+				})
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("could not list cluster parameter groups: %s", err)
+	}
+	return nil
+}
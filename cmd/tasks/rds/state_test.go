@@ -0,0 +1,309 @@
+package rds
+
+import (
+	"testing"
+
+	"github.com/18F/aws-broker/base"
+	"github.com/18F/aws-broker/catalog"
+	"github.com/18F/aws-broker/common"
+	"github.com/18F/aws-broker/helpers/request"
+	"github.com/18F/aws-broker/services/rds"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	awsRds "github.com/aws/aws-sdk-go/service/rds"
+	"github.com/aws/aws-sdk-go/service/rds/rdsiface"
+	brokertags "github.com/cloud-gov/go-broker-tags"
+	"github.com/go-test/deep"
+
+	"github.com/cloud-gov/aws-broker/cmd/tasks/drift"
+)
+
+type mockRdsStateClient struct {
+	rdsiface.RDSAPI
+
+	tags []*awsRds.Tag
+
+	dbInstances            []*awsRds.DBInstance
+	dbClusters             []*awsRds.DBCluster
+	clusterParameterGroups []*awsRds.DBClusterParameterGroup
+
+	modifyDbInput      *awsRds.ModifyDBInstanceInput
+	modifyClusterInput *awsRds.ModifyDBClusterInput
+	addTagsInput       *awsRds.AddTagsToResourceInput
+}
+
+func (m *mockRdsStateClient) DescribeDBClusters(input *awsRds.DescribeDBClustersInput) (*awsRds.DescribeDBClustersOutput, error) {
+	for _, dbCluster := range m.dbClusters {
+		if aws.StringValue(dbCluster.DBClusterIdentifier) == aws.StringValue(input.DBClusterIdentifier) {
+			return &awsRds.DescribeDBClustersOutput{DBClusters: []*awsRds.DBCluster{dbCluster}}, nil
+		}
+	}
+	return nil, awserr.New(awsRds.ErrCodeDBClusterNotFoundFault, "not found", nil)
+}
+
+func (m *mockRdsStateClient) DescribeDBInstancesPages(input *awsRds.DescribeDBInstancesInput, fn func(*awsRds.DescribeDBInstancesOutput, bool) bool) error {
+	fn(&awsRds.DescribeDBInstancesOutput{DBInstances: m.dbInstances}, true)
+	return nil
+}
+
+func (m *mockRdsStateClient) DescribeDBClustersPages(input *awsRds.DescribeDBClustersInput, fn func(*awsRds.DescribeDBClustersOutput, bool) bool) error {
+	fn(&awsRds.DescribeDBClustersOutput{DBClusters: m.dbClusters}, true)
+	return nil
+}
+
+func (m *mockRdsStateClient) DescribeDBParameterGroupsPages(input *awsRds.DescribeDBParameterGroupsInput, fn func(*awsRds.DescribeDBParameterGroupsOutput, bool) bool) error {
+	fn(&awsRds.DescribeDBParameterGroupsOutput{}, true)
+	return nil
+}
+
+func (m *mockRdsStateClient) DescribeDBClusterParameterGroupsPages(input *awsRds.DescribeDBClusterParameterGroupsInput, fn func(*awsRds.DescribeDBClusterParameterGroupsOutput, bool) bool) error {
+	fn(&awsRds.DescribeDBClusterParameterGroupsOutput{DBClusterParameterGroups: m.clusterParameterGroups}, true)
+	return nil
+}
+
+func (m *mockRdsStateClient) ModifyDBCluster(input *awsRds.ModifyDBClusterInput) (*awsRds.ModifyDBClusterOutput, error) {
+	m.modifyClusterInput = input
+	return &awsRds.ModifyDBClusterOutput{}, nil
+}
+
+func (m *mockRdsStateClient) ListTagsForResource(*awsRds.ListTagsForResourceInput) (*awsRds.ListTagsForResourceOutput, error) {
+	return &awsRds.ListTagsForResourceOutput{
+		TagList: m.tags,
+	}, nil
+}
+
+func (m *mockRdsStateClient) ModifyDBInstance(input *awsRds.ModifyDBInstanceInput) (*awsRds.ModifyDBInstanceOutput, error) {
+	m.modifyDbInput = input
+	return &awsRds.ModifyDBInstanceOutput{}, nil
+}
+
+func (m *mockRdsStateClient) AddTagsToResource(input *awsRds.AddTagsToResourceInput) (*awsRds.AddTagsToResourceOutput, error) {
+	m.addTagsInput = input
+	return &awsRds.AddTagsToResourceOutput{}, nil
+}
+
+type mockTagManager struct {
+	tags map[string]string
+}
+
+func (m mockTagManager) GenerateTags(
+	action brokertags.Action,
+	serviceName string,
+	servicePlanName string,
+	resourceGUIDs brokertags.ResourceGUIDs,
+	getMissingResources bool,
+) (map[string]string, error) {
+	return m.tags, nil
+}
+
+func TestCompareRDSInstance(t *testing.T) {
+	c := &catalog.Catalog{
+		RdsService: catalog.RDSService{
+			Plans: []catalog.RDSPlan{
+				{
+					Plan:          catalog.Plan{ID: "plan-id", Name: "micro-psql"},
+					InstanceClass: "db.t3.micro",
+				},
+			},
+		},
+	}
+	rdsInstance := rds.RDSInstance{
+		Instance: base.Instance{
+			Uuid: "instance-guid",
+			Request: request.Request{
+				PlanID: "plan-id",
+			},
+		},
+		Database:                         "db-name",
+		AllocatedStorage:                 20,
+		DbVersion:                        "15",
+		BackupRetentionPeriod:            14,
+		EnabledCloudwatchLogGroupExports: []string{"postgresql"},
+	}
+	dbInstance := &awsRds.DBInstance{
+		DBInstanceArn:                aws.String("db-arn"),
+		DBInstanceClass:              aws.String("db.t3.small"),
+		AllocatedStorage:             aws.Int64(20),
+		EngineVersion:                aws.String("15.4"),
+		BackupRetentionPeriod:        aws.Int64(7),
+		EnabledCloudwatchLogsExports: aws.StringSlice([]string{"postgresql"}),
+	}
+	tagManager := mockTagManager{tags: map[string]string{"client": "the-client"}}
+
+	testCases := map[string]struct {
+		fix           bool
+		expectedFixed bool
+	}{
+		"report only": {},
+		"fix": {
+			fix:           true,
+			expectedFixed: true,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			rdsClient := &mockRdsStateClient{}
+			report := drift.NewReport()
+
+			err := compareRDSInstance(c, rdsClient, tagManager, rdsInstance, dbInstance, test.fix, report)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expected := []drift.Difference{
+				{
+					Service:      serviceName,
+					InstanceGUID: "instance-guid",
+					Resource:     "db-name",
+					Field:        "instance_class",
+					Broker:       "db.t3.micro",
+					AWS:          "db.t3.small",
+				},
+				{
+					Service:      serviceName,
+					InstanceGUID: "instance-guid",
+					Resource:     "db-name",
+					Field:        "backup_retention_period",
+					Broker:       int64(14),
+					AWS:          int64(7),
+					Fixed:        test.expectedFixed,
+				},
+				{
+					Service:      serviceName,
+					InstanceGUID: "instance-guid",
+					Resource:     "db-name",
+					Field:        "tags",
+					Broker:       map[string]string{"client": "the-client"},
+					AWS:          map[string]string{},
+					Fixed:        test.expectedFixed,
+				},
+			}
+			if diff := deep.Equal(report.Differences, expected); diff != nil {
+				t.Error(diff)
+			}
+
+			if test.fix != (rdsClient.modifyDbInput != nil) || test.fix != (rdsClient.addTagsInput != nil) {
+				t.Fatal("expected the backup retention and tags to be updated only with fix")
+			}
+			if test.fix && *rdsClient.modifyDbInput.BackupRetentionPeriod != 14 {
+				t.Errorf("unexpected backup retention %d", *rdsClient.modifyDbInput.BackupRetentionPeriod)
+			}
+		})
+	}
+}
+
+func TestReconcileRDSStateAurora(t *testing.T) {
+	db, err := common.DBInit(&common.DBConfig{DbType: "sqlite3", DbName: ":memory:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every connection to an in-memory sqlite database gets its own database
+	db.DB().SetMaxOpenConns(1)
+	db.AutoMigrate(&rds.RDSInstance{})
+	t.Cleanup(func() { db.Close() })
+
+	c := &catalog.Catalog{
+		RdsService: catalog.RDSService{
+			Plans: []catalog.RDSPlan{
+				{
+					Plan:            catalog.Plan{ID: "plan-id", Name: "aurora-psql"},
+					Adapter:         "aurora",
+					ReaderInstances: 1,
+				},
+			},
+		},
+	}
+	db.Create(&rds.RDSInstance{
+		Instance: base.Instance{
+			Uuid: "instance-guid",
+			Request: request.Request{
+				PlanID: "plan-id",
+			},
+		},
+		Database:              "cg-aws-broker-db",
+		Adapter:               "aurora",
+		DbVersion:             "15",
+		BackupRetentionPeriod: 14,
+		ParameterGroupName:    "cg-aws-broker-cluster-params",
+	})
+
+	testCases := map[string]struct {
+		fix           bool
+		expectedFixed bool
+	}{
+		"report only": {},
+		"fix": {
+			fix:           true,
+			expectedFixed: true,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			rdsClient := &mockRdsStateClient{
+				tags: []*awsRds.Tag{{Key: aws.String("client"), Value: aws.String("the-client")}},
+				dbClusters: []*awsRds.DBCluster{
+					{
+						DBClusterIdentifier:   aws.String("cg-aws-broker-db"),
+						DBClusterArn:          aws.String("cluster-arn"),
+						EngineVersion:         aws.String("15.4"),
+						BackupRetentionPeriod: aws.Int64(7),
+						DBClusterMembers: []*awsRds.DBClusterMember{
+							{DBInstanceIdentifier: aws.String("cg-aws-broker-db-instance-1")},
+							{DBInstanceIdentifier: aws.String("cg-aws-broker-db-instance-2")},
+						},
+					},
+					{DBClusterIdentifier: aws.String("cg-aws-broker-orphan")},
+				},
+				dbInstances: []*awsRds.DBInstance{
+					{DBInstanceIdentifier: aws.String("cg-aws-broker-db-instance-1")},
+					{DBInstanceIdentifier: aws.String("cg-aws-broker-db-instance-2")},
+					{DBInstanceIdentifier: aws.String("cg-aws-broker-orphan-instance-1")},
+				},
+				clusterParameterGroups: []*awsRds.DBClusterParameterGroup{
+					{DBClusterParameterGroupName: aws.String("cg-aws-broker-cluster-params")},
+					{DBClusterParameterGroupName: aws.String("cg-aws-broker-orphan-params")},
+				},
+			}
+			tagManager := mockTagManager{tags: map[string]string{"client": "the-client"}}
+			report := drift.NewReport()
+
+			err := ReconcileRDSState(c, db, rdsClient, tagManager, "cg-aws-broker-", test.fix, report)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expectedDifferences := []drift.Difference{
+				{
+					Service:      serviceName,
+					InstanceGUID: "instance-guid",
+					Resource:     "cg-aws-broker-db",
+					Field:        "backup_retention_period",
+					Broker:       int64(14),
+					AWS:          int64(7),
+					Fixed:        test.expectedFixed,
+				},
+			}
+			if diff := deep.Equal(report.Differences, expectedDifferences); diff != nil {
+				t.Error(diff)
+			}
+
+			expectedOrphans := []drift.Resource{
+				{Service: serviceName, Type: "db-instance", Identifier: "cg-aws-broker-orphan-instance-1"},
+				{Service: serviceName, Type: "db-cluster", Identifier: "cg-aws-broker-orphan"},
+				{Service: serviceName, Type: "db-cluster-parameter-group", Identifier: "cg-aws-broker-orphan-params"},
+			}
+			if diff := deep.Equal(report.Orphans, expectedOrphans); diff != nil {
+				t.Error(diff)
+			}
+
+			if test.fix != (rdsClient.modifyClusterInput != nil) {
+				t.Fatal("expected the backup retention of the cluster to be updated only with fix")
+			}
+			if test.fix && *rdsClient.modifyClusterInput.BackupRetentionPeriod != 14 {
+				t.Errorf("unexpected backup retention %d", *rdsClient.modifyClusterInput.BackupRetentionPeriod)
+			}
+		})
+	}
+}
@@ -53,6 +53,38 @@ func getRDSInstanceArn(rdsClient rdsiface.RDSAPI, rdsInstance rds.RDSInstance) (
 	return *instanceInfo.DBInstances[0].DBInstanceArn, nil
 }
 
+// getAuroraClusterArns returns the ARNs of an Aurora cluster and of its
+// instances, which are tagged separately, or none if the cluster is gone.
+func getAuroraClusterArns(rdsClient rdsiface.RDSAPI, rdsInstance rds.RDSInstance) ([]string, error) {
+	clusterInfo, err := rdsClient.DescribeDBClusters(&awsRds.DescribeDBClustersInput{
+		DBClusterIdentifier: aws.String(rdsInstance.Database),
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == awsRds.ErrCodeDBClusterNotFoundFault {
+			log.Printf("Could not find database cluster %s, continuing", rdsInstance.Database)
+			return nil, nil
+		}
+		return nil, fmt.Errorf("could not describe database cluster: %s", err)
+	}
+	arns := []string{aws.StringValue(clusterInfo.DBClusters[0].DBClusterArn)}
+
+	instanceInfo, err := rdsClient.DescribeDBInstances(&awsRds.DescribeDBInstancesInput{
+		Filters: []*awsRds.Filter{
+			{
+				Name:   aws.String("db-cluster-id"),
+				Values: []*string{aws.String(rdsInstance.Database)},
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not describe the instances of database cluster: %s", err)
+	}
+	for _, dbInstance := range instanceInfo.DBInstances {
+		arns = append(arns, aws.StringValue(dbInstance.DBInstanceArn))
+	}
+	return arns, nil
+}
+
 func doRDSResourceTagsContainGeneratedTags(rdsTags []*awsRds.Tag, generatedTags []*awsRds.Tag) bool {
 	for _, v := range generatedTags {
 		if slices.Contains([]string{"Created at", "Updated at"}, *v.Key) {
@@ -107,11 +139,20 @@ func ReconcileRDSResourceTags(catalog *catalog.Catalog, db *gorm.DB, rdsClient r
 		var rdsInstance rds.RDSInstance
 		db.ScanRows(rows, &rdsInstance)
 
-		dbInstanceArn, err := getRDSInstanceArn(rdsClient, rdsInstance)
+		var arns []string
+		if rdsInstance.Adapter == "aurora" {
+			arns, err = getAuroraClusterArns(rdsClient, rdsInstance)
+		} else {
+			var dbInstanceArn string
+			dbInstanceArn, err = getRDSInstanceArn(rdsClient, rdsInstance)
+			if dbInstanceArn != "" {
+				arns = []string{dbInstanceArn}
+			}
+		}
 		if err != nil {
 			return fmt.Errorf("could not get ARN for database %s: %s", rdsInstance.Database, err)
 		}
-		if dbInstanceArn == "" {
+		if len(arns) == 0 {
 			continue
 		}
 
@@ -136,12 +177,28 @@ func ReconcileRDSResourceTags(catalog *catalog.Catalog, db *gorm.DB, rdsClient r
 
 		generatedRdsTags := rds.ConvertTagsToRDSTags(generatedTags)
 
-		err = processRDSResource(rdsClient, dbInstanceArn, generatedRdsTags)
-		if err != nil {
-			return err
+		for _, arn := range arns {
+			err = processRDSResource(rdsClient, arn, generatedRdsTags)
+			if err != nil {
+				return err
+			}
 		}
 
-		if rdsInstance.ParameterGroupName != "" {
+		if rdsInstance.ParameterGroupName != "" && rdsInstance.Adapter == "aurora" {
+			groupInfo, err := rdsClient.DescribeDBClusterParameterGroups(&awsRds.DescribeDBClusterParameterGroupsInput{
+				DBClusterParameterGroupName: aws.String(rdsInstance.ParameterGroupName),
+			})
+			if err != nil {
+				log.Fatalf("could not find cluster parameter group with name %s: %s", rdsInstance.ParameterGroupName, err)
+			}
+
+			parameterGroupArn := groupInfo.DBClusterParameterGroups[0].DBClusterParameterGroupArn
+
+			err = processRDSResource(rdsClient, *parameterGroupArn, generatedRdsTags)
+			if err != nil {
+				return err
+			}
+		} else if rdsInstance.ParameterGroupName != "" {
 			groupInfo, err := rdsClient.DescribeDBParameterGroups(&awsRds.DescribeDBParameterGroupsInput{
 				DBParameterGroupName: aws.String(rdsInstance.ParameterGroupName),
 			})
@@ -164,6 +221,9 @@ func ReconcileRDSResourceTags(catalog *catalog.Catalog, db *gorm.DB, rdsClient r
 
 		for _, logGroupType := range rdsInstance.EnabledCloudwatchLogGroupExports {
 			logGroupName := getLogGroupPrefix(rdsInstance.Database, logGroupType)
+			if rdsInstance.Adapter == "aurora" {
+				logGroupName = getClusterLogGroupPrefix(rdsInstance.Database, logGroupType)
+			}
 			log.Printf("adding tags to log group %s", logGroupName)
 
 			resp, err := logs.DescribeLogGroups(logsClient, logGroupName)
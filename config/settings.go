@@ -1,15 +1,33 @@
 package config
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/18F/aws-broker/common"
+	"github.com/18F/aws-broker/helpers"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
 )
 
+// DefaultEncryptionKeyID identifies the encryption key when ENC_KEY_ID is not
+// set. Secrets encrypted before key IDs were recorded were encrypted with it.
+const DefaultEncryptionKeyID = "default"
+
+// KMSSecretEncryption selects the encryption of secrets with data keys from the
+// KMS key KMSKeyID, instead of with EncryptionKey.
+const KMSSecretEncryption = "kms"
+
+// kmsKeyIDPrefix marks the IDs of KMS keys among encryption key IDs.
+const kmsKeyIDPrefix = "kms:"
+
 // Settings stores settings used to run the application
 type Settings struct {
 	EncryptionKey             string
@@ -29,6 +47,22 @@ type Settings struct {
 	CfApiClientSecret         string
 	MaxBackupRetention        int64
 	MinBackupRetention        int64
+
+	// EncryptionKeyID identifies EncryptionKey, which new secrets are encrypted with.
+	EncryptionKeyID string
+	// DecryptionKeys holds previous encryption keys by ID, so that secrets
+	// encrypted before the key was rotated can still be decrypted.
+	DecryptionKeys map[string]string
+
+	// SecretEncryption is "kms" to encrypt new secrets with KMSKeyID, or empty
+	// to encrypt them with EncryptionKey.
+	SecretEncryption string
+	KMSKeyID         string
+	KMSClient        kmsiface.KMSAPI
+
+	// SecretsManagerCredentials stores the credentials issued to bindings in
+	// Secrets Manager.
+	SecretsManagerCredentials bool
 }
 
 // LoadFromEnv loads settings from environment variables
@@ -72,6 +106,17 @@ func (s *Settings) LoadFromEnv() error {
 	} else {
 		return errors.New("an encryption key is required. Must specify ENC_KEY environment variable")
 	}
+	s.EncryptionKeyID = os.Getenv("ENC_KEY_ID")
+	if s.EncryptionKeyID == "" {
+		s.EncryptionKeyID = DefaultEncryptionKeyID
+	}
+	// Previous keys are given as a JSON object of keys by ID.
+	s.DecryptionKeys = map[string]string{}
+	if decryptionKeys := os.Getenv("ENC_DECRYPTION_KEYS"); decryptionKeys != "" {
+		if err := json.Unmarshal([]byte(decryptionKeys), &s.DecryptionKeys); err != nil {
+			return fmt.Errorf("couldn't load ENC_DECRYPTION_KEYS: %s", err)
+		}
+	}
 
 	s.DbNamePrefix = os.Getenv("DB_PREFIX")
 	if s.DbNamePrefix == "" {
@@ -87,6 +132,23 @@ func (s *Settings) LoadFromEnv() error {
 
 	s.Region = os.Getenv("AWS_DEFAULT_REGION")
 
+	// Secrets are encrypted with ENC_KEY unless a KMS key is configured.
+	s.SecretEncryption = os.Getenv("SECRET_ENCRYPTION")
+	s.KMSKeyID = os.Getenv("KMS_KEY_ID")
+	switch s.SecretEncryption {
+	case "", "local":
+		s.SecretEncryption = ""
+	case KMSSecretEncryption:
+		if s.KMSKeyID == "" {
+			return errors.New("KMS_KEY_ID environment variable is required to encrypt secrets with KMS")
+		}
+	default:
+		return fmt.Errorf("unknown SECRET_ENCRYPTION %s. Must be local or kms", s.SecretEncryption)
+	}
+	// Previously stored secrets may have been encrypted with KMS whatever the
+	// current setting.
+	s.KMSClient = kms.New(session.Must(session.NewSession()), aws.NewConfig().WithRegion(s.Region))
+
 	storage := os.Getenv("MAX_ALLOCATED_STORAGE")
 	if storage != "" {
 		var err error
@@ -112,6 +174,9 @@ func (s *Settings) LoadFromEnv() error {
 		s.EnableFunctionsFeature = false
 	}
 
+	// Feature flag to store the credentials issued to bindings in Secrets Manager
+	_, s.SecretsManagerCredentials = os.LookupEnv("SECRETS_MANAGER_CREDENTIALS")
+
 	// set the bucketname created by TF, empty string is ok.
 	// broker will check for nil and skip snaphot config
 	s.SnapshotsBucketName = os.Getenv("S3_SNAPSHOT_BUCKET")
@@ -155,3 +220,55 @@ func (s *Settings) LoadFromEnv() error {
 
 	return nil
 }
+
+// CurrentEncryptionKeyID returns the ID of the key new secrets are encrypted with.
+func (s *Settings) CurrentEncryptionKeyID() string {
+	if s.SecretEncryption == KMSSecretEncryption {
+		return kmsKeyIDPrefix + s.KMSKeyID
+	}
+	return s.localEncryptionKeyID()
+}
+
+// localEncryptionKeyID returns the ID of EncryptionKey.
+func (s *Settings) localEncryptionKeyID() string {
+	if s.EncryptionKeyID == "" {
+		return DefaultEncryptionKeyID
+	}
+	return s.EncryptionKeyID
+}
+
+// DecryptionKey returns the key with the given ID. Secrets encrypted before
+// key IDs were recorded have no key ID, and use the key with the default ID.
+func (s *Settings) DecryptionKey(keyID string) (string, error) {
+	if keyID == "" {
+		keyID = DefaultEncryptionKeyID
+	}
+	if keyID == s.localEncryptionKeyID() {
+		return s.EncryptionKey, nil
+	}
+	if key, ok := s.DecryptionKeys[keyID]; ok {
+		return key, nil
+	}
+	return "", fmt.Errorf("no decryption key with ID %s", keyID)
+}
+
+// SecretEncrypter returns the encrypter of secrets encrypted with the key with
+// the given ID, either a KMS key or a key held by the broker.
+func (s *Settings) SecretEncrypter(keyID string) (helpers.SecretEncrypter, error) {
+	if strings.HasPrefix(keyID, kmsKeyIDPrefix) {
+		if s.KMSClient == nil {
+			return nil, fmt.Errorf("no KMS client to decrypt with key %s", keyID)
+		}
+		return helpers.NewKMSEncrypter(s.KMSClient, strings.TrimPrefix(keyID, kmsKeyIDPrefix)), nil
+	}
+	key, err := s.DecryptionKey(keyID)
+	if err != nil {
+		return nil, err
+	}
+	return helpers.NewLocalKeyEncrypter(key), nil
+}
+
+// CurrentSecretEncrypter returns the encrypter new secrets are encrypted with.
+func (s *Settings) CurrentSecretEncrypter() (helpers.SecretEncrypter, error) {
+	return s.SecretEncrypter(s.CurrentEncryptionKeyID())
+}
@@ -0,0 +1,111 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/18F/aws-broker/helpers"
+	"github.com/aws/aws-sdk-go/service/kms"
+)
+
+func TestDecryptionKey(t *testing.T) {
+	settings := &Settings{
+		EncryptionKey:   "current-key",
+		EncryptionKeyID: "2",
+		DecryptionKeys: map[string]string{
+			DefaultEncryptionKeyID: "first-key",
+		},
+	}
+
+	testCases := map[string]struct {
+		keyID       string
+		expectedKey string
+		expectErr   bool
+	}{
+		"current key": {
+			keyID:       "2",
+			expectedKey: "current-key",
+		},
+		"previous key": {
+			keyID:       DefaultEncryptionKeyID,
+			expectedKey: "first-key",
+		},
+		"no key ID": {
+			expectedKey: "first-key",
+		},
+		"unknown key": {
+			keyID:     "3",
+			expectErr: true,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			key, err := settings.DecryptionKey(test.keyID)
+			if test.expectErr != (err != nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if key != test.expectedKey {
+				t.Errorf("expected key %q, got %q", test.expectedKey, key)
+			}
+		})
+	}
+}
+
+func TestDecryptionKeyWithoutKeyIDs(t *testing.T) {
+	settings := &Settings{EncryptionKey: "current-key"}
+	key, err := settings.DecryptionKey("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "current-key" {
+		t.Errorf("expected the current key, got %q", key)
+	}
+}
+
+func TestSecretEncrypter(t *testing.T) {
+	settings := &Settings{
+		EncryptionKey:    "12345678901234567890123456789012",
+		SecretEncryption: KMSSecretEncryption,
+		KMSKeyID:         "the-kms-key",
+		KMSClient:        &kms.KMS{},
+	}
+
+	if settings.CurrentEncryptionKeyID() != "kms:the-kms-key" {
+		t.Errorf("unexpected current key ID %s", settings.CurrentEncryptionKeyID())
+	}
+
+	testCases := map[string]struct {
+		keyID     string
+		expected  interface{}
+		expectErr bool
+	}{
+		"kms key": {
+			keyID:    "kms:the-kms-key",
+			expected: &helpers.KMSEncrypter{},
+		},
+		"local key encrypted before switching to KMS": {
+			keyID:    DefaultEncryptionKeyID,
+			expected: &helpers.LocalKeyEncrypter{},
+		},
+		"unknown local key": {
+			keyID:     "2",
+			expectErr: true,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			encrypter, err := settings.SecretEncrypter(test.keyID)
+			if test.expectErr != (err != nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if test.expectErr {
+				return
+			}
+			if reflect.TypeOf(encrypter) != reflect.TypeOf(test.expected) {
+				t.Errorf("expected a %T, got a %T", test.expected, encrypter)
+			}
+		})
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/18F/aws-broker/services/elasticsearch"
 	"github.com/18F/aws-broker/services/rds"
 	"github.com/18F/aws-broker/services/redis"
+	"github.com/18F/aws-broker/taskqueue"
 	"github.com/jinzhu/gorm"
 )
 
@@ -24,7 +25,27 @@ func InternalDBInit(dbConfig *common.DBConfig) (*gorm.DB, error) {
 	log.Println("Migrating")
 	// db.LogMode(true)
 	// Automigrate!
-	db.AutoMigrate(&rds.RDSInstance{}, &redis.RedisInstance{}, &elasticsearch.ElasticsearchInstance{}, &base.Instance{}) // Add all your models here to help setup the database tables
+	db.AutoMigrate(&rds.RDSInstance{}, &rds.RDSBinding{}, &rds.RDSSnapshot{}, &redis.RedisInstance{}, &redis.RedisBinding{}, &elasticsearch.ElasticsearchInstance{}, &elasticsearch.ElasticsearchBinding{}, &base.Instance{}, &base.ProvisionedResource{}, &taskqueue.AsyncJob{}) // Add all your models here to help setup the database tables
+	// Secrets encrypted with KMS carry their encrypted data key, and do not fit
+	// in the varchar(255) columns they were first stored in.
+	if db.Dialect().GetName() == "postgres" {
+		secretColumns := []struct {
+			model  interface{}
+			column string
+		}{
+			{&rds.RDSInstance{}, "password"},
+			{&rds.RDSBinding{}, "password"},
+			{&redis.RedisInstance{}, "password"},
+			{&elasticsearch.ElasticsearchInstance{}, "password"},
+			{&elasticsearch.ElasticsearchInstance{}, "access_key"},
+			{&elasticsearch.ElasticsearchInstance{}, "secret_key"},
+		}
+		for _, secret := range secretColumns {
+			if err := db.Model(secret.model).ModifyColumn(secret.column, "text").Error; err != nil {
+				return nil, err
+			}
+		}
+	}
 	log.Println("Migrated")
 	return db, err
 }
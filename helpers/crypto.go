@@ -5,7 +5,9 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"math/big"
+	"strings"
 )
 
 // RandStr will generate a random alphanumeric string of the specified length.
@@ -32,24 +34,77 @@ func StringWithCharset(length int, charset string) string {
 	return string(b)
 }
 
-// Encrypt will encrypt the given plain text string.
-func Encrypt(msg, key string, iv []byte) (string, error) {
-	src := []byte(msg)
-	dst := make([]byte, len(src))
+// gcmPrefix marks values encrypted with AES-GCM. Values without it were
+// encrypted with AES-CFB by earlier versions of the broker.
+const gcmPrefix = "v2:"
 
-	aesBlockEncrypter, err := aes.NewCipher([]byte(key))
+// Encrypt will encrypt the given plain text string with AES-GCM. The iv is
+// authenticated along with the message, so the result only decrypts with the
+// same iv.
+func Encrypt(msg, key string, iv []byte) (string, error) {
+	aesGCM, err := newGCM(key)
 	if err != nil {
 		return "", err
 	}
 
-	aesEncrypter := cipher.NewCFBEncrypter(aesBlockEncrypter, iv)
-	aesEncrypter.XORKeyStream(dst, src)
+	nonce := generateIv(aesGCM.NonceSize())
+	sealed := aesGCM.Seal(nonce, nonce, []byte(msg), iv)
 
-	return base64.StdEncoding.EncodeToString(dst), nil
+	return gcmPrefix + base64.StdEncoding.EncodeToString(sealed), nil
 }
 
-// Decrypt will decrypt the given encrypted string.
+// Decrypt will decrypt the given encrypted string. It returns an error if the
+// string was encrypted with AES-GCM and has been tampered with. Strings
+// encrypted with AES-CFB are decrypted without any integrity check.
 func Decrypt(msg, key string, iv []byte) (string, error) {
+	if IsLegacyEncryption(msg) {
+		return decryptCFB(msg, key, iv)
+	}
+
+	src, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(msg, gcmPrefix))
+	if err != nil {
+		return "", err
+	}
+
+	aesGCM, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	if len(src) < aesGCM.NonceSize() {
+		return "", errors.New("encrypted value is too short")
+	}
+
+	nonce, sealed := src[:aesGCM.NonceSize()], src[aesGCM.NonceSize():]
+	dst, err := aesGCM.Open(nil, nonce, sealed, iv)
+	if err != nil {
+		return "", errors.New("encrypted value could not be authenticated")
+	}
+
+	return string(dst), nil
+}
+
+// IsEncrypted reports whether the given string was encrypted with Encrypt or
+// a SecretEncrypter. Strings encrypted with AES-CFB cannot be told apart from
+// plain text.
+func IsEncrypted(msg string) bool {
+	return strings.HasPrefix(msg, gcmPrefix) || strings.HasPrefix(msg, kmsPrefix)
+}
+
+// IsLegacyEncryption reports whether the given encrypted string was encrypted
+// with AES-CFB, and should be encrypted again with Encrypt.
+func IsLegacyEncryption(msg string) bool {
+	return msg != "" && !IsEncrypted(msg)
+}
+
+func newGCM(key string) (cipher.AEAD, error) {
+	aesBlockCipher, err := aes.NewCipher([]byte(key))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(aesBlockCipher)
+}
+
+func decryptCFB(msg, key string, iv []byte) (string, error) {
 	src, _ := base64.StdEncoding.DecodeString(msg)
 	dst := make([]byte, len(src))
 
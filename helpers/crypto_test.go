@@ -2,7 +2,10 @@ package helpers
 
 import (
 	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
 	"fmt"
+	"strings"
 	"testing"
 )
 
@@ -52,6 +55,104 @@ func TestKeyChangesEncryption(t *testing.T) {
 	}
 }
 
+func TestTamperedEncryption(t *testing.T) {
+	msg := "Very secure message"
+	key := "12345678901234567890123456789012"
+	iv := generateIv(aes.BlockSize)
+
+	encrypted, err := Encrypt(msg, key, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(encrypted, gcmPrefix))
+
+	testCases := map[string]struct {
+		encrypted string
+		key       string
+		iv        []byte
+	}{
+		"modified ciphertext": {
+			encrypted: gcmPrefix + base64.StdEncoding.EncodeToString(flipLastBit(sealed)),
+			key:       key,
+			iv:        iv,
+		},
+		"truncated ciphertext": {
+			encrypted: gcmPrefix + base64.StdEncoding.EncodeToString(sealed[:len(sealed)-1]),
+			key:       key,
+			iv:        iv,
+		},
+		"too short": {
+			encrypted: gcmPrefix + base64.StdEncoding.EncodeToString(sealed[:4]),
+			key:       key,
+			iv:        iv,
+		},
+		"other iv": {
+			encrypted: encrypted,
+			key:       key,
+			iv:        generateIv(aes.BlockSize),
+		},
+		"other key": {
+			encrypted: encrypted,
+			key:       "21098765432109876543210987654321",
+			iv:        iv,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			decrypted, err := Decrypt(test.encrypted, test.key, test.iv)
+			if err == nil {
+				t.Fatalf("expected an error, decrypted %q", decrypted)
+			}
+		})
+	}
+}
+
+func TestLegacyDecryption(t *testing.T) {
+	msg := "Very secure message"
+	key := "12345678901234567890123456789012"
+	iv := generateIv(aes.BlockSize)
+
+	encrypted := encryptCFB(t, msg, key, iv)
+	if !IsLegacyEncryption(encrypted) {
+		t.Error("expected a value encrypted with CFB to need upgrading")
+	}
+
+	decrypted, err := Decrypt(encrypted, key, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decrypted != msg {
+		t.Error("decrypted should be the same as the original")
+	}
+
+	upgraded, _ := Encrypt(decrypted, key, iv)
+	if IsLegacyEncryption(upgraded) {
+		t.Error("expected a value encrypted with Encrypt not to need upgrading")
+	}
+}
+
+func flipLastBit(src []byte) []byte {
+	dst := append([]byte{}, src...)
+	dst[len(dst)-1] ^= 1
+	return dst
+}
+
+// encryptCFB encrypts msg like earlier versions of the broker did.
+func encryptCFB(t *testing.T, msg, key string, iv []byte) string {
+	src := []byte(msg)
+	dst := make([]byte, len(src))
+
+	aesBlockEncrypter, err := aes.NewCipher([]byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cipher.NewCFBEncrypter(aesBlockEncrypter, iv).XORKeyStream(dst, src)
+
+	return base64.StdEncoding.EncodeToString(dst)
+}
+
 func TestRandStringGeneration(t *testing.T) {
 	randstrings := []string{}
 
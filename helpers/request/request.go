@@ -1,6 +1,7 @@
 package request
 
 import (
+	"bytes"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
@@ -33,6 +34,22 @@ func ExtractRequest(req *http.Request) (Request, response.Response) {
 	if err != nil {
 		return cr, response.NewErrorResponse(http.StatusBadRequest, err.Error())
 	}
-	json.Unmarshal(body, &cr)
+	if err := json.Unmarshal(body, &cr); err != nil {
+		return cr, response.NewErrorResponse(http.StatusBadRequest, "Invalid request body. Error: "+err.Error())
+	}
 	return cr, nil
 }
+
+// DecodeParameters decodes the raw parameters of a request into the options
+// struct pointed to by v. The parameters are validated against the schemas of
+// the plan before they reach the brokers; decoding still rejects parameters
+// that v has no field for, so that a broker called directly does not silently
+// ignore a misspelled parameter.
+func DecodeParameters(raw json.RawMessage, v interface{}) error {
+	if len(raw) == 0 {
+		return nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
@@ -52,6 +52,12 @@ var (
 	SuccessBindResponseType Type = "success_bind"
 	// SuccessDeleteResponseType represents a response for a successful instance deletion.
 	SuccessDeleteResponseType Type = "success_delete"
+	// SuccessUnbindResponseType represents a response for a successful instance unbinding.
+	SuccessUnbindResponseType Type = "success_unbind"
+	// SuccessFetchInstanceResponseType represents a response for a successful instance fetch.
+	SuccessFetchInstanceResponseType Type = "success_fetch_instance"
+	// SuccessFetchBindingResponseType represents a response for a successful binding fetch.
+	SuccessFetchBindingResponseType Type = "success_fetch_binding"
 	// ErrorResponseType represents a response for an error.
 	ErrorResponseType Type = "error"
 )
@@ -84,6 +90,39 @@ func NewSuccessBindResponse(credentials map[string]string) Response {
 	return &successBindResponse{baseResponse: baseResponse{StatusCode: http.StatusCreated, StatusType: SuccessBindResponseType}, Credentials: credentials}
 }
 
+type successFetchInstanceResponse struct {
+	baseResponse
+	ServiceID    string                 `json:"service_id"`
+	PlanID       string                 `json:"plan_id"`
+	DashboardURL string                 `json:"dashboard_url,omitempty"`
+	Parameters   map[string]interface{} `json:"parameters"`
+}
+
+// NewSuccessFetchInstanceResponse is the constructor for a successFetchInstanceResponse.
+func NewSuccessFetchInstanceResponse(serviceID string, planID string, dashboardURL string, parameters map[string]interface{}) Response {
+	return &successFetchInstanceResponse{
+		baseResponse: baseResponse{StatusCode: http.StatusOK, StatusType: SuccessFetchInstanceResponseType},
+		ServiceID:    serviceID,
+		PlanID:       planID,
+		DashboardURL: dashboardURL,
+		Parameters:   parameters,
+	}
+}
+
+type successFetchBindingResponse struct {
+	baseResponse
+	Credentials map[string]string `json:"credentials"`
+}
+
+// NewSuccessFetchBindingResponse is the constructor for a successFetchBindingResponse.
+func NewSuccessFetchBindingResponse(credentials map[string]string) Response {
+	return &successFetchBindingResponse{baseResponse: baseResponse{StatusCode: http.StatusOK, StatusType: SuccessFetchBindingResponseType}, Credentials: credentials}
+}
+
+type emptyResponse struct {
+	baseResponse
+}
+
 // NewSuccessLastOperation for async responses
 func NewSuccessLastOperation(state string, description string) Response {
 	return &lastOperationResponse{baseResponse: baseResponse{StatusCode: http.StatusOK, StatusType: SuccessLastOperationResponseType}, State: state, Description: description}
@@ -96,6 +135,9 @@ var (
 	SuccessAcceptedResponse = newSuccessResponse(http.StatusAccepted, SuccessAcceptedResponseType, "The operation was accepted")
 	// SuccessDeleteResponse represents the response that all successful instance deletions should return.
 	SuccessDeleteResponse = newSuccessResponse(http.StatusOK, SuccessDeleteResponseType, "The instance was deleted")
+	// SuccessUnbindResponse represents the response that all successful unbindings should return.
+	// The Open Service Broker API expects an empty JSON object as the body.
+	SuccessUnbindResponse = &emptyResponse{baseResponse: baseResponse{StatusCode: http.StatusOK, StatusType: SuccessUnbindResponseType}}
 )
 
 // If a broker has an async operation ( create, modify, delete, bind) and wants to return an "operation" they should use this
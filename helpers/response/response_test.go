@@ -19,6 +19,9 @@ var responseTests = []responseTest{
 	{SuccessDeleteResponse, "{\"description\":\"The instance was deleted\"}", http.StatusOK, SuccessDeleteResponseType},
 	{NewErrorResponse(http.StatusNotFound, "oops"), "{\"description\":\"oops\"}", http.StatusNotFound, ErrorResponseType},
 	{NewSuccessBindResponse(map[string]string{"username": "myuser"}), "{\"credentials\":{\"username\":\"myuser\"}}", http.StatusCreated, SuccessBindResponseType},
+	{SuccessUnbindResponse, "{}", http.StatusOK, SuccessUnbindResponseType},
+	{NewSuccessFetchInstanceResponse("service", "plan", "", map[string]interface{}{"storage": 10}), "{\"service_id\":\"service\",\"plan_id\":\"plan\",\"parameters\":{\"storage\":10}}", http.StatusOK, SuccessFetchInstanceResponseType},
+	{NewSuccessFetchBindingResponse(map[string]string{"username": "myuser"}), "{\"credentials\":{\"username\":\"myuser\"}}", http.StatusOK, SuccessFetchBindingResponseType},
 }
 
 func TestGenericSuccessResponse(t *testing.T) {
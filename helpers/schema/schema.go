@@ -0,0 +1,219 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Draft04 is the JSON Schema version the Open Service Broker API expects.
+const Draft04 = "http://json-schema.org/draft-04/schema#"
+
+// Schema is the subset of JSON Schema needed to describe the parameters of
+// services, as generated from the structs their parameters are decoded into.
+type Schema struct {
+	SchemaURI   string             `json:"$schema,omitempty"`
+	Type        string             `json:"type,omitempty"`
+	Description string             `json:"description,omitempty"`
+	Properties  map[string]*Schema `json:"properties,omitempty"`
+	Items       *Schema            `json:"items,omitempty"`
+	// AdditionalProperties is false for objects that only accept their properties.
+	AdditionalProperties *bool `json:"additionalProperties,omitempty"`
+}
+
+// Generate returns the schema of the parameters decoded into v, a struct. The
+// properties are named by the json tags of the fields and described by their
+// description tags, and no other properties are accepted.
+func Generate(v interface{}) *Schema {
+	s := generate(reflect.TypeOf(v))
+	s.SchemaURI = Draft04
+	return s
+}
+
+func generate(t reflect.Type) *Schema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: generate(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object"}
+	case reflect.Struct:
+		additionalProperties := false
+		s := &Schema{Type: "object", Properties: map[string]*Schema{}, AdditionalProperties: &additionalProperties}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name := jsonName(field)
+			if name == "" {
+				continue
+			}
+			property := generate(field.Type)
+			property.Description = field.Tag.Get("description")
+			s.Properties[name] = property
+		}
+		return s
+	}
+	// e.g. interfaces, which can hold any value
+	return &Schema{}
+}
+
+// Without returns a copy of an object schema without the given properties, e.g.
+// the schema of the parameters accepted on update, which leaves out those only
+// accepted on create.
+func (s *Schema) Without(names ...string) *Schema {
+	without := *s
+	without.Properties = map[string]*Schema{}
+	for name, property := range s.Properties {
+		without.Properties[name] = property
+	}
+	for _, name := range names {
+		delete(without.Properties, name)
+	}
+	return &without
+}
+
+// jsonName returns the name a field is decoded from, or "" if it is not decoded.
+func jsonName(field reflect.StructField) string {
+	if field.PkgPath != "" {
+		return ""
+	}
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	switch name {
+	case "-":
+		return ""
+	case "":
+		return field.Name
+	}
+	return name
+}
+
+// Validate checks that the raw parameters of a request match the schema, and
+// returns an error listing every parameter that does not, followed by the
+// parameters that are accepted.
+func (s *Schema) Validate(raw json.RawMessage) error {
+	if len(raw) == 0 {
+		return nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return fmt.Errorf("parameters must be a JSON object: %s", err)
+	}
+	// no parameters at all
+	if value == nil {
+		return nil
+	}
+	if _, ok := value.(map[string]interface{}); !ok {
+		return errors.New("parameters must be a JSON object")
+	}
+
+	var problems []string
+	s.validate("", value, &problems)
+	if len(problems) > 0 {
+		return fmt.Errorf("%s. Accepted parameters: %s", strings.Join(problems, "; "), strings.Join(s.propertyNames(), ", "))
+	}
+	return nil
+}
+
+// propertyNames returns the sorted names of the properties of an object schema.
+func (s *Schema) propertyNames() []string {
+	names := make([]string, 0, len(s.Properties))
+	for name := range s.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (s *Schema) validate(path string, value interface{}, problems *[]string) {
+	// null leaves a parameter unset
+	if value == nil || s.Type == "" {
+		return
+	}
+
+	name := path
+	if name == "" {
+		name = "parameters"
+	}
+	invalid := func() {
+		*problems = append(*problems, fmt.Sprintf("%s must be of type %s", name, s.Type))
+	}
+
+	switch s.Type {
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			invalid()
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			invalid()
+		}
+	case "number":
+		if _, ok := value.(json.Number); !ok {
+			invalid()
+		}
+	case "integer":
+		n, ok := value.(json.Number)
+		if !ok {
+			invalid()
+			return
+		}
+		if f, err := n.Float64(); err != nil || f != math.Trunc(f) {
+			invalid()
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			invalid()
+			return
+		}
+		if s.Items != nil {
+			for i, item := range items {
+				s.Items.validate(fmt.Sprintf("%s[%d]", name, i), item, problems)
+			}
+		}
+	case "object":
+		properties, ok := value.(map[string]interface{})
+		if !ok {
+			invalid()
+			return
+		}
+		keys := make([]string, 0, len(properties))
+		for key := range properties {
+			keys = append(keys, key)
+		}
+		// report the problems in a stable order
+		sort.Strings(keys)
+		for _, key := range keys {
+			propertyPath := key
+			if path != "" {
+				propertyPath = path + "." + key
+			}
+			property, ok := s.Properties[key]
+			if !ok {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					*problems = append(*problems, fmt.Sprintf("unknown parameter %s", propertyPath))
+				}
+				continue
+			}
+			property.validate(propertyPath, properties[key], problems)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package schema
+
+import (
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+type testNested struct {
+	Size string `json:"size,omitempty"`
+}
+
+type testOptions struct {
+	Name      string     `json:"name" description:"The name"`
+	Count     int64      `json:"count"`
+	Retention *int64     `json:"retention"`
+	Enabled   *bool      `json:"enabled"`
+	Exports   []string   `json:"exports"`
+	Nested    testNested `json:"nested"`
+	Ignored   string     `json:"-"`
+	unused    string
+}
+
+func TestGenerate(t *testing.T) {
+	additionalProperties := false
+	expected := &Schema{
+		SchemaURI:            Draft04,
+		Type:                 "object",
+		AdditionalProperties: &additionalProperties,
+		Properties: map[string]*Schema{
+			"name":      {Type: "string", Description: "The name"},
+			"count":     {Type: "integer"},
+			"retention": {Type: "integer"},
+			"enabled":   {Type: "boolean"},
+			"exports":   {Type: "array", Items: &Schema{Type: "string"}},
+			"nested": {
+				Type: "object",
+				Properties: map[string]*Schema{
+					"size": {Type: "string"},
+				},
+				AdditionalProperties: &additionalProperties,
+			},
+		},
+	}
+	if diff := deep.Equal(Generate(testOptions{}), expected); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestWithout(t *testing.T) {
+	s := Generate(testOptions{})
+	without := s.Without("name", "count")
+	if diff := deep.Equal(without.propertyNames(), []string{"enabled", "exports", "nested", "retention"}); diff != nil {
+		t.Error(diff)
+	}
+	if _, ok := s.Properties["name"]; !ok {
+		t.Error("expected the original schema to keep its properties")
+	}
+	if err := without.Validate([]byte(`{"name": "a"}`)); err == nil {
+		t.Error("expected the removed properties to be rejected")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	s := Generate(testOptions{})
+	accepted := ". Accepted parameters: count, enabled, exports, name, nested, retention"
+
+	testCases := map[string]struct {
+		parameters    string
+		expectedError string
+	}{
+		"no parameters": {
+			parameters: "",
+		},
+		"null parameters": {
+			parameters: "null",
+		},
+		"valid parameters": {
+			parameters: `{"name": "a", "count": 10, "retention": null, "enabled": true, "exports": ["a"], "nested": {"size": "1"}}`,
+		},
+		"unknown parameters": {
+			parameters:    `{"other": 1, "nested": {"color": "red"}}`,
+			expectedError: "unknown parameter nested.color; unknown parameter other" + accepted,
+		},
+		"not an object": {
+			parameters:    `["a"]`,
+			expectedError: "parameters must be a JSON object",
+		},
+		"wrong types": {
+			parameters:    `{"name": 1, "count": "10", "enabled": "yes"}`,
+			expectedError: "count must be of type integer; enabled must be of type boolean; name must be of type string" + accepted,
+		},
+		"fractional integer": {
+			parameters:    `{"count": 1.5}`,
+			expectedError: "count must be of type integer" + accepted,
+		},
+		"wrong item type": {
+			parameters:    `{"exports": ["a", 2]}`,
+			expectedError: "exports[1] must be of type string" + accepted,
+		},
+		"wrong nested type": {
+			parameters:    `{"nested": {"size": 1}}`,
+			expectedError: "nested.size must be of type string" + accepted,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			err := s.Validate([]byte(test.parameters))
+			if test.expectedError == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected error %q", test.expectedError)
+			}
+			if err.Error() != test.expectedError {
+				t.Errorf("expected error %q, got %q", test.expectedError, err.Error())
+			}
+		})
+	}
+}
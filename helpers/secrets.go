@@ -0,0 +1,104 @@
+package helpers
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+)
+
+// kmsPrefix marks values encrypted with a KMS data key. The encrypted data key
+// follows the prefix, then the value encrypted with it by Encrypt.
+const kmsPrefix = "kms:"
+
+// SecretEncrypter encrypts the secrets the broker stores in its database. The
+// iv of a secret is its salt.
+type SecretEncrypter interface {
+	Encrypt(msg string, iv []byte) (string, error)
+	Decrypt(msg string, iv []byte) (string, error)
+}
+
+// LocalKeyEncrypter encrypts secrets with an AES key held by the broker.
+type LocalKeyEncrypter struct {
+	key string
+}
+
+// NewLocalKeyEncrypter returns an encrypter for the given AES key.
+func NewLocalKeyEncrypter(key string) *LocalKeyEncrypter {
+	return &LocalKeyEncrypter{key: key}
+}
+
+// Encrypt will encrypt the given plain text string with the key.
+func (e *LocalKeyEncrypter) Encrypt(msg string, iv []byte) (string, error) {
+	return Encrypt(msg, e.key, iv)
+}
+
+// Decrypt will decrypt the given encrypted string with the key.
+func (e *LocalKeyEncrypter) Decrypt(msg string, iv []byte) (string, error) {
+	if strings.HasPrefix(msg, kmsPrefix) {
+		return "", errors.New("value was encrypted with KMS, not with a local key")
+	}
+	return Decrypt(msg, e.key, iv)
+}
+
+// KMSEncrypter encrypts each secret with a new data key generated from a KMS
+// key, and stores the data key, encrypted by KMS, along with the secret.
+type KMSEncrypter struct {
+	client kmsiface.KMSAPI
+	keyID  string
+}
+
+// NewKMSEncrypter returns an encrypter for the KMS key with the given ID, ARN
+// or alias.
+func NewKMSEncrypter(client kmsiface.KMSAPI, keyID string) *KMSEncrypter {
+	return &KMSEncrypter{client: client, keyID: keyID}
+}
+
+// Encrypt will encrypt the given plain text string with a new data key.
+func (e *KMSEncrypter) Encrypt(msg string, iv []byte) (string, error) {
+	dataKey, err := e.client.GenerateDataKey(&kms.GenerateDataKeyInput{
+		KeyId:   aws.String(e.keyID),
+		KeySpec: aws.String(kms.DataKeySpecAes256),
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not generate a data key: %s", err)
+	}
+
+	encrypted, err := Encrypt(msg, string(dataKey.Plaintext), iv)
+	if err != nil {
+		return "", err
+	}
+
+	return kmsPrefix + base64.StdEncoding.EncodeToString(dataKey.CiphertextBlob) + ":" + encrypted, nil
+}
+
+// Decrypt will decrypt the given encrypted string with the data key stored
+// along with it.
+func (e *KMSEncrypter) Decrypt(msg string, iv []byte) (string, error) {
+	if !strings.HasPrefix(msg, kmsPrefix) {
+		return "", errors.New("value was not encrypted with KMS")
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(msg, kmsPrefix), ":", 2)
+	if len(parts) != 2 {
+		return "", errors.New("value encrypted with KMS has no data key")
+	}
+	encryptedDataKey, err := base64.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", err
+	}
+
+	dataKey, err := e.client.Decrypt(&kms.DecryptInput{
+		KeyId:          aws.String(e.keyID),
+		CiphertextBlob: encryptedDataKey,
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not decrypt the data key: %s", err)
+	}
+
+	return Decrypt(parts[1], string(dataKey.Plaintext), iv)
+}
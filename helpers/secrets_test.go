@@ -0,0 +1,128 @@
+package helpers
+
+import (
+	"crypto/aes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+)
+
+// fakeKMSClient wraps data keys by prefixing them with the ID of the KMS key,
+// and keeps count of the data keys it generates.
+type fakeKMSClient struct {
+	kmsiface.KMSAPI
+
+	generatedKeys int
+}
+
+func (f *fakeKMSClient) GenerateDataKey(input *kms.GenerateDataKeyInput) (*kms.GenerateDataKeyOutput, error) {
+	if aws.StringValue(input.KeySpec) != kms.DataKeySpecAes256 {
+		return nil, errors.New("unexpected key spec")
+	}
+	f.generatedKeys++
+	plaintext := []byte(RandStr(32))
+	return &kms.GenerateDataKeyOutput{
+		KeyId:          input.KeyId,
+		Plaintext:      plaintext,
+		CiphertextBlob: append([]byte(aws.StringValue(input.KeyId)+"/"), plaintext...),
+	}, nil
+}
+
+func (f *fakeKMSClient) Decrypt(input *kms.DecryptInput) (*kms.DecryptOutput, error) {
+	prefix := aws.StringValue(input.KeyId) + "/"
+	if !strings.HasPrefix(string(input.CiphertextBlob), prefix) {
+		return nil, errors.New("IncorrectKeyException: the data key was not encrypted with the key")
+	}
+	return &kms.DecryptOutput{
+		KeyId:     input.KeyId,
+		Plaintext: input.CiphertextBlob[len(prefix):],
+	}, nil
+}
+
+func TestSecretEncrypters(t *testing.T) {
+	msg := "Very secure message"
+	key := "12345678901234567890123456789012"
+
+	testCases := map[string]struct {
+		encrypter SecretEncrypter
+	}{
+		"local key": {
+			encrypter: NewLocalKeyEncrypter(key),
+		},
+		"kms": {
+			encrypter: NewKMSEncrypter(&fakeKMSClient{}, "the-key"),
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			iv := generateIv(aes.BlockSize)
+
+			encrypted, err := test.encrypter.Encrypt(msg, iv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(encrypted, msg) {
+				t.Error("encrypted should not contain the original")
+			}
+			if !IsEncrypted(encrypted) || IsLegacyEncryption(encrypted) {
+				t.Errorf("unexpected encrypted value %s", encrypted)
+			}
+
+			decrypted, err := test.encrypter.Decrypt(encrypted, iv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if decrypted != msg {
+				t.Error("decrypted should be the same as the original")
+			}
+
+			if _, err := test.encrypter.Decrypt(encrypted, generateIv(aes.BlockSize)); err == nil {
+				t.Error("expected an error decrypting with another iv")
+			}
+		})
+	}
+}
+
+func TestKMSEncrypter(t *testing.T) {
+	msg := "Very secure message"
+	iv := generateIv(aes.BlockSize)
+	client := &fakeKMSClient{}
+	encrypter := NewKMSEncrypter(client, "the-key")
+
+	encrypted1, err := encrypter.Encrypt(msg, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted2, err := encrypter.Encrypt(msg, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.generatedKeys != 2 || encrypted1 == encrypted2 {
+		t.Error("expected each secret to be encrypted with its own data key")
+	}
+
+	if _, err := NewKMSEncrypter(client, "another-key").Decrypt(encrypted1, iv); err == nil {
+		t.Error("expected an error decrypting with another KMS key")
+	}
+
+	if _, err := NewLocalKeyEncrypter("12345678901234567890123456789012").Decrypt(encrypted1, iv); err == nil {
+		t.Error("expected an error decrypting a KMS value with a local key")
+	}
+
+	local, _ := Encrypt(msg, "12345678901234567890123456789012", iv)
+	if _, err := encrypter.Decrypt(local, iv); err == nil {
+		t.Error("expected an error decrypting a local key value with KMS")
+	}
+
+	// Swap the data key of the first value for the one of the second value.
+	dataKey2 := strings.SplitN(encrypted2, ":", 3)[1]
+	parts := strings.SplitN(encrypted1, ":", 3)
+	if _, err := encrypter.Decrypt(kmsPrefix+dataKey2+":"+parts[2], iv); err == nil {
+		t.Error("expected an error decrypting with another data key")
+	}
+}
@@ -31,11 +31,13 @@ func main() {
 		return
 	}
 
-	Queue := taskqueue.NewQueueManager()
-	Queue.Init()
+	Queue := taskqueue.NewQueueManager(DB)
 
 	// Try to connect and create the app.
 	if m := App(&settings, DB, Queue); m != nil {
+		// Start the queue once the brokers have registered their job handlers
+		// so that unfinished jobs are resumed right away.
+		Queue.Init()
 		log.Println("Starting app...")
 		m.Run()
 	} else {
@@ -59,7 +61,11 @@ func App(settings *config.Settings, DB *gorm.DB, TaskQueue *taskqueue.QueueManag
 	m.Map(TaskQueue)
 
 	path, _ := os.Getwd()
-	m.Map(catalog.InitCatalog(path))
+	c := catalog.InitCatalog(path)
+	m.Map(c)
+
+	registerJobHandlers(c, DB, settings, TaskQueue)
+	registerSchemas(c)
 
 	log.Println("Loading Routes")
 
@@ -77,17 +83,23 @@ func App(settings *config.Settings, DB *gorm.DB, TaskQueue *taskqueue.QueueManag
 	// Update the service instance
 	m.Patch("/v2/service_instances/:id", ModifyInstance)
 
+	// Fetch the service instance
+	m.Get("/v2/service_instances/:instance_id", FetchInstance)
+
 	// Poll service endpoint to get status of rds or elasticache
 	m.Get("/v2/service_instances/:instance_id/last_operation", LastOperation)
 
 	// Bind the service to app (cf bind-service)
 	m.Put("/v2/service_instances/:instance_id/service_bindings/:id", BindInstance)
 
+	// Fetch the binding of the service to app
+	m.Get("/v2/service_instances/:instance_id/service_bindings/:id", FetchBinding)
+
+	// Poll service binding endpoint to get status of an async binding
+	m.Get("/v2/service_instances/:instance_id/service_bindings/:id/last_operation", BindingLastOperation)
+
 	// Unbind the service from app
-	m.Delete("/v2/service_instances/:instance_id/service_bindings/:id", func(p martini.Params, r render.Render) {
-		var emptyJSON struct{}
-		r.JSON(200, emptyJSON)
-	})
+	m.Delete("/v2/service_instances/:instance_id/service_bindings/:id", UnbindInstance)
 
 	// Delete service instance
 	m.Delete("/v2/service_instances/:instance_id", DeleteInstance)
@@ -8,6 +8,7 @@ import (
 	"strings"
 
 	"github.com/go-martini/martini"
+	"github.com/go-test/deep"
 	"github.com/google/uuid"
 	"github.com/jinzhu/gorm"
 
@@ -17,7 +18,10 @@ import (
 	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/18F/aws-broker/base"
+	"github.com/18F/aws-broker/catalog"
 	"github.com/18F/aws-broker/common"
 	"github.com/18F/aws-broker/config"
 	"github.com/18F/aws-broker/db"
@@ -31,6 +35,7 @@ var (
 	originalRDSPlanID           = "da91e15c-98c9-46a9-b114-02b8d28062c6"
 	updateableRDSPlanID         = "1070028c-b5fb-4de8-989b-4e00d07ef5e8"
 	originalRedisPlanID         = "475e36bf-387f-44c1-9b81-575fec2ee443"
+	updatedRedisPlanID          = "5nd336bf-0k7f-44c1-9b81-575fp3k764r6"
 	originalElasticsearchPlanID = "55b529cf-639e-4673-94fd-ad0a5dafe0ad"
 )
 
@@ -98,6 +103,42 @@ var createRDSPostgreSQLWithEnablePgCron = []byte(
 	"space_guid":"a-space"
 }`)
 
+var createRDSPostgreSQLWithIAMAuth = []byte(
+	`{
+	"service_id":"db80ca29-2d1b-4fbc-aad3-d03c0bfa7593",
+	"plan_id":"da91e15c-98c9-46a9-b114-02b8d28062c6",
+	"parameters": {
+		"iam_auth": true
+	},
+	"organization_guid":"an-org",
+	"space_guid":"a-space"
+}`)
+
+var modifyRDSPostgreSQLDisableIAMAuth = []byte(
+	`{
+	"service_id":"db80ca29-2d1b-4fbc-aad3-d03c0bfa7593",
+	"plan_id":"da91e15c-98c9-46a9-b114-02b8d28062c6",
+	"parameters": {
+		"iam_auth": false
+	},
+	"organization_guid":"an-org",
+	"space_guid":"a-space",
+	"previous_values": {
+		"plan_id": "da91e15c-98c9-46a9-b114-02b8d28062c6"
+	}
+}`)
+
+var createRDSPGWithVersion12InstanceReq = []byte(
+	`{
+	"service_id":"db80ca29-2d1b-4fbc-aad3-d03c0bfa7593",
+	"plan_id":"da91e15c-98c9-46a9-b114-02b8d28062c6",
+	"parameters": {
+		"version": "12"
+	},
+	"organization_guid":"an-org",
+	"space_guid":"a-space"
+}`)
+
 // micro-psql plan but with parameters
 var modifyRDSInstanceReqStorage = []byte(
 	`{
@@ -287,7 +328,7 @@ func setup() *martini.ClassicMartini {
 	if err != nil {
 		log.Fatal(err)
 	}
-	tq := taskqueue.NewQueueManager()
+	tq := taskqueue.NewQueueManager(brokerDB)
 	tq.Init()
 
 	m := App(&s, brokerDB, tq)
@@ -344,11 +385,275 @@ func TestCatalog(t *testing.T) {
 
 	// Is it a valid JSON?
 	validJSON(res.Body.Bytes(), url, t)
+
+	// Do the plans describe their parameters?
+	var c struct {
+		Services []struct {
+			Plans []struct {
+				Schemas catalog.Schemas
+			}
+		}
+	}
+	json.Unmarshal(res.Body.Bytes(), &c)
+	for _, service := range c.Services {
+		for _, plan := range service.Plans {
+			if plan.Schemas.ServiceInstance.Create.Parameters == nil {
+				t.Fatal(url, "should return the schemas of the plan parameters")
+			}
+		}
+	}
+}
+
+func TestInvalidParameters(t *testing.T) {
+	rdsUUID := uuid.NewString()
+	res, m := doRequest(nil, fmt.Sprintf("/v2/service_instances/%s?accepts_incomplete=true", rdsUUID), "PUT", true, bytes.NewBuffer(createRDSInstanceReq))
+	if res.Code != http.StatusAccepted {
+		t.Fatal("Unable to create instance. Body is: " + res.Body.String())
+	}
+	esUUID := uuid.NewString()
+	res, _ = doRequest(m, fmt.Sprintf("/v2/service_instances/%s?accepts_incomplete=true", esUUID), "PUT", true, bytes.NewBuffer(createElasticsearchInstanceReq))
+	if res.Code != http.StatusAccepted {
+		t.Fatal("Unable to create instance. Body is: " + res.Body.String())
+	}
+
+	testCases := map[string]struct {
+		url           string
+		method        string
+		body          string
+		expectedError string
+	}{
+		"create": {
+			url:    fmt.Sprintf("/v2/service_instances/%s?accepts_incomplete=true", uuid.NewString()),
+			method: "PUT",
+			body: `{
+				"service_id":"db80ca29-2d1b-4fbc-aad3-d03c0bfa7593",
+				"plan_id":"da91e15c-98c9-46a9-b114-02b8d28062c6",
+				"organization_guid":"an-org",
+				"space_guid":"a-space",
+				"parameters": {"storage": "ten"}
+			}`,
+			expectedError: "storage must be of type integer",
+		},
+		"update": {
+			url:    fmt.Sprintf("/v2/service_instances/%s?accepts_incomplete=true", rdsUUID),
+			method: "PATCH",
+			body: `{
+				"service_id":"db80ca29-2d1b-4fbc-aad3-d03c0bfa7593",
+				"parameters": {"backup_retention_period": 1.5, "rotate_credentials": "yes"}
+			}`,
+			expectedError: "backup_retention_period must be of type integer; rotate_credentials must be of type boolean",
+		},
+		"unknown": {
+			url:    fmt.Sprintf("/v2/service_instances/%s?accepts_incomplete=true", rdsUUID),
+			method: "PATCH",
+			body: `{
+				"service_id":"db80ca29-2d1b-4fbc-aad3-d03c0bfa7593",
+				"parameters": {"backup_retention_peroid": 14}
+			}`,
+			expectedError: "unknown parameter backup_retention_peroid. Accepted parameters: backup_retention_period, ",
+		},
+		"create only": {
+			url:    fmt.Sprintf("/v2/service_instances/%s?accepts_incomplete=true", rdsUUID),
+			method: "PATCH",
+			body: `{
+				"service_id":"db80ca29-2d1b-4fbc-aad3-d03c0bfa7593",
+				"parameters": {"restore_from_snapshot": "a-snapshot"}
+			}`,
+			expectedError: "unknown parameter restore_from_snapshot",
+		},
+		"update only": {
+			url:    fmt.Sprintf("/v2/service_instances/%s?accepts_incomplete=true", uuid.NewString()),
+			method: "PUT",
+			body: `{
+				"service_id":"90413816-9c77-418b-9fc7-b9739e7c1254",
+				"plan_id":"55b529cf-639e-4673-94fd-ad0a5dafe0ad",
+				"organization_guid":"an-org",
+				"space_guid":"a-space",
+				"parameters": {"snapshot": "a-snapshot"}
+			}`,
+			expectedError: "unknown parameter snapshot",
+		},
+		"invalid body": {
+			url:           fmt.Sprintf("/v2/service_instances/%s?accepts_incomplete=true", uuid.NewString()),
+			method:        "PUT",
+			body:          `{"service_id": 1}`,
+			expectedError: "Invalid request body",
+		},
+		"bind": {
+			url:    fmt.Sprintf("/v2/service_instances/%s/service_bindings/%s?accepts_incomplete=true", esUUID, uuid.NewString()),
+			method: "PUT",
+			body: `{
+				"service_id":"90413816-9c77-418b-9fc7-b9739e7c1254",
+				"plan_id":"55b529cf-639e-4673-94fd-ad0a5dafe0ad",
+				"parameters": {"bucket": ["a-bucket"]}
+			}`,
+			expectedError: "bucket must be of type string",
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			res, _ := doRequest(m, test.url, test.method, true, strings.NewReader(test.body))
+			if res.Code != http.StatusBadRequest {
+				t.Fatal(test.url, "should return 400 and it returned", res.Code, res.Body.String())
+			}
+			if !strings.Contains(res.Body.String(), test.expectedError) {
+				t.Errorf("expected error %q, got %s", test.expectedError, res.Body.String())
+			}
+		})
+	}
 }
 
 /*
 Testing RDS
 */
+func TestFetchInstance(t *testing.T) {
+	testCases := map[string]struct {
+		createReq          []byte
+		expectedParameters map[string]interface{}
+	}{
+		"rds": {
+			createReq: createRDSPGWithVersionInstanceReq,
+			expectedParameters: map[string]interface{}{
+				"version": "15",
+			},
+		},
+		"redis": {
+			createReq: createRedisInstanceReq,
+			expectedParameters: map[string]interface{}{
+				"numCacheClusters": float64(5),
+			},
+		},
+		"elasticsearch": {
+			createReq: createElasticsearchInstanceAdvancedOptionsReq,
+			expectedParameters: map[string]interface{}{
+				"advanced_options": map[string]interface{}{
+					"indices.query.bool.max_clause_count": "1024",
+					"indices.fielddata.cache.size":        "80",
+				},
+			},
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			instanceUUID := uuid.NewString()
+			url := fmt.Sprintf("/v2/service_instances/%s", instanceUUID)
+
+			// Without the instance
+			res, m := doRequest(nil, url, "GET", true, nil)
+			if res.Code != http.StatusNotFound {
+				t.Error(url, "with auth should return 404 and it returned", res.Code)
+			}
+
+			res, _ = doRequest(m, url+"?accepts_incomplete=true", "PUT", true, bytes.NewBuffer(test.createReq))
+			if res.Code != http.StatusAccepted {
+				t.Fatal("Unable to create instance. Body is: " + res.Body.String())
+			}
+
+			res, _ = doRequest(m, url, "GET", true, nil)
+			if res.Code != http.StatusOK {
+				t.Logf("Unable to fetch instance. Body is: " + res.Body.String())
+				t.Fatal(url, "with auth should return 200 and it returned", res.Code)
+			}
+
+			var fetched struct {
+				PlanID     string                 `json:"plan_id"`
+				Parameters map[string]interface{} `json:"parameters"`
+			}
+			json.Unmarshal(res.Body.Bytes(), &fetched)
+
+			var created struct {
+				PlanID string `json:"plan_id"`
+			}
+			json.Unmarshal(test.createReq, &created)
+			if fetched.PlanID != created.PlanID {
+				t.Errorf("expected plan %s, got %s", created.PlanID, fetched.PlanID)
+			}
+			for key, expected := range test.expectedParameters {
+				if diff := deep.Equal(fetched.Parameters[key], expected); diff != nil {
+					t.Errorf("parameter %s: %v", key, diff)
+				}
+			}
+		})
+	}
+}
+
+func TestFetchBinding(t *testing.T) {
+	testCases := map[string]struct {
+		createReq []byte
+		// whether bindings are made by a job the platform polls
+		async bool
+	}{
+		"rds": {
+			createReq: createRDSInstanceReq,
+		},
+		"redis": {
+			createReq: createRedisInstanceReq,
+		},
+		"elasticsearch": {
+			createReq: createElasticsearchInstanceReq,
+			async:     true,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			instanceUUID := uuid.NewString()
+			res, m := doRequest(nil, fmt.Sprintf("/v2/service_instances/%s?accepts_incomplete=true", instanceUUID), "PUT", true, bytes.NewBuffer(test.createReq))
+			if res.Code != http.StatusAccepted {
+				t.Fatal("Unable to create instance. Body is: " + res.Body.String())
+			}
+
+			url := fmt.Sprintf("/v2/service_instances/%s/service_bindings/%s", instanceUUID, uuid.NewString())
+			bound := ""
+			if test.async {
+				res, _ = doRequest(m, url+"?accepts_incomplete=true", "PUT", true, bytes.NewBuffer(test.createReq))
+				if res.Code != http.StatusAccepted {
+					t.Fatal("Unable to bind instance. Body is: " + res.Body.String())
+				}
+				pollBinding(t, m, url)
+				// binding again returns the credentials of the finished binding
+				res, _ = doRequest(m, url+"?accepts_incomplete=true", "PUT", true, bytes.NewBuffer(test.createReq))
+				if res.Code != http.StatusOK {
+					t.Fatal("Unable to bind instance. Body is: " + res.Body.String())
+				}
+				bound = res.Body.String()
+			} else {
+				res, _ = doRequest(m, url, "PUT", true, bytes.NewBuffer(test.createReq))
+				if res.Code != http.StatusCreated {
+					t.Fatal("Unable to bind instance. Body is: " + res.Body.String())
+				}
+				bound = res.Body.String()
+			}
+
+			res, _ = doRequest(m, url, "GET", true, nil)
+			if res.Code != http.StatusOK {
+				t.Logf("Unable to fetch binding. Body is: " + res.Body.String())
+				t.Fatal(url, "with auth should return 200 and it returned", res.Code)
+			}
+			if res.Body.String() != bound {
+				t.Errorf("expected the credentials of the binding %s, got %s", bound, res.Body.String())
+			}
+
+			unknownURL := fmt.Sprintf("/v2/service_instances/%s/service_bindings/%s", instanceUUID, uuid.NewString())
+			res, _ = doRequest(m, unknownURL, "GET", true, nil)
+			if res.Code != http.StatusNotFound {
+				t.Error(unknownURL, "should return 404 and it returned", res.Code)
+			}
+
+			res, _ = doRequest(m, url, "DELETE", true, nil)
+			if res.Code != http.StatusOK {
+				t.Fatal("Unable to unbind instance. Body is: " + res.Body.String())
+			}
+			res, _ = doRequest(m, url, "GET", true, nil)
+			if res.Code != http.StatusNotFound {
+				t.Error(url, "should return 404 after unbinding and it returned", res.Code)
+			}
+		})
+	}
+}
+
 func TestCreateRDSInstance(t *testing.T) {
 	instanceUUID := uuid.NewString()
 	urlUnacceptsIncomplete := fmt.Sprintf("/v2/service_instances/%s", instanceUUID)
@@ -1033,6 +1338,180 @@ func TestRDSUnbind(t *testing.T) {
 	}
 }
 
+func TestRDSUnbindInstance(t *testing.T) {
+	instanceUUID := uuid.NewString()
+	url := fmt.Sprintf("/v2/service_instances/%s/service_bindings/the_binding", instanceUUID)
+
+	// Create the instance and bind it
+	res, m := doRequest(nil, fmt.Sprintf("/v2/service_instances/%s?accepts_incomplete=true", instanceUUID), "PUT", true, bytes.NewBuffer(createRDSInstanceReq))
+	if res.Code != http.StatusAccepted {
+		t.Logf("Unable to create instance. Body is: " + res.Body.String())
+		t.Error(url, "with auth should return 202 and it returned", res.Code)
+	}
+
+	res, _ = doRequest(m, url, "PUT", true, bytes.NewBuffer(createRDSInstanceReq))
+	if res.Code != http.StatusCreated {
+		t.Logf("Unable to bind instance. Body is: " + res.Body.String())
+		t.Error(url, "with auth should return 201 and it returned", res.Code)
+	}
+
+	var r struct {
+		Credentials struct {
+			Username string
+		}
+	}
+	json.Unmarshal(res.Body.Bytes(), &r)
+
+	// Does the binding get its own user?
+	instance := rds.RDSInstance{}
+	brokerDB.Where("uuid = ?", instanceUUID).First(&instance)
+	binding := rds.RDSBinding{}
+	brokerDB.Where("binding_id = ?", "the_binding").First(&binding)
+	if binding.InstanceUuid != instanceUUID {
+		t.Error("The binding should be saved in the DB")
+	}
+	if r.Credentials.Username == "" || r.Credentials.Username == instance.Username {
+		t.Error(url, "should return credentials for a binding user and it returned", r.Credentials.Username)
+	}
+	if r.Credentials.Username != binding.Username {
+		t.Error(url, "should return the credentials saved for the binding")
+	}
+
+	res, _ = doRequest(m, url, "DELETE", true, nil)
+	if res.Code != http.StatusOK {
+		t.Logf("Unable to unbind instance. Body is: " + res.Body.String())
+		t.Error(url, "with auth should return 200 and it returned", res.Code)
+	}
+	if res.Body.String() != "{}" {
+		t.Error(url, "should return an empty JSON")
+	}
+
+	// Is the binding gone from the DB?
+	binding = rds.RDSBinding{}
+	brokerDB.Where("binding_id = ?", "the_binding").First(&binding)
+	if binding.BindingID != "" {
+		t.Error("The binding shouldn't be in the DB")
+	}
+}
+
+func TestRDSBindInstanceWithIAMAuth(t *testing.T) {
+	instanceUUID := uuid.NewString()
+	instanceURL := fmt.Sprintf("/v2/service_instances/%s?accepts_incomplete=true", instanceUUID)
+	url := fmt.Sprintf("/v2/service_instances/%s/service_bindings/the_iam_binding", instanceUUID)
+
+	res, m := doRequest(nil, instanceURL, "PUT", true, bytes.NewBuffer(createRDSPostgreSQLWithIAMAuth))
+	if res.Code != http.StatusAccepted {
+		t.Logf("Unable to create instance. Body is: " + res.Body.String())
+		t.Error(instanceURL, "with auth should return 202 and it returned", res.Code)
+	}
+
+	res, _ = doRequest(m, url, "PUT", true, bytes.NewBuffer(createRDSInstanceReq))
+	if res.Code != http.StatusCreated {
+		t.Logf("Unable to bind instance. Body is: " + res.Body.String())
+		t.Error(url, "with auth should return 201 and it returned", res.Code)
+	}
+
+	var r struct {
+		Credentials map[string]string
+	}
+	json.Unmarshal(res.Body.Bytes(), &r)
+
+	// Does the binding get an IAM user instead of a password?
+	binding := rds.RDSBinding{}
+	brokerDB.Where("binding_id = ?", "the_iam_binding").First(&binding)
+	if binding.IAMUserName == "" || binding.Password != "" {
+		t.Error("The binding should have an IAM user and no password")
+	}
+	if _, ok := r.Credentials["password"]; ok {
+		t.Error(url, "should not return a password")
+	}
+	if _, ok := r.Credentials["access_key_id"]; !ok {
+		t.Error(url, "should return access keys")
+	}
+	if r.Credentials["username"] != binding.Username || r.Credentials["db_name"] == "" {
+		t.Error(url, "should return the database user and name of the binding")
+	}
+
+	// IAM authentication cannot be disabled while the binding uses it.
+	res, _ = doRequest(m, instanceURL, "PATCH", true, bytes.NewBuffer(modifyRDSPostgreSQLDisableIAMAuth))
+	if res.Code != http.StatusBadRequest {
+		t.Logf("Unexpected modify response. Body is: " + res.Body.String())
+		t.Error(instanceURL, "with IAM bindings should return 400 and it returned", res.Code)
+	}
+
+	res, _ = doRequest(m, url, "DELETE", true, nil)
+	if res.Code != http.StatusOK {
+		t.Logf("Unable to unbind instance. Body is: " + res.Body.String())
+		t.Error(url, "with auth should return 200 and it returned", res.Code)
+	}
+
+	res, _ = doRequest(m, instanceURL, "PATCH", true, bytes.NewBuffer(modifyRDSPostgreSQLDisableIAMAuth))
+	if res.Code != http.StatusAccepted {
+		t.Logf("Unable to modify instance. Body is: " + res.Body.String())
+		t.Error(instanceURL, "with auth should return 202 and it returned", res.Code)
+	}
+}
+
+func TestModifyRDSInstanceUpgradeVersion(t *testing.T) {
+	instanceUUID := uuid.NewString()
+	instanceURL := fmt.Sprintf("/v2/service_instances/%s?accepts_incomplete=true", instanceUUID)
+	res, m := doRequest(nil, instanceURL, "PUT", true, bytes.NewBuffer(createRDSPGWithVersion12InstanceReq))
+	if res.Code != http.StatusAccepted {
+		t.Logf("Unable to create instance. Body is: " + res.Body.String())
+		t.Fatal(instanceURL, "with auth should return 202 and it returned", res.Code)
+	}
+
+	modifyVersion := func(version string) *httptest.ResponseRecorder {
+		res, _ := doRequest(m, instanceURL, "PATCH", true, bytes.NewBuffer([]byte(`{
+	"service_id":"db80ca29-2d1b-4fbc-aad3-d03c0bfa7593",
+	"plan_id":"da91e15c-98c9-46a9-b114-02b8d28062c6",
+	"parameters": {
+		"version": "`+version+`"
+	},
+	"previous_values": {
+		"plan_id": "da91e15c-98c9-46a9-b114-02b8d28062c6"
+	}
+}`)))
+		return res
+	}
+
+	// The version must be approved by the plan.
+	res = modifyVersion("16")
+	if res.Code != http.StatusBadRequest {
+		t.Logf("Unexpected modify response. Body is: " + res.Body.String())
+		t.Error(instanceURL, "with an unapproved version should return 400 and it returned", res.Code)
+	}
+
+	res = modifyVersion("15")
+	if res.Code != http.StatusAccepted {
+		t.Logf("Unable to modify instance. Body is: " + res.Body.String())
+		t.Fatal(instanceURL, "with auth should return 202 and it returned", res.Code)
+	}
+	i := rds.RDSInstance{}
+	brokerDB.Where("uuid = ?", instanceUUID).First(&i)
+	if i.UpgradeVersion != "15" || i.DbVersion != "12" {
+		t.Errorf("The instance should be upgrading from 12 to 15, got %s to %s", i.DbVersion, i.UpgradeVersion)
+	}
+
+	lastOperationURL := fmt.Sprintf("/v2/service_instances/%s/last_operation?operation=modify", instanceUUID)
+	res, _ = doRequest(m, lastOperationURL, "GET", true, nil)
+	if res.Code != http.StatusOK || !strings.Contains(res.Body.String(), "succeeded") {
+		t.Error(lastOperationURL, "should return that the upgrade succeeded, got", res.Body.String())
+	}
+	i = rds.RDSInstance{}
+	brokerDB.Where("uuid = ?", instanceUUID).First(&i)
+	if i.UpgradeVersion != "" || i.DbVersion != "15" {
+		t.Errorf("The instance should be upgraded to 15, got %s", i.DbVersion)
+	}
+
+	// Downgrading is not allowed.
+	res = modifyVersion("13")
+	if res.Code != http.StatusBadRequest {
+		t.Logf("Unexpected modify response. Body is: " + res.Body.String())
+		t.Error(instanceURL, "with an older version should return 400 and it returned", res.Code)
+	}
+}
+
 func TestRDSDeleteInstance(t *testing.T) {
 	instanceUUID := uuid.NewString()
 	url := fmt.Sprintf("/v2/service_instances/%s", instanceUUID)
@@ -1051,7 +1530,13 @@ func TestRDSDeleteInstance(t *testing.T) {
 		t.Error("The instance should be in the DB")
 	}
 
+	// Deletion is async to take a final snapshot
 	res, _ = doRequest(m, url, "DELETE", true, nil)
+	if res.Code != http.StatusUnprocessableEntity {
+		t.Error(url, "without accepts_incomplete should return 422 and it returned", res.Code)
+	}
+
+	res, _ = doRequest(m, url+"?accepts_incomplete=true", "DELETE", true, nil)
 
 	if res.Code != http.StatusOK {
 		t.Logf("Unable to create instance. Body is: " + res.Body.String())
@@ -1064,6 +1549,481 @@ func TestRDSDeleteInstance(t *testing.T) {
 	if len(i.Uuid) > 0 {
 		t.Error("The instance shouldn't be in the DB")
 	}
+
+	// The instance was gone already, so no final snapshot was taken
+	var snapshotCount int64
+	brokerDB.Model(&rds.RDSSnapshot{}).Where("instance_uuid = ?", instanceUUID).Count(&snapshotCount)
+	if snapshotCount != 0 {
+		t.Error("No final snapshot should be recorded for an instance that is gone")
+	}
+}
+
+func TestDeleteOrphanedInstance(t *testing.T) {
+	instanceUUID := uuid.NewString()
+
+	// The resources are only tracked until the instance is saved.
+	res, m := doRequest(nil, fmt.Sprintf("/v2/service_instances/%s?accepts_incomplete=true", instanceUUID), "PUT", true, bytes.NewBuffer(createRDSInstanceReq))
+	if res.Code != http.StatusAccepted {
+		t.Fatalf("Unable to create instance. Body is: %s", res.Body.String())
+	}
+	resources, err := base.FindProvisionedResources(brokerDB, instanceUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resources) != 0 {
+		t.Errorf("expected the resources of a saved instance to be forgotten, found %d", len(resources))
+	}
+
+	// An instance whose provisioning failed leaves its resources behind.
+	orphanUUID := uuid.NewString()
+	url := fmt.Sprintf("/v2/service_instances/%s?accepts_incomplete=true", orphanUUID)
+	err = base.SaveProvisionedResources(brokerDB, orphanUUID, "db80ca29-2d1b-4fbc-aad3-d03c0bfa7593", "da91e15c-98c9-46a9-b114-02b8d28062c6", base.ProvisionedResources{
+		{Type: "db-parameter-group", Identifier: "cg-aws-broker-orphan"},
+		{Type: "db-instance", Identifier: "db-orphan"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, _ = doRequest(m, url, "DELETE", true, nil)
+	if res.Code != http.StatusOK {
+		t.Logf("Unable to delete instance. Body is: " + res.Body.String())
+		t.Error(url, "with orphaned resources should return 200 and it returned", res.Code)
+	}
+	resources, err = base.FindProvisionedResources(brokerDB, orphanUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resources) != 0 {
+		t.Errorf("expected the orphaned resources to be deleted, found %d", len(resources))
+	}
+
+	// Once they are gone, the instance is not found.
+	res, _ = doRequest(m, url, "DELETE", true, nil)
+	if res.Code != http.StatusNotFound {
+		t.Error(url, "without orphaned resources should return 404 and it returned", res.Code)
+	}
+}
+
+func TestRetryFailedProvision(t *testing.T) {
+	instanceUUID := uuid.NewString()
+	url := fmt.Sprintf("/v2/service_instances/%s?accepts_incomplete=true", instanceUUID)
+
+	// A conflicting record makes saving the instance fail after the broker
+	// created it.
+	_, m := doRequest(nil, "/v2/catalog", "GET", true, nil)
+	conflict := base.Instance{Uuid: instanceUUID}
+	brokerDB.Create(&conflict)
+	res, _ := doRequest(m, url, "PUT", true, bytes.NewBuffer(createRDSInstanceReq))
+	if res.Code != http.StatusBadRequest {
+		t.Fatal(url, "should return 400 when the instance cannot be saved and it returned", res.Code, res.Body.String())
+	}
+	var count int64
+	brokerDB.Model(&rds.RDSInstance{}).Where("uuid = ?", instanceUUID).Count(&count)
+	if count != 0 {
+		t.Error("The instance of the failed provision shouldn't be in the DB")
+	}
+
+	brokerDB.Unscoped().Delete(&conflict)
+	res, _ = doRequest(m, url, "PUT", true, bytes.NewBuffer(createRDSInstanceReq))
+	if res.Code != http.StatusAccepted {
+		t.Error(url, "should return 202 when the provision is retried and it returned", res.Code, res.Body.String())
+	}
+}
+
+func TestRDSCreateInstanceFromSnapshot(t *testing.T) {
+	createFromSnapshotReq := func(snapshotID string) *bytes.Buffer {
+		return bytes.NewBuffer([]byte(fmt.Sprintf(`{
+			"service_id":"db80ca29-2d1b-4fbc-aad3-d03c0bfa7593",
+			"plan_id":"da91e15c-98c9-46a9-b114-02b8d28062c6",
+			"organization_guid":"an-org",
+			"space_guid":"a-space",
+			"parameters": {
+				"restore_from_snapshot": "%s"
+			}
+		}`, snapshotID)))
+	}
+
+	_, m := doRequest(nil, "/v2/catalog", "GET", true, nil)
+	brokerDB.Create(&rds.RDSSnapshot{
+		SnapshotIdentifier: "cg-aws-broker-abc-final-snapshot",
+		InstanceUuid:       "old-instance",
+		OrganizationGUID:   "an-org",
+		SpaceGUID:          "a-space",
+		DbType:             "postgres",
+		DbName:             "cgawsbrokerabc",
+		Username:           "uoldmaster",
+	})
+	brokerDB.Create(&rds.RDSSnapshot{
+		SnapshotIdentifier: "cg-aws-broker-def-final-snapshot",
+		InstanceUuid:       "other-instance",
+		OrganizationGUID:   "an-org",
+		SpaceGUID:          "another-space",
+		DbType:             "postgres",
+	})
+
+	testCases := map[string]struct {
+		snapshotID   string
+		expectedCode int
+	}{
+		"snapshot owned by the space": {
+			snapshotID:   "cg-aws-broker-abc-final-snapshot",
+			expectedCode: http.StatusAccepted,
+		},
+		"snapshot owned by another space": {
+			snapshotID:   "cg-aws-broker-def-final-snapshot",
+			expectedCode: http.StatusBadRequest,
+		},
+		"unknown snapshot": {
+			snapshotID:   "unknown",
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			instanceUUID := uuid.NewString()
+			url := fmt.Sprintf("/v2/service_instances/%s?accepts_incomplete=true", instanceUUID)
+			res, _ := doRequest(m, url, "PUT", true, createFromSnapshotReq(test.snapshotID))
+			if res.Code != test.expectedCode {
+				t.Logf("Body is: " + res.Body.String())
+				t.Fatal(url, "should return", test.expectedCode, "and it returned", res.Code)
+			}
+			if test.expectedCode != http.StatusAccepted {
+				return
+			}
+
+			i := rds.RDSInstance{}
+			brokerDB.Where("uuid = ?", instanceUUID).First(&i)
+			if i.RestoredFromSnapshot != test.snapshotID {
+				t.Error("The instance should be restored from the snapshot")
+			}
+			if i.Username != "uoldmaster" || i.DbName != "cgawsbrokerabc" {
+				t.Error("The instance should keep the master user and database of the snapshot")
+			}
+			if !i.MasterPasswordResetPending {
+				t.Error("The master password of the instance should be reset once it is available")
+			}
+		})
+	}
+}
+
+func TestRDSCloneInstance(t *testing.T) {
+	sourceUUID := uuid.NewString()
+	res, m := doRequest(nil, fmt.Sprintf("/v2/service_instances/%s?accepts_incomplete=true", sourceUUID), "PUT", true, bytes.NewBuffer(createRDSInstanceReq))
+	if res.Code != http.StatusAccepted {
+		t.Fatal("Unable to create source instance. Body is: " + res.Body.String())
+	}
+	source := rds.RDSInstance{}
+	brokerDB.Where("uuid = ?", sourceUUID).First(&source)
+
+	cloneReq := func(orgGUID string) *bytes.Buffer {
+		return bytes.NewBuffer([]byte(fmt.Sprintf(`{
+			"service_id":"db80ca29-2d1b-4fbc-aad3-d03c0bfa7593",
+			"plan_id":"da91e15c-98c9-46a9-b114-02b8d28062c6",
+			"organization_guid":"%s",
+			"space_guid":"another-space",
+			"parameters": {
+				"source_instance_guid": "%s",
+				"restore_time": "2024-01-02T15:04:05Z"
+			}
+		}`, orgGUID, sourceUUID)))
+	}
+
+	testCases := map[string]struct {
+		orgGUID      string
+		expectedCode int
+	}{
+		"same org": {
+			orgGUID:      "an-org",
+			expectedCode: http.StatusAccepted,
+		},
+		"another org": {
+			orgGUID:      "another-org",
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			instanceUUID := uuid.NewString()
+			url := fmt.Sprintf("/v2/service_instances/%s?accepts_incomplete=true", instanceUUID)
+			res, _ := doRequest(m, url, "PUT", true, cloneReq(test.orgGUID))
+			if res.Code != test.expectedCode {
+				t.Logf("Body is: " + res.Body.String())
+				t.Fatal(url, "should return", test.expectedCode, "and it returned", res.Code)
+			}
+			if test.expectedCode != http.StatusAccepted {
+				return
+			}
+
+			i := rds.RDSInstance{}
+			brokerDB.Where("uuid = ?", instanceUUID).First(&i)
+			if i.RestoredFromInstance != source.Database {
+				t.Error("The instance should be cloned from the source instance")
+			}
+			if i.Password == source.Password {
+				t.Error("The clone should get fresh credentials")
+			}
+			if !i.MasterPasswordResetPending {
+				t.Error("The master password of the clone should be reset once it is available")
+			}
+		})
+	}
+}
+
+func TestRDSReadReplica(t *testing.T) {
+	primaryUUID := uuid.NewString()
+	res, m := doRequest(nil, fmt.Sprintf("/v2/service_instances/%s?accepts_incomplete=true", primaryUUID), "PUT", true, bytes.NewBuffer(createRDSInstanceReq))
+	if res.Code != http.StatusAccepted {
+		t.Fatal("Unable to create primary instance. Body is: " + res.Body.String())
+	}
+	primary := rds.RDSInstance{}
+	brokerDB.Where("uuid = ?", primaryUUID).First(&primary)
+
+	replicaReq := func(orgGUID string, primaryGUID string) *bytes.Buffer {
+		return bytes.NewBuffer([]byte(fmt.Sprintf(`{
+			"service_id":"db80ca29-2d1b-4fbc-aad3-d03c0bfa7593",
+			"plan_id":"5c9f1d2e-8a43-4b7e-9f06-2d7c3b1e4a58",
+			"organization_guid":"%s",
+			"space_guid":"a-space",
+			"parameters": {
+				"read_replica_of": "%s"
+			}
+		}`, orgGUID, primaryGUID)))
+	}
+
+	testCases := map[string]struct {
+		orgGUID      string
+		primaryGUID  string
+		expectedCode int
+	}{
+		"same org": {
+			orgGUID:      "an-org",
+			primaryGUID:  primaryUUID,
+			expectedCode: http.StatusAccepted,
+		},
+		"another org": {
+			orgGUID:      "another-org",
+			primaryGUID:  primaryUUID,
+			expectedCode: http.StatusBadRequest,
+		},
+		"replica plan without primary": {
+			orgGUID:      "an-org",
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	var replicaUUID string
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			instanceUUID := uuid.NewString()
+			url := fmt.Sprintf("/v2/service_instances/%s?accepts_incomplete=true", instanceUUID)
+			res, _ := doRequest(m, url, "PUT", true, replicaReq(test.orgGUID, test.primaryGUID))
+			if res.Code != test.expectedCode {
+				t.Logf("Body is: " + res.Body.String())
+				t.Fatal(url, "should return", test.expectedCode, "and it returned", res.Code)
+			}
+			if test.expectedCode != http.StatusAccepted {
+				return
+			}
+
+			i := rds.RDSInstance{}
+			brokerDB.Where("uuid = ?", instanceUUID).First(&i)
+			if i.ReplicaOf != primaryUUID {
+				t.Error("The instance should be a read replica of the primary")
+			}
+			if i.Username != primary.Username || i.Password != primary.Password {
+				t.Error("The read replica should share the master credentials of the primary")
+			}
+			replicaUUID = instanceUUID
+		})
+	}
+	if replicaUUID == "" {
+		t.Fatal("No read replica was created")
+	}
+
+	// Bindings of the primary can read from the replica
+	res, _ = doRequest(m, fmt.Sprintf("/v2/service_instances/%s/service_bindings/%s", primaryUUID, uuid.NewString()), "PUT", true, bytes.NewBuffer(createRDSInstanceReq))
+	if res.Code != http.StatusCreated {
+		t.Fatal("Unable to bind primary instance. Body is: " + res.Body.String())
+	}
+	var r struct {
+		Credentials map[string]string
+	}
+	json.Unmarshal(res.Body.Bytes(), &r)
+	if r.Credentials["replica_uri"] == "" || !strings.Contains(r.Credentials["replica_uri"], r.Credentials["username"]) {
+		t.Error("The binding should include the replica URI for the binding user, got", r.Credentials["replica_uri"])
+	}
+
+	// Bindings of the replica share the master credentials and are recorded too
+	replicaBindingURL := fmt.Sprintf("/v2/service_instances/%s/service_bindings/%s", replicaUUID, uuid.NewString())
+	res, _ = doRequest(m, replicaBindingURL, "PUT", true, bytes.NewBuffer(createRDSInstanceReq))
+	if res.Code != http.StatusCreated {
+		t.Fatal("Unable to bind read replica. Body is: " + res.Body.String())
+	}
+	bound := res.Body.String()
+	res, _ = doRequest(m, replicaBindingURL, "GET", true, nil)
+	if res.Code != http.StatusOK || res.Body.String() != bound {
+		t.Errorf("expected the credentials of the replica binding %s, got %d %s", bound, res.Code, res.Body.String())
+	}
+	unknownURL := fmt.Sprintf("/v2/service_instances/%s/service_bindings/%s", replicaUUID, uuid.NewString())
+	res, _ = doRequest(m, unknownURL, "GET", true, nil)
+	if res.Code != http.StatusNotFound {
+		t.Error(unknownURL, "should return 404 and it returned", res.Code)
+	}
+
+	// The primary cannot be deleted while it has replicas
+	primaryURL := fmt.Sprintf("/v2/service_instances/%s?accepts_incomplete=true", primaryUUID)
+	res, _ = doRequest(m, primaryURL, "DELETE", true, nil)
+	if res.Code != http.StatusBadRequest {
+		t.Error(primaryURL, "should return 400 and it returned", res.Code)
+	}
+
+	res, _ = doRequest(m, fmt.Sprintf("/v2/service_instances/%s?accepts_incomplete=true", replicaUUID), "DELETE", true, nil)
+	if res.Code != http.StatusOK {
+		t.Fatal("Unable to delete read replica. Body is: " + res.Body.String())
+	}
+	res, _ = doRequest(m, primaryURL, "DELETE", true, nil)
+	if res.Code != http.StatusOK {
+		t.Error(primaryURL, "should return 200 once the replicas are deleted and it returned", res.Code)
+	}
+}
+
+func TestRDSReadReplicaRotateCredentialsWithNewKey(t *testing.T) {
+	primaryUUID := uuid.NewString()
+	primaryURL := fmt.Sprintf("/v2/service_instances/%s?accepts_incomplete=true", primaryUUID)
+	res, m := doRequest(nil, primaryURL, "PUT", true, bytes.NewBuffer(createRDSInstanceReq))
+	if res.Code != http.StatusAccepted {
+		t.Fatal("Unable to create primary instance. Body is: " + res.Body.String())
+	}
+	replicaUUID := uuid.NewString()
+	res, _ = doRequest(m, fmt.Sprintf("/v2/service_instances/%s?accepts_incomplete=true", replicaUUID), "PUT", true, bytes.NewBuffer([]byte(fmt.Sprintf(`{
+		"service_id":"db80ca29-2d1b-4fbc-aad3-d03c0bfa7593",
+		"plan_id":"5c9f1d2e-8a43-4b7e-9f06-2d7c3b1e4a58",
+		"organization_guid":"an-org",
+		"space_guid":"a-space",
+		"parameters": {
+			"read_replica_of": "%s"
+		}
+	}`, primaryUUID))))
+	if res.Code != http.StatusAccepted {
+		t.Fatal("Unable to create read replica. Body is: " + res.Body.String())
+	}
+
+	// The broker restarts with a new encryption key
+	var s config.Settings
+	s.EncryptionKey = "abcdefghijklmnopqrstuvwxyzabcdef"
+	s.EncryptionKeyID = "new-key"
+	s.DecryptionKeys = map[string]string{config.DefaultEncryptionKeyID: "12345678901234567890123456789012"}
+	s.Environment = "test"
+	s.MaxAllocatedStorage = 1024
+	s.CfApiUrl = "fake-api-url"
+	s.CfApiClientId = "fake-client-id"
+	s.CfApiClientSecret = "fake-client-secret"
+	tq := taskqueue.NewQueueManager(brokerDB)
+	tq.Init()
+	m = App(&s, brokerDB, tq)
+
+	res, _ = doRequest(m, primaryURL, "PATCH", true, bytes.NewBuffer([]byte(`{
+		"service_id":"db80ca29-2d1b-4fbc-aad3-d03c0bfa7593",
+		"plan_id":"da91e15c-98c9-46a9-b114-02b8d28062c6",
+		"parameters": {
+			"rotate_credentials": true
+		}
+	}`)))
+	if res.Code != http.StatusAccepted {
+		t.Fatal("Unable to rotate the credentials of the primary. Body is: " + res.Body.String())
+	}
+
+	primary := rds.RDSInstance{}
+	brokerDB.Where("uuid = ?", primaryUUID).First(&primary)
+	replica := rds.RDSInstance{}
+	brokerDB.Where("uuid = ?", replicaUUID).First(&replica)
+	if primary.EncryptionKeyID != "new-key" {
+		t.Error("The rotated password should be encrypted with the new key, got", primary.EncryptionKeyID)
+	}
+	if replica.Password != primary.Password || replica.Salt != primary.Salt || replica.EncryptionKeyID != primary.EncryptionKeyID {
+		t.Error("The read replica should share the rotated master credentials and their key ID")
+	}
+}
+
+func TestRDSAuroraCluster(t *testing.T) {
+	auroraReq := func(parameters string) *bytes.Buffer {
+		return bytes.NewBuffer([]byte(fmt.Sprintf(`{
+			"service_id":"db80ca29-2d1b-4fbc-aad3-d03c0bfa7593",
+			"plan_id":"93c3e661-d445-4176-8363-af316172d306",
+			"organization_guid":"an-org",
+			"space_guid":"a-space",
+			"parameters": %s
+		}`, parameters)))
+	}
+
+	clusterUUID := uuid.NewString()
+	clusterURL := fmt.Sprintf("/v2/service_instances/%s?accepts_incomplete=true", clusterUUID)
+	res, m := doRequest(nil, clusterURL, "PUT", true, auroraReq("{}"))
+	if res.Code != http.StatusAccepted {
+		t.Fatal("Unable to create cluster. Body is: " + res.Body.String())
+	}
+	i := rds.RDSInstance{}
+	brokerDB.Where("uuid = ?", clusterUUID).First(&i)
+	if i.Adapter != "aurora" {
+		t.Errorf("The instance should be an Aurora cluster, got adapter %s", i.Adapter)
+	}
+
+	testCases := map[string]struct {
+		method string
+		body   *bytes.Buffer
+	}{
+		"read replica of a cluster": {
+			method: "PUT",
+			body:   auroraReq(fmt.Sprintf(`{"read_replica_of": "%s"}`, clusterUUID)),
+		},
+		"IAM database authentication": {
+			method: "PUT",
+			body:   auroraReq(`{"iam_auth": true}`),
+		},
+		"clone of a cluster": {
+			method: "PUT",
+			body: bytes.NewBuffer([]byte(fmt.Sprintf(`{
+				"service_id":"db80ca29-2d1b-4fbc-aad3-d03c0bfa7593",
+				"plan_id":"da91e15c-98c9-46a9-b114-02b8d28062c6",
+				"organization_guid":"an-org",
+				"space_guid":"a-space",
+				"parameters": {
+					"source_instance_guid": "%s"
+				}
+			}`, clusterUUID))),
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			url := fmt.Sprintf("/v2/service_instances/%s?accepts_incomplete=true", uuid.NewString())
+			res, _ := doRequest(m, url, test.method, true, test.body)
+			if res.Code != http.StatusBadRequest {
+				t.Logf("Body is: " + res.Body.String())
+				t.Error(url, "should return 400 and it returned", res.Code)
+			}
+		})
+	}
+
+	// A cluster cannot be switched to a plan of single instances
+	res, _ = doRequest(m, clusterURL, "PATCH", true, bytes.NewBuffer(modifyRDSInstanceReq))
+	if res.Code != http.StatusBadRequest || !strings.Contains(res.Body.String(), "Aurora") {
+		t.Error(clusterURL, "should not switch to a plan of single instances, it returned", res.Code, res.Body.String())
+	}
+
+	// No final snapshot is recorded for the cluster, since it cannot be restored
+	res, _ = doRequest(m, clusterURL, "DELETE", true, nil)
+	if res.Code != http.StatusOK {
+		t.Fatal("Unable to delete cluster. Body is: " + res.Body.String())
+	}
+	var snapshotCount int64
+	brokerDB.Model(&rds.RDSSnapshot{}).Where("instance_uuid = ?", clusterUUID).Count(&snapshotCount)
+	if snapshotCount != 0 {
+		t.Error("No final snapshot should be recorded for an Aurora cluster")
+	}
 }
 
 /*
@@ -1111,6 +2071,61 @@ func TestCreateRedisInstance(t *testing.T) {
 	}
 }
 
+func TestRestoreRedisInstance(t *testing.T) {
+	restoreReq := func(sourceGUID string) *bytes.Buffer {
+		return bytes.NewBuffer([]byte(fmt.Sprintf(`{
+			"service_id":"cda65825-e357-4a93-a24b-9ab138d97815",
+			"plan_id":"475e36bf-387f-44c1-9b81-575fec2ee443",
+			"organization_guid":"an-org",
+			"space_guid":"a-space",
+			"parameters": {
+				"restore_from_instance": "%s"
+			}
+		}`, sourceGUID)))
+	}
+
+	existingUUID := uuid.NewString()
+	res, m := doRequest(nil, fmt.Sprintf("/v2/service_instances/%s?accepts_incomplete=true", existingUUID), "PUT", true, bytes.NewBuffer(createRedisInstanceReq))
+	if res.Code != http.StatusAccepted {
+		t.Fatal("Unable to create instance. Body is: " + res.Body.String())
+	}
+
+	testCases := map[string]struct {
+		sourceGUID   string
+		expectedCode int
+	}{
+		"deleted instance": {
+			sourceGUID:   uuid.NewString(),
+			expectedCode: http.StatusAccepted,
+		},
+		"instance that still exists": {
+			sourceGUID:   existingUUID,
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			instanceUUID := uuid.NewString()
+			url := fmt.Sprintf("/v2/service_instances/%s?accepts_incomplete=true", instanceUUID)
+			res, _ := doRequest(m, url, "PUT", true, restoreReq(test.sourceGUID))
+			if res.Code != test.expectedCode {
+				t.Logf("Body is: " + res.Body.String())
+				t.Fatal(url, "should return", test.expectedCode, "and it returned", res.Code)
+			}
+			if test.expectedCode != http.StatusAccepted {
+				return
+			}
+
+			i := redis.RedisInstance{}
+			brokerDB.Where("uuid = ?", instanceUUID).First(&i)
+			if i.RestoredFromInstance != test.sourceGUID {
+				t.Error("The instance should be restored from the deleted instance")
+			}
+		})
+	}
+}
+
 func TestModifyRedisInstance(t *testing.T) {
 	instanceUUID := uuid.NewString()
 	// We need to create an instance first before we can try to modify it.
@@ -1146,25 +2161,46 @@ func TestModifyRedisInstance(t *testing.T) {
 	urlAcceptsIncomplete := fmt.Sprintf("/v2/service_instances/%s?accepts_incomplete=true", instanceUUID)
 	resp, _ = doRequest(m, urlAcceptsIncomplete, "PATCH", true, bytes.NewBuffer(modifyRedisInstanceReq))
 
-	if resp.Code != http.StatusBadRequest {
+	if resp.Code != http.StatusAccepted {
 		t.Logf("Unable to modify instance. Body is: " + resp.Body.String())
-		t.Error(urlAcceptsIncomplete, "with auth should return 400 and it returned", resp.Code)
+		t.Error(urlAcceptsIncomplete, "with auth should return 202 and it returned", resp.Code)
 	}
 
 	// Is it a valid JSON?
 	validJSON(resp.Body.Bytes(), urlAcceptsIncomplete, t)
 
-	// Does it contain "Updating Redis service instances is not supported at this time"?
-	if !strings.Contains(resp.Body.String(), "Updating Redis service instances is not supported at this time") {
-		t.Error(urlAcceptsIncomplete, "should return a message that Redis services cannot be modified at this time")
+	// Is the modify operation returned for polling?
+	if !strings.Contains(resp.Body.String(), `"operation":"modify"`) {
+		t.Error(urlAcceptsIncomplete, "should return the modify operation, got", resp.Body.String())
 	}
 
-	// Reload the instance and check to see that the plan has not been modified.
+	// Reload the instance and check to see that the plan has been modified.
 	i = redis.RedisInstance{}
 	brokerDB.Where("uuid = ?", instanceUUID).First(&i)
-	if i.PlanID != originalRedisPlanID {
-		t.Logf("The instance was modified: " + i.PlanID + " != " + originalRedisPlanID)
-		t.Error("The instance was modified to have a new instance class plan when it should not have been.")
+	if i.PlanID != updatedRedisPlanID {
+		t.Logf("The instance was not modified: " + i.PlanID + " != " + updatedRedisPlanID)
+		t.Error("The instance should have the plan provided with the modify request.")
+	}
+	if !i.AutomaticFailoverEnabled || i.NumCacheClusters != 5 {
+		t.Error("The instance should have the node settings of the new plan.")
+	}
+
+	lastOperationURL := fmt.Sprintf("/v2/service_instances/%s/last_operation?operation=modify", instanceUUID)
+	resp, _ = doRequest(m, lastOperationURL, "GET", true, nil)
+	if resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), "succeeded") {
+		t.Error(lastOperationURL, "should return that the modification succeeded, got", resp.Body.String())
+	}
+
+	// Downgrading the engine is not allowed.
+	resp, _ = doRequest(m, urlAcceptsIncomplete, "PATCH", true, bytes.NewBuffer([]byte(`{
+	"service_id":"cda65825-e357-4a93-a24b-9ab138d97815",
+	"plan_id":"5nd336bf-0k7f-44c1-9b81-575fp3k764r6",
+	"parameters": {
+		"engineVersion": "4.0.10"
+	}
+}`)))
+	if resp.Code != http.StatusBadRequest {
+		t.Error(urlAcceptsIncomplete, "should not allow downgrading the engine and it returned", resp.Code)
 	}
 }
 
@@ -1540,10 +2576,169 @@ func TestElasticsearchLastOperation(t *testing.T) {
 	}
 }
 
+func TestRestoreElasticsearchInstance(t *testing.T) {
+	restoreReq := func(sourceGUID string) *bytes.Buffer {
+		return bytes.NewBuffer([]byte(fmt.Sprintf(`{
+			"service_id":"90413816-9c77-418b-9fc7-b9739e7c1254",
+			"plan_id":"55b529cf-639e-4673-94fd-ad0a5dafe0ad",
+			"organization_guid":"an-org",
+			"space_guid":"a-space",
+			"parameters": {
+				"restore_from_instance": "%s"
+			}
+		}`, sourceGUID)))
+	}
+
+	existingUUID := uuid.NewString()
+	res, m := doRequest(nil, fmt.Sprintf("/v2/service_instances/%s?accepts_incomplete=true", existingUUID), "PUT", true, bytes.NewBuffer(createElasticsearchInstanceReq))
+	if res.Code != http.StatusAccepted {
+		t.Fatal("Unable to create instance. Body is: " + res.Body.String())
+	}
+
+	testCases := map[string]struct {
+		sourceGUID   string
+		expectedCode int
+	}{
+		"deleted instance": {
+			sourceGUID:   uuid.NewString(),
+			expectedCode: http.StatusAccepted,
+		},
+		"instance that still exists": {
+			sourceGUID:   existingUUID,
+			expectedCode: http.StatusBadRequest,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			instanceUUID := uuid.NewString()
+			url := fmt.Sprintf("/v2/service_instances/%s?accepts_incomplete=true", instanceUUID)
+			res, _ := doRequest(m, url, "PUT", true, restoreReq(test.sourceGUID))
+			if res.Code != test.expectedCode {
+				t.Logf("Body is: " + res.Body.String())
+				t.Fatal(url, "should return", test.expectedCode, "and it returned", res.Code)
+			}
+			if test.expectedCode != http.StatusAccepted {
+				return
+			}
+
+			i := elasticsearch.ElasticsearchInstance{}
+			brokerDB.Where("uuid = ?", instanceUUID).First(&i)
+			if i.RestoredFromInstance != test.sourceGUID {
+				t.Error("The instance should be restored from the deleted instance")
+			}
+
+			// The snapshot is restored once the domain is ready
+			lastOpURL := fmt.Sprintf("/v2/service_instances/%s/last_operation?operation=create", instanceUUID)
+			res, _ = doRequest(m, lastOpURL, "GET", true, nil)
+			if !strings.Contains(res.Body.String(), "in progress") {
+				t.Error(lastOpURL, "should report the restore in progress and it returned", res.Body.String())
+			}
+			for attempt := 0; attempt < 50; attempt++ {
+				res, _ = doRequest(m, lastOpURL, "GET", true, nil)
+				if strings.Contains(res.Body.String(), "succeeded") {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if !strings.Contains(res.Body.String(), "succeeded") {
+				t.Error(lastOpURL, "should report the restore succeeded and it returned", res.Body.String())
+			}
+
+			i = elasticsearch.ElasticsearchInstance{}
+			brokerDB.Where("uuid = ?", instanceUUID).First(&i)
+			if !i.SnapshotRestored {
+				t.Error("The snapshot should be restored")
+			}
+			// The snapshot role created while restoring is saved for its clean up
+			if i.SnapshotARN != "mock-snapshot-role-arn" {
+				t.Errorf("expected the snapshot role of the restore to be saved, got %q", i.SnapshotARN)
+			}
+		})
+	}
+}
+
+func TestElasticsearchSnapshot(t *testing.T) {
+	snapshotReq := func(name string) *bytes.Buffer {
+		return bytes.NewBuffer([]byte(fmt.Sprintf(`{
+			"service_id":"90413816-9c77-418b-9fc7-b9739e7c1254",
+			"plan_id":"55b529cf-639e-4673-94fd-ad0a5dafe0ad",
+			"organization_guid":"an-org",
+			"space_guid":"a-space",
+			"parameters": {
+				"snapshot": "%s"
+			}
+		}`, name)))
+	}
+
+	instanceUUID := uuid.NewString()
+	url := fmt.Sprintf("/v2/service_instances/%s?accepts_incomplete=true", instanceUUID)
+	res, m := doRequest(nil, url, "PUT", true, bytes.NewBuffer(createElasticsearchInstanceReq))
+	if res.Code != http.StatusAccepted {
+		t.Fatal("Unable to create instance. Body is: " + res.Body.String())
+	}
+
+	// Snapshot names follow the rules for index names
+	res, _ = doRequest(m, url, "PATCH", true, snapshotReq("Before Reindex"))
+	if res.Code != http.StatusBadRequest {
+		t.Error(url, "with an invalid snapshot name should return 400 and it returned", res.Code)
+	}
+
+	res, _ = doRequest(m, url, "PATCH", true, snapshotReq("before-reindex"))
+	if res.Code != http.StatusAccepted {
+		t.Logf("Unable to take snapshot. Body is: " + res.Body.String())
+		t.Fatal(url, "with auth should return 202 and it returned", res.Code)
+	}
+	if !strings.Contains(res.Body.String(), `"operation":"modify"`) {
+		t.Error(url, "should return the modify operation and it returned", res.Body.String())
+	}
+
+	i := elasticsearch.ElasticsearchInstance{}
+	brokerDB.Where("uuid = ?", instanceUUID).First(&i)
+	if i.PendingSnapshot != "before-reindex" {
+		t.Error("The snapshot should be in progress")
+	}
+
+	// Only one snapshot can be taken at a time
+	res, _ = doRequest(m, url, "PATCH", true, snapshotReq("another-one"))
+	if res.Code != http.StatusBadRequest {
+		t.Error(url, "with a snapshot in progress should return 400 and it returned", res.Code)
+	}
+
+	lastOpURL := fmt.Sprintf("/v2/service_instances/%s/last_operation?operation=modify", instanceUUID)
+	res, _ = doRequest(m, lastOpURL, "GET", true, nil)
+	if !strings.Contains(res.Body.String(), "succeeded") {
+		t.Error(lastOpURL, "should report the snapshot succeeded and it returned", res.Body.String())
+	}
+	i = elasticsearch.ElasticsearchInstance{}
+	brokerDB.Where("uuid = ?", instanceUUID).First(&i)
+	if i.PendingSnapshot != "" {
+		t.Error("The snapshot should no longer be in progress")
+	}
+
+	// The snapshots that succeeded are reported when the instance is fetched
+	instanceURL := fmt.Sprintf("/v2/service_instances/%s", instanceUUID)
+	res, _ = doRequest(m, instanceURL, "GET", true, nil)
+	if res.Code != http.StatusOK {
+		t.Logf("Unable to fetch instance. Body is: " + res.Body.String())
+		t.Fatal(instanceURL, "with auth should return 200 and it returned", res.Code)
+	}
+	var fetched struct {
+		Parameters struct {
+			Snapshots []string `json:"snapshots"`
+		} `json:"parameters"`
+	}
+	json.Unmarshal(res.Body.Bytes(), &fetched)
+	if len(fetched.Parameters.Snapshots) != 1 || fetched.Parameters.Snapshots[0] != "before-reindex" {
+		t.Error(instanceURL, "should report the snapshot and it returned", res.Body.String())
+	}
+}
+
 func TestElasticsearchBindInstance(t *testing.T) {
 	instanceUUID := uuid.NewString()
 	url := fmt.Sprintf("/v2/service_instances/%s/service_bindings/the_binding", instanceUUID)
-	res, m := doRequest(nil, url, "PUT", true, bytes.NewBuffer(createElasticsearchInstanceReq))
+	urlAcceptsIncomplete := url + "?accepts_incomplete=true"
+	res, m := doRequest(nil, urlAcceptsIncomplete, "PUT", true, bytes.NewBuffer(createElasticsearchInstanceReq))
 
 	// Without the instance
 	if res.Code != http.StatusNotFound {
@@ -1551,27 +2746,42 @@ func TestElasticsearchBindInstance(t *testing.T) {
 	}
 
 	// Create the instance and try again
-	res, _ = doRequest(m, fmt.Sprintf("/v2/service_instances/%s?accepts_incomplete=true", instanceUUID), "PUT", true, bytes.NewBuffer(createRedisInstanceReq))
+	res, _ = doRequest(m, fmt.Sprintf("/v2/service_instances/%s?accepts_incomplete=true", instanceUUID), "PUT", true, bytes.NewBuffer(createElasticsearchInstanceReq))
 	if res.Code != http.StatusAccepted {
 		t.Logf("Unable to create instance. Body is: " + res.Body.String())
 		t.Error(url, "with auth should return 202 and it returned", res.Code)
 	}
 
+	// Binding is asynchronous
 	res, _ = doRequest(m, url, "PUT", true, bytes.NewBuffer(createElasticsearchInstanceReq))
-	if res.Code != http.StatusCreated {
+	if res.Code != http.StatusUnprocessableEntity {
+		t.Error(url, "without accepts_incomplete should return 422 and it returned", res.Code)
+	}
+
+	res, _ = doRequest(m, urlAcceptsIncomplete, "PUT", true, bytes.NewBuffer(createElasticsearchInstanceReq))
+	if res.Code != http.StatusAccepted {
 		t.Logf("Unable to bind instance. Body is: " + res.Body.String())
-		t.Error(url, "with auth should return 202 and it returned", res.Code)
+		t.Fatal(url, "with auth should return 202 and it returned", res.Code)
+	}
+	if !strings.Contains(res.Body.String(), "bind") {
+		t.Error(url, "should return the bind operation and returned", res.Body.String())
+	}
+
+	pollBinding(t, m, url)
+
+	res, _ = doRequest(m, url, "GET", true, nil)
+	if res.Code != http.StatusOK {
+		t.Logf("Unable to fetch binding. Body is: " + res.Body.String())
+		t.Error(url, "with auth should return 200 and it returned", res.Code)
 	}
 
 	// Is it a valid JSON?
 	validJSON(res.Body.Bytes(), url, t)
 
 	type credentials struct {
-		URI      string
-		Username string
-		Password string
-		Host     string
-		DbName   string
+		URI       string
+		AccessKey string `json:"access_key"`
+		Host      string
 	}
 
 	type response struct {
@@ -1588,14 +2798,40 @@ func TestElasticsearchBindInstance(t *testing.T) {
 	}
 
 	instance := elasticsearch.ElasticsearchInstance{}
-	brokerDB.Where("uuid = ?", "the_elasticsearch_instance").First(&instance)
+	brokerDB.Where("uuid = ?", instanceUUID).First(&instance)
 
-	// Does it return an unencrypted password?
-	if instance.Password == r.Credentials.Password || r.Credentials.Password == "" {
-		t.Error(url, "should return an unencrypted password and it returned", r.Credentials.Password)
+	// Does it return the keys of the instance?
+	if instance.AccessKey != r.Credentials.AccessKey {
+		t.Error(url, "should return the access key of the instance and it returned", r.Credentials.AccessKey)
+	}
+
+	binding := elasticsearch.ElasticsearchBinding{}
+	brokerDB.Where("binding_id = ?", "the_binding").First(&binding)
+	if binding.InstanceUuid != instanceUUID {
+		t.Error("The binding should be in the DB")
 	}
 }
 
+// pollBinding waits for the bind job of an asynchronous binding to succeed.
+func pollBinding(t *testing.T, m *martini.ClassicMartini, url string) {
+	t.Helper()
+	lastOperationURL := url + "/last_operation?operation=bind"
+	for attempt := 0; attempt < 50; attempt++ {
+		res, _ := doRequest(m, lastOperationURL, "GET", true, nil)
+		if res.Code != http.StatusOK {
+			t.Fatal(lastOperationURL, "should return 200 and it returned", res.Code, res.Body.String())
+		}
+		if strings.Contains(res.Body.String(), "succeeded") {
+			return
+		}
+		if strings.Contains(res.Body.String(), "failed") {
+			t.Fatal(lastOperationURL, "reported the binding as failed:", res.Body.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal(lastOperationURL, "did not report the binding as succeeded")
+}
+
 func TestElasticsearchUnbind(t *testing.T) {
 	instanceUUID := uuid.NewString()
 	url := fmt.Sprintf("/v2/service_instances/%s/service_bindings/the_binding", instanceUUID)
@@ -1646,3 +2882,57 @@ func TestElasticsearchDeleteInstance(t *testing.T) {
 		t.Error("The instance shouldn't be in the DB")
 	}
 }
+
+func TestElasticsearchResumeDeleteInstance(t *testing.T) {
+	instanceUUID := uuid.NewString()
+	url := fmt.Sprintf("/v2/service_instances/%s/last_operation?operation=delete", instanceUUID)
+	res, m := doRequest(nil, fmt.Sprintf("/v2/service_instances/%s?accepts_incomplete=true", instanceUUID), "PUT", true, bytes.NewBuffer(createElasticsearchInstanceReq))
+	if res.Code != http.StatusAccepted {
+		t.Logf("Unable to create instance. Body is: " + res.Body.String())
+		t.Error("create instance with auth should return 202 and it returned", res.Code)
+	}
+
+	// A deletion left unfinished by a broker process that stopped running
+	i := elasticsearch.ElasticsearchInstance{}
+	brokerDB.Where("uuid = ?", instanceUUID).First(&i)
+	brokerDB.Create(&taskqueue.AsyncJob{
+		BrokerId:       i.ServiceID,
+		InstanceId:     instanceUUID,
+		Operation:      base.DeleteOp,
+		State:          base.InstanceInProgress,
+		Owner:          "a-stopped-broker",
+		LeaseExpiresAt: time.Now().Add(-time.Minute),
+	})
+
+	res, _ = doRequest(m, url, "GET", true, nil)
+	if !strings.Contains(res.Body.String(), "in progress") {
+		t.Error(url, "should report the deletion in progress and it returned", res.Body.String())
+	}
+
+	// Another broker process resumes the deletion
+	var s config.Settings
+	s.EncryptionKey = "12345678901234567890123456789012"
+	s.Environment = "test"
+	path, _ := os.Getwd()
+	other := taskqueue.NewQueueManager(brokerDB)
+	registerJobHandlers(catalog.InitCatalog(path), brokerDB, &s, other)
+	other.ResumeJobs()
+
+	for attempt := 0; attempt < 50; attempt++ {
+		res, _ = doRequest(m, url, "GET", true, nil)
+		if strings.Contains(res.Body.String(), "succeeded") {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(res.Body.String(), "succeeded") {
+		t.Error(url, "should report the deletion succeeded and it returned", res.Body.String())
+	}
+
+	// Is it actually gone from the DB?
+	i = elasticsearch.ElasticsearchInstance{}
+	brokerDB.Where("uuid = ?", instanceUUID).First(&i)
+	if len(i.Uuid) > 0 {
+		t.Error("The instance shouldn't be in the DB")
+	}
+}
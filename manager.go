@@ -1,6 +1,7 @@
 package main
 
 import (
+	"log"
 	"net/http"
 
 	"github.com/18F/aws-broker/base"
@@ -65,6 +66,18 @@ func findBroker(serviceID string, c *catalog.Catalog, brokerDb *gorm.DB, setting
 	return nil, response.NewErrorResponse(http.StatusNotFound, catalog.ErrNoServiceFound.Error())
 }
 
+// registerJobHandlers lets the task queue resume the async jobs of brokers that run them.
+func registerJobHandlers(c *catalog.Catalog, brokerDb *gorm.DB, settings *config.Settings, taskqueue *taskqueue.QueueManager) {
+	elasticsearch.RegisterJobHandlers(c, brokerDb, settings, taskqueue)
+}
+
+// registerSchemas adds the schemas of the parameters each broker accepts to its plans in the catalog.
+func registerSchemas(c *catalog.Catalog) {
+	c.SetSchemas(c.RdsService.ID, rds.ParameterSchemas())
+	c.SetSchemas(c.RedisService.ID, redis.ParameterSchemas())
+	c.SetSchemas(c.ElasticsearchService.ID, elasticsearch.ParameterSchemas())
+}
+
 func createInstance(req *http.Request, c *catalog.Catalog, brokerDb *gorm.DB, id string, settings *config.Settings, taskqueue *taskqueue.QueueManager) response.Response {
 	createRequest, err := request.ExtractRequest(req)
 	if err != nil {
@@ -80,6 +93,16 @@ func createInstance(req *http.Request, c *catalog.Catalog, brokerDb *gorm.DB, id
 		return response.ErrUnprocessableEntityResponse
 	}
 
+	schemas, err := c.FetchPlanSchemas(createRequest.ServiceID, createRequest.PlanID)
+	if err != nil {
+		return err
+	}
+	if schemas != nil {
+		if err := schemas.ServiceInstance.Create.ValidateParameters(createRequest.RawParameters); err != nil {
+			return err
+		}
+	}
+
 	// Create instance
 	resp := broker.CreateInstance(c, id, createRequest)
 
@@ -90,13 +113,36 @@ func createInstance(req *http.Request, c *catalog.Catalog, brokerDb *gorm.DB, id
 		err := brokerDb.Create(&instance).Error
 
 		if err != nil {
+			// The instance cannot be found without its record, so delete what
+			// was created for it.
+			if cleanupResp := cleanupProvision(c, brokerDb, broker, id); cleanupResp.GetResponseType() == response.ErrorResponseType {
+				log.Printf("createInstance - unable to clean up instance %s: status %d", id, cleanupResp.GetStatusCode())
+			}
 			return response.NewErrorResponse(http.StatusBadRequest, err.Error())
 		}
+		// The resources no longer need to be tracked once the instance is saved.
+		if err := base.ForgetProvisionedResources(brokerDb, id); err != nil {
+			log.Printf("createInstance - unable to forget the resources of instance %s: %s", id, err)
+		}
 	}
 
 	return resp
 }
 
+// cleanupProvision asks the broker to tear down the recorded resources of an
+// instance that was not saved.
+func cleanupProvision(c *catalog.Catalog, brokerDb *gorm.DB, broker base.Broker, id string) response.Response {
+	orphanBroker, ok := broker.(base.OrphanMitigationBroker)
+	if !ok {
+		return response.SuccessDeleteResponse
+	}
+	resources, err := base.FindProvisionedResources(brokerDb, id)
+	if err != nil {
+		return response.NewErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+	return orphanBroker.CleanupProvision(c, id, resources)
+}
+
 func modifyInstance(req *http.Request, c *catalog.Catalog, brokerDb *gorm.DB, id string, settings *config.Settings, taskqueue *taskqueue.QueueManager) response.Response {
 	// Extract the request information.
 	modifyRequest, err := request.ExtractRequest(req)
@@ -122,6 +168,21 @@ func modifyInstance(req *http.Request, c *catalog.Catalog, brokerDb *gorm.DB, id
 		return response.ErrUnprocessableEntityResponse
 	}
 
+	// The plan is only sent when it changes.
+	planID := modifyRequest.PlanID
+	if planID == "" {
+		planID = instance.PlanID
+	}
+	schemas, err := c.FetchPlanSchemas(instance.ServiceID, planID)
+	if err != nil {
+		return err
+	}
+	if schemas != nil {
+		if err := schemas.ServiceInstance.Update.ValidateParameters(modifyRequest.RawParameters); err != nil {
+			return err
+		}
+	}
+
 	// Attempt to modify the database instance.
 	resp := broker.ModifyInstance(c, id, modifyRequest, instance)
 
@@ -150,7 +211,7 @@ func lastOperation(req *http.Request, c *catalog.Catalog, brokerDb *gorm.DB, id
 	return broker.LastOperation(c, id, instance, operation)
 }
 
-func bindInstance(req *http.Request, c *catalog.Catalog, brokerDb *gorm.DB, id string, settings *config.Settings, taskqueue *taskqueue.QueueManager) response.Response {
+func bindInstance(req *http.Request, c *catalog.Catalog, brokerDb *gorm.DB, id string, bindingID string, settings *config.Settings, taskqueue *taskqueue.QueueManager) response.Response {
 	// Extract the request information.
 	bindRequest, err := request.ExtractRequest(req)
 	if err != nil {
@@ -166,12 +227,69 @@ func bindInstance(req *http.Request, c *catalog.Catalog, brokerDb *gorm.DB, id s
 		return resp
 	}
 
-	return broker.BindInstance(c, id, bindRequest, instance)
+	if broker.AsyncOperationRequired(c, instance, base.BindOp) {
+		// Check if async calls are allowed.
+		asyncAllowed := req.FormValue("accepts_incomplete") == "true"
+		if !asyncAllowed {
+			return response.ErrUnprocessableEntityResponse
+		}
+	}
+
+	schemas, resp := c.FetchPlanSchemas(instance.ServiceID, instance.PlanID)
+	if resp != nil {
+		return resp
+	}
+	if schemas != nil {
+		if resp := schemas.ServiceBinding.Create.ValidateParameters(bindRequest.RawParameters); resp != nil {
+			return resp
+		}
+	}
+
+	return broker.BindInstance(c, id, bindingID, bindRequest, instance)
+}
+
+func bindingLastOperation(req *http.Request, c *catalog.Catalog, brokerDb *gorm.DB, id string, bindingID string, settings *config.Settings, taskqueue *taskqueue.QueueManager) response.Response {
+	instance, resp := base.FindBaseInstance(brokerDb, id)
+	if resp != nil {
+		return resp
+	}
+	broker, resp := findBroker(instance.ServiceID, c, brokerDb, settings, taskqueue)
+	if resp != nil {
+		return resp
+	}
+	asyncBroker, ok := broker.(base.AsyncBindingBroker)
+	if !ok {
+		return response.NewErrorResponse(http.StatusBadRequest, "Bindings of this service are not asynchronous.")
+	}
+	operation := req.URL.Query().Get("operation")
+	return asyncBroker.BindingLastOperation(c, id, bindingID, instance, operation)
+}
+
+func unbindInstance(req *http.Request, c *catalog.Catalog, brokerDb *gorm.DB, id string, bindingID string, settings *config.Settings, taskqueue *taskqueue.QueueManager) response.Response {
+	instance, resp := base.FindBaseInstance(brokerDb, id)
+	if resp != nil {
+		// The binding cannot exist without its instance, so there is nothing left to revoke.
+		if resp.GetStatusCode() == http.StatusNotFound {
+			return response.SuccessUnbindResponse
+		}
+		return resp
+	}
+	broker, resp := findBroker(instance.ServiceID, c, brokerDb, settings, taskqueue)
+	if resp != nil {
+		return resp
+	}
+
+	return broker.UnbindInstance(c, id, bindingID, instance)
 }
 
 func deleteInstance(req *http.Request, c *catalog.Catalog, brokerDb *gorm.DB, id string, settings *config.Settings, taskqueue *taskqueue.QueueManager) response.Response {
 	instance, resp := base.FindBaseInstance(brokerDb, id)
 	if resp != nil {
+		if resp.GetStatusCode() == http.StatusNotFound {
+			// The platform deletes instances whose provisioning failed to
+			// mitigate orphans.
+			return deleteOrphan(c, brokerDb, id, settings, taskqueue, resp)
+		}
 		return resp
 	}
 	broker, resp := findBroker(instance.ServiceID, c, brokerDb, settings, taskqueue)
@@ -193,3 +311,55 @@ func deleteInstance(req *http.Request, c *catalog.Catalog, brokerDb *gorm.DB, id
 	}
 	return resp
 }
+
+// deleteOrphan tears down the recorded resources of an instance that was never
+// saved, or returns notFound if nothing was recorded for it.
+func deleteOrphan(c *catalog.Catalog, brokerDb *gorm.DB, id string, settings *config.Settings, taskqueue *taskqueue.QueueManager, notFound response.Response) response.Response {
+	resources, err := base.FindProvisionedResources(brokerDb, id)
+	if err != nil || len(resources) == 0 {
+		return notFound
+	}
+	broker, resp := findBroker(resources[0].ServiceID, c, brokerDb, settings, taskqueue)
+	if resp != nil {
+		return resp
+	}
+	return cleanupProvision(c, brokerDb, broker, id)
+}
+
+func fetchInstance(req *http.Request, c *catalog.Catalog, brokerDb *gorm.DB, id string, settings *config.Settings, taskqueue *taskqueue.QueueManager) response.Response {
+	instance, resp := base.FindBaseInstance(brokerDb, id)
+	if resp != nil {
+		return resp
+	}
+	service, resp := c.FetchService(instance.ServiceID)
+	if resp != nil {
+		return resp
+	}
+	if !service.InstancesRetrievable {
+		return response.NewErrorResponse(http.StatusBadRequest, "Fetching instances is not supported for this service.")
+	}
+	broker, resp := findBroker(instance.ServiceID, c, brokerDb, settings, taskqueue)
+	if resp != nil {
+		return resp
+	}
+	return broker.FetchInstance(c, id, instance)
+}
+
+func fetchBinding(req *http.Request, c *catalog.Catalog, brokerDb *gorm.DB, id string, bindingID string, settings *config.Settings, taskqueue *taskqueue.QueueManager) response.Response {
+	instance, resp := base.FindBaseInstance(brokerDb, id)
+	if resp != nil {
+		return resp
+	}
+	service, resp := c.FetchService(instance.ServiceID)
+	if resp != nil {
+		return resp
+	}
+	if !service.BindingsRetrievable {
+		return response.NewErrorResponse(http.StatusBadRequest, "Fetching bindings is not supported for this service.")
+	}
+	broker, resp := findBroker(instance.ServiceID, c, brokerDb, settings, taskqueue)
+	if resp != nil {
+		return resp
+	}
+	return broker.FetchBinding(c, id, bindingID, instance)
+}
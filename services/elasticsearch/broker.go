@@ -1,7 +1,6 @@
 package elasticsearch
 
 import (
-	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
@@ -11,44 +10,76 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/iam"
 	"github.com/aws/aws-sdk-go/service/opensearchservice"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/jinzhu/gorm"
 
+	"github.com/18F/aws-broker/awssecrets"
 	"github.com/18F/aws-broker/base"
 	"github.com/18F/aws-broker/catalog"
 	"github.com/18F/aws-broker/config"
 	"github.com/18F/aws-broker/helpers/request"
 	"github.com/18F/aws-broker/helpers/response"
+	"github.com/18F/aws-broker/helpers/schema"
 	"github.com/18F/aws-broker/taskqueue"
 
 	brokertags "github.com/cloud-gov/go-broker-tags"
 )
 
 type ElasticsearchAdvancedOptions struct {
-	IndicesFieldDataCacheSize      string `json:"indices.fielddata.cache.size,omitempty"`
-	IndicesQueryBoolMaxClauseCount string `json:"indices.query.bool.max_clause_count,omitempty"`
+	IndicesFieldDataCacheSize      string `json:"indices.fielddata.cache.size,omitempty" description:"Percentage of the heap used for the field data cache"`
+	IndicesQueryBoolMaxClauseCount string `json:"indices.query.bool.max_clause_count,omitempty" description:"Maximum number of clauses in a bool query"`
 }
 
 type ElasticsearchOptions struct {
-	ElasticsearchVersion string                       `json:"elasticsearchVersion"`
-	Bucket               string                       `json:"bucket"`
-	AdvancedOptions      ElasticsearchAdvancedOptions `json:"advanced_options,omitempty"`
-	VolumeType           string                       `json:"volume_type"`
+	ElasticsearchVersion string                       `json:"elasticsearchVersion" description:"Engine version approved by the plan"`
+	Bucket               string                       `json:"bucket" description:"S3 bucket the domain can take snapshots into"`
+	AdvancedOptions      ElasticsearchAdvancedOptions `json:"advanced_options,omitempty" description:"Advanced cluster settings"`
+	VolumeType           string                       `json:"volume_type" description:"EBS volume type of the data nodes, e.g. gp3"`
+	RestoreFromInstance  string                       `json:"restore_from_instance" description:"GUID of a deleted instance to restore the last snapshot of"`
+	Snapshot             string                       `json:"snapshot" description:"Name of a manual snapshot to take of the instance"`
+}
+
+// ElasticsearchBindOptions are the parameters of bindings.
+type ElasticsearchBindOptions struct {
+	Bucket string `json:"bucket" description:"S3 bucket the domain can take snapshots into"`
 }
 
 func (o ElasticsearchOptions) Validate(settings *config.Settings) error {
 	if err := validateVolumeType(o.VolumeType); err != nil {
 		return err
 	}
+	if o.Snapshot != "" {
+		if err := validateSnapshotName(o.Snapshot, settings.LastSnapshotName); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// ParameterSchemas returns the schemas of the parameters accepted by Elasticsearch plans.
+func ParameterSchemas() *catalog.Schemas {
+	options := schema.Generate(ElasticsearchOptions{})
+	return &catalog.Schemas{
+		ServiceInstance: catalog.ServiceInstanceSchema{
+			// Snapshots can only be taken of a domain that exists, and only new
+			// domains can be restored from the snapshot of a deleted one.
+			Create: catalog.InputParametersSchema{Parameters: options.Without("snapshot")},
+			Update: catalog.InputParametersSchema{Parameters: options.Without("restore_from_instance")},
+		},
+		ServiceBinding: catalog.ServiceBindingSchema{
+			Create: catalog.InputParametersSchema{Parameters: schema.Generate(ElasticsearchBindOptions{})},
+		},
+	}
+}
+
 type elasticsearchBroker struct {
-	brokerDB   *gorm.DB
-	settings   *config.Settings
-	taskqueue  *taskqueue.QueueManager
-	logger     lager.Logger
-	tagManager brokertags.TagManager
+	brokerDB         *gorm.DB
+	settings         *config.Settings
+	taskqueue        *taskqueue.QueueManager
+	logger           lager.Logger
+	tagManager       brokertags.TagManager
+	credentialsStore awssecrets.CredentialsStore
 }
 
 // InitelasticsearchBroker is the constructor for the elasticsearchBroker.  
@@ -58,18 +89,44 @@ func InitElasticsearchBroker(
 	taskqueue *taskqueue.QueueManager,
 	tagManager brokertags.TagManager,
 ) (base.Broker, error) {
-	logger := lager.NewLogger("aws-es-broker")
-	logger.RegisterSink(lager.NewWriterSink(os.Stdout, lager.INFO))
-
 	return &elasticsearchBroker{
 		brokerDB,
 		settings,
 		taskqueue,
-		logger,
+		newLogger(),
 		tagManager,
+		awssecrets.NewCredentialsStore(settings),
 	}, nil
 }
 
+func newLogger() lager.Logger {
+	logger := lager.NewLogger("aws-es-broker")
+	logger.RegisterSink(lager.NewWriterSink(os.Stdout, lager.INFO))
+	return logger
+}
+
+// RegisterJobHandlers lets the task queue resume deletions, snapshot restores and
+// bindings that were interrupted, e.g. by a restart of the broker process running them.
+func RegisterJobHandlers(c *catalog.Catalog, brokerDB *gorm.DB, settings *config.Settings, queue *taskqueue.QueueManager) {
+	broker := &elasticsearchBroker{
+		brokerDB:         brokerDB,
+		settings:         settings,
+		taskqueue:        queue,
+		logger:           newLogger(),
+		credentialsStore: awssecrets.NewCredentialsStore(settings),
+	}
+	queue.RegisterJobHandler(c.ElasticsearchService.ID, base.DeleteOp, func(instanceID string, jobchan chan taskqueue.AsyncJobMsg) {
+		broker.resumeDeleteInstance(c, instanceID, jobchan)
+	})
+	queue.RegisterJobHandler(c.ElasticsearchService.ID, base.CreateOp, func(instanceID string, jobchan chan taskqueue.AsyncJobMsg) {
+		broker.resumeRestoreInstance(c, instanceID, jobchan)
+	})
+	// bind jobs are keyed by the binding ID
+	queue.RegisterJobHandler(c.ElasticsearchService.ID, base.BindOp, func(bindingID string, jobchan chan taskqueue.AsyncJobMsg) {
+		broker.resumeBindInstance(c, bindingID, jobchan)
+	})
+}
+
 // initializeAdapter is the main function to create database instances
 func initializeAdapter(plan catalog.ElasticsearchPlan, s *config.Settings, logger lager.Logger) (ElasticsearchAdapter, response.Response) {
 	var elasticsearchAdapter ElasticsearchAdapter
@@ -86,6 +143,7 @@ func initializeAdapter(plan catalog.ElasticsearchPlan, s *config.Settings, logge
 		opensearch: opensearchservice.New(session.Must(session.NewSession()), aws.NewConfig().WithRegion(s.Region)),
 		iam:        iam.New(session.Must(session.NewSession()), aws.NewConfig().WithRegion(s.Region)),
 		sts:        sts.New(session.Must(session.NewSession()), aws.NewConfig().WithRegion(s.Region)),
+		s3:         s3.New(session.Must(session.NewSession()), aws.NewConfig().WithRegion(s.Region)),
 	}
 
 	return elasticsearchAdapter, nil
@@ -101,7 +159,7 @@ func (broker *elasticsearchBroker) AsyncOperationRequired(c *catalog.Catalog, i
 	case base.ModifyOp:
 		return true
 	case base.BindOp:
-		return false
+		return true
 	default:
 		return false
 	}
@@ -112,7 +170,7 @@ func (broker *elasticsearchBroker) CreateInstance(c *catalog.Catalog, id string,
 
 	options := ElasticsearchOptions{}
 	if len(createRequest.RawParameters) > 0 {
-		err := json.Unmarshal(createRequest.RawParameters, &options)
+		err := request.DecodeParameters(createRequest.RawParameters, &options)
 		if err != nil {
 			return response.NewErrorResponse(http.StatusBadRequest, "Invalid parameters. Error: "+err.Error())
 		}
@@ -177,9 +235,17 @@ func (broker *elasticsearchBroker) CreateInstance(c *catalog.Catalog, id string,
 	if adapterErr != nil {
 		return adapterErr
 	}
+
+	if options.RestoreFromInstance != "" {
+		if errResp := broker.restoreFromInstance(adapter, &newInstance, options.RestoreFromInstance); errResp != nil {
+			return errResp
+		}
+	}
+
 	// Create the elasticsearch instance.
 	status, err := adapter.createElasticsearch(&newInstance, newInstance.ClearPassword)
 	if status == base.InstanceNotCreated {
+		broker.cleanupProvision(adapter, &newInstance)
 		desc := "There was an error creating the instance."
 		if err != nil {
 			desc = desc + " Error: " + err.Error()
@@ -191,16 +257,158 @@ func (broker *elasticsearchBroker) CreateInstance(c *catalog.Catalog, id string,
 	broker.brokerDB.NewRecord(newInstance)
 	err = broker.brokerDB.Create(&newInstance).Error
 	if err != nil {
+		broker.cleanupProvision(adapter, &newInstance)
 		return response.NewErrorResponse(http.StatusBadRequest, err.Error())
 	}
+	// Keep track of the resources until the instance is saved by the manager.
+	err = base.SaveProvisionedResources(broker.brokerDB, id, createRequest.ServiceID, createRequest.PlanID, newInstance.Provisioned)
+	if err != nil {
+		broker.logger.Error("CreateInstance - unable to record the resources of instance "+id, err)
+	}
 	return response.NewAsyncOperationResponse(base.CreateOp.String())
 }
 
+// cleanupProvision tears down the resources created for an instance whose
+// provisioning failed, and records those that could not be deleted so that the
+// platform's orphan-mitigation delete can try again.
+func (broker *elasticsearchBroker) cleanupProvision(adapter ElasticsearchAdapter, i *ElasticsearchInstance) {
+	remaining, err := i.Provisioned.Teardown(adapter.deleteProvisionedResource)
+	if err != nil {
+		broker.logger.Error("cleanupProvision - instance "+i.Uuid, err)
+	}
+	if err := base.SaveProvisionedResources(broker.brokerDB, i.Uuid, i.ServiceID, i.PlanID, remaining); err != nil {
+		broker.logger.Error("cleanupProvision - unable to record the resources of instance "+i.Uuid, err)
+	}
+}
+
+// CleanupProvision tears down the recorded resources of an instance that the
+// broker did not save, e.g. when the platform deletes it to mitigate orphans,
+// along with the domain row saved by CreateInstance.
+func (broker *elasticsearchBroker) CleanupProvision(c *catalog.Catalog, id string, resources base.ProvisionedResources) response.Response {
+	if err := broker.brokerDB.Unscoped().Where("uuid = ?", id).Delete(&ElasticsearchInstance{}).Error; err != nil {
+		return response.NewErrorResponse(http.StatusInternalServerError, "Unable to delete the instance. Error: "+err.Error())
+	}
+	if len(resources) == 0 {
+		return response.SuccessDeleteResponse
+	}
+	plan, planErr := c.ElasticsearchService.FetchPlan(resources[0].PlanID)
+	if planErr != nil {
+		return planErr
+	}
+	adapter, adapterErr := initializeAdapter(plan, broker.settings, broker.logger)
+	if adapterErr != nil {
+		return adapterErr
+	}
+
+	remaining, err := resources.Teardown(adapter.deleteProvisionedResource)
+	if saveErr := base.SaveProvisionedResources(broker.brokerDB, id, resources[0].ServiceID, resources[0].PlanID, remaining); saveErr != nil {
+		return response.NewErrorResponse(http.StatusInternalServerError, "Unable to record the resources of the instance. Error: "+saveErr.Error())
+	}
+	if err != nil {
+		return response.NewErrorResponse(http.StatusInternalServerError, "There was an error deleting the resources of the instance. Error: "+err.Error())
+	}
+	return response.SuccessDeleteResponse
+}
+
+// restoreFromInstance sets up the instance to restore the last snapshot that was
+// taken when the source instance was deleted.
+func (broker *elasticsearchBroker) restoreFromInstance(adapter ElasticsearchAdapter, i *ElasticsearchInstance, sourceGUID string) response.Response {
+	var count int64
+	broker.brokerDB.Where("uuid = ?", sourceGUID).First(&ElasticsearchInstance{}).Count(&count)
+	if count != 0 {
+		return response.NewErrorResponse(http.StatusBadRequest, "Instance "+sourceGUID+" has not been deleted; only deleted instances can be restored.")
+	}
+
+	manifest, err := adapter.findSnapshotManifest(i, sourceGUID)
+	if err != nil {
+		return response.NewErrorResponse(http.StatusBadRequest, "Unable to restore instance "+sourceGUID+". Error: "+err.Error())
+	}
+	if err := i.restoreFromManifest(sourceGUID, manifest); err != nil {
+		return response.NewErrorResponse(http.StatusBadRequest, "Unable to restore instance "+sourceGUID+". Error: "+err.Error())
+	}
+	return nil
+}
+
+// restoreSnapshot starts the job restoring the last snapshot of the source instance
+// once the domain is ready, and reports the state of that job afterwards.
+func (broker *elasticsearchBroker) restoreSnapshot(adapter ElasticsearchAdapter, i *ElasticsearchInstance) base.InstanceState {
+	jobstate, err := broker.taskqueue.GetTaskState(i.ServiceID, i.Uuid, base.CreateOp)
+	if err != nil {
+		password, err := i.getPassword(broker.settings)
+		if err != nil {
+			broker.logger.Error("restoreSnapshot - unable to get instance password", err)
+			return base.InstanceNotCreated
+		}
+		// the job may have been started by another broker process in the meantime
+		jobchan, err := broker.taskqueue.RequestTaskQueue(i.ServiceID, i.Uuid, base.CreateOp)
+		if err == nil {
+			restored := *i
+			go broker.asyncRestoreInstance(adapter, &restored, password, jobchan)
+		}
+		return base.InstanceInProgress
+	}
+	broker.logger.Debug(fmt.Sprintf("Restore Job state: %s\n Message: %s\n", jobstate.State.String(), jobstate.Message))
+	if jobstate.State == base.InstanceReady {
+		i.SnapshotRestored = true
+		broker.brokerDB.Model(&ElasticsearchInstance{}).Where("uuid = ?", i.Uuid).Update("snapshot_restored", true)
+	}
+	return jobstate.State
+}
+
+// asyncRestoreInstance restores the last snapshot of the source instance in a job.
+// Restoring binds the domain and creates its snapshot role and policies, which
+// are saved even if the restore fails so that they are reused by later bindings
+// and cleaned up with the instance.
+func (broker *elasticsearchBroker) asyncRestoreInstance(adapter ElasticsearchAdapter, i *ElasticsearchInstance, password string, jobstate chan taskqueue.AsyncJobMsg) {
+	defer close(jobstate)
+
+	msg := taskqueue.AsyncJobMsg{
+		BrokerId:   i.ServiceID,
+		InstanceId: i.Uuid,
+		JobType:    base.CreateOp,
+		JobState:   taskqueue.AsyncJobState{},
+	}
+	msg.JobState.Message = fmt.Sprintf("Async RestoreOperation Started for Service Instance: %s", i.Uuid)
+	msg.JobState.State = base.InstanceInProgress
+	jobstate <- msg
+
+	restoreErr := adapter.restoreLastSnapshot(i, password)
+
+	// only the fields set by the restore are saved, since LastOperation saves
+	// the rest of the instance while the job runs
+	err := broker.brokerDB.Model(&ElasticsearchInstance{}).Where("uuid = ?", i.Uuid).Updates(map[string]interface{}{
+		"host":                     i.Host,
+		"arn":                      i.ARN,
+		"current_es_version":       i.CurrentESVersion,
+		"snapshot_path":            i.SnapshotPath,
+		"broker_snapshots_enabled": i.BrokerSnapshotsEnabled,
+		"snapshot_arn":             i.SnapshotARN,
+		"iam_pass_role_policy_arn": i.IamPassRolePolicyARN,
+		"snapshot_policy_arn":      i.SnapshotPolicyARN,
+	}).Error
+	if err != nil {
+		broker.logger.Error("asyncRestoreInstance - unable to save instance", err)
+	}
+
+	if restoreErr != nil {
+		desc := fmt.Sprintf("asyncRestore - \n\t restoreLastSnapshot returned error: %v\n", restoreErr)
+		broker.logger.Error("asyncRestoreInstance - unable to restore snapshot", restoreErr)
+		msg.JobState.State = base.InstanceNotCreated
+		msg.JobState.Message = desc
+		jobstate <- msg
+		return
+	}
+
+	msg.JobState.Message = fmt.Sprintf("Async RestoreOperation Completed for Service Instance: %s", i.Uuid)
+	msg.JobState.State = base.InstanceReady
+	jobstate <- msg
+}
+
 func (broker *elasticsearchBroker) ModifyInstance(c *catalog.Catalog, id string, updateRequest request.Request, baseInstance base.Instance) response.Response {
 	esInstance := ElasticsearchInstance{}
 	options := ElasticsearchOptions{}
 	if len(updateRequest.RawParameters) > 0 {
-		err := json.Unmarshal(updateRequest.RawParameters, &options)
+		err := request.DecodeParameters(updateRequest.RawParameters, &options)
 		if err != nil {
 			return response.NewErrorResponse(http.StatusBadRequest, "Invalid parameters. Error: "+err.Error())
 		}
@@ -227,6 +435,9 @@ func (broker *elasticsearchBroker) ModifyInstance(c *catalog.Catalog, id string,
 	if esInstance.PlanID != updateRequest.PlanID {
 		return response.NewErrorResponse(http.StatusBadRequest, "Updating Elasticsearch service instances is not supported at this time.")
 	}
+	if options.Snapshot != "" {
+		return broker.createSnapshot(adapter, &esInstance, options.Snapshot)
+	}
 	err := esInstance.update(options)
 	if err != nil {
 		broker.logger.Error("Updating instance failed", err)
@@ -246,6 +457,56 @@ func (broker *elasticsearchBroker) ModifyInstance(c *catalog.Catalog, id string,
 	return response.NewAsyncOperationResponse(base.ModifyOp.String())
 }
 
+// createSnapshot takes a snapshot requested by the user into the broker snapshot repo
+// of the instance. No other change is made to the instance by the same request.
+func (broker *elasticsearchBroker) createSnapshot(adapter ElasticsearchAdapter, i *ElasticsearchInstance, name string) response.Response {
+	if i.PendingSnapshot != "" {
+		return response.NewErrorResponse(http.StatusBadRequest, "Snapshot "+i.PendingSnapshot+" is still in progress.")
+	}
+	password, err := i.getPassword(broker.settings)
+	if err != nil {
+		return response.NewErrorResponse(http.StatusInternalServerError, "Unable to get instance password.")
+	}
+
+	status, err := adapter.createSnapshot(i, password, name)
+	if status != base.InstanceInProgress {
+		desc := "There was an error taking the snapshot."
+		if err != nil {
+			desc = desc + " Error: " + err.Error()
+		}
+		return response.NewErrorResponse(http.StatusBadRequest, desc)
+	}
+
+	i.PendingSnapshot = name
+	err = broker.brokerDB.Save(i).Error
+	if err != nil {
+		broker.logger.Error("Saving instance failed", err)
+		return response.NewErrorResponse(http.StatusBadRequest, "Error saving updated Elasticsearch service instance")
+	}
+	return response.NewAsyncOperationResponse(base.ModifyOp.String())
+}
+
+// checkSnapshot reports the progress of the snapshot requested by the user.
+func (broker *elasticsearchBroker) checkSnapshot(adapter ElasticsearchAdapter, i *ElasticsearchInstance) base.InstanceState {
+	password, err := i.getPassword(broker.settings)
+	if err != nil {
+		broker.logger.Error("checkSnapshot - unable to get instance password", err)
+		return base.InstanceNotModified
+	}
+
+	status, err := adapter.checkSnapshotStatus(i, password, i.PendingSnapshot)
+	if err != nil {
+		broker.logger.Error("checkSnapshot - snapshot "+i.PendingSnapshot+" failed", err)
+	}
+	if status == base.InstanceReady {
+		i.Snapshots = append(i.Snapshots, i.PendingSnapshot)
+	}
+	if status != base.InstanceInProgress {
+		i.PendingSnapshot = ""
+	}
+	return status
+}
+
 func (broker *elasticsearchBroker) LastOperation(c *catalog.Catalog, id string, baseInstance base.Instance, operation string) response.Response {
 	existingInstance := ElasticsearchInstance{}
 
@@ -268,8 +529,8 @@ func (broker *elasticsearchBroker) LastOperation(c *catalog.Catalog, id string,
 	var state string
 	var status base.InstanceState
 
-	switch operation {
-	case base.DeleteOp.String(): // delete is true concurrent operation
+	switch {
+	case operation == base.DeleteOp.String(): // delete is true concurrent operation
 		jobstate, err := broker.taskqueue.GetTaskState(existingInstance.ServiceID, existingInstance.Uuid, base.DeleteOp)
 		if err != nil {
 			jobstate.State = base.InstanceNotGone //indicate a failure
@@ -277,9 +538,18 @@ func (broker *elasticsearchBroker) LastOperation(c *catalog.Catalog, id string,
 		status = jobstate.State
 		broker.logger.Debug(fmt.Sprintf("Deletion Job state: %s\n Message: %s\n", jobstate.State.String(), jobstate.Message))
 
+	case operation == base.ModifyOp.String() && existingInstance.PendingSnapshot != "":
+		status = broker.checkSnapshot(adapter, &existingInstance)
+		broker.brokerDB.Save(&existingInstance)
+
 	default: //all other ops use synchronous checking of aws api
 		status, _ = adapter.checkElasticsearchStatus(&existingInstance)
-		broker.brokerDB.Save(&existingInstance)
+		if status == base.InstanceReady && existingInstance.restorePending() {
+			// the restore job saves the instance itself
+			status = broker.restoreSnapshot(adapter, &existingInstance)
+		} else {
+			broker.brokerDB.Save(&existingInstance)
+		}
 
 	}
 
@@ -292,10 +562,13 @@ func (broker *elasticsearchBroker) LastOperation(c *catalog.Catalog, id string,
 		state = "failed"
 	case base.InstanceGone:
 		state = "succeeded"
+		broker.deleteBindings(id)
 		broker.brokerDB.Unscoped().Delete(&existingInstance)
 		broker.brokerDB.Unscoped().Delete(&baseInstance)
 	case base.InstanceNotGone:
 		state = "failed"
+	case base.InstanceNotModified:
+		state = "failed"
 	default:
 		state = "in progress"
 	}
@@ -304,16 +577,15 @@ func (broker *elasticsearchBroker) LastOperation(c *catalog.Catalog, id string,
 	return response.NewSuccessLastOperation(state, "The service instance status is "+state)
 }
 
-func (broker *elasticsearchBroker) BindInstance(c *catalog.Catalog, id string, bindRequest request.Request, baseInstance base.Instance) response.Response {
+// BindInstance sets up the IAM roles and policies the instance needs in a bind job
+// and reports the binding as in progress. The credentials of the binding are
+// fetched once the job has finished.
+func (broker *elasticsearchBroker) BindInstance(c *catalog.Catalog, id string, bindingID string, bindRequest request.Request, baseInstance base.Instance) response.Response {
 	existingInstance := ElasticsearchInstance{}
 
-	options := ElasticsearchOptions{}
+	options := ElasticsearchBindOptions{}
 	if len(bindRequest.RawParameters) > 0 {
-		err := json.Unmarshal(bindRequest.RawParameters, &options)
-		if err != nil {
-			return response.NewErrorResponse(http.StatusBadRequest, "Invalid parameters. Error: "+err.Error())
-		}
-		err = options.Validate(broker.settings)
+		err := request.DecodeParameters(bindRequest.RawParameters, &options)
 		if err != nil {
 			return response.NewErrorResponse(http.StatusBadRequest, "Invalid parameters. Error: "+err.Error())
 		}
@@ -325,12 +597,35 @@ func (broker *elasticsearchBroker) BindInstance(c *catalog.Catalog, id string, b
 		return response.NewErrorResponse(http.StatusNotFound, "Instance not found")
 	}
 
+	binding := ElasticsearchBinding{}
+	var bindingCount int64
+	broker.brokerDB.Where("binding_id = ?", bindingID).First(&binding).Count(&bindingCount)
+	if bindingCount != 0 {
+		if binding.InstanceUuid != id {
+			return response.NewErrorResponse(http.StatusConflict, "The binding already exists for another instance")
+		}
+		switch binding.State {
+		case base.InstanceInProgress:
+			return response.NewAsyncOperationResponse(base.BindOp.String())
+		case base.InstanceReady:
+			return broker.FetchBinding(c, id, bindingID, baseInstance)
+		}
+		// a failed binding is attempted again
+	} else {
+		binding = ElasticsearchBinding{
+			BindingID:    bindingID,
+			InstanceUuid: id,
+		}
+	}
+	binding.Bucket = options.Bucket
+	binding.State = base.InstanceInProgress
+
 	plan, planErr := c.ElasticsearchService.FetchPlan(baseInstance.PlanID)
 	if planErr != nil {
 		return planErr
 	}
 
-	password, err := existingInstance.getPassword(broker.settings.EncryptionKey)
+	password, err := existingInstance.getPassword(broker.settings)
 	if err != nil {
 		return response.NewErrorResponse(http.StatusInternalServerError, "Unable to get instance password.")
 	}
@@ -341,19 +636,283 @@ func (broker *elasticsearchBroker) BindInstance(c *catalog.Catalog, id string, b
 		return adapterErr
 	}
 
-	var credentials map[string]string
-	// Bind the database instance to the application.
-	existingInstance.setBucket(options.Bucket)
-	if credentials, err = adapter.bindElasticsearchToApp(&existingInstance, password); err != nil {
-		desc := "There was an error binding the database instance to the application."
-		if err != nil {
-			desc = desc + " Error: " + err.Error()
+	jobchan, err := broker.taskqueue.RequestTaskQueue(existingInstance.ServiceID, bindingID, base.BindOp)
+	if err != nil {
+		return response.NewErrorResponse(http.StatusBadRequest, "There was an error binding the instance to the application. Error: "+err.Error())
+	}
+	if err := broker.brokerDB.Save(&binding).Error; err != nil {
+		close(jobchan)
+		return response.NewErrorResponse(http.StatusInternalServerError, "Unable to save binding. Error: "+err.Error())
+	}
+
+	go broker.asyncBindInstance(c, adapter, &existingInstance, &binding, password, jobchan)
+	return response.NewAsyncOperationResponse(base.BindOp.String())
+}
+
+// asyncBindInstance binds the instance to the application, stores the
+// credentials of the binding and persists the resulting state of the instance
+// and the binding, which the job state outlives.
+func (broker *elasticsearchBroker) asyncBindInstance(c *catalog.Catalog, adapter ElasticsearchAdapter, i *ElasticsearchInstance, b *ElasticsearchBinding, password string, jobstate chan taskqueue.AsyncJobMsg) {
+	defer close(jobstate)
+
+	msg := taskqueue.AsyncJobMsg{
+		BrokerId:   i.ServiceID,
+		InstanceId: b.BindingID,
+		JobType:    base.BindOp,
+		JobState:   taskqueue.AsyncJobState{},
+	}
+	msg.JobState.Message = fmt.Sprintf("Async BindOperation Started for Service Binding: %s", b.BindingID)
+	msg.JobState.State = base.InstanceInProgress
+	jobstate <- msg
+
+	i.setBucket(b.Bucket)
+	if _, err := adapter.bindElasticsearchToApp(i, password); err != nil {
+		desc := fmt.Sprintf("asyncBind - \n\t bindElasticsearchToApp returned error: %v\n", err)
+		broker.logger.Error("asyncBindInstance - unable to bind instance", err)
+		b.State = base.InstanceNotCreated
+		broker.brokerDB.Save(b)
+		msg.JobState.State = base.InstanceNotCreated
+		msg.JobState.Message = desc
+		jobstate <- msg
+		return
+	}
+
+	broker.brokerDB.Save(i)
+	credentials, err := i.getCredentials(password, broker.settings)
+	if err == nil {
+		err = broker.storeCredentials(c, i, b, credentials)
+	}
+	if err != nil {
+		broker.logger.Error("asyncBindInstance - unable to store credentials", err)
+		b.State = base.InstanceNotCreated
+		broker.brokerDB.Save(b)
+		msg.JobState.State = base.InstanceNotCreated
+		msg.JobState.Message = fmt.Sprintf("asyncBind - \n\t unable to store the credentials: %v\n", err)
+		jobstate <- msg
+		return
+	}
+
+	b.State = base.InstanceReady
+	broker.brokerDB.Save(b)
+	msg.JobState.Message = fmt.Sprintf("Async BindOperation Completed for Service Binding: %s", b.BindingID)
+	msg.JobState.State = base.InstanceReady
+	jobstate <- msg
+}
+
+// BindingLastOperation reports the state of the bind job of a binding.
+func (broker *elasticsearchBroker) BindingLastOperation(c *catalog.Catalog, id string, bindingID string, baseInstance base.Instance, operation string) response.Response {
+	binding := ElasticsearchBinding{}
+
+	var count int64
+	broker.brokerDB.Where("binding_id = ? AND instance_uuid = ?", bindingID, id).First(&binding).Count(&count)
+	if count == 0 {
+		return response.NewErrorResponse(http.StatusNotFound, "Binding not found")
+	}
+
+	// the job state is cleaned up a while after the job finished
+	status := binding.State
+	jobstate, err := broker.taskqueue.GetTaskState(baseInstance.ServiceID, bindingID, base.BindOp)
+	if err == nil {
+		status = jobstate.State
+		broker.logger.Debug(fmt.Sprintf("Bind Job state: %s\n Message: %s\n", jobstate.State.String(), jobstate.Message))
+	}
+
+	var state string
+	switch status {
+	case base.InstanceReady:
+		state = "succeeded"
+	case base.InstanceNotCreated:
+		state = "failed"
+	default:
+		state = "in progress"
+	}
+	return response.NewSuccessLastOperation(state, "The service binding status is "+state)
+}
+
+// FetchBinding returns the instance credentials, which all bindings share, once
+// the bind job of the binding has succeeded.
+func (broker *elasticsearchBroker) FetchBinding(c *catalog.Catalog, id string, bindingID string, baseInstance base.Instance) response.Response {
+	existingInstance := ElasticsearchInstance{}
+
+	var count int64
+	broker.brokerDB.Where("uuid = ?", id).First(&existingInstance).Count(&count)
+	if count == 0 {
+		return response.NewErrorResponse(http.StatusNotFound, "Instance not found")
+	}
+
+	binding := ElasticsearchBinding{}
+	var bindingCount int64
+	broker.brokerDB.Where("binding_id = ? AND instance_uuid = ?", bindingID, id).First(&binding).Count(&bindingCount)
+	if bindingCount == 0 || binding.State != base.InstanceReady {
+		return response.NewErrorResponse(http.StatusNotFound, "Binding not found")
+	}
+
+	password, err := existingInstance.getPassword(broker.settings)
+	if err != nil {
+		return response.NewErrorResponse(http.StatusInternalServerError, "Unable to get instance password.")
+	}
+	credentials, err := existingInstance.getCredentials(password, broker.settings)
+	if err != nil {
+		return response.NewErrorResponse(http.StatusInternalServerError, "Unable to get instance credentials.")
+	}
+	if binding.CredentialsSecretARN != "" {
+		credentials[awssecrets.SecretARNKey] = binding.CredentialsSecretARN
+	}
+	return response.NewSuccessFetchBindingResponse(credentials)
+}
+
+// storeCredentials writes the credentials of a binding to Secrets Manager, when
+// credentials are stored there, and adds the ARN of the secret to them.
+func (broker *elasticsearchBroker) storeCredentials(c *catalog.Catalog, i *ElasticsearchInstance, b *ElasticsearchBinding, credentials map[string]string) error {
+	if b.CredentialsSecretARN != "" {
+		credentials[awssecrets.SecretARNKey] = b.CredentialsSecretARN
+		return nil
+	}
+	if broker.credentialsStore == nil {
+		return nil
+	}
+
+	plan, planErr := c.ElasticsearchService.FetchPlan(i.PlanID)
+	if planErr != nil {
+		return fmt.Errorf("unable to find plan %s", i.PlanID)
+	}
+	tags, err := broker.tagManager.GenerateTags(
+		brokertags.Create,
+		c.ElasticsearchService.Name,
+		plan.Name,
+		brokertags.ResourceGUIDs{
+			InstanceGUID:     i.Uuid,
+			SpaceGUID:        i.SpaceGUID,
+			OrganizationGUID: i.OrganizationGUID,
+		},
+		false,
+	)
+	if err != nil {
+		return err
+	}
+	name := awssecrets.CredentialsSecretName(c.ElasticsearchService.Name, i.Uuid, b.BindingID)
+	if err := awssecrets.StoreCredentials(broker.credentialsStore, name, credentials, tags); err != nil {
+		return err
+	}
+	b.CredentialsSecretARN = credentials[awssecrets.SecretARNKey]
+	return broker.brokerDB.Save(b).Error
+}
+
+// FetchInstance returns the plan and the settings applied to the instance, and
+// the dashboards of the domain.
+func (broker *elasticsearchBroker) FetchInstance(c *catalog.Catalog, id string, baseInstance base.Instance) response.Response {
+	existingInstance := ElasticsearchInstance{}
+
+	var count int64
+	broker.brokerDB.Where("uuid = ?", id).First(&existingInstance).Count(&count)
+	if count == 0 {
+		return response.NewErrorResponse(http.StatusNotFound, "Instance not found")
+	}
+	return response.NewSuccessFetchInstanceResponse(existingInstance.ServiceID, existingInstance.PlanID, existingInstance.dashboardURL(), existingInstance.parameters())
+}
+
+// UnbindInstance has nothing to revoke since all bindings share the instance
+// credentials, so it only forgets the binding.
+func (broker *elasticsearchBroker) UnbindInstance(c *catalog.Catalog, id string, bindingID string, baseInstance base.Instance) response.Response {
+	bindings := []ElasticsearchBinding{}
+	broker.brokerDB.Where("binding_id = ? AND instance_uuid = ?", bindingID, id).Find(&bindings)
+	if err := broker.deleteCredentialsSecrets(bindings); err != nil {
+		return response.NewErrorResponse(http.StatusInternalServerError, "There was an error deleting the stored credentials. Error: "+err.Error())
+	}
+	broker.brokerDB.Unscoped().Where("binding_id = ? AND instance_uuid = ?", bindingID, id).Delete(ElasticsearchBinding{})
+	return response.SuccessUnbindResponse
+}
+
+// deleteCredentialsSecrets deletes the secrets holding the credentials of the
+// bindings.
+func (broker *elasticsearchBroker) deleteCredentialsSecrets(bindings []ElasticsearchBinding) error {
+	if broker.credentialsStore == nil {
+		return nil
+	}
+	for _, b := range bindings {
+		if b.CredentialsSecretARN == "" {
+			continue
 		}
-		return response.NewErrorResponse(http.StatusBadRequest, desc)
+		if err := broker.credentialsStore.DeleteCredentials(b.CredentialsSecretARN); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadJobInstance loads what a resumed job needs to run for an instance.
+func (broker *elasticsearchBroker) loadJobInstance(c *catalog.Catalog, id string) (*ElasticsearchInstance, string, ElasticsearchAdapter, error) {
+	existingInstance := ElasticsearchInstance{}
+	if err := broker.brokerDB.Where("uuid = ?", id).First(&existingInstance).Error; err != nil {
+		return nil, "", nil, fmt.Errorf("unable to find instance %s: %s", id, err)
+	}
+
+	plan, planErr := c.ElasticsearchService.FetchPlan(existingInstance.PlanID)
+	if planErr != nil {
+		return nil, "", nil, fmt.Errorf("unable to find plan %s for instance %s", existingInstance.PlanID, id)
+	}
+	password, err := existingInstance.getPassword(broker.settings)
+	if err != nil {
+		return nil, "", nil, fmt.Errorf("unable to get password for instance %s", id)
 	}
 
-	broker.brokerDB.Save(&existingInstance)
-	return response.NewSuccessBindResponse(credentials)
+	adapter, adapterErr := initializeAdapter(plan, broker.settings, broker.logger)
+	if adapterErr != nil {
+		return nil, "", nil, fmt.Errorf("unable to initialize adapter for instance %s", id)
+	}
+	return &existingInstance, password, adapter, nil
+}
+
+// failJob reports a job that could not be resumed as failed.
+func (broker *elasticsearchBroker) failJob(c *catalog.Catalog, id string, operation base.Operation, state base.InstanceState, desc string, jobchan chan taskqueue.AsyncJobMsg) {
+	broker.logger.Info(desc)
+	jobchan <- taskqueue.AsyncJobMsg{
+		BrokerId:   c.ElasticsearchService.ID,
+		InstanceId: id,
+		JobType:    operation,
+		JobState: taskqueue.AsyncJobState{
+			State:   state,
+			Message: desc,
+		},
+	}
+	close(jobchan)
+}
+
+// resumeDeleteInstance restarts the async deletion of an instance from the beginning.
+func (broker *elasticsearchBroker) resumeDeleteInstance(c *catalog.Catalog, id string, jobchan chan taskqueue.AsyncJobMsg) {
+	existingInstance, password, adapter, err := broker.loadJobInstance(c, id)
+	if err != nil {
+		broker.failJob(c, id, base.DeleteOp, base.InstanceNotGone, "resumeDeleteInstance - "+err.Error(), jobchan)
+		return
+	}
+	adapter.asyncDeleteElasticSearchDomain(existingInstance, password, jobchan)
+}
+
+// resumeBindInstance restarts the bind job of a binding from the beginning.
+func (broker *elasticsearchBroker) resumeBindInstance(c *catalog.Catalog, bindingID string, jobchan chan taskqueue.AsyncJobMsg) {
+	binding := ElasticsearchBinding{}
+	if err := broker.brokerDB.Where("binding_id = ?", bindingID).First(&binding).Error; err != nil {
+		broker.failJob(c, bindingID, base.BindOp, base.InstanceNotCreated, fmt.Sprintf("resumeBindInstance - unable to find binding %s: %s", bindingID, err), jobchan)
+		return
+	}
+	existingInstance, password, adapter, err := broker.loadJobInstance(c, binding.InstanceUuid)
+	if err != nil {
+		binding.State = base.InstanceNotCreated
+		broker.brokerDB.Save(&binding)
+		broker.failJob(c, bindingID, base.BindOp, base.InstanceNotCreated, "resumeBindInstance - "+err.Error(), jobchan)
+		return
+	}
+	broker.asyncBindInstance(c, adapter, existingInstance, &binding, password, jobchan)
+}
+
+// resumeRestoreInstance restarts the restore of the last snapshot of the source instance.
+func (broker *elasticsearchBroker) resumeRestoreInstance(c *catalog.Catalog, id string, jobchan chan taskqueue.AsyncJobMsg) {
+	existingInstance, password, adapter, err := broker.loadJobInstance(c, id)
+	if err != nil {
+		broker.failJob(c, id, base.CreateOp, base.InstanceNotCreated, "resumeRestoreInstance - "+err.Error(), jobchan)
+		return
+	}
+	broker.asyncRestoreInstance(adapter, existingInstance, password, jobchan)
 }
 
 func (broker *elasticsearchBroker) DeleteInstance(c *catalog.Catalog, id string, baseInstance base.Instance) response.Response {
@@ -368,7 +927,7 @@ func (broker *elasticsearchBroker) DeleteInstance(c *catalog.Catalog, id string,
 	if planErr != nil {
 		return planErr
 	}
-	password, err := existingInstance.getPassword(broker.settings.EncryptionKey)
+	password, err := existingInstance.getPassword(broker.settings)
 	if err != nil {
 		return response.NewErrorResponse(http.StatusInternalServerError, "Unable to get instance password.")
 	}
@@ -382,6 +941,7 @@ func (broker *elasticsearchBroker) DeleteInstance(c *catalog.Catalog, id string,
 	status, err := adapter.deleteElasticsearch(&existingInstance, password, broker.taskqueue)
 	switch status {
 	case base.InstanceGone: // somehow the instance is gone already
+		broker.deleteBindings(id)
 		broker.brokerDB.Unscoped().Delete(&existingInstance)
 		broker.brokerDB.Unscoped().Delete(&baseInstance)
 		return response.SuccessDeleteResponse
@@ -399,3 +959,14 @@ func (broker *elasticsearchBroker) DeleteInstance(c *catalog.Catalog, id string,
 	}
 
 }
+
+// deleteBindings forgets the bindings of an instance that is gone, along with
+// their stored credentials.
+func (broker *elasticsearchBroker) deleteBindings(id string) {
+	bindings := []ElasticsearchBinding{}
+	broker.brokerDB.Where("instance_uuid = ?", id).Find(&bindings)
+	if err := broker.deleteCredentialsSecrets(bindings); err != nil {
+		broker.logger.Error("deleteBindings - unable to delete stored credentials", err)
+	}
+	broker.brokerDB.Unscoped().Where("instance_uuid = ?", id).Delete(ElasticsearchBinding{})
+}
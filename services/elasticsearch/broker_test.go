@@ -26,6 +26,15 @@ func TestValidate(t *testing.T) {
 			settings:    &config.Settings{},
 			expectedErr: true,
 		},
+		"reserved snapshot name": {
+			options: ElasticsearchOptions{
+				Snapshot: "cg-last-snapshot",
+			},
+			settings: &config.Settings{
+				LastSnapshotName: "cg-last-snapshot",
+			},
+			expectedErr: true,
+		},
 	}
 
 	for name, test := range testCases {
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"log"
+	"strings"
 	"time"
 
 	"code.cloudfoundry.org/lager"
@@ -20,6 +21,7 @@ import (
 	"github.com/aws/aws-sdk-go/service/opensearchservice"
 	"github.com/aws/aws-sdk-go/service/opensearchservice/opensearchserviceiface"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/aws/aws-sdk-go/service/sts/stsiface"
 
@@ -35,16 +37,38 @@ type ElasticsearchAdapter interface {
 	checkElasticsearchStatus(i *ElasticsearchInstance) (base.InstanceState, error)
 	bindElasticsearchToApp(i *ElasticsearchInstance, password string) (map[string]string, error)
 	deleteElasticsearch(i *ElasticsearchInstance, passoword string, queue *taskqueue.QueueManager) (base.InstanceState, error)
+	asyncDeleteElasticSearchDomain(i *ElasticsearchInstance, password string, jobstate chan taskqueue.AsyncJobMsg)
+	findSnapshotManifest(i *ElasticsearchInstance, sourceGUID string) (*ElasticsearchInstance, error)
+	restoreLastSnapshot(i *ElasticsearchInstance, password string) error
+	createSnapshot(i *ElasticsearchInstance, password string, name string) (base.InstanceState, error)
+	checkSnapshotStatus(i *ElasticsearchInstance, password string, name string) (base.InstanceState, error)
+	deleteProvisionedResource(r base.ProvisionedResource) error
 }
 
+// The types of the resources recorded while provisioning instances.
+const (
+	iamUserResource                 = "iam-user"
+	iamAccessKeyResource            = "iam-access-key"
+	iamPolicyResource               = "iam-policy"
+	iamUserPolicyAttachmentResource = "iam-user-policy-attachment"
+	iamRoleResource                 = "iam-role"
+	iamRolePolicyAttachmentResource = "iam-role-policy-attachment"
+	domainResource                  = "opensearch-domain"
+)
+
 type mockElasticsearchAdapter struct {
 }
 
 func (d *mockElasticsearchAdapter) createElasticsearch(i *ElasticsearchInstance, password string) (base.InstanceState, error) {
 	// TODO
+	i.Provisioned.Add(domainResource, i.Domain, "")
 	return base.InstanceReady, nil
 }
 
+func (d *mockElasticsearchAdapter) deleteProvisionedResource(r base.ProvisionedResource) error {
+	return nil
+}
+
 func (d *mockElasticsearchAdapter) modifyElasticsearch(i *ElasticsearchInstance) (base.InstanceState, error) {
 	// TODO
 	return base.InstanceReady, nil
@@ -57,7 +81,7 @@ func (d *mockElasticsearchAdapter) checkElasticsearchStatus(i *ElasticsearchInst
 
 func (d *mockElasticsearchAdapter) bindElasticsearchToApp(i *ElasticsearchInstance, password string) (map[string]string, error) {
 	// TODO
-	return i.getCredentials(password)
+	return i.getCredentials(password, &config.Settings{})
 }
 
 func (d *mockElasticsearchAdapter) deleteElasticsearch(i *ElasticsearchInstance, password string, queue *taskqueue.QueueManager) (base.InstanceState, error) {
@@ -65,6 +89,40 @@ func (d *mockElasticsearchAdapter) deleteElasticsearch(i *ElasticsearchInstance,
 	return base.InstanceGone, nil
 }
 
+func (d *mockElasticsearchAdapter) asyncDeleteElasticSearchDomain(i *ElasticsearchInstance, password string, jobstate chan taskqueue.AsyncJobMsg) {
+	defer close(jobstate)
+
+	jobstate <- taskqueue.AsyncJobMsg{
+		BrokerId:   i.ServiceID,
+		InstanceId: i.Uuid,
+		JobType:    base.DeleteOp,
+		JobState: taskqueue.AsyncJobState{
+			State:   base.InstanceGone,
+			Message: fmt.Sprintf("Async DeleteOperation Completed for Service Instance: %s", i.Uuid),
+		},
+	}
+}
+
+func (d *mockElasticsearchAdapter) findSnapshotManifest(i *ElasticsearchInstance, sourceGUID string) (*ElasticsearchInstance, error) {
+	manifest := &ElasticsearchInstance{}
+	manifest.Uuid = sourceGUID
+	return manifest, nil
+}
+
+func (d *mockElasticsearchAdapter) restoreLastSnapshot(i *ElasticsearchInstance, password string) error {
+	// the snapshot role is created while restoring
+	i.SnapshotARN = "mock-snapshot-role-arn"
+	return nil
+}
+
+func (d *mockElasticsearchAdapter) createSnapshot(i *ElasticsearchInstance, password string, name string) (base.InstanceState, error) {
+	return base.InstanceInProgress, nil
+}
+
+func (d *mockElasticsearchAdapter) checkSnapshotStatus(i *ElasticsearchInstance, password string, name string) (base.InstanceState, error) {
+	return base.InstanceReady, nil
+}
+
 type dedicatedElasticsearchAdapter struct {
 	Plan       catalog.ElasticsearchPlan
 	settings   config.Settings
@@ -72,6 +130,7 @@ type dedicatedElasticsearchAdapter struct {
 	iam        iamiface.IAMAPI
 	sts        stsiface.STSAPI
 	opensearch opensearchserviceiface.OpenSearchServiceAPI
+	s3         s3iface.S3API
 }
 
 // This is the prefix for all pgroups created by the broker.
@@ -88,12 +147,15 @@ func (d *dedicatedElasticsearchAdapter) createElasticsearch(i *ElasticsearchInst
 		fmt.Println(err.Error())
 		return base.InstanceNotCreated, err
 	}
+	i.Provisioned.Add(iamUserResource, i.Domain, "")
 	accessKeyID, secretAccessKey, err := user.CreateAccessKey(i.Domain)
 	if err != nil {
 		return base.InstanceNotCreated, err
 	}
-	i.AccessKey = accessKeyID
-	i.SecretKey = secretAccessKey
+	i.Provisioned.Add(iamAccessKeyResource, accessKeyID, i.Domain)
+	if err := i.setAccessKeys(accessKeyID, secretAccessKey, &d.settings); err != nil {
+		return base.InstanceNotCreated, err
+	}
 
 	userParams := &iam.GetUserInput{
 		UserName: aws.String(i.Domain),
@@ -138,6 +200,7 @@ func (d *dedicatedElasticsearchAdapter) createElasticsearch(i *ElasticsearchInst
 
 	// Decide if AWS service call was successful
 	if yes := d.didAwsCallSucceed(err); yes {
+		i.Provisioned.Add(domainResource, i.Domain, "")
 		i.ARN = *(resp.DomainStatus.ARN)
 		esARNs := make([]string, 0)
 		esARNs = append(esARNs, i.ARN)
@@ -146,10 +209,12 @@ func (d *dedicatedElasticsearchAdapter) createElasticsearch(i *ElasticsearchInst
 		if err != nil {
 			return base.InstanceNotCreated, err
 		}
+		i.Provisioned.Add(iamPolicyResource, policyARN, "")
 
 		if err = user.AttachUserPolicy(i.Domain, policyARN); err != nil {
 			return base.InstanceNotCreated, err
 		}
+		i.Provisioned.Add(iamUserPolicyAttachmentResource, policyARN, i.Domain)
 		i.IamPolicy = policy
 		i.IamPolicyARN = policyARN
 
@@ -242,7 +307,7 @@ func (d *dedicatedElasticsearchAdapter) bindElasticsearchToApp(i *ElasticsearchI
 		}
 	}
 	// If we get here that means the instance is up and we have the information for it.
-	return i.getCredentials(password)
+	return i.getCredentials(password, &d.settings)
 }
 
 // we make the deletion async, set status to in-progress and rollup to return a 202
@@ -362,6 +427,7 @@ func (d *dedicatedElasticsearchAdapter) createUpdateBucketRolesAndPolicies(
 
 		i.SnapshotARN = *arole.Arn
 		snapshotRole = arole
+		i.Provisioned.Add(iamRoleResource, rolename, "")
 
 	}
 
@@ -376,6 +442,8 @@ func (d *dedicatedElasticsearchAdapter) createUpdateBucketRolesAndPolicies(
 			return err
 		}
 		i.IamPassRolePolicyARN = policyarn
+		i.Provisioned.Add(iamPolicyResource, policyarn, "")
+		i.Provisioned.Add(iamUserPolicyAttachmentResource, policyarn, username)
 	}
 
 	// Create PolicyDoc Statements
@@ -416,6 +484,8 @@ func (d *dedicatedElasticsearchAdapter) createUpdateBucketRolesAndPolicies(
 			return err
 		}
 		i.SnapshotPolicyARN = policyarn
+		i.Provisioned.Add(iamPolicyResource, policyarn, "")
+		i.Provisioned.Add(iamRolePolicyAttachmentResource, policyarn, *snapshotRole.RoleName)
 
 	} else {
 		// snaphost policy has already been created so we need to add the new statements for this new bucket
@@ -494,6 +564,36 @@ func (d *dedicatedElasticsearchAdapter) asyncDeleteElasticSearchDomain(i *Elasti
 func (d *dedicatedElasticsearchAdapter) takeLastSnapshot(i *ElasticsearchInstance, password string) error {
 
 	var sleep = 10 * time.Second
+
+	esApi, err := d.brokerSnapshotRepo(i, password)
+	if err != nil {
+		return err
+	}
+
+	// create snapshot
+	_, err = esApi.CreateSnapshot(d.settings.SnapshotsRepoName, d.settings.LastSnapshotName)
+	if err != nil {
+		d.logger.Error("CreateSnapshot returns error", err)
+		return err
+	}
+
+	// poll for snapshot completion and continue once no longer "IN_PROGRESS"
+	for {
+		res, err := esApi.GetSnapshotStatus(d.settings.SnapshotsRepoName, d.settings.LastSnapshotName)
+		if err != nil {
+			d.logger.Error("GetSnapShotStatus failed", err)
+			return err
+		}
+		if res != "IN_PROGRESS" {
+			break
+		}
+		time.Sleep(sleep)
+	}
+	return nil
+}
+
+// in which we register the broker snapshot repo of the domain and return an api handler to use it
+func (d *dedicatedElasticsearchAdapter) brokerSnapshotRepo(i *ElasticsearchInstance, password string) (*EsApiHandler, error) {
 	var creds map[string]string
 	var err error
 
@@ -502,13 +602,13 @@ func (d *dedicatedElasticsearchAdapter) takeLastSnapshot(i *ElasticsearchInstanc
 		creds, err = d.bindElasticsearchToApp(i, password)
 		if err != nil {
 			fmt.Println(err)
-			return err
+			return nil, err
 		}
 	} else {
-		creds, err = i.getCredentials(password)
+		creds, err = i.getCredentials(password, &d.settings)
 		if err != nil {
 			fmt.Println(err)
-			return err
+			return nil, err
 		}
 	}
 
@@ -521,7 +621,7 @@ func (d *dedicatedElasticsearchAdapter) takeLastSnapshot(i *ElasticsearchInstanc
 		err := d.createUpdateBucketRolesAndPolicies(i, d.settings.SnapshotsBucketName, i.SnapshotPath, iamTags)
 		if err != nil {
 			d.logger.Error("bindElasticsearchToApp - Error in createUpdateRolesAndPolicies", err)
-			return err
+			return nil, err
 		}
 		i.BrokerSnapshotsEnabled = true
 	}
@@ -540,29 +640,151 @@ func (d *dedicatedElasticsearchAdapter) takeLastSnapshot(i *ElasticsearchInstanc
 	)
 	if err != nil {
 		d.logger.Error("createsnapshotrepo returns error", err)
-		return err
+		return nil, err
 	}
+	return esApi, nil
+}
 
-	// create snapshot
-	_, err = esApi.CreateSnapshot(d.settings.SnapshotsRepoName, d.settings.LastSnapshotName)
+// in which we start a snapshot requested by the user, its progress is checked by checkSnapshotStatus
+func (d *dedicatedElasticsearchAdapter) createSnapshot(i *ElasticsearchInstance, password string, name string) (base.InstanceState, error) {
+	esApi, err := d.brokerSnapshotRepo(i, password)
+	if err != nil {
+		return base.InstanceNotModified, err
+	}
+	_, err = esApi.CreateSnapshot(d.settings.SnapshotsRepoName, name)
 	if err != nil {
 		d.logger.Error("CreateSnapshot returns error", err)
+		return base.InstanceNotModified, err
+	}
+	return base.InstanceInProgress, nil
+}
+
+func (d *dedicatedElasticsearchAdapter) checkSnapshotStatus(i *ElasticsearchInstance, password string, name string) (base.InstanceState, error) {
+	creds, err := i.getCredentials(password, &d.settings)
+	if err != nil {
+		return base.InstanceNotModified, err
+	}
+	esApi := &EsApiHandler{}
+	esApi.Init(creds, d.settings.Region)
+
+	res, err := esApi.GetSnapshotStatus(d.settings.SnapshotsRepoName, name)
+	if err != nil {
+		d.logger.Error("GetSnapShotStatus failed", err)
+		return base.InstanceNotModified, err
+	}
+	switch res {
+	case "SUCCESS":
+		return base.InstanceReady, nil
+	case "IN_PROGRESS", "STARTED":
+		return base.InstanceInProgress, nil
+	default:
+		return base.InstanceNotModified, fmt.Errorf("snapshot %s finished with state %s", name, res)
+	}
+}
+
+// findSnapshotManifest reads the manifest written when the source instance was deleted.
+// Manifests are stored under the org and space of their instance, so only the
+// instances deleted in the space the instance is created in are found.
+func (d *dedicatedElasticsearchAdapter) findSnapshotManifest(i *ElasticsearchInstance, sourceGUID string) (*ElasticsearchInstance, error) {
+	path := snapshotPath(i.OrganizationGUID, i.SpaceGUID, i.ServiceID, sourceGUID)
+	resp, err := d.s3.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(d.settings.SnapshotsBucketName),
+		Key:    aws.String(path + "/instance_manifest.json"),
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, fmt.Errorf("no snapshot of instance %s was found in this space", sourceGUID)
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	manifest := &ElasticsearchInstance{}
+	if err := json.NewDecoder(resp.Body).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("the manifest of instance %s could not be read: %s", sourceGUID, err)
+	}
+	return manifest, nil
+}
+
+// in which we register the snapshot repo of the source instance read-only, restore its last snapshot
+// then poll for the restored indices to be available, may block for a considerable time
+func (d *dedicatedElasticsearchAdapter) restoreLastSnapshot(i *ElasticsearchInstance, password string) error {
+	var sleep = 10 * time.Second
+	var creds map[string]string
+	var err error
+
+	if i.Host == "" {
+		creds, err = d.bindElasticsearchToApp(i, password)
+		if err != nil {
+			fmt.Println(err)
+			return err
+		}
+	} else {
+		creds, err = i.getCredentials(password, &d.settings)
+		if err != nil {
+			fmt.Println(err)
+			return err
+		}
+	}
+
+	// the snapshot role of the domain needs to read the snapshots of the source instance
+	iamTags := awsiam.ConvertTagsMapToIAMTags(i.Tags)
+	sourcePath := i.restoreSnapshotPath()
+	err = d.createUpdateBucketRolesAndPolicies(i, d.settings.SnapshotsBucketName, sourcePath, iamTags)
+	if err != nil {
+		d.logger.Error("restoreLastSnapshot - Error in createUpdateRolesAndPolicies", err)
 		return err
 	}
 
-	// poll for snapshot completion and continue once no longer "IN_PROGRESS"
+	esApi := &EsApiHandler{}
+	esApi.Init(creds, d.settings.Region)
+
+	repoName := d.settings.SnapshotsRepoName + "-restore"
+	_, err = esApi.CreateReadOnlySnapshotRepo(
+		repoName,
+		d.settings.SnapshotsBucketName,
+		sourcePath,
+		d.settings.Region,
+		i.SnapshotARN,
+	)
+	if err != nil {
+		d.logger.Error("CreateReadOnlySnapshotRepo returns error", err)
+		return err
+	}
+
+	snapshots, err := esApi.GetSnapshots(repoName)
+	if err != nil {
+		d.logger.Error("GetSnapshots returns error", err)
+		return err
+	}
+	found := false
+	for _, snapshot := range snapshots.Snapshots {
+		if snapshot.Snapshot == d.settings.LastSnapshotName && snapshot.State == "SUCCESS" {
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("snapshot %s of instance %s was not found", d.settings.LastSnapshotName, i.RestoredFromInstance)
+	}
+
+	_, err = esApi.RestoreSnapshot(repoName, d.settings.LastSnapshotName)
+	if err != nil {
+		d.logger.Error("RestoreSnapshot returns error", err)
+		return err
+	}
+
+	// restored indices are red until their primary shards are recovered from the snapshot
 	for {
-		res, err := esApi.GetSnapshotStatus(d.settings.SnapshotsRepoName, d.settings.LastSnapshotName)
+		time.Sleep(sleep)
+		health, err := esApi.GetClusterHealth()
 		if err != nil {
-			d.logger.Error("GetSnapShotStatus failed", err)
+			d.logger.Error("GetClusterHealth failed", err)
 			return err
 		}
-		if res != "IN_PROGRESS" {
-			break
+		if health.Status != "red" && health.InitializingShards == 0 {
+			return nil
 		}
-		time.Sleep(sleep)
 	}
-	return nil
 }
 
 // in which we clean up all the roles and policies for the ES domain
@@ -575,7 +797,12 @@ func (d *dedicatedElasticsearchAdapter) cleanupRolesAndPolicies(i *Elasticsearch
 		return err
 	}
 
-	if err := user.DeleteAccessKey(i.Domain, i.AccessKey); err != nil {
+	accessKey, _, err := i.getAccessKeys(&d.settings)
+	if err != nil {
+		fmt.Println(err.Error())
+		return err
+	}
+	if err := user.DeleteAccessKey(i.Domain, accessKey); err != nil {
 		fmt.Println(err.Error())
 		return err
 	}
@@ -626,6 +853,61 @@ func (d *dedicatedElasticsearchAdapter) cleanupRolesAndPolicies(i *Elasticsearch
 	return nil
 }
 
+// deleteProvisionedResource deletes a resource created while provisioning an
+// instance that failed. Resources that are already gone count as deleted, and
+// domains are deleted without waiting for the deletion to complete.
+func (d *dedicatedElasticsearchAdapter) deleteProvisionedResource(r base.ProvisionedResource) error {
+	user := awsiam.NewIAMUserClient(d.iam, d.logger)
+	policyHandler := awsiam.NewIAMPolicyClient(d.settings.Region, d.logger)
+
+	var err error
+	switch r.Type {
+	case iamUserResource:
+		err = user.Delete(r.Identifier)
+	case iamAccessKeyResource:
+		err = user.DeleteAccessKey(r.Parent, r.Identifier)
+	case iamPolicyResource:
+		err = policyHandler.DeletePolicy(r.Identifier)
+	case iamUserPolicyAttachmentResource:
+		err = user.DetachUserPolicy(r.Parent, r.Identifier)
+	case iamRoleResource:
+		_, err = d.iam.DeleteRole(&iam.DeleteRoleInput{
+			RoleName: aws.String(r.Identifier),
+		})
+	case iamRolePolicyAttachmentResource:
+		_, err = d.iam.DetachRolePolicy(&iam.DetachRolePolicyInput{
+			PolicyArn: aws.String(r.Identifier),
+			RoleName:  aws.String(r.Parent),
+		})
+	case domainResource:
+		_, err = d.opensearch.DeleteDomain(&opensearchservice.DeleteDomainInput{
+			DomainName: aws.String(r.Identifier),
+		})
+	default:
+		return fmt.Errorf("unknown resource type %s", r.Type)
+	}
+	if isResourceGone(err) {
+		return nil
+	}
+	return err
+}
+
+// isResourceGone reports whether err says the resource does not exist. The
+// awsiam clients return the code of AWS errors as the prefix of their message.
+func isResourceGone(err error) bool {
+	if err == nil {
+		return false
+	}
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case iam.ErrCodeNoSuchEntityException, opensearchservice.ErrCodeResourceNotFoundException:
+			return true
+		}
+		return false
+	}
+	return strings.HasPrefix(err.Error(), iam.ErrCodeNoSuchEntityException+":")
+}
+
 // in which we finally delete the ES Domain and wait for it to complete
 func (d *dedicatedElasticsearchAdapter) cleanupElasticSearchDomain(i *ElasticsearchInstance) error {
 	params := &opensearchservice.DeleteDomainInput{
@@ -39,13 +39,14 @@ type SnapshotRepoSettings struct {
 	SSE      bool   `json:"server_side_encryption"` //we set this to true, default is false
 	Region   string `json:"region"`
 	RoleArn  string `json:"role_arn"`
+	ReadOnly bool   `json:"readonly,omitempty"` //set when registering the repo of another domain
 }
 
 type Snapshot struct {
 	Snapshot  string   `json:"snapshot"`
 	Version   string   `json:"version"`
 	State     string   `json:"state"`
-	Indicies  []string `json:"indicies"`
+	Indicies  []string `json:"indices"`
 	StartTime string   `json:"start_time"`
 	EndTime   string   `json:"end_time"`
 }
@@ -54,6 +55,19 @@ type Snapshots struct {
 	Snapshots []Snapshot `json:"snapshots"`
 }
 
+// the system indices of the domain already exist and cannot be restored over
+const restoreIndices = "-.kibana*,-.opendistro*,-.opensearch*"
+
+type SnapshotRestore struct {
+	Indices            string `json:"indices"`
+	IncludeGlobalState bool   `json:"include_global_state"`
+}
+
+type ClusterHealth struct {
+	Status             string `json:"status"`
+	InitializingShards int    `json:"initializing_shards"`
+}
+
 func NewSnapshotRepo(bucketname string, path string, region string, rolearn string) *SnapshotRepo {
 	sr := &SnapshotRepo{}
 	sr.Type = "s3"
@@ -147,6 +161,27 @@ func (es *EsApiHandler) CreateSnapshotRepo(reponame string, bucketname string, p
 	return string(resp), err
 }
 
+// registers the snapshot repo of another domain, e.g. a deleted one, so that its
+// snapshots can be restored without this domain writing to it.
+func (es *EsApiHandler) CreateReadOnlySnapshotRepo(reponame string, bucketname string, path string, region string, rolearn string) (string, error) {
+	path = strings.TrimPrefix(path, "/")
+
+	snaprepo := NewSnapshotRepo(bucketname, path, region, rolearn)
+	snaprepo.Settings.ReadOnly = true
+	repo, err := snaprepo.ToString()
+	if err != nil {
+		fmt.Print(err)
+		return "", err
+	}
+	endpoint := "/_snapshot/" + reponame
+	resp, err := es.Send(http.MethodPut, endpoint, repo)
+	if err != nil {
+		fmt.Print(err)
+		return "", err
+	}
+	return string(resp), err
+}
+
 func (es *EsApiHandler) CreateSnapshot(reponame string, snapshotname string) (string, error) {
 
 	endpoint := "/_snapshot/" + reponame + "/" + snapshotname
@@ -189,3 +224,56 @@ func (es *EsApiHandler) GetSnapshotStatus(reponame string, snapshotname string)
 	//fmt.Printf("GetSnapshotSnapshot: \n\tEndpoint: %s\n\tResponse %v", endpoint, string(resp))
 	return snapshots.Snapshots[0].State, nil
 }
+
+func (es *EsApiHandler) GetSnapshots(reponame string) (*Snapshots, error) {
+	endpoint := "/_snapshot/" + reponame + "/_all"
+	resp, err := es.Send(http.MethodGet, endpoint, "")
+	if err != nil {
+		fmt.Printf("es_api getsnapshots error %v", err)
+		return nil, err
+	}
+	snapshots := &Snapshots{}
+	err = json.Unmarshal(resp, snapshots)
+	if err != nil {
+		fmt.Printf("es_api unmarshall reply error: %v", err)
+		return nil, err
+	}
+	return snapshots, nil
+}
+
+// restores the indices of a snapshot, leaving out the system indices and the cluster state
+// of the domain the snapshot was taken from.
+func (es *EsApiHandler) RestoreSnapshot(reponame string, snapshotname string) (string, error) {
+	restore, err := json.Marshal(SnapshotRestore{Indices: restoreIndices})
+	if err != nil {
+		return "", err
+	}
+	endpoint := "/_snapshot/" + reponame + "/" + snapshotname + "/_restore"
+	resp, err := es.Send(http.MethodPost, endpoint, string(restore))
+	if err != nil {
+		fmt.Printf("es_api restoresnapshot error:%v", err)
+		return "", err
+	}
+	result := map[string]interface{}{}
+	if err = json.Unmarshal(resp, &result); err == nil {
+		if reason, ok := result["error"]; ok {
+			return string(resp), fmt.Errorf("restore of snapshot %s failed: %v", snapshotname, reason)
+		}
+	}
+	return string(resp), nil
+}
+
+func (es *EsApiHandler) GetClusterHealth() (*ClusterHealth, error) {
+	resp, err := es.Send(http.MethodGet, "/_cluster/health", "")
+	if err != nil {
+		fmt.Printf("es_api getclusterhealth error %v", err)
+		return nil, err
+	}
+	health := &ClusterHealth{}
+	err = json.Unmarshal(resp, health)
+	if err != nil {
+		fmt.Printf("es_api unmarshall reply error: %v", err)
+		return nil, err
+	}
+	return health, nil
+}
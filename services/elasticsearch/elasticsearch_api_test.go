@@ -132,3 +132,47 @@ func TestGetSnapshotStatus(t *testing.T) {
 		t.Errorf("Response is %s, not SUCCESS", resp)
 	}
 }
+
+func TestCreateReadOnlySnapshotRepo(t *testing.T) {
+	es := createMockESHandler("")
+	_, err := es.CreateReadOnlySnapshotRepo(reponame, bucket, path, region, rolearn)
+	if err != nil {
+		t.Errorf("Err is not nil: %v", err)
+	}
+}
+
+func TestGetSnapshots(t *testing.T) {
+	es := createMockESHandler(snapshotstatus)
+	snapshots, err := es.GetSnapshots(reponame)
+	if err != nil {
+		t.Errorf("Err is not nil: %v", err)
+	}
+	if len(snapshots.Snapshots) != 1 || snapshots.Snapshots[0].Snapshot != "backup3" {
+		t.Errorf("Snapshots are %+v, not backup3", snapshots.Snapshots)
+	}
+}
+
+func TestRestoreSnapshot(t *testing.T) {
+	es := createMockESHandler("{\"accepted\":true}")
+	_, err := es.RestoreSnapshot(reponame, snapshotname)
+	if err != nil {
+		t.Errorf("Err is not nil: %v", err)
+	}
+
+	es = createMockESHandler("{\"error\":{\"type\":\"snapshot_restore_exception\"},\"status\":500}")
+	_, err = es.RestoreSnapshot(reponame, snapshotname)
+	if err == nil {
+		t.Error("Expected an error for a failed restore")
+	}
+}
+
+func TestGetClusterHealth(t *testing.T) {
+	es := createMockESHandler("{\"cluster_name\":\"domain\",\"status\":\"yellow\",\"initializing_shards\":0}")
+	health, err := es.GetClusterHealth()
+	if err != nil {
+		t.Errorf("Err is not nil: %v", err)
+	}
+	if health.Status != "yellow" {
+		t.Errorf("Status is %s, not yellow", health.Status)
+	}
+}
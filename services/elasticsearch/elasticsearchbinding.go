@@ -0,0 +1,25 @@
+package elasticsearch
+
+import (
+	"time"
+
+	"github.com/18F/aws-broker/base"
+)
+
+// ElasticsearchBinding records a binding to an instance so that the IAM users,
+// policies and snapshot roles it needs can be set up asynchronously. All
+// bindings share the credentials of the instance once they are ready.
+type ElasticsearchBinding struct {
+	BindingID    string `gorm:"primary_key" sql:"type:varchar(255) PRIMARY KEY"`
+	InstanceUuid string `sql:"size(255)"`
+
+	Bucket string `sql:"size(255)"`
+	State  base.InstanceState
+
+	// CredentialsSecretARN is the secret holding the credentials of the
+	// binding when they are stored in Secrets Manager.
+	CredentialsSecretARN string `sql:"size(2048)"`
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
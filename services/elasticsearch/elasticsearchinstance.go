@@ -13,6 +13,7 @@ import (
 
 	"github.com/18F/aws-broker/catalog"
 	"github.com/18F/aws-broker/config"
+	"github.com/lib/pq"
 )
 
 // ElasticsearchInstance represents the information of an Elasticsearch Service instance.
@@ -21,10 +22,11 @@ type ElasticsearchInstance struct {
 
 	Description string `sql:"size(255)"`
 
-	Password                       string `sql:"size(255)"`
+	Password                       string `sql:"type:text"`
 	Salt                           string `sql:"size(255)"`
-	AccessKey                      string `sql:"size(255)"`
-	SecretKey                      string `sql:"size(255)"`
+	EncryptionKeyID                string `sql:"size(255)"`
+	AccessKey                      string `sql:"type:text"`
+	SecretKey                      string `sql:"type:text"`
 	IamPolicy                      string `sql:"size(255)"`
 	IamPolicyARN                   string `sql:"size(255)"`
 	AccessControlPolicy            string `sql:"size(255)"`
@@ -48,6 +50,12 @@ type ElasticsearchInstance struct {
 	IamPassRolePolicyARN           string `sql:"size(255)"`
 	IndicesFieldDataCacheSize      string `sql:"size(255)"`
 	IndicesQueryBoolMaxClauseCount string `sql:"size(255)"`
+	RestoredFromInstance           string `sql:"size(255)"`
+	SnapshotRestored               bool
+	PendingSnapshot                string `sql:"size(255)"`
+	// Snapshots are the snapshots taken with update-service that succeeded, so
+	// that they can be reported without calling the domain.
+	Snapshots pq.StringArray `sql:"type:text[]"`
 
 	ClearPassword string `sql:"-"`
 
@@ -67,50 +75,169 @@ type ElasticsearchInstance struct {
 	AuditLogsGroupARN      string `sql:"size(2048)"`
 }
 
-func (i *ElasticsearchInstance) setPassword(password, key string) error {
+func (i *ElasticsearchInstance) setPassword(password string, s *config.Settings) error {
 	if i.Salt == "" {
 		return errors.New("Salt has to be set before writing the password")
 	}
 
 	iv, _ := base64.StdEncoding.DecodeString(i.Salt)
 
-	encrypted, err := helpers.Encrypt(password, key, iv)
+	encrypter, err := s.CurrentSecretEncrypter()
+	if err != nil {
+		return err
+	}
+	encrypted, err := encrypter.Encrypt(password, iv)
 	if err != nil {
 		return err
 	}
 
 	i.Password = encrypted
+	i.EncryptionKeyID = s.CurrentEncryptionKeyID()
 	i.ClearPassword = password
 
 	return nil
 }
 
-func (i *ElasticsearchInstance) getPassword(key string) (string, error) {
+func (i *ElasticsearchInstance) getPassword(s *config.Settings) (string, error) {
 	if i.Salt == "" || i.Password == "" {
 		return "", errors.New("Salt and password has to be set before writing the password")
 	}
 
+	encrypter, err := s.SecretEncrypter(i.EncryptionKeyID)
+	if err != nil {
+		return "", err
+	}
+
 	iv, _ := base64.StdEncoding.DecodeString(i.Salt)
 
-	decrypted, err := helpers.Decrypt(i.Password, key, iv)
+	decrypted, err := encrypter.Decrypt(i.Password, iv)
 	if err != nil {
 		return "", err
 	}
 
+	// Re-encrypt secrets stored by earlier versions of the broker, so that
+	// the next save stores them with authenticated encryption.
+	if i.hasLegacySecrets() {
+		if err := i.encryptSecrets(decrypted, s); err != nil {
+			return "", err
+		}
+	}
+
 	return decrypted, nil
 }
 
-func (i *ElasticsearchInstance) getCredentials(password string) (map[string]string, error) {
+// setAccessKeys encrypts the keys of the IAM user of the domain with the key
+// the password is encrypted with.
+func (i *ElasticsearchInstance) setAccessKeys(accessKey string, secretKey string, s *config.Settings) error {
+	if i.Salt == "" {
+		return errors.New("Salt has to be set before writing the access keys")
+	}
+
+	encrypter, err := s.SecretEncrypter(i.EncryptionKeyID)
+	if err != nil {
+		return err
+	}
+
+	iv, _ := base64.StdEncoding.DecodeString(i.Salt)
+
+	encryptedAccessKey, err := encrypter.Encrypt(accessKey, iv)
+	if err != nil {
+		return err
+	}
+	encryptedSecretKey, err := encrypter.Encrypt(secretKey, iv)
+	if err != nil {
+		return err
+	}
+
+	i.AccessKey = encryptedAccessKey
+	i.SecretKey = encryptedSecretKey
+
+	return nil
+}
+
+// getAccessKeys decrypts the keys of the IAM user of the domain. Keys stored in
+// plain text by earlier versions of the broker are returned as they are.
+func (i *ElasticsearchInstance) getAccessKeys(s *config.Settings) (string, string, error) {
+	if !helpers.IsEncrypted(i.AccessKey) && !helpers.IsEncrypted(i.SecretKey) {
+		return i.AccessKey, i.SecretKey, nil
+	}
+
+	encrypter, err := s.SecretEncrypter(i.EncryptionKeyID)
+	if err != nil {
+		return "", "", err
+	}
+
+	iv, _ := base64.StdEncoding.DecodeString(i.Salt)
+
+	accessKey, err := encrypter.Decrypt(i.AccessKey, iv)
+	if err != nil {
+		return "", "", err
+	}
+	secretKey, err := encrypter.Decrypt(i.SecretKey, iv)
+	if err != nil {
+		return "", "", err
+	}
+
+	return accessKey, secretKey, nil
+}
+
+// hasLegacySecrets reports whether the password was encrypted with AES-CFB, or
+// the access keys were stored in plain text.
+func (i *ElasticsearchInstance) hasLegacySecrets() bool {
+	return helpers.IsLegacyEncryption(i.Password) ||
+		(i.AccessKey != "" && !helpers.IsEncrypted(i.AccessKey)) ||
+		(i.SecretKey != "" && !helpers.IsEncrypted(i.SecretKey))
+}
+
+// encryptSecrets encrypts the password and the access keys of the instance
+// with the current encryption key.
+func (i *ElasticsearchInstance) encryptSecrets(password string, s *config.Settings) error {
+	accessKey, secretKey, err := i.getAccessKeys(s)
+	if err != nil {
+		return err
+	}
+	if err := i.setPassword(password, s); err != nil {
+		return err
+	}
+	if accessKey == "" && secretKey == "" {
+		return nil
+	}
+	return i.setAccessKeys(accessKey, secretKey, s)
+}
+
+// RotateEncryptionKey re-encrypts the password and the access keys of the
+// instance with the current encryption key, and reports whether it did.
+// Secrets already encrypted with the current key and scheme are left unchanged.
+func (i *ElasticsearchInstance) RotateEncryptionKey(s *config.Settings) (bool, error) {
+	if i.EncryptionKeyID == s.CurrentEncryptionKeyID() && !i.hasLegacySecrets() {
+		return false, nil
+	}
+	password, err := i.getPassword(s)
+	if err != nil {
+		return false, err
+	}
+	if err := i.encryptSecrets(password, s); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (i *ElasticsearchInstance) getCredentials(password string, s *config.Settings) (map[string]string, error) {
 	var credentials map[string]string
 
+	accessKey, secretKey, err := i.getAccessKeys(s)
+	if err != nil {
+		return nil, err
+	}
+
 	uri := fmt.Sprintf("https://%s:443",
 		i.Host)
 
 	if len(i.Bucket) > 0 {
 		credentials = map[string]string{
 			"uri":                           uri,
-			"access_key":                    i.AccessKey,
-			"secret_key":                    i.SecretKey,
+			"access_key":                    accessKey,
+			"secret_key":                    secretKey,
 			"host":                          i.Host,
 			"current_elasticsearch_version": i.CurrentESVersion,
 			"bucket":                        i.Bucket,
@@ -119,8 +246,8 @@ func (i *ElasticsearchInstance) getCredentials(password string) (map[string]stri
 	} else {
 		credentials = map[string]string{
 			"uri":                           uri,
-			"access_key":                    i.AccessKey,
-			"secret_key":                    i.SecretKey,
+			"access_key":                    accessKey,
+			"secret_key":                    secretKey,
 			"host":                          i.Host,
 			"current_elasticsearch_version": i.CurrentESVersion,
 		}
@@ -128,6 +255,40 @@ func (i *ElasticsearchInstance) getCredentials(password string) (map[string]stri
 	return credentials, nil
 }
 
+// parameters returns the settings applied to the instance, keyed like the
+// options they can be set with.
+func (i *ElasticsearchInstance) parameters() map[string]interface{} {
+	parameters := map[string]interface{}{
+		"elasticsearchVersion": i.ElasticsearchVersion,
+		"volume_type":          i.VolumeType,
+	}
+	advancedOptions := ElasticsearchAdvancedOptions{
+		IndicesFieldDataCacheSize:      i.IndicesFieldDataCacheSize,
+		IndicesQueryBoolMaxClauseCount: i.IndicesQueryBoolMaxClauseCount,
+	}
+	if advancedOptions != (ElasticsearchAdvancedOptions{}) {
+		parameters["advanced_options"] = advancedOptions
+	}
+	if i.Bucket != "" {
+		parameters["bucket"] = i.Bucket
+	}
+	if i.RestoredFromInstance != "" {
+		parameters["restore_from_instance"] = i.RestoredFromInstance
+	}
+	if len(i.Snapshots) > 0 {
+		parameters["snapshots"] = []string(i.Snapshots)
+	}
+	return parameters
+}
+
+// dashboardURL is the URL of the dashboards of the domain, once its endpoint is known.
+func (i *ElasticsearchInstance) dashboardURL() string {
+	if i.Host == "" {
+		return ""
+	}
+	return fmt.Sprintf("https://%s/_dashboards", i.Host)
+}
+
 func (i *ElasticsearchInstance) setBucket(bucket string) error {
 	i.Bucket = bucket
 
@@ -156,7 +317,7 @@ func (i *ElasticsearchInstance) init(
 
 	i.Salt = helpers.GenerateSalt(aes.BlockSize)
 	password := helpers.RandStr(25)
-	if err := i.setPassword(password, s.EncryptionKey); err != nil {
+	if err := i.setPassword(password, s); err != nil {
 		return err
 	}
 
@@ -177,7 +338,7 @@ func (i *ElasticsearchInstance) init(
 	i.SubnetID4AZ2 = plan.SubnetID4AZ2
 	i.IndicesFieldDataCacheSize = options.AdvancedOptions.IndicesFieldDataCacheSize
 	i.IndicesQueryBoolMaxClauseCount = options.AdvancedOptions.IndicesQueryBoolMaxClauseCount
-	i.SnapshotPath = "/" + i.OrganizationGUID + "/" + i.SpaceGUID + "/" + i.ServiceID + "/" + i.Uuid
+	i.SnapshotPath = snapshotPath(i.OrganizationGUID, i.SpaceGUID, i.ServiceID, i.Uuid)
 	i.BrokerSnapshotsEnabled = false
 	if options.ElasticsearchVersion != "" {
 		i.ElasticsearchVersion = options.ElasticsearchVersion
@@ -191,6 +352,35 @@ func (i *ElasticsearchInstance) init(
 	return nil
 }
 
+// snapshotPath is where the broker keeps the snapshots and manifest of an instance
+// in the snapshots bucket.
+func snapshotPath(orgGUID, spaceGUID, serviceID, uuid string) string {
+	return "/" + orgGUID + "/" + spaceGUID + "/" + serviceID + "/" + uuid
+}
+
+// restoreFromManifest sets up the instance to restore the indices of the last
+// snapshot taken of the source instance, once its domain has been created.
+func (i *ElasticsearchInstance) restoreFromManifest(sourceGUID string, manifest *ElasticsearchInstance) error {
+	if manifest.Uuid != "" && manifest.Uuid != sourceGUID {
+		return fmt.Errorf("the manifest is for instance %s", manifest.Uuid)
+	}
+	i.RestoredFromInstance = sourceGUID
+	i.SnapshotRestored = false
+	return nil
+}
+
+// restorePending reports whether the indices of the source instance still have
+// to be restored into the domain.
+func (i *ElasticsearchInstance) restorePending() bool {
+	return i.RestoredFromInstance != "" && !i.SnapshotRestored
+}
+
+// restoreSnapshotPath is where the snapshots of the source instance are kept.
+// Instances can only be restored in the space of their source instance.
+func (i *ElasticsearchInstance) restoreSnapshotPath() string {
+	return snapshotPath(i.OrganizationGUID, i.SpaceGUID, i.ServiceID, i.RestoredFromInstance)
+}
+
 func (i *ElasticsearchInstance) update(
 	options ElasticsearchOptions,
 ) error {
@@ -1,6 +1,7 @@
 package elasticsearch
 
 import (
+	"crypto/aes"
 	"testing"
 
 	"github.com/18F/aws-broker/catalog"
@@ -78,3 +79,127 @@ func TestUpdateInstance(t *testing.T) {
 		})
 	}
 }
+
+func TestRestoreFromManifest(t *testing.T) {
+	testCases := map[string]struct {
+		sourceGUID       string
+		manifestUuid     string
+		expectedInstance *ElasticsearchInstance
+		expectErr        bool
+	}{
+		"matching manifest": {
+			sourceGUID:   "source-1",
+			manifestUuid: "source-1",
+			expectedInstance: &ElasticsearchInstance{
+				RestoredFromInstance: "source-1",
+			},
+		},
+		"manifest of another instance": {
+			sourceGUID:       "source-1",
+			manifestUuid:     "source-2",
+			expectedInstance: &ElasticsearchInstance{},
+			expectErr:        true,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			instance := &ElasticsearchInstance{}
+			manifest := &ElasticsearchInstance{}
+			manifest.Uuid = test.manifestUuid
+
+			err := instance.restoreFromManifest(test.sourceGUID, manifest)
+			if test.expectErr && err == nil {
+				t.Fatal("expected error, got nil")
+			}
+			if !test.expectErr && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if diff := deep.Equal(instance, test.expectedInstance); diff != nil {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestRestoreSnapshotPath(t *testing.T) {
+	instance := &ElasticsearchInstance{
+		RestoredFromInstance: "source-1",
+	}
+	instance.OrganizationGUID = "org-1"
+	instance.SpaceGUID = "space-1"
+	instance.ServiceID = "service-1"
+
+	expected := "/org-1/space-1/service-1/source-1"
+	if path := instance.restoreSnapshotPath(); path != expected {
+		t.Errorf("expected %s, got %s", expected, path)
+	}
+	if !instance.restorePending() {
+		t.Error("expected the restore to be pending")
+	}
+}
+
+func TestAccessKeysEncryption(t *testing.T) {
+	settings := &config.Settings{EncryptionKey: helpers.RandStr(32)}
+
+	testCases := map[string]struct {
+		instance func(t *testing.T) *ElasticsearchInstance
+	}{
+		"encrypted keys": {
+			instance: func(t *testing.T) *ElasticsearchInstance {
+				i := &ElasticsearchInstance{Salt: helpers.GenerateSalt(aes.BlockSize)}
+				if err := i.setPassword("the-password", settings); err != nil {
+					t.Fatal(err)
+				}
+				if err := i.setAccessKeys("the-access-key", "the-secret-key", settings); err != nil {
+					t.Fatal(err)
+				}
+				return i
+			},
+		},
+		"keys stored in plain text": {
+			instance: func(t *testing.T) *ElasticsearchInstance {
+				i := &ElasticsearchInstance{Salt: helpers.GenerateSalt(aes.BlockSize)}
+				if err := i.setPassword("the-password", settings); err != nil {
+					t.Fatal(err)
+				}
+				i.AccessKey = "the-access-key"
+				i.SecretKey = "the-secret-key"
+				return i
+			},
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			i := test.instance(t)
+
+			password, err := i.getPassword(settings)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if password != "the-password" {
+				t.Errorf("unexpected password %s", password)
+			}
+			if !helpers.IsEncrypted(i.AccessKey) || !helpers.IsEncrypted(i.SecretKey) {
+				t.Error("expected the access keys to be stored encrypted")
+			}
+
+			credentials, err := i.getCredentials(password, settings)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if credentials["access_key"] != "the-access-key" || credentials["secret_key"] != "the-secret-key" {
+				t.Errorf("unexpected credentials %v", credentials)
+			}
+
+			rotated, err := i.RotateEncryptionKey(settings)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rotated {
+				t.Error("expected secrets encrypted with the current key to be left unchanged")
+			}
+		})
+	}
+}
@@ -1,6 +1,9 @@
 package elasticsearch
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 func validateVolumeType(volumeType string) error {
 	switch volumeType {
@@ -10,3 +13,20 @@ func validateVolumeType(volumeType string) error {
 		return fmt.Errorf("volume type is not supported: %s", volumeType)
 	}
 }
+
+// snapshot names follow the rules for index names
+func validateSnapshotName(name string, lastSnapshotName string) error {
+	if name != strings.ToLower(name) {
+		return fmt.Errorf("snapshot name must be lowercase: %s", name)
+	}
+	if strings.HasPrefix(name, "_") || strings.HasPrefix(name, "-") {
+		return fmt.Errorf("snapshot name cannot start with _ or -: %s", name)
+	}
+	if strings.ContainsAny(name, " \\/*?\"<>|,#") {
+		return fmt.Errorf("snapshot name cannot contain spaces or any of \\/*?\"<>|,#: %s", name)
+	}
+	if name == lastSnapshotName {
+		return fmt.Errorf("snapshot name is reserved for the broker: %s", name)
+	}
+	return nil
+}
@@ -37,3 +37,47 @@ func TestValidateVolumeType(t *testing.T) {
 		})
 	}
 }
+
+func TestValidateSnapshotName(t *testing.T) {
+	testCases := map[string]struct {
+		name        string
+		expectedErr bool
+	}{
+		"valid": {
+			name:        "before-reindex-2024.01.02",
+			expectedErr: false,
+		},
+		"uppercase": {
+			name:        "Before-Reindex",
+			expectedErr: true,
+		},
+		"leading underscore": {
+			name:        "_backup",
+			expectedErr: true,
+		},
+		"space": {
+			name:        "my backup",
+			expectedErr: true,
+		},
+		"slash": {
+			name:        "my/backup",
+			expectedErr: true,
+		},
+		"reserved": {
+			name:        "cg-last-snapshot",
+			expectedErr: true,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			err := validateSnapshotName(test.name, "cg-last-snapshot")
+			if test.expectedErr && err == nil {
+				t.Fatalf("expected error")
+			}
+			if !test.expectedErr && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		})
+	}
+}
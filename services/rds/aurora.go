@@ -0,0 +1,479 @@
+package rds
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/rds"
+	"github.com/aws/aws-sdk-go/service/rds/rdsiface"
+
+	"github.com/18F/aws-broker/base"
+	"github.com/18F/aws-broker/catalog"
+	"github.com/18F/aws-broker/config"
+)
+
+// auroraDBAdapter provisions Aurora clusters. A cluster has a writer instance
+// and the number of reader instances set by its plan, which all share the
+// storage of the cluster. Its parameters are set on a cluster parameter group.
+type auroraDBAdapter struct {
+	Plan                 catalog.RDSPlan
+	settings             config.Settings
+	rds                  rdsiface.RDSAPI
+	parameterGroupClient parameterGroupClient
+	dbUsers              dbUserClient
+	dbExtensions         dbExtensionClient
+}
+
+// clusterInstanceIdentifier is the identifier of the nth instance of the
+// cluster. The first instance is created first, which makes it the writer.
+func clusterInstanceIdentifier(i *RDSInstance, n int) string {
+	return fmt.Sprintf("%s-instance-%d", i.Database, n)
+}
+
+func (d *auroraDBAdapter) prepareCreateDbClusterInput(
+	i *RDSInstance,
+	password string,
+) (*rds.CreateDBClusterInput, error) {
+	rdsTags := ConvertTagsToRDSTags(i.Tags)
+
+	// Storage is managed by Aurora, so it is not set.
+	params := &rds.CreateDBClusterInput{
+		DBClusterIdentifier:   &i.Database,
+		DatabaseName:          aws.String(i.FormatDBName()),
+		Engine:                aws.String(i.engine()),
+		MasterUserPassword:    &password,
+		MasterUsername:        &i.Username,
+		StorageEncrypted:      aws.Bool(d.Plan.Encrypted),
+		Tags:                  rdsTags,
+		BackupRetentionPeriod: aws.Int64(i.BackupRetentionPeriod),
+		DBSubnetGroupName:     &i.DbSubnetGroup,
+		VpcSecurityGroupIds: []*string{
+			&i.SecGroup,
+		},
+	}
+	if i.DbVersion != "" {
+		params.EngineVersion = aws.String(i.DbVersion)
+	}
+
+	err := d.parameterGroupClient.ProvisionCustomParameterGroupIfNecessary(i, rdsTags)
+	if err != nil {
+		return nil, err
+	}
+	if i.ParameterGroupName != "" {
+		params.DBClusterParameterGroupName = aws.String(i.ParameterGroupName)
+	}
+
+	return params, nil
+}
+
+func (d *auroraDBAdapter) prepareCreateDbInstanceInput(i *RDSInstance, identifier string) *rds.CreateDBInstanceInput {
+	// The database, master user, storage and network come from the cluster.
+	return &rds.CreateDBInstanceInput{
+		DBClusterIdentifier:     &i.Database,
+		DBInstanceIdentifier:    aws.String(identifier),
+		DBInstanceClass:         &d.Plan.InstanceClass,
+		Engine:                  aws.String(i.engine()),
+		AutoMinorVersionUpgrade: aws.Bool(true),
+		PubliclyAccessible:      aws.Bool(d.settings.PubliclyAccessibleFeature && i.PubliclyAccessible),
+		Tags:                    ConvertTagsToRDSTags(i.Tags),
+	}
+}
+
+// createDB creates the cluster, then its writer and reader instances.
+func (d *auroraDBAdapter) createDB(i *RDSInstance, password string) (base.InstanceState, error) {
+	params, err := d.prepareCreateDbClusterInput(i, password)
+	if err != nil {
+		return base.InstanceNotCreated, err
+	}
+
+	_, err = d.rds.CreateDBCluster(params)
+	if err != nil {
+		return base.InstanceNotCreated, err
+	}
+	i.Provisioned.Add(dbClusterResource, i.Database, "")
+
+	for n := 1; n <= int(d.Plan.ReaderInstances)+1; n++ {
+		identifier := clusterInstanceIdentifier(i, n)
+		_, err = d.rds.CreateDBInstance(d.prepareCreateDbInstanceInput(i, identifier))
+		if err != nil {
+			return base.InstanceNotCreated, err
+		}
+		i.Provisioned.Add(dbInstanceResource, identifier, "")
+	}
+	return base.InstanceInProgress, nil
+}
+
+// completeRestore has nothing to do since clusters are not restored.
+func (d *auroraDBAdapter) completeRestore(i *RDSInstance, password string) (base.InstanceState, error) {
+	return base.InstanceReady, nil
+}
+
+// dropBindingUsers has nothing to drop since clusters are not cloned.
+func (d *auroraDBAdapter) dropBindingUsers(i *RDSInstance, password string, bindings []RDSBinding) error {
+	return nil
+}
+
+// applyExtensions reboots the instances of the cluster whose cluster parameter
+// group has changes that are pending a reboot, and otherwise creates the loaded
+// extensions in the database if that was asked for.
+func (d *auroraDBAdapter) applyExtensions(i *RDSInstance, password string) (base.InstanceState, error) {
+	cluster, err := d.describeCluster(i)
+	if err != nil {
+		return base.InstanceNotModified, err
+	}
+
+	rebooting := false
+	for _, member := range cluster.DBClusterMembers {
+		switch aws.StringValue(member.DBClusterParameterGroupStatus) {
+		case "in-sync":
+		case "pending-reboot":
+			log.Printf("rebooting %s to apply cluster parameter group %s", aws.StringValue(member.DBInstanceIdentifier), i.ParameterGroupName)
+			_, err := d.rds.RebootDBInstance(&rds.RebootDBInstanceInput{
+				DBInstanceIdentifier: member.DBInstanceIdentifier,
+			})
+			if err != nil {
+				return base.InstanceNotModified, err
+			}
+			rebooting = true
+		default:
+			return base.InstanceInProgress, nil
+		}
+	}
+	if rebooting {
+		return base.InstanceInProgress, nil
+	}
+
+	if !i.CreateExtensions {
+		return base.InstanceReady, nil
+	}
+	if err := d.refreshEndpoint(i); err != nil {
+		return base.InstanceNotModified, err
+	}
+	if err := d.dbExtensions.createExtensions(i, password); err != nil {
+		return base.InstanceNotModified, err
+	}
+	return base.InstanceReady, nil
+}
+
+// upgradeDB is not supported for clusters; setUpgradeVersion rejects upgrades
+// of them.
+func (d *auroraDBAdapter) upgradeDB(i *RDSInstance) (base.InstanceState, string, error) {
+	return base.InstanceNotModified, "", errors.New("major version upgrades are not supported for Aurora clusters")
+}
+
+// modifyDB applies the settings of the cluster, moves its instances to the
+// instance class of the plan, and adds or removes readers to match the plan.
+func (d *auroraDBAdapter) modifyDB(i *RDSInstance, password string) (base.InstanceState, error) {
+	err := d.parameterGroupClient.ProvisionCustomParameterGroupIfNecessary(i, ConvertTagsToRDSTags(i.Tags))
+	if err != nil {
+		return base.InstanceNotModified, err
+	}
+
+	params := &rds.ModifyDBClusterInput{
+		DBClusterIdentifier:   &i.Database,
+		ApplyImmediately:      aws.Bool(true),
+		BackupRetentionPeriod: aws.Int64(i.BackupRetentionPeriod),
+	}
+	if i.ClearPassword != "" {
+		params.MasterUserPassword = aws.String(i.ClearPassword)
+	}
+	if i.ParameterGroupName != "" {
+		params.DBClusterParameterGroupName = aws.String(i.ParameterGroupName)
+	}
+	_, err = d.rds.ModifyDBCluster(params)
+	if err != nil {
+		return base.InstanceNotModified, err
+	}
+
+	if err := d.modifyClusterInstances(i); err != nil {
+		return base.InstanceNotModified, err
+	}
+	return base.InstanceInProgress, nil
+}
+
+// modifyClusterInstances changes the instance class of the instances of the
+// cluster when the plan has another one, and creates or deletes readers until
+// the cluster has as many as the plan. The newest readers are deleted first.
+func (d *auroraDBAdapter) modifyClusterInstances(i *RDSInstance) error {
+	cluster, err := d.describeCluster(i)
+	if err != nil {
+		return err
+	}
+	writers := map[string]bool{}
+	for _, member := range cluster.DBClusterMembers {
+		if aws.BoolValue(member.IsClusterWriter) {
+			writers[aws.StringValue(member.DBInstanceIdentifier)] = true
+		}
+	}
+
+	instances, err := d.describeClusterInstances(i)
+	if err != nil {
+		return err
+	}
+	identifiers := map[string]bool{}
+	var readers []*rds.DBInstance
+	for _, instance := range instances {
+		identifier := aws.StringValue(instance.DBInstanceIdentifier)
+		identifiers[identifier] = true
+		if aws.StringValue(instance.DBInstanceStatus) == "deleting" {
+			continue
+		}
+		if aws.StringValue(instance.DBInstanceClass) != d.Plan.InstanceClass {
+			log.Printf("changing the instance class of %s to %s", identifier, d.Plan.InstanceClass)
+			_, err := d.rds.ModifyDBInstance(&rds.ModifyDBInstanceInput{
+				DBInstanceIdentifier: instance.DBInstanceIdentifier,
+				DBInstanceClass:      &d.Plan.InstanceClass,
+				ApplyImmediately:     aws.Bool(true),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if !writers[identifier] {
+			readers = append(readers, instance)
+		}
+	}
+
+	sort.SliceStable(readers, func(a, b int) bool {
+		return aws.TimeValue(readers[a].InstanceCreateTime).After(aws.TimeValue(readers[b].InstanceCreateTime))
+	})
+	for n := len(readers); n > int(d.Plan.ReaderInstances); n-- {
+		reader := readers[len(readers)-n]
+		log.Printf("deleting reader %s of %s", aws.StringValue(reader.DBInstanceIdentifier), i.Database)
+		_, err := d.rds.DeleteDBInstance(&rds.DeleteDBInstanceInput{
+			DBInstanceIdentifier: reader.DBInstanceIdentifier,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for n, count := 1, len(readers); count < int(d.Plan.ReaderInstances); n++ {
+		identifier := clusterInstanceIdentifier(i, n)
+		if identifiers[identifier] {
+			continue
+		}
+		log.Printf("creating reader %s of %s", identifier, i.Database)
+		_, err := d.rds.CreateDBInstance(d.prepareCreateDbInstanceInput(i, identifier))
+		if err != nil {
+			return err
+		}
+		count++
+	}
+	return nil
+}
+
+func (d *auroraDBAdapter) describeCluster(i *RDSInstance) (*rds.DBCluster, error) {
+	resp, err := d.rds.DescribeDBClusters(&rds.DescribeDBClustersInput{
+		DBClusterIdentifier: aws.String(i.Database),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.DBClusters) == 0 {
+		return nil, fmt.Errorf("cluster %s was not found", i.Database)
+	}
+	return resp.DBClusters[0], nil
+}
+
+func (d *auroraDBAdapter) describeClusterInstances(i *RDSInstance) ([]*rds.DBInstance, error) {
+	resp, err := d.rds.DescribeDBInstances(&rds.DescribeDBInstancesInput{
+		Filters: []*rds.Filter{
+			{
+				Name:   aws.String("db-cluster-id"),
+				Values: []*string{aws.String(i.Database)},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.DBInstances, nil
+}
+
+// checkDBStatus reports the cluster as ready once it and all of its instances
+// are available.
+func (d *auroraDBAdapter) checkDBStatus(i *RDSInstance) (base.InstanceState, error) {
+	// Only search for details if the instance was not indicated as ready.
+	if i.State == base.InstanceReady {
+		return base.InstanceNotCreated, nil
+	}
+
+	cluster, err := d.describeCluster(i)
+	if err != nil {
+		return base.InstanceNotCreated, err
+	}
+	log.Printf("Database cluster %s is %s", i.Database, aws.StringValue(cluster.Status))
+	switch aws.StringValue(cluster.Status) {
+	case "available":
+	case "deleting":
+		return base.InstanceNotGone, nil
+	case "failed":
+		return base.InstanceNotCreated, nil
+	default:
+		return base.InstanceInProgress, nil
+	}
+
+	instances, err := d.describeClusterInstances(i)
+	if err != nil {
+		return base.InstanceNotCreated, err
+	}
+	if len(instances) == 0 {
+		return base.InstanceNotCreated, fmt.Errorf("cluster %s has no instances", i.Database)
+	}
+	for _, instance := range instances {
+		switch aws.StringValue(instance.DBInstanceStatus) {
+		case "available":
+		case "failed":
+			return base.InstanceNotCreated, nil
+		default:
+			return base.InstanceInProgress, nil
+		}
+	}
+	return base.InstanceReady, nil
+}
+
+// bindDBToApp waits for the cluster endpoints to be known and returns the
+// credentials for the application, which include the reader endpoint. If a
+// binding is given, a database user is created for it and its credentials are
+// returned instead of the master credentials.
+func (d *auroraDBAdapter) bindDBToApp(i *RDSInstance, password string, b *RDSBinding) (map[string]string, error) {
+	if err := d.refreshEndpoint(i); err != nil {
+		return nil, err
+	}
+	if b == nil {
+		return i.getCredentials(password)
+	}
+	if err := d.dbUsers.createUser(i, password, b); err != nil {
+		return nil, err
+	}
+	return i.getBindingCredentials(b, d.settings.Region)
+}
+
+// refreshEndpoint looks up the writer and reader endpoints of a cluster that
+// is not known to be ready yet, and marks it as ready once it is available.
+func (d *auroraDBAdapter) refreshEndpoint(i *RDSInstance) error {
+	if i.State == base.InstanceReady {
+		return nil
+	}
+
+	cluster, err := d.describeCluster(i)
+	if err != nil {
+		return err
+	}
+	if aws.StringValue(cluster.Status) != "available" {
+		return errors.New("Cluster not available yet. Please wait and try again..")
+	}
+	if cluster.Endpoint == nil || cluster.Port == nil {
+		return fmt.Errorf("cluster %s has no endpoint", i.Database)
+	}
+	i.Host = aws.StringValue(cluster.Endpoint)
+	i.ReaderHost = aws.StringValue(cluster.ReaderEndpoint)
+	i.Port = aws.Int64Value(cluster.Port)
+	i.State = base.InstanceReady
+	return nil
+}
+
+func (d *auroraDBAdapter) unbindDBFromApp(i *RDSInstance, password string, b *RDSBinding) error {
+	return d.dbUsers.dropUser(i, password, b)
+}
+
+// deleteDB starts deleting the instances of the cluster and the cluster, taking
+// a final snapshot of the cluster first. Deletion completes asynchronously.
+func (d *auroraDBAdapter) deleteDB(i *RDSInstance) (base.InstanceState, error) {
+	instances, err := d.describeClusterInstances(i)
+	if err != nil {
+		return base.InstanceNotGone, err
+	}
+	for _, instance := range instances {
+		if aws.StringValue(instance.DBInstanceStatus) == "deleting" {
+			continue
+		}
+		_, err := d.rds.DeleteDBInstance(&rds.DeleteDBInstanceInput{
+			DBInstanceIdentifier: instance.DBInstanceIdentifier,
+		})
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == rds.ErrCodeDBInstanceNotFoundFault {
+			continue
+		}
+		if err != nil {
+			return base.InstanceNotGone, err
+		}
+	}
+
+	_, err = d.rds.DeleteDBCluster(&rds.DeleteDBClusterInput{
+		DBClusterIdentifier:       aws.String(i.Database),
+		FinalDBSnapshotIdentifier: aws.String(i.finalSnapshotIdentifier()),
+		SkipFinalSnapshot:         aws.Bool(false),
+	})
+	if err != nil {
+		// Cluster no longer exists, so there is nothing to snapshot
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == rds.ErrCodeDBClusterNotFoundFault {
+			return base.InstanceGone, nil
+		}
+		return base.InstanceNotGone, err
+	}
+	return base.InstanceInProgress, nil
+}
+
+// checkDBDeletionStatus reports whether a cluster being deleted is gone, and
+// cleans up the custom cluster parameter groups that were left unused once it is.
+func (d *auroraDBAdapter) checkDBDeletionStatus(i *RDSInstance) (base.InstanceState, error) {
+	_, err := d.rds.DescribeDBClusters(&rds.DescribeDBClustersInput{
+		DBClusterIdentifier: aws.String(i.Database),
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == rds.ErrCodeDBClusterNotFoundFault {
+			d.parameterGroupClient.CleanupCustomParameterGroups()
+			return base.InstanceGone, nil
+		}
+		return base.InstanceNotGone, err
+	}
+	return base.InstanceInProgress, nil
+}
+
+// deleteProvisionedResource deletes a resource created while provisioning a
+// cluster that failed. Since the cluster was never provisioned, it is deleted
+// without a final snapshot.
+func (d *auroraDBAdapter) deleteProvisionedResource(r base.ProvisionedResource) error {
+	switch r.Type {
+	case dbInstanceResource:
+		_, err := d.rds.DeleteDBInstance(&rds.DeleteDBInstanceInput{
+			DBInstanceIdentifier: aws.String(r.Identifier),
+		})
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == rds.ErrCodeDBInstanceNotFoundFault {
+			return nil
+		}
+		return err
+	case dbClusterResource:
+		// The instances of the cluster are deleted first, since they were
+		// created after it.
+		_, err := d.rds.DeleteDBCluster(&rds.DeleteDBClusterInput{
+			DBClusterIdentifier: aws.String(r.Identifier),
+			SkipFinalSnapshot:   aws.Bool(true),
+		})
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == rds.ErrCodeDBClusterNotFoundFault {
+			return nil
+		}
+		return err
+	case dbClusterParameterGroupResource:
+		_, err := d.rds.DeleteDBClusterParameterGroup(&rds.DeleteDBClusterParameterGroupInput{
+			DBClusterParameterGroupName: aws.String(r.Identifier),
+		})
+		if awsErr, ok := err.(awserr.Error); ok {
+			switch awsErr.Code() {
+			case rds.ErrCodeDBParameterGroupNotFoundFault:
+				return nil
+			case rds.ErrCodeInvalidDBParameterGroupStateFault:
+				// The group is in use until the cluster is deleted, after
+				// which CleanupCustomParameterGroups deletes it.
+				return nil
+			}
+		}
+		return err
+	}
+	return fmt.Errorf("unknown resource type %s", r.Type)
+}
@@ -1,38 +1,51 @@
 package rds
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/iam"
 	"github.com/aws/aws-sdk-go/service/rds"
 	brokertags "github.com/cloud-gov/go-broker-tags"
 	"github.com/jinzhu/gorm"
 
+	"github.com/18F/aws-broker/awssecrets"
 	"github.com/18F/aws-broker/base"
 	"github.com/18F/aws-broker/catalog"
 	"github.com/18F/aws-broker/config"
 	"github.com/18F/aws-broker/helpers/request"
 	"github.com/18F/aws-broker/helpers/response"
+	"github.com/18F/aws-broker/helpers/schema"
 )
 
 // Options is a struct containing all of the custom parameters supported by
 // the broker for the "cf create-service" and "cf update-service" commands -
 // they are passed in via the "-c <JSON string or file>" flag.
 type Options struct {
-	AllocatedStorage                int64    `json:"storage"`
-	EnableFunctions                 bool     `json:"enable_functions"`
-	PubliclyAccessible              bool     `json:"publicly_accessible"`
-	Version                         string   `json:"version"`
-	BackupRetentionPeriod           *int64   `json:"backup_retention_period"`
-	BinaryLogFormat                 string   `json:"binary_log_format"`
-	EnablePgCron                    *bool    `json:"enable_pg_cron"`
-	RotateCredentials               *bool    `json:"rotate_credentials"`
-	StorageType                     string   `json:"storage_type"`
-	EnableCloudWatchLogGroupExports []string `json:"enable_cloudwatch_log_groups_exports"`
+	AllocatedStorage                int64             `json:"storage" description:"Storage of the database in GB"`
+	EnableFunctions                 bool              `json:"enable_functions" description:"Allow MySQL users to create functions"`
+	PubliclyAccessible              bool              `json:"publicly_accessible" description:"Make the database accessible from outside of the VPC"`
+	Version                         string            `json:"version" description:"Major engine version approved by the plan"`
+	BackupRetentionPeriod           *int64            `json:"backup_retention_period" description:"Number of days automated backups are kept"`
+	BinaryLogFormat                 string            `json:"binary_log_format" description:"MySQL binary log format: ROW, STATEMENT or MIXED"`
+	EnablePgCron                    *bool             `json:"enable_pg_cron" description:"Enable the pg_cron extension of PostgreSQL"`
+	RotateCredentials               *bool             `json:"rotate_credentials" description:"Rotate the master credentials of the database"`
+	StorageType                     string            `json:"storage_type" description:"Storage type of the database, e.g. gp3"`
+	EnableCloudWatchLogGroupExports []string          `json:"enable_cloudwatch_log_groups_exports" description:"Database logs exported to CloudWatch"`
+	RestoreFromSnapshot             string            `json:"restore_from_snapshot" description:"Final snapshot of a deleted instance to create the instance from"`
+	SourceInstanceGUID              string            `json:"source_instance_guid" description:"GUID of an instance to clone"`
+	RestoreTime                     string            `json:"restore_time" description:"RFC 3339 time to clone the source instance at"`
+	ReadReplicaOf                   string            `json:"read_replica_of" description:"GUID of the primary instance to create a read replica of"`
+	IAMAuth                         *bool             `json:"iam_auth" description:"Enable IAM database authentication for new bindings"`
+	Parameters                      map[string]string `json:"parameters" description:"Database parameters allowed by the plan, e.g. max_connections"`
+	Extensions                      []string          `json:"extensions" description:"PostgreSQL extensions to load, e.g. pg_stat_statements"`
+	CreateExtensions                *bool             `json:"create_extensions" description:"Create the loaded extensions in the database"`
 }
 
 // Validate the custom parameters passed in via the "-c <JSON string or file>"
@@ -60,13 +73,55 @@ func (o Options) Validate(settings *config.Settings) error {
 		return err
 	}
 
+	if _, err := o.parseRestoreTime(); err != nil {
+		return err
+	}
+
+	if o.RestoreTime != "" && o.SourceInstanceGUID == "" {
+		return errors.New("restore_time requires source_instance_guid")
+	}
+
+	if o.SourceInstanceGUID != "" && o.RestoreFromSnapshot != "" {
+		return errors.New("only one of source_instance_guid and restore_from_snapshot can be set")
+	}
+
+	if o.ReadReplicaOf != "" && (o.SourceInstanceGUID != "" || o.RestoreFromSnapshot != "") {
+		return errors.New("read_replica_of cannot be combined with source_instance_guid or restore_from_snapshot")
+	}
+
 	return nil
 }
 
+// parseRestoreTime returns the point in time to clone the source instance at,
+// or nil to clone it at its latest restorable time.
+func (o Options) parseRestoreTime() (*time.Time, error) {
+	if o.RestoreTime == "" {
+		return nil, nil
+	}
+	restoreTime, err := time.Parse(time.RFC3339, o.RestoreTime)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid restore_time %s; must be an RFC 3339 timestamp, e.g. 2024-01-02T15:04:05Z", o.RestoreTime)
+	}
+	return &restoreTime, nil
+}
+
+// ParameterSchemas returns the schemas of the parameters accepted by RDS plans.
+func ParameterSchemas() *catalog.Schemas {
+	options := schema.Generate(Options{})
+	return &catalog.Schemas{
+		ServiceInstance: catalog.ServiceInstanceSchema{
+			Create: catalog.InputParametersSchema{Parameters: options},
+			// Restoring, cloning and replicating only apply to new instances.
+			Update: catalog.InputParametersSchema{Parameters: options.Without("restore_from_snapshot", "source_instance_guid", "restore_time", "read_replica_of")},
+		},
+	}
+}
+
 type rdsBroker struct {
-	brokerDB   *gorm.DB
-	settings   *config.Settings
-	tagManager brokertags.TagManager
+	brokerDB         *gorm.DB
+	settings         *config.Settings
+	tagManager       brokertags.TagManager
+	credentialsStore awssecrets.CredentialsStore
 }
 
 // initializeAdapter is the main function to create database instances
@@ -88,6 +143,19 @@ func initializeAdapter(plan catalog.RDSPlan, s *config.Settings, c *catalog.Cata
 			settings:             *s,
 			rds:                  rdsClient,
 			parameterGroupClient: parameterGroupClient,
+			dbUsers:              &sqlDBUserClient{},
+			dbExtensions:         &sqlDBUserClient{},
+			iamAuth:              newAWSIAMAuthClient(iam.New(session.New(), aws.NewConfig().WithRegion(s.Region)), rdsClient),
+		}
+	case "aurora":
+		rdsClient := rds.New(session.New(), aws.NewConfig().WithRegion(s.Region))
+		dbAdapter = &auroraDBAdapter{
+			Plan:                 plan,
+			settings:             *s,
+			rds:                  rdsClient,
+			parameterGroupClient: NewAwsClusterParameterGroupClient(rdsClient, *s),
+			dbUsers:              &sqlDBUserClient{},
+			dbExtensions:         &sqlDBUserClient{},
 		}
 	default:
 		return nil, response.NewErrorResponse(http.StatusInternalServerError, "Adapter not found")
@@ -98,14 +166,19 @@ func initializeAdapter(plan catalog.RDSPlan, s *config.Settings, c *catalog.Cata
 
 // InitRDSBroker is the constructor for the rdsBroker.
 func InitRDSBroker(brokerDB *gorm.DB, settings *config.Settings, tagManager brokertags.TagManager) base.Broker {
-	return &rdsBroker{brokerDB, settings, tagManager}
+	return &rdsBroker{
+		brokerDB:         brokerDB,
+		settings:         settings,
+		tagManager:       tagManager,
+		credentialsStore: awssecrets.NewCredentialsStore(settings),
+	}
 }
 
 // this helps the manager to respond appropriately depending on whether a service/plan needs an operation to be async
 func (broker *rdsBroker) AsyncOperationRequired(c *catalog.Catalog, i base.Instance, o base.Operation) bool {
 	switch o {
 	case base.DeleteOp:
-		return false
+		return true
 	case base.CreateOp:
 		return true
 	case base.ModifyOp:
@@ -122,7 +195,7 @@ func (broker *rdsBroker) CreateInstance(c *catalog.Catalog, id string, createReq
 
 	options := Options{}
 	if len(createRequest.RawParameters) > 0 {
-		err := json.Unmarshal(createRequest.RawParameters, &options)
+		err := request.DecodeParameters(createRequest.RawParameters, &options)
 		if err != nil {
 			return response.NewErrorResponse(http.StatusBadRequest, "Invalid parameters. Error: "+err.Error())
 		}
@@ -142,6 +215,22 @@ func (broker *rdsBroker) CreateInstance(c *catalog.Catalog, id string, createReq
 	if planErr != nil {
 		return planErr
 	}
+	if plan.Replica && options.ReadReplicaOf == "" {
+		return response.NewErrorResponse(
+			http.StatusBadRequest,
+			"The "+plan.Name+" plan creates read replicas; please set read_replica_of to the GUID of the primary instance.",
+		)
+	}
+	// The readers of Aurora clusters are set by their plan.
+	if plan.Adapter == "aurora" && (options.RestoreFromSnapshot != "" || options.SourceInstanceGUID != "" || options.ReadReplicaOf != "") {
+		return response.NewErrorResponse(
+			http.StatusBadRequest,
+			"The "+plan.Name+" plan creates Aurora clusters, which cannot be restored from snapshots, cloned or replicated.",
+		)
+	}
+	if err := validateCustomParameters(options.Parameters, plan); err != nil {
+		return response.NewErrorResponse(http.StatusBadRequest, err.Error())
+	}
 	// make sure it's a valid major version.
 	if options.Version != "" {
 		// Check to make sure that the version specified is allowed by the plan.
@@ -183,6 +272,31 @@ func (broker *rdsBroker) CreateInstance(c *catalog.Catalog, id string, createReq
 		return response.NewErrorResponse(http.StatusBadRequest, "There was an error initializing the instance. Error: "+err.Error())
 	}
 
+	if options.RestoreFromSnapshot != "" {
+		snapshot, errResp := broker.findSnapshot(options.RestoreFromSnapshot, createRequest.SpaceGUID, plan)
+		if errResp != nil {
+			return errResp
+		}
+		newInstance.restoreFromSnapshot(snapshot)
+	}
+
+	if options.SourceInstanceGUID != "" {
+		source, errResp := broker.findSourceInstance(options.SourceInstanceGUID, createRequest.OrganizationGUID, plan)
+		if errResp != nil {
+			return errResp
+		}
+		restoreTime, _ := options.parseRestoreTime()
+		newInstance.restoreFromInstance(source, restoreTime)
+	}
+
+	if options.ReadReplicaOf != "" {
+		primary, errResp := broker.findPrimaryInstance(options.ReadReplicaOf, createRequest.OrganizationGUID, plan)
+		if errResp != nil {
+			return errResp
+		}
+		newInstance.replicate(primary)
+	}
+
 	adapter, adapterErr := initializeAdapter(plan, broker.settings, c)
 	if adapterErr != nil {
 		return adapterErr
@@ -191,6 +305,7 @@ func (broker *rdsBroker) CreateInstance(c *catalog.Catalog, id string, createReq
 	// Create the database instance.
 	status, err := adapter.createDB(newInstance, newInstance.ClearPassword)
 	if status == base.InstanceNotCreated {
+		broker.cleanupProvision(adapter, newInstance)
 		desc := "There was an error creating the instance."
 		if err != nil {
 			desc = desc + " Error: " + err.Error()
@@ -203,19 +318,144 @@ func (broker *rdsBroker) CreateInstance(c *catalog.Catalog, id string, createReq
 	broker.brokerDB.NewRecord(newInstance)
 	err = broker.brokerDB.Create(newInstance).Error
 	if err != nil {
+		broker.cleanupProvision(adapter, newInstance)
 		return response.NewErrorResponse(http.StatusBadRequest, err.Error())
 	}
+	// Keep track of the resources until the instance is saved by the manager.
+	err = base.SaveProvisionedResources(broker.brokerDB, id, createRequest.ServiceID, createRequest.PlanID, newInstance.Provisioned)
+	if err != nil {
+		log.Printf("CreateInstance - unable to record the resources of instance %s: %s", id, err)
+	}
 	return response.SuccessAcceptedResponse
 }
 
+// cleanupProvision tears down the resources created for an instance whose
+// provisioning failed, and records those that could not be deleted so that the
+// platform's orphan-mitigation delete can try again.
+func (broker *rdsBroker) cleanupProvision(adapter dbAdapter, i *RDSInstance) {
+	remaining, err := i.Provisioned.Teardown(adapter.deleteProvisionedResource)
+	if err != nil {
+		log.Printf("cleanupProvision - instance %s: %s", i.Uuid, err)
+	}
+	if err := base.SaveProvisionedResources(broker.brokerDB, i.Uuid, i.ServiceID, i.PlanID, remaining); err != nil {
+		log.Printf("cleanupProvision - unable to record the resources of instance %s: %s", i.Uuid, err)
+	}
+}
+
+// CleanupProvision tears down the recorded resources of an instance that the
+// broker did not save, e.g. when the platform deletes it to mitigate orphans.
+// The database row saved by CreateInstance is deleted too, so that the
+// provision can be retried with the same GUID.
+func (broker *rdsBroker) CleanupProvision(c *catalog.Catalog, id string, resources base.ProvisionedResources) response.Response {
+	if err := broker.brokerDB.Unscoped().Where("uuid = ?", id).Delete(&RDSInstance{}).Error; err != nil {
+		return response.NewErrorResponse(http.StatusInternalServerError, "Unable to delete the instance. Error: "+err.Error())
+	}
+	if len(resources) == 0 {
+		return response.SuccessDeleteResponse
+	}
+	plan, planErr := c.RdsService.FetchPlan(resources[0].PlanID)
+	if planErr != nil {
+		return planErr
+	}
+	adapter, adapterErr := initializeAdapter(plan, broker.settings, c)
+	if adapterErr != nil {
+		return adapterErr
+	}
+
+	remaining, err := resources.Teardown(adapter.deleteProvisionedResource)
+	if saveErr := base.SaveProvisionedResources(broker.brokerDB, id, resources[0].ServiceID, resources[0].PlanID, remaining); saveErr != nil {
+		return response.NewErrorResponse(http.StatusInternalServerError, "Unable to record the resources of the instance. Error: "+saveErr.Error())
+	}
+	if err != nil {
+		return response.NewErrorResponse(http.StatusInternalServerError, "There was an error deleting the resources of the instance. Error: "+err.Error())
+	}
+	return response.SuccessDeleteResponse
+}
+
+// findSnapshot returns a final snapshot that the space may restore with the plan.
+// Snapshots of other spaces are reported as not found.
+func (broker *rdsBroker) findSnapshot(snapshotID string, spaceGUID string, plan catalog.RDSPlan) (*RDSSnapshot, response.Response) {
+	snapshot := RDSSnapshot{}
+	err := broker.brokerDB.Where("snapshot_identifier = ? AND space_guid = ?", snapshotID, spaceGUID).First(&snapshot).Error
+	if err != nil {
+		return nil, response.NewErrorResponse(http.StatusBadRequest, "Snapshot "+snapshotID+" was not found in this space.")
+	}
+	if snapshot.DbType != plan.DbType {
+		return nil, response.NewErrorResponse(
+			http.StatusBadRequest,
+			"Snapshot "+snapshotID+" is of a "+snapshot.DbType+" database; please select a plan with the same database engine/type.",
+		)
+	}
+	return &snapshot, nil
+}
+
+// dropSourceBindingUsers drops the users of the bindings of the source of a
+// clone from the clone. Apps bound to the source know their passwords, so they
+// would otherwise have access to the clone too.
+func (broker *rdsBroker) dropSourceBindingUsers(adapter dbAdapter, i *RDSInstance, password string) error {
+	source := RDSInstance{}
+	var count int64
+	broker.brokerDB.Where(&RDSInstance{Database: i.RestoredFromInstance}).First(&source).Count(&count)
+	if count == 0 {
+		return nil
+	}
+	bindings := []RDSBinding{}
+	if err := broker.brokerDB.Where("instance_uuid = ? AND username <> ''", source.Uuid).Find(&bindings).Error; err != nil {
+		return err
+	}
+	if len(bindings) == 0 {
+		return nil
+	}
+	return adapter.dropBindingUsers(i, password, bindings)
+}
+
+// findSourceInstance returns an instance that can be cloned with the plan by the org.
+// Instances of other orgs are reported as not found.
+func (broker *rdsBroker) findSourceInstance(sourceGUID string, orgGUID string, plan catalog.RDSPlan) (*RDSInstance, response.Response) {
+	source := NewRDSInstance()
+	err := broker.brokerDB.Where("uuid = ? AND organization_guid = ?", sourceGUID, orgGUID).First(source).Error
+	if err != nil {
+		return nil, response.NewErrorResponse(http.StatusBadRequest, "Source instance "+sourceGUID+" was not found in this organization.")
+	}
+	if source.DbType != plan.DbType {
+		return nil, response.NewErrorResponse(
+			http.StatusBadRequest,
+			"Source instance "+sourceGUID+" is a "+source.DbType+" database; please select a plan with the same database engine/type.",
+		)
+	}
+	if source.isAurora() {
+		return nil, response.NewErrorResponse(
+			http.StatusBadRequest,
+			"Source instance "+sourceGUID+" is an Aurora cluster, which cannot be cloned or replicated.",
+		)
+	}
+	return source, nil
+}
+
+// findPrimaryInstance returns an instance that the org may create a read replica
+// of with the plan. Instances of other orgs are reported as not found.
+func (broker *rdsBroker) findPrimaryInstance(primaryGUID string, orgGUID string, plan catalog.RDSPlan) (*RDSInstance, response.Response) {
+	primary, errResp := broker.findSourceInstance(primaryGUID, orgGUID, plan)
+	if errResp != nil {
+		return nil, errResp
+	}
+	if primary.isReplica() {
+		return nil, response.NewErrorResponse(
+			http.StatusBadRequest,
+			"Instance "+primaryGUID+" is itself a read replica; please create the replica of its primary instance.",
+		)
+	}
+	return primary, nil
+}
+
 func (broker *rdsBroker) parseModifyOptionsFromRequest(
 	modifyRequest request.Request,
 ) (Options, error) {
 	options := Options{}
 	if len(modifyRequest.RawParameters) > 0 {
-		err := json.Unmarshal(modifyRequest.RawParameters, &options)
+		err := request.DecodeParameters(modifyRequest.RawParameters, &options)
 		if err != nil {
-			return options, err
+			return Options{}, err
 		}
 		err = options.Validate(broker.settings)
 		if err != nil {
@@ -246,11 +486,39 @@ func (broker *rdsBroker) ModifyInstance(c *catalog.Catalog, id string, modifyReq
 		return newPlanErr
 	}
 
+	if err := validateCustomParameters(options.Parameters, newPlan); err != nil {
+		return response.NewErrorResponse(http.StatusBadRequest, err.Error())
+	}
+
 	err = existingInstance.modify(options, newPlan, broker.settings)
 	if err != nil {
 		return response.NewErrorResponse(http.StatusBadRequest, "Failed to modify instance. Error: "+err.Error())
 	}
 
+	// Bindings with IAM database authentication cannot connect without it.
+	if !existingInstance.iamAuthEnabled() {
+		var iamBindingCount int64
+		broker.brokerDB.Model(&RDSBinding{}).Where("instance_uuid = ? AND iam_user_name <> ''", id).Count(&iamBindingCount)
+		if iamBindingCount != 0 {
+			return response.NewErrorResponse(
+				http.StatusBadRequest,
+				"Cannot disable IAM database authentication while bindings use it. Please unbind them first.",
+			)
+		}
+	}
+
+	// Read replicas would be left on the previous major version.
+	if existingInstance.UpgradeVersion != "" {
+		var replicaCount int64
+		broker.brokerDB.Model(&RDSInstance{}).Where("replica_of = ?", id).Count(&replicaCount)
+		if replicaCount != 0 {
+			return response.NewErrorResponse(
+				http.StatusBadRequest,
+				"Cannot upgrade the major version of an instance with read replicas. Please delete the replicas first.",
+			)
+		}
+	}
+
 	// Check to make sure that we're not switching database engines; this is not
 	// allowed.
 	if newPlan.DbType != existingInstance.DbType {
@@ -260,6 +528,21 @@ func (broker *rdsBroker) ModifyInstance(c *catalog.Catalog, id string, modifyReq
 		)
 	}
 
+	// Clusters and single instances cannot be converted into each other.
+	if (newPlan.Adapter == "aurora") != existingInstance.isAurora() {
+		return response.NewErrorResponse(
+			http.StatusBadRequest,
+			"Cannot switch between Aurora clusters and single instances. Please select a plan of the same kind.",
+		)
+	}
+
+	if newPlan.Replica && !existingInstance.isReplica() {
+		return response.NewErrorResponse(
+			http.StatusBadRequest,
+			"Cannot switch to "+newPlan.Name+" because the service plan is for read replicas only.",
+		)
+	}
+
 	// Don't allow updating to a service plan that doesn't support updates.
 	if !newPlan.PlanUpdateable {
 		return response.NewErrorResponse(
@@ -295,6 +578,21 @@ func (broker *rdsBroker) ModifyInstance(c *catalog.Catalog, id string, modifyReq
 		return response.NewErrorResponse(http.StatusBadRequest, err.Error())
 	}
 
+	// Read replicas share the master credentials of their primary.
+	if options.RotateCredentials != nil && *options.RotateCredentials {
+		err = broker.brokerDB.Model(&RDSInstance{}).Where("replica_of = ?", id).Updates(map[string]interface{}{
+			"password":          existingInstance.Password,
+			"salt":              existingInstance.Salt,
+			"encryption_key_id": existingInstance.EncryptionKeyID,
+		}).Error
+		if err != nil {
+			return response.NewErrorResponse(http.StatusInternalServerError, err.Error())
+		}
+		if err := broker.updateMasterCredentialsSecrets(c, adapter, existingInstance); err != nil {
+			return response.NewErrorResponse(http.StatusInternalServerError, "There was an error updating the stored credentials. Error: "+err.Error())
+		}
+	}
+
 	return response.SuccessAcceptedResponse
 }
 
@@ -317,8 +615,76 @@ func (broker *rdsBroker) LastOperation(c *catalog.Catalog, id string, baseInstan
 		return adapterErr
 	}
 
+	if operation == base.DeleteOp.String() {
+		return broker.lastDeleteOperation(adapter, existingInstance, baseInstance)
+	}
+
 	var state string
 	status, _ := adapter.checkDBStatus(existingInstance)
+
+	// A restored instance still has the master password of the snapshot's source
+	// instance until it is reset, which can only be done once it is available.
+	if status == base.InstanceReady && existingInstance.MasterPasswordResetPending {
+		password, err := existingInstance.getPassword(broker.settings)
+		if err != nil {
+			return response.NewErrorResponse(http.StatusInternalServerError, "Unable to get instance password.")
+		}
+		status, err = adapter.completeRestore(existingInstance, password)
+		if err != nil {
+			return response.NewErrorResponse(http.StatusInternalServerError, "There was an error completing the restore. Error: "+err.Error())
+		}
+		if status == base.InstanceReady && existingInstance.RestoredFromInstance != "" {
+			if err := broker.dropSourceBindingUsers(adapter, existingInstance, password); err != nil {
+				return response.NewErrorResponse(http.StatusInternalServerError, "There was an error dropping the binding users of the source instance. Error: "+err.Error())
+			}
+		}
+		if status == base.InstanceReady {
+			existingInstance.MasterPasswordResetPending = false
+		}
+		broker.brokerDB.Save(existingInstance)
+	}
+
+	// Major version upgrades take a snapshot of the instance before upgrading
+	// it, so they take several steps, and follow the instance while it is
+	// upgrading to tell a failed upgrade from one that has not started yet.
+	var description string
+	if (status == base.InstanceReady || status == base.InstanceInProgress) && existingInstance.UpgradeVersion != "" {
+		tags, err := broker.resourceTags(c, existingInstance)
+		if err != nil {
+			return response.NewErrorResponse(http.StatusInternalServerError, "There was an error generating the tags. Error: "+err.Error())
+		}
+		existingInstance.setTags(plan, tags)
+		status, description, err = adapter.upgradeDB(existingInstance)
+		if err != nil {
+			return response.NewErrorResponse(http.StatusInternalServerError, "There was an error upgrading the instance. Error: "+err.Error())
+		}
+		if status != base.InstanceInProgress {
+			existingInstance.UpgradeVersion = ""
+		}
+		broker.brokerDB.Save(existingInstance)
+	}
+
+	// Changed extensions are loaded by rebooting the instance once it is
+	// available, and then created in the database.
+	if status == base.InstanceReady && existingInstance.ExtensionsPending {
+		password, err := existingInstance.getPassword(broker.settings)
+		if err != nil {
+			return response.NewErrorResponse(http.StatusInternalServerError, "Unable to get instance password.")
+		}
+		status, err = adapter.applyExtensions(existingInstance, password)
+		if err != nil {
+			log.Printf("LastOperation - unable to apply the extensions of instance %s: %s", id, err)
+			status = base.InstanceNotModified
+			description = "the extensions could not be applied: " + err.Error()
+		}
+		// A failed update is not retried, so later polls neither reboot the
+		// instance nor create the extensions again.
+		if status != base.InstanceInProgress {
+			existingInstance.ExtensionsPending = false
+			broker.brokerDB.Save(existingInstance)
+		}
+	}
+
 	switch status {
 	case base.InstanceInProgress:
 		state = "in progress"
@@ -333,10 +699,31 @@ func (broker *rdsBroker) LastOperation(c *catalog.Catalog, id string, baseInstan
 	default:
 		state = "in progress"
 	}
+	if description != "" {
+		return response.NewSuccessLastOperation(state, "The service instance status is "+state+": "+description)
+	}
 	return response.NewSuccessLastOperation(state, "The service instance status is "+state)
 }
 
-func (broker *rdsBroker) BindInstance(c *catalog.Catalog, id string, bindRequest request.Request, baseInstance base.Instance) response.Response {
+func (broker *rdsBroker) lastDeleteOperation(adapter dbAdapter, existingInstance *RDSInstance, baseInstance base.Instance) response.Response {
+	var state string
+	status, _ := adapter.checkDBDeletionStatus(existingInstance)
+	switch status {
+	case base.InstanceGone:
+		state = "succeeded"
+		broker.deleteCredentialsSecrets(existingInstance)
+		broker.brokerDB.Unscoped().Where("instance_uuid = ?", existingInstance.Uuid).Delete(RDSBinding{})
+		broker.brokerDB.Unscoped().Delete(existingInstance)
+		broker.brokerDB.Unscoped().Delete(&baseInstance)
+	case base.InstanceNotGone:
+		state = "failed"
+	default:
+		state = "in progress"
+	}
+	return response.NewSuccessLastOperation(state, "The service instance status is "+state)
+}
+
+func (broker *rdsBroker) BindInstance(c *catalog.Catalog, id string, bindingID string, bindRequest request.Request, baseInstance base.Instance) response.Response {
 	existingInstance := NewRDSInstance()
 
 	var count int64
@@ -350,11 +737,7 @@ func (broker *rdsBroker) BindInstance(c *catalog.Catalog, id string, bindRequest
 		return planErr
 	}
 
-	password, err := existingInstance.dbUtils.getPassword(
-		existingInstance.Salt,
-		existingInstance.Password,
-		broker.settings.EncryptionKey,
-	)
+	password, err := existingInstance.getPassword(broker.settings)
 	if err != nil {
 		return response.NewErrorResponse(http.StatusInternalServerError, "Unable to get instance password.")
 	}
@@ -365,10 +748,57 @@ func (broker *rdsBroker) BindInstance(c *catalog.Catalog, id string, bindRequest
 		return adapterErr
 	}
 
+	// If the binding already exists, return the credentials that were issued for it.
+	var bindingCount int64
+	existingBinding := RDSBinding{}
+	broker.brokerDB.Where("binding_id = ?", bindingID).First(&existingBinding).Count(&bindingCount)
+	if bindingCount != 0 {
+		if existingBinding.InstanceUuid != id {
+			return response.NewErrorResponse(http.StatusConflict, "The binding already exists for another instance")
+		}
+		credentials, errResp := broker.bindingCredentials(adapter, existingInstance, &existingBinding)
+		if errResp != nil {
+			return errResp
+		}
+		// The credentials could not be stored when the binding was created.
+		if broker.credentialsStore != nil {
+			if existingBinding.sharesMasterCredentials() {
+				if existingInstance.CredentialsSecretARN == "" {
+					if err := broker.storeMasterCredentials(c, existingInstance, credentials); err != nil {
+						return response.NewErrorResponse(http.StatusInternalServerError, "There was an error storing the credentials. Error: "+err.Error())
+					}
+				}
+			} else if existingBinding.CredentialsSecretARN == "" {
+				if errResp := broker.storeBindingCredentials(c, existingInstance, &existingBinding, credentials); errResp != nil {
+					return errResp
+				}
+			}
+		}
+		return response.NewSuccessBindResponse(credentials)
+	}
+
+	// Issue a database user for this binding when the engine supports it. Read
+	// replicas are read-only, so their bindings get the master credentials.
+	var newBinding *RDSBinding
+	if supportsBindingUsers(existingInstance.DbType) && !existingInstance.isReplica() {
+		newBinding = &RDSBinding{}
+		if err := newBinding.init(bindingID, existingInstance, broker.settings); err != nil {
+			return response.NewErrorResponse(http.StatusInternalServerError, "There was an error initializing the binding. Error: "+err.Error())
+		}
+		// The IAM user of the binding is tagged like the instance.
+		if newBinding.isIAMAuth() {
+			tags, err := broker.resourceTags(c, existingInstance)
+			if err != nil {
+				return response.NewErrorResponse(http.StatusInternalServerError, "There was an error generating the tags. Error: "+err.Error())
+			}
+			existingInstance.setTags(plan, tags)
+		}
+	}
+
 	var credentials map[string]string
 	// Bind the database instance to the application.
 	originalInstanceState := existingInstance.State
-	if credentials, err = adapter.bindDBToApp(existingInstance, password); err != nil {
+	if credentials, err = adapter.bindDBToApp(existingInstance, password, newBinding); err != nil {
 		desc := "There was an error binding the database instance to the application."
 		if err != nil {
 			desc = desc + " Error: " + err.Error()
@@ -381,9 +811,334 @@ func (broker *rdsBroker) BindInstance(c *catalog.Catalog, id string, bindRequest
 		broker.brokerDB.Save(existingInstance)
 	}
 
+	if newBinding != nil {
+		if err := broker.saveBinding(adapter, existingInstance, password, newBinding); err != nil {
+			return response.NewErrorResponse(http.StatusInternalServerError, err.Error())
+		}
+	} else if err := broker.brokerDB.Create(&RDSBinding{BindingID: bindingID, InstanceUuid: id}).Error; err != nil {
+		return response.NewErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+
+	broker.addReplicaURI(adapter, existingInstance, credentials)
+
+	if newBinding != nil {
+		if errResp := broker.storeBindingCredentials(c, existingInstance, newBinding, credentials); errResp != nil {
+			return errResp
+		}
+	} else if broker.credentialsStore != nil {
+		if err := broker.storeMasterCredentials(c, existingInstance, credentials); err != nil {
+			return response.NewErrorResponse(http.StatusInternalServerError, "There was an error storing the credentials. Error: "+err.Error())
+		}
+	}
 	return response.NewSuccessBindResponse(credentials)
 }
 
+// saveBinding records a binding whose users were just created. A binding that
+// cannot be recorded could not be unbound, so its users are dropped then.
+func (broker *rdsBroker) saveBinding(adapter dbAdapter, i *RDSInstance, password string, b *RDSBinding) error {
+	err := broker.brokerDB.Create(b).Error
+	if err != nil {
+		if unbindErr := adapter.unbindDBFromApp(i, password, b); unbindErr != nil {
+			log.Printf("unable to drop the users of binding %s: %s", b.BindingID, unbindErr)
+		}
+	}
+	return err
+}
+
+// resourceTags returns the tags of the resources created for an instance
+// after it was provisioned, like the secrets holding its credentials, the IAM
+// users of its bindings and the snapshots taken before upgrades.
+func (broker *rdsBroker) resourceTags(c *catalog.Catalog, i *RDSInstance) (map[string]string, error) {
+	plan, planErr := c.RdsService.FetchPlan(i.PlanID)
+	if planErr != nil {
+		return nil, fmt.Errorf("unable to find plan %s", i.PlanID)
+	}
+	return broker.tagManager.GenerateTags(
+		brokertags.Create,
+		c.RdsService.Name,
+		plan.Name,
+		brokertags.ResourceGUIDs{
+			InstanceGUID:     i.Uuid,
+			SpaceGUID:        i.SpaceGUID,
+			OrganizationGUID: i.OrganizationGUID,
+		},
+		false,
+	)
+}
+
+// storeBindingCredentials writes the credentials of a binding with its own
+// database user to Secrets Manager, when credentials are stored there, and
+// records the ARN of the secret.
+func (broker *rdsBroker) storeBindingCredentials(c *catalog.Catalog, i *RDSInstance, b *RDSBinding, credentials map[string]string) response.Response {
+	if broker.credentialsStore == nil {
+		return nil
+	}
+	tags, err := broker.resourceTags(c, i)
+	if err != nil {
+		return response.NewErrorResponse(http.StatusInternalServerError, "There was an error generating the tags. Error: "+err.Error())
+	}
+	name := awssecrets.CredentialsSecretName(c.RdsService.Name, i.Uuid, b.BindingID)
+	if err := awssecrets.StoreCredentials(broker.credentialsStore, name, credentials, tags); err != nil {
+		return response.NewErrorResponse(http.StatusInternalServerError, "There was an error storing the credentials. Error: "+err.Error())
+	}
+	b.CredentialsSecretARN = credentials[awssecrets.SecretARNKey]
+	if err := broker.brokerDB.Save(b).Error; err != nil {
+		return response.NewErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+	return nil
+}
+
+// storeMasterCredentials writes the master credentials of an instance, which
+// are shared by all of its bindings, to Secrets Manager and records the ARN of
+// the secret.
+func (broker *rdsBroker) storeMasterCredentials(c *catalog.Catalog, i *RDSInstance, credentials map[string]string) error {
+	tags, err := broker.resourceTags(c, i)
+	if err != nil {
+		return err
+	}
+	name := awssecrets.CredentialsSecretName(c.RdsService.Name, i.Uuid, "")
+	if err := awssecrets.StoreCredentials(broker.credentialsStore, name, credentials, tags); err != nil {
+		return err
+	}
+	if i.CredentialsSecretARN != credentials[awssecrets.SecretARNKey] {
+		i.CredentialsSecretARN = credentials[awssecrets.SecretARNKey]
+		return broker.brokerDB.Save(i).Error
+	}
+	return nil
+}
+
+// updateMasterCredentialsSecrets writes the rotated master credentials of an
+// instance to the secrets of the instance and of its read replicas, which share
+// them.
+func (broker *rdsBroker) updateMasterCredentialsSecrets(c *catalog.Catalog, adapter dbAdapter, i *RDSInstance) error {
+	if broker.credentialsStore == nil {
+		return nil
+	}
+
+	instances := []*RDSInstance{i}
+	replicas := []RDSInstance{}
+	broker.brokerDB.Where("replica_of = ?", i.Uuid).Find(&replicas)
+	for idx := range replicas {
+		replicas[idx].dbUtils = i.dbUtils
+		instances = append(instances, &replicas[idx])
+	}
+
+	for _, instance := range instances {
+		if instance.CredentialsSecretARN == "" {
+			continue
+		}
+		credentials, err := instance.getCredentials(i.ClearPassword)
+		if err != nil {
+			return err
+		}
+		if instance == i {
+			broker.addReplicaURI(adapter, i, credentials)
+		}
+		if err := broker.storeMasterCredentials(c, instance, credentials); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteCredentialsSecrets deletes the secrets holding the credentials issued
+// for an instance that is gone. Failures are only logged, since the credentials
+// are revoked along with the instance.
+func (broker *rdsBroker) deleteCredentialsSecrets(i *RDSInstance) {
+	if broker.credentialsStore == nil {
+		return
+	}
+	arns := []string{}
+	if i.CredentialsSecretARN != "" {
+		arns = append(arns, i.CredentialsSecretARN)
+	}
+	bindings := []RDSBinding{}
+	broker.brokerDB.Where("instance_uuid = ?", i.Uuid).Find(&bindings)
+	for _, b := range bindings {
+		if b.CredentialsSecretARN != "" {
+			arns = append(arns, b.CredentialsSecretARN)
+		}
+	}
+	for _, arn := range arns {
+		if err := broker.credentialsStore.DeleteCredentials(arn); err != nil {
+			log.Printf("unable to delete secret %s: %s", arn, err)
+		}
+	}
+}
+
+// bindingCredentials returns the credentials that were issued for an existing binding.
+func (broker *rdsBroker) bindingCredentials(adapter dbAdapter, i *RDSInstance, b *RDSBinding) (map[string]string, response.Response) {
+	if b.sharesMasterCredentials() {
+		credentials, errResp := broker.masterCredentials(i)
+		if errResp != nil {
+			return nil, errResp
+		}
+		broker.addReplicaURI(adapter, i, credentials)
+		return credentials, nil
+	}
+
+	var err error
+	err = b.decryptSecrets(i.dbUtils, broker.settings)
+	if err != nil {
+		return nil, response.NewErrorResponse(http.StatusInternalServerError, "Unable to get binding password.")
+	}
+	credentials, err := i.getBindingCredentials(b, broker.settings.Region)
+	if err != nil {
+		return nil, response.NewErrorResponse(http.StatusInternalServerError, "Unable to get binding credentials.")
+	}
+	broker.addReplicaURI(adapter, i, credentials)
+	if b.CredentialsSecretARN != "" {
+		credentials[awssecrets.SecretARNKey] = b.CredentialsSecretARN
+	}
+	return credentials, nil
+}
+
+// masterCredentials returns the master credentials of an instance.
+func (broker *rdsBroker) masterCredentials(i *RDSInstance) (map[string]string, response.Response) {
+	password, err := i.getPassword(broker.settings)
+	if err != nil {
+		return nil, response.NewErrorResponse(http.StatusInternalServerError, "Unable to get instance password.")
+	}
+	credentials, err := i.getCredentials(password)
+	if err != nil {
+		return nil, response.NewErrorResponse(http.StatusInternalServerError, "Unable to get instance credentials.")
+	}
+	if i.CredentialsSecretARN != "" {
+		credentials[awssecrets.SecretARNKey] = i.CredentialsSecretARN
+	}
+	return credentials, nil
+}
+
+// addReplicaURI adds the URI of the first available read replica of the
+// instance to the credentials. Users are replicated, so the binding's user
+// can read from the replica too.
+func (broker *rdsBroker) addReplicaURI(adapter dbAdapter, i *RDSInstance, credentials map[string]string) {
+	replicas := []RDSInstance{}
+	broker.brokerDB.Where("replica_of = ?", i.Uuid).Order("created_at").Find(&replicas)
+	for idx := range replicas {
+		replica := &replicas[idx]
+		replica.dbUtils = i.dbUtils
+
+		originalState := replica.State
+		if err := adapter.refreshEndpoint(replica); err != nil {
+			continue
+		}
+		if replica.State != originalState {
+			broker.brokerDB.Save(replica)
+		}
+
+		replicaCredentials, err := replica.dbUtils.getCredentials(replica, credentials["username"], credentials["password"])
+		if err != nil {
+			continue
+		}
+		credentials["replica_uri"] = replicaCredentials["uri"]
+		return
+	}
+}
+
+// FetchBinding returns the credentials of an existing binding. Instances that do
+// not issue a database user per binding share the master credentials with all
+// of their bindings.
+func (broker *rdsBroker) FetchBinding(c *catalog.Catalog, id string, bindingID string, baseInstance base.Instance) response.Response {
+	existingInstance := NewRDSInstance()
+
+	var count int64
+	broker.brokerDB.Where("uuid = ?", id).First(existingInstance).Count(&count)
+	if count == 0 {
+		return response.NewErrorResponse(http.StatusNotFound, "Instance not found")
+	}
+
+	plan, planErr := c.RdsService.FetchPlan(baseInstance.PlanID)
+	if planErr != nil {
+		return planErr
+	}
+
+	adapter, adapterErr := initializeAdapter(plan, broker.settings, c)
+	if adapterErr != nil {
+		return adapterErr
+	}
+
+	var bindingCount int64
+	existingBinding := RDSBinding{}
+	broker.brokerDB.Where("binding_id = ? AND instance_uuid = ?", bindingID, id).First(&existingBinding).Count(&bindingCount)
+	if bindingCount != 0 {
+		credentials, errResp := broker.bindingCredentials(adapter, existingInstance, &existingBinding)
+		if errResp != nil {
+			return errResp
+		}
+		return response.NewSuccessFetchBindingResponse(credentials)
+	}
+	return response.NewErrorResponse(http.StatusNotFound, "Binding not found")
+}
+
+// FetchInstance returns the plan and the settings applied to the instance.
+func (broker *rdsBroker) FetchInstance(c *catalog.Catalog, id string, baseInstance base.Instance) response.Response {
+	existingInstance := NewRDSInstance()
+
+	var count int64
+	broker.brokerDB.Where("uuid = ?", id).First(existingInstance).Count(&count)
+	if count == 0 {
+		return response.NewErrorResponse(http.StatusNotFound, "Instance not found")
+	}
+	return response.NewSuccessFetchInstanceResponse(existingInstance.ServiceID, existingInstance.PlanID, "", existingInstance.parameters())
+}
+
+func (broker *rdsBroker) UnbindInstance(c *catalog.Catalog, id string, bindingID string, baseInstance base.Instance) response.Response {
+	existingInstance := NewRDSInstance()
+
+	var count int64
+	broker.brokerDB.Where("uuid = ?", id).First(existingInstance).Count(&count)
+	if count == 0 {
+		return response.NewErrorResponse(http.StatusNotFound, "Instance not found")
+	}
+
+	// Bindings made before bindings were recorded share the master credentials
+	// and have no record, so there is nothing to revoke for them.
+	var bindingCount int64
+	existingBinding := RDSBinding{}
+	broker.brokerDB.Where("binding_id = ? AND instance_uuid = ?", bindingID, id).First(&existingBinding).Count(&bindingCount)
+	if bindingCount == 0 {
+		return response.SuccessUnbindResponse
+	}
+	if existingBinding.sharesMasterCredentials() {
+		if err := broker.brokerDB.Unscoped().Delete(&existingBinding).Error; err != nil {
+			return response.NewErrorResponse(http.StatusInternalServerError, err.Error())
+		}
+		return response.SuccessUnbindResponse
+	}
+
+	plan, planErr := c.RdsService.FetchPlan(baseInstance.PlanID)
+	if planErr != nil {
+		return planErr
+	}
+
+	password, err := existingInstance.getPassword(broker.settings)
+	if err != nil {
+		return response.NewErrorResponse(http.StatusInternalServerError, "Unable to get instance password.")
+	}
+
+	adapter, adapterErr := initializeAdapter(plan, broker.settings, c)
+	if adapterErr != nil {
+		return adapterErr
+	}
+
+	if err := adapter.unbindDBFromApp(existingInstance, password, &existingBinding); err != nil {
+		return response.NewErrorResponse(http.StatusInternalServerError, "There was an error unbinding the database instance from the application. Error: "+err.Error())
+	}
+
+	if broker.credentialsStore != nil && existingBinding.CredentialsSecretARN != "" {
+		if err := broker.credentialsStore.DeleteCredentials(existingBinding.CredentialsSecretARN); err != nil {
+			return response.NewErrorResponse(http.StatusInternalServerError, "There was an error deleting the stored credentials. Error: "+err.Error())
+		}
+	}
+
+	err = broker.brokerDB.Unscoped().Delete(&existingBinding).Error
+	if err != nil {
+		return response.NewErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+	return response.SuccessUnbindResponse
+}
+
 func (broker *rdsBroker) DeleteInstance(c *catalog.Catalog, id string, baseInstance base.Instance) response.Response {
 	existingInstance := NewRDSInstance()
 	var count int64
@@ -392,6 +1147,15 @@ func (broker *rdsBroker) DeleteInstance(c *catalog.Catalog, id string, baseInsta
 		return response.NewErrorResponse(http.StatusNotFound, "Instance not found")
 	}
 
+	var replicaCount int64
+	broker.brokerDB.Model(&RDSInstance{}).Where("replica_of = ?", id).Count(&replicaCount)
+	if replicaCount != 0 {
+		return response.NewErrorResponse(
+			http.StatusBadRequest,
+			"Cannot delete an instance that has read replicas. Please delete its read replicas first.",
+		)
+	}
+
 	plan, planErr := c.RdsService.FetchPlan(baseInstance.PlanID)
 	if planErr != nil {
 		return planErr
@@ -401,14 +1165,44 @@ func (broker *rdsBroker) DeleteInstance(c *catalog.Catalog, id string, baseInsta
 	if adapterErr != nil {
 		return adapterErr
 	}
+	// The final snapshot is recorded before the deletion starts, so that a
+	// failure to record it does not leave an instance being deleted behind.
+	// A snapshot recorded by an earlier attempt is kept. The final snapshots of
+	// Aurora clusters are cluster snapshots, which cannot be restored by the broker.
+	var finalSnapshot *RDSSnapshot
+	if !existingInstance.isReplica() && !existingInstance.isAurora() {
+		snapshot := newFinalSnapshot(existingInstance)
+		var snapshotCount int64
+		broker.brokerDB.Model(&RDSSnapshot{}).Where("snapshot_identifier = ?", snapshot.SnapshotIdentifier).Count(&snapshotCount)
+		if snapshotCount == 0 {
+			if err := broker.brokerDB.Create(snapshot).Error; err != nil {
+				return response.NewErrorResponse(http.StatusInternalServerError, "There was an error recording the final snapshot. Error: "+err.Error())
+			}
+			finalSnapshot = snapshot
+		}
+	}
+
 	// Delete the database instance.
-	if status, err := adapter.deleteDB(existingInstance); status == base.InstanceNotGone {
+	status, err := adapter.deleteDB(existingInstance)
+	if status != base.InstanceInProgress && finalSnapshot != nil {
+		// no final snapshot is taken of an instance that is gone or was not deleted
+		broker.brokerDB.Delete(finalSnapshot)
+	}
+	switch status {
+	case base.InstanceGone: // the instance is gone already
+		broker.deleteCredentialsSecrets(existingInstance)
+		broker.brokerDB.Unscoped().Where("instance_uuid = ?", id).Delete(RDSBinding{})
+		broker.brokerDB.Unscoped().Delete(existingInstance)
+		return response.SuccessDeleteResponse
+	case base.InstanceInProgress: // a final snapshot is taken before the instance is deleted
+		existingInstance.State = status
+		broker.brokerDB.Save(existingInstance)
+		return response.NewAsyncOperationResponse(base.DeleteOp.String())
+	default:
 		desc := "There was an error deleting the instance."
 		if err != nil {
 			desc = desc + " Error: " + err.Error()
 		}
 		return response.NewErrorResponse(http.StatusBadRequest, desc)
 	}
-	broker.brokerDB.Unscoped().Delete(existingInstance)
-	return response.SuccessDeleteResponse
 }
@@ -1,12 +1,16 @@
 package rds
 
 import (
+	"errors"
 	"reflect"
 	"testing"
 
+	"github.com/18F/aws-broker/base"
+	"github.com/18F/aws-broker/common"
 	"github.com/18F/aws-broker/config"
 	"github.com/18F/aws-broker/helpers/request"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/jinzhu/gorm"
 )
 
 func TestValidate(t *testing.T) {
@@ -43,6 +47,52 @@ func TestValidate(t *testing.T) {
 			settings:    &config.Settings{},
 			expectedErr: true,
 		},
+		"clone at restore time": {
+			options: Options{
+				SourceInstanceGUID: "source-guid",
+				RestoreTime:        "2024-01-02T15:04:05Z",
+			},
+			settings:    &config.Settings{},
+			expectedErr: false,
+		},
+		"invalid restore time": {
+			options: Options{
+				SourceInstanceGUID: "source-guid",
+				RestoreTime:        "yesterday",
+			},
+			settings:    &config.Settings{},
+			expectedErr: true,
+		},
+		"restore time without source instance": {
+			options: Options{
+				RestoreTime: "2024-01-02T15:04:05Z",
+			},
+			settings:    &config.Settings{},
+			expectedErr: true,
+		},
+		"clone and restore from snapshot": {
+			options: Options{
+				SourceInstanceGUID:  "source-guid",
+				RestoreFromSnapshot: "snapshot",
+			},
+			settings:    &config.Settings{},
+			expectedErr: true,
+		},
+		"read replica": {
+			options: Options{
+				ReadReplicaOf: "primary-guid",
+			},
+			settings:    &config.Settings{},
+			expectedErr: false,
+		},
+		"read replica and restore from snapshot": {
+			options: Options{
+				ReadReplicaOf:       "primary-guid",
+				RestoreFromSnapshot: "snapshot",
+			},
+			settings:    &config.Settings{},
+			expectedErr: true,
+		},
 	}
 
 	for name, test := range testCases {
@@ -196,6 +246,26 @@ func TestParseModifyOptionsFromRequest(t *testing.T) {
 			},
 			expectErr: true,
 		},
+		"misspelled parameter is rejected": {
+			broker: &rdsBroker{
+				settings: &config.Settings{},
+			},
+			modifyRequest: request.Request{
+				RawParameters: []byte(`{"backup_retention_peroid": 14}`),
+			},
+			expectedOptions: Options{},
+			expectErr:       true,
+		},
+		"parameter of the wrong type is rejected": {
+			broker: &rdsBroker{
+				settings: &config.Settings{},
+			},
+			modifyRequest: request.Request{
+				RawParameters: []byte(`{"enable_pg_cron": "true"}`),
+			},
+			expectedOptions: Options{},
+			expectErr:       true,
+		},
 		"throws error on invalid JSON": {
 			broker: &rdsBroker{
 				settings: &config.Settings{},
@@ -228,3 +298,111 @@ func TestParseModifyOptionsFromRequest(t *testing.T) {
 		})
 	}
 }
+
+// unbindRecordingAdapter records the bindings whose users are dropped.
+type unbindRecordingAdapter struct {
+	mockDBAdapter
+	unbound []string
+}
+
+func (d *unbindRecordingAdapter) unbindDBFromApp(i *RDSInstance, password string, b *RDSBinding) error {
+	d.unbound = append(d.unbound, b.BindingID)
+	return nil
+}
+
+func (d *unbindRecordingAdapter) dropBindingUsers(i *RDSInstance, password string, bindings []RDSBinding) error {
+	for _, b := range bindings {
+		d.unbound = append(d.unbound, b.BindingID)
+	}
+	return nil
+}
+
+// newTestBrokerDB returns an empty broker database, in which bindings cannot
+// be recorded until their table is migrated.
+func newTestBrokerDB(t *testing.T) *gorm.DB {
+	db, err := common.DBInit(&common.DBConfig{DbType: "sqlite3", DbName: ":memory:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every connection to an in-memory sqlite database gets its own database
+	db.DB().SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestSaveBinding(t *testing.T) {
+	db := newTestBrokerDB(t)
+	broker := &rdsBroker{brokerDB: db, settings: &config.Settings{}}
+	adapter := &unbindRecordingAdapter{}
+
+	// without its table, the binding cannot be recorded
+	err := broker.saveBinding(adapter, &RDSInstance{}, "password", &RDSBinding{BindingID: "binding-1"})
+	if err == nil {
+		t.Fatal("expected an error recording the binding")
+	}
+	if len(adapter.unbound) != 1 || adapter.unbound[0] != "binding-1" {
+		t.Errorf("expected the users of the binding to be dropped, got %v", adapter.unbound)
+	}
+
+	db.AutoMigrate(&RDSBinding{})
+	adapter.unbound = nil
+	if err := broker.saveBinding(adapter, &RDSInstance{}, "password", &RDSBinding{BindingID: "binding-2"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(adapter.unbound) != 0 {
+		t.Errorf("expected the users of a recorded binding to be kept, got %v", adapter.unbound)
+	}
+}
+
+// failingDBUserClient cannot connect to the instance.
+type failingDBUserClient struct{}
+
+func (c *failingDBUserClient) createUser(i *RDSInstance, masterPassword string, b *RDSBinding) error {
+	return errors.New("connection refused")
+}
+
+func (c *failingDBUserClient) dropUser(i *RDSInstance, masterPassword string, b *RDSBinding) error {
+	return errors.New("connection refused")
+}
+
+func TestSaveBindingDeletesIAMUser(t *testing.T) {
+	iamClient := newMockIAMClientForIAMAuth()
+	iamAuth := newAWSIAMAuthClient(iamClient, &mockRDSClientForIAMAuth{})
+	adapter := &dedicatedDBAdapter{dbUsers: &failingDBUserClient{}, iamAuth: iamAuth}
+	broker := &rdsBroker{brokerDB: newTestBrokerDB(t), settings: &config.Settings{}}
+
+	instance := &RDSInstance{Database: "db1"}
+	binding := &RDSBinding{BindingID: "binding-1", Username: "u1", IAMUserName: "db1-u1"}
+	if _, err := iamAuth.createBindingUser(instance, binding); err != nil {
+		t.Fatal(err)
+	}
+
+	// the IAM user is deleted even though the database user cannot be dropped
+	if err := broker.saveBinding(adapter, instance, "password", binding); err == nil {
+		t.Fatal("expected an error recording the binding")
+	}
+	if len(iamClient.users)+len(iamClient.accessKeys)+len(iamClient.policies)+len(iamClient.attachments) != 0 {
+		t.Error("expected the IAM user of the binding and its resources to be deleted")
+	}
+}
+
+func TestDropSourceBindingUsers(t *testing.T) {
+	db := newTestBrokerDB(t)
+	db.AutoMigrate(&RDSInstance{}, &RDSBinding{})
+	db.Create(&RDSInstance{Instance: base.Instance{Uuid: "source"}, Database: "source-db"})
+	db.Create(&RDSInstance{Instance: base.Instance{Uuid: "other"}, Database: "other-db"})
+	db.Create(&RDSBinding{BindingID: "binding-1", InstanceUuid: "source", Username: "u1"})
+	// bindings sharing the master credentials have no user to drop
+	db.Create(&RDSBinding{BindingID: "binding-2", InstanceUuid: "source"})
+	db.Create(&RDSBinding{BindingID: "binding-3", InstanceUuid: "other", Username: "u3"})
+
+	broker := &rdsBroker{brokerDB: db, settings: &config.Settings{}}
+	adapter := &unbindRecordingAdapter{}
+	clone := &RDSInstance{Instance: base.Instance{Uuid: "clone"}, Database: "clone-db", RestoredFromInstance: "source-db"}
+	if err := broker.dropSourceBindingUsers(adapter, clone, "password"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(adapter.unbound) != 1 || adapter.unbound[0] != "binding-1" {
+		t.Errorf("expected the user of the binding of the source to be dropped, got %v", adapter.unbound)
+	}
+}
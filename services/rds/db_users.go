@@ -0,0 +1,150 @@
+package rds
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/18F/aws-broker/common"
+	"github.com/jinzhu/gorm"
+)
+
+// dbUserClient manages the database users that are issued to individual bindings.
+type dbUserClient interface {
+	createUser(i *RDSInstance, masterPassword string, b *RDSBinding) error
+	dropUser(i *RDSInstance, masterPassword string, b *RDSBinding) error
+}
+
+// supportsBindingUsers reports whether per-binding database users can be created
+// for the given engine. The broker does not ship an Oracle driver, so Oracle
+// bindings continue to receive the instance credentials.
+func supportsBindingUsers(dbType string) bool {
+	switch dbType {
+	case "postgres", "mysql":
+		return true
+	default:
+		return false
+	}
+}
+
+// sqlDBUserClient connects to the instance endpoint with the master credentials
+// and manages binding users with plain SQL.
+type sqlDBUserClient struct{}
+
+func (c *sqlDBUserClient) connect(i *RDSInstance, masterPassword string) (*gorm.DB, error) {
+	if i.Host == "" || i.Port == 0 {
+		return nil, fmt.Errorf("endpoint for database %s is not known yet", i.Database)
+	}
+	return common.DBInit(&common.DBConfig{
+		DbType:   i.DbType,
+		URL:      i.Host,
+		Username: i.Username,
+		Password: masterPassword,
+		DbName:   i.FormatDBName(),
+		Sslmode:  "require",
+		Port:     i.Port,
+	})
+}
+
+func (c *sqlDBUserClient) exec(i *RDSInstance, masterPassword string, statements []string) error {
+	db, err := c.connect(i, masterPassword)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	for _, statement := range statements {
+		if err := db.Exec(statement).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *sqlDBUserClient) createUser(i *RDSInstance, masterPassword string, b *RDSBinding) error {
+	statements, err := createUserStatements(i, b)
+	if err != nil {
+		return err
+	}
+	log.Printf("creating database user %s for binding %s on %s", b.Username, b.BindingID, i.Database)
+	if err := c.exec(i, masterPassword, statements); err != nil {
+		// the binding is not recorded, so a user left behind could not be dropped
+		if dropErr := c.dropUser(i, masterPassword, b); dropErr != nil {
+			log.Printf("unable to drop database user %s: %s", b.Username, dropErr)
+		}
+		return err
+	}
+	return nil
+}
+
+func (c *sqlDBUserClient) dropUser(i *RDSInstance, masterPassword string, b *RDSBinding) error {
+	statements, err := dropUserStatements(i, b)
+	if err != nil {
+		return err
+	}
+	log.Printf("dropping database user %s for binding %s on %s", b.Username, b.BindingID, i.Database)
+	return c.exec(i, masterPassword, statements)
+}
+
+// createUserStatements builds the SQL used to create a binding user with the
+// same access to the database as the master user. Usernames and passwords are
+// generated by the broker from an alphanumeric charset, so they are safe to
+// interpolate. Users of bindings with IAM database authentication have no
+// password and authenticate with tokens generated by their IAM user instead.
+// The statements can be run again when a bind is retried: a user left by an
+// earlier attempt is given the password of the new one.
+func createUserStatements(i *RDSInstance, b *RDSBinding) ([]string, error) {
+	dbName := i.FormatDBName()
+	switch i.DbType {
+	case "postgres":
+		createUser := []string{
+			fmt.Sprintf(`DO $$ BEGIN IF NOT EXISTS (SELECT FROM pg_roles WHERE rolname = '%s') THEN CREATE USER "%s"; END IF; END $$`, b.Username, b.Username),
+		}
+		if b.isIAMAuth() {
+			createUser = append(createUser, fmt.Sprintf(`GRANT rds_iam TO "%s"`, b.Username))
+		} else {
+			createUser = append(createUser, fmt.Sprintf(`ALTER USER "%s" WITH PASSWORD '%s'`, b.Username, b.ClearPassword))
+		}
+		// The user acts as the master user, so that the tables it creates, e.g.
+		// in migrations, belong to the master user and are shared by every
+		// binding of the instance rather than owned by this one.
+		return append(createUser,
+			fmt.Sprintf(`GRANT "%s" TO "%s"`, i.Username, b.Username),
+			fmt.Sprintf(`ALTER ROLE "%s" SET ROLE "%s"`, b.Username, i.Username),
+		), nil
+	case "mysql":
+		createUser := []string{
+			fmt.Sprintf("CREATE USER IF NOT EXISTS '%s'@'%%' IDENTIFIED BY '%s'", b.Username, b.ClearPassword),
+			fmt.Sprintf("ALTER USER '%s'@'%%' IDENTIFIED BY '%s'", b.Username, b.ClearPassword),
+		}
+		if b.isIAMAuth() {
+			createUser = []string{
+				fmt.Sprintf("CREATE USER IF NOT EXISTS '%s'@'%%' IDENTIFIED WITH AWSAuthenticationPlugin AS 'RDS'", b.Username),
+			}
+		}
+		return append(createUser,
+			fmt.Sprintf("GRANT ALL PRIVILEGES ON `%s`.* TO '%s'@'%%'", dbName, b.Username),
+		), nil
+	default:
+		return nil, fmt.Errorf("cannot create binding users for unsupported db type: %s", i.DbType)
+	}
+}
+
+// dropUserStatements builds the SQL used to remove a binding user. For Postgres,
+// any objects the user created are handed back to the master user first so that
+// application data survives the unbind. The statements succeed when the user
+// does not exist, e.g. on a clone taken before the binding was made.
+func dropUserStatements(i *RDSInstance, b *RDSBinding) ([]string, error) {
+	switch i.DbType {
+	case "postgres":
+		return []string{
+			fmt.Sprintf(`DO $$ BEGIN IF EXISTS (SELECT FROM pg_roles WHERE rolname = '%s') THEN REASSIGN OWNED BY "%s" TO "%s"; DROP OWNED BY "%s"; END IF; END $$`, b.Username, b.Username, i.Username, b.Username),
+			fmt.Sprintf(`DROP USER IF EXISTS "%s"`, b.Username),
+		}, nil
+	case "mysql":
+		return []string{
+			fmt.Sprintf("DROP USER IF EXISTS '%s'@'%%'", b.Username),
+		}, nil
+	default:
+		return nil, fmt.Errorf("cannot drop binding users for unsupported db type: %s", i.DbType)
+	}
+}
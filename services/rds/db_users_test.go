@@ -0,0 +1,150 @@
+package rds
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCreateUserStatements(t *testing.T) {
+	testCases := map[string]struct {
+		instance          *RDSInstance
+		binding           *RDSBinding
+		expectErr         bool
+		expectedFirst     string
+		expectedContained string
+	}{
+		"postgres": {
+			instance: &RDSInstance{
+				DbType:   "postgres",
+				Database: "db1",
+				Username: "master",
+				dbUtils:  &RDSDatabaseUtils{},
+			},
+			binding: &RDSBinding{
+				Username:      "binding",
+				ClearPassword: "secret",
+			},
+			expectedFirst:     `DO $$ BEGIN IF NOT EXISTS (SELECT FROM pg_roles WHERE rolname = 'binding') THEN CREATE USER "binding"; END IF; END $$`,
+			expectedContained: `ALTER USER "binding" WITH PASSWORD 'secret'`,
+		},
+		"postgres users act as the master user": {
+			instance: &RDSInstance{
+				DbType:   "postgres",
+				Database: "db1",
+				Username: "master",
+				dbUtils:  &RDSDatabaseUtils{},
+			},
+			binding: &RDSBinding{
+				Username:      "binding",
+				ClearPassword: "secret",
+			},
+			expectedFirst:     `DO $$ BEGIN IF NOT EXISTS (SELECT FROM pg_roles WHERE rolname = 'binding') THEN CREATE USER "binding"; END IF; END $$`,
+			expectedContained: `GRANT "master" TO "binding";ALTER ROLE "binding" SET ROLE "master"`,
+		},
+		"mysql": {
+			instance: &RDSInstance{
+				DbType:   "mysql",
+				Database: "db1",
+				Username: "master",
+				dbUtils:  &RDSDatabaseUtils{},
+			},
+			binding: &RDSBinding{
+				Username:      "binding",
+				ClearPassword: "secret",
+			},
+			expectedFirst:     "CREATE USER IF NOT EXISTS 'binding'@'%' IDENTIFIED BY 'secret'",
+			expectedContained: "ALTER USER 'binding'@'%' IDENTIFIED BY 'secret';GRANT ALL PRIVILEGES ON `db1`.* TO 'binding'@'%'",
+		},
+		"postgres with IAM auth": {
+			instance: &RDSInstance{
+				DbType:   "postgres",
+				Database: "db1",
+				Username: "master",
+				dbUtils:  &RDSDatabaseUtils{},
+			},
+			binding: &RDSBinding{
+				Username:    "binding",
+				IAMUserName: "db1-binding",
+			},
+			expectedFirst:     `DO $$ BEGIN IF NOT EXISTS (SELECT FROM pg_roles WHERE rolname = 'binding') THEN CREATE USER "binding"; END IF; END $$`,
+			expectedContained: `GRANT rds_iam TO "binding"`,
+		},
+		"mysql with IAM auth": {
+			instance: &RDSInstance{
+				DbType:   "mysql",
+				Database: "db1",
+				Username: "master",
+				dbUtils:  &RDSDatabaseUtils{},
+			},
+			binding: &RDSBinding{
+				Username:    "binding",
+				IAMUserName: "db1-binding",
+			},
+			expectedFirst:     "CREATE USER IF NOT EXISTS 'binding'@'%' IDENTIFIED WITH AWSAuthenticationPlugin AS 'RDS'",
+			expectedContained: "GRANT ALL PRIVILEGES ON `db1`.* TO 'binding'@'%'",
+		},
+		"oracle is not supported": {
+			instance: &RDSInstance{
+				DbType:  "oracle-se2",
+				dbUtils: &RDSDatabaseUtils{},
+			},
+			binding:   &RDSBinding{},
+			expectErr: true,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			statements, err := createUserStatements(test.instance, test.binding)
+			if test.expectErr {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if statements[0] != test.expectedFirst {
+				t.Errorf("expected first statement %s, got %s", test.expectedFirst, statements[0])
+			}
+			if !strings.Contains(strings.Join(statements, ";"), test.expectedContained) {
+				t.Errorf("expected statements to contain %s, got %v", test.expectedContained, statements)
+			}
+		})
+	}
+}
+
+func TestDropUserStatements(t *testing.T) {
+	instance := &RDSInstance{
+		DbType:   "postgres",
+		Username: "master",
+		dbUtils:  &RDSDatabaseUtils{},
+	}
+	statements, err := dropUserStatements(instance, &RDSBinding{Username: "binding"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expected := `REASSIGN OWNED BY "binding" TO "master"; DROP OWNED BY "binding"`
+	if !strings.Contains(statements[0], expected) {
+		t.Errorf("expected objects to be reassigned first, got %s", statements[0])
+	}
+	if !strings.Contains(statements[0], `IF EXISTS (SELECT FROM pg_roles WHERE rolname = 'binding')`) {
+		t.Errorf("expected objects to be reassigned only if the user exists, got %s", statements[0])
+	}
+	if statements[len(statements)-1] != `DROP USER IF EXISTS "binding"` {
+		t.Errorf("expected user to be dropped last, got %s", statements[len(statements)-1])
+	}
+}
+
+func TestSupportsBindingUsers(t *testing.T) {
+	for dbType, expected := range map[string]bool{
+		"postgres":   true,
+		"mysql":      true,
+		"oracle-se2": false,
+	} {
+		if supportsBindingUsers(dbType) != expected {
+			t.Errorf("expected supportsBindingUsers(%s) to be %t", dbType, expected)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package rds
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// postgresExtension describes an extension that can be loaded with the
+// extensions option.
+type postgresExtension struct {
+	// minMajorVersion is the first major version of PostgreSQL on RDS that
+	// supports the extension.
+	minMajorVersion int
+	// createExtension is set for extensions that are created in the database
+	// once loaded. Some, like auto_explain, are only libraries.
+	createExtension bool
+}
+
+// postgresExtensions are the extensions users can load through
+// shared_preload_libraries. pg_cron has its own option.
+var postgresExtensions = map[string]postgresExtension{
+	"auto_explain":       {minMajorVersion: 9},
+	"pg_stat_statements": {minMajorVersion: 9, createExtension: true},
+	"pgaudit":            {minMajorVersion: 10, createExtension: true},
+}
+
+// allowedExtensions returns the extensions supported by the given engine
+// version. All of them are supported by the default version, which is used
+// when no version is given.
+func allowedExtensions(dbVersion string) []string {
+	majorVersion := 0
+	if dbVersion != "" {
+		major, _, _ := strings.Cut(dbVersion, ".")
+		majorVersion, _ = strconv.Atoi(major)
+	}
+	var allowed []string
+	for name, extension := range postgresExtensions {
+		if dbVersion == "" || majorVersion >= extension.minMajorVersion {
+			allowed = append(allowed, name)
+		}
+	}
+	sort.Strings(allowed)
+	return allowed
+}
+
+// createExtensionStatements builds the SQL creating the given extensions in the
+// database. Extension names come from the allow-list, so they are safe to
+// interpolate.
+func createExtensionStatements(extensions []string) []string {
+	var statements []string
+	for _, name := range extensions {
+		if postgresExtensions[name].createExtension {
+			statements = append(statements, fmt.Sprintf(`CREATE EXTENSION IF NOT EXISTS "%s"`, name))
+		}
+	}
+	return statements
+}
+
+// dbExtensionClient creates the extensions loaded on an instance in its
+// database.
+type dbExtensionClient interface {
+	createExtensions(i *RDSInstance, masterPassword string) error
+}
+
+func (c *sqlDBUserClient) createExtensions(i *RDSInstance, masterPassword string) error {
+	statements := createExtensionStatements(i.Extensions)
+	if len(statements) == 0 {
+		return nil
+	}
+	log.Printf("creating extensions %s on %s", strings.Join(i.Extensions, ", "), i.Database)
+	return c.exec(i, masterPassword, statements)
+}
@@ -0,0 +1,45 @@
+package rds
+
+import (
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func TestAllowedExtensions(t *testing.T) {
+	testCases := map[string]struct {
+		dbVersion string
+		expected  []string
+	}{
+		"default version": {
+			expected: []string{"auto_explain", "pg_stat_statements", "pgaudit"},
+		},
+		"minor version": {
+			dbVersion: "15.4",
+			expected:  []string{"auto_explain", "pg_stat_statements", "pgaudit"},
+		},
+		"old version": {
+			dbVersion: "9.6",
+			expected:  []string{"auto_explain", "pg_stat_statements"},
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if diff := deep.Equal(allowedExtensions(test.dbVersion), test.expected); diff != nil {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestCreateExtensionStatements(t *testing.T) {
+	statements := createExtensionStatements([]string{"auto_explain", "pg_stat_statements", "pgaudit"})
+	expected := []string{
+		`CREATE EXTENSION IF NOT EXISTS "pg_stat_statements"`,
+		`CREATE EXTENSION IF NOT EXISTS "pgaudit"`,
+	}
+	if diff := deep.Equal(statements, expected); diff != nil {
+		t.Error(diff)
+	}
+}
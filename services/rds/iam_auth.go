@@ -0,0 +1,167 @@
+package rds
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/iam/iamiface"
+	"github.com/aws/aws-sdk-go/service/rds"
+	"github.com/aws/aws-sdk-go/service/rds/rdsiface"
+
+	"github.com/18F/aws-broker/awsiam"
+)
+
+// iamAuthClient manages the IAM users issued to bindings of instances with IAM
+// database authentication. Each IAM user may only connect to the instance as
+// the database user of its binding.
+type iamAuthClient interface {
+	createBindingUser(i *RDSInstance, b *RDSBinding) (string, error)
+	deleteBindingUser(b *RDSBinding) error
+}
+
+type awsIAMAuthClient struct {
+	iam   iamiface.IAMAPI
+	rds   rdsiface.RDSAPI
+	users *awsiam.IAMUserClient
+}
+
+func newAWSIAMAuthClient(iamClient iamiface.IAMAPI, rdsClient rdsiface.RDSAPI) *awsIAMAuthClient {
+	logger := lager.NewLogger("aws-rds-broker")
+	logger.RegisterSink(lager.NewWriterSink(os.Stdout, lager.INFO))
+	return &awsIAMAuthClient{
+		iam:   iamClient,
+		rds:   rdsClient,
+		users: awsiam.NewIAMUserClient(iamClient, logger),
+	}
+}
+
+// dbUserResourceARN returns the ARN used to grant connecting to the instance as
+// the given database user.
+func (c *awsIAMAuthClient) dbUserResourceARN(i *RDSInstance, username string) (string, error) {
+	resp, err := c.rds.DescribeDBInstances(&rds.DescribeDBInstancesInput{
+		DBInstanceIdentifier: aws.String(i.Database),
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(resp.DBInstances) == 0 {
+		return "", fmt.Errorf("database %s was not found", i.Database)
+	}
+	instance := resp.DBInstances[0]
+	instanceARN, err := arn.Parse(aws.StringValue(instance.DBInstanceArn))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(
+		"arn:%s:rds-db:%s:%s:dbuser:%s/%s",
+		instanceARN.Partition,
+		instanceARN.Region,
+		instanceARN.AccountID,
+		aws.StringValue(instance.DbiResourceId),
+		username,
+	), nil
+}
+
+// createBindingUser creates the IAM user of a binding with a policy letting it
+// connect as the database user of the binding, and returns the secret access
+// key of the user. Whatever was created is deleted again if a step fails.
+func (c *awsIAMAuthClient) createBindingUser(i *RDSInstance, b *RDSBinding) (string, error) {
+	resourceARN, err := c.dbUserResourceARN(i, b.Username)
+	if err != nil {
+		return "", err
+	}
+
+	secretAccessKey, err := c.createBindingUserResources(i, b, resourceARN)
+	if err != nil {
+		if cleanupErr := c.deleteBindingUser(b); cleanupErr != nil {
+			log.Printf("unable to clean up IAM user %s: %s", b.IAMUserName, cleanupErr)
+		}
+		return "", err
+	}
+	return secretAccessKey, nil
+}
+
+func (c *awsIAMAuthClient) createBindingUserResources(i *RDSInstance, b *RDSBinding, resourceARN string) (string, error) {
+	iamTags := awsiam.ConvertTagsMapToIAMTags(i.Tags)
+
+	log.Printf("creating IAM user %s for binding %s on %s", b.IAMUserName, b.BindingID, i.Database)
+	if _, err := c.users.Create(b.IAMUserName, "", iamTags); err != nil {
+		return "", err
+	}
+
+	policyDoc := awsiam.PolicyDocument{
+		Version: "2012-10-17",
+		Statement: []awsiam.PolicyStatementEntry{
+			{
+				Effect:   "Allow",
+				Action:   []string{"rds-db:connect"},
+				Resource: []string{resourceARN},
+			},
+		},
+	}
+	policy, err := policyDoc.ToString()
+	if err != nil {
+		return "", err
+	}
+	policyResp, err := c.iam.CreatePolicy(&iam.CreatePolicyInput{
+		PolicyName:     aws.String(b.IAMUserName),
+		PolicyDocument: aws.String(policy),
+		Tags:           iamTags,
+	})
+	if err != nil {
+		return "", err
+	}
+	b.IAMPolicyARN = aws.StringValue(policyResp.Policy.Arn)
+
+	if err := c.users.AttachUserPolicy(b.IAMUserName, b.IAMPolicyARN); err != nil {
+		return "", err
+	}
+
+	accessKeyID, secretAccessKey, err := c.users.CreateAccessKey(b.IAMUserName)
+	if err != nil {
+		return "", err
+	}
+	b.AccessKeyID = accessKeyID
+	return secretAccessKey, nil
+}
+
+// deleteBindingUser deletes the IAM user of a binding along with its access key
+// and policy. Resources that are already gone count as deleted.
+func (c *awsIAMAuthClient) deleteBindingUser(b *RDSBinding) error {
+	log.Printf("deleting IAM user %s for binding %s", b.IAMUserName, b.BindingID)
+	if b.AccessKeyID != "" {
+		if err := c.users.DeleteAccessKey(b.IAMUserName, b.AccessKeyID); err != nil && !isIAMEntityGone(err) {
+			return err
+		}
+	}
+	if b.IAMPolicyARN != "" {
+		if err := c.users.DetachUserPolicy(b.IAMUserName, b.IAMPolicyARN); err != nil && !isIAMEntityGone(err) {
+			return err
+		}
+		if _, err := c.iam.DeletePolicy(&iam.DeletePolicyInput{PolicyArn: aws.String(b.IAMPolicyARN)}); err != nil && !isIAMEntityGone(err) {
+			return err
+		}
+	}
+	if err := c.users.Delete(b.IAMUserName); err != nil && !isIAMEntityGone(err) {
+		return err
+	}
+	return nil
+}
+
+// isIAMEntityGone reports whether err says the IAM entity does not exist. The
+// awsiam clients return the code of AWS errors as the prefix of their message.
+func isIAMEntityGone(err error) bool {
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		return awsErr.Code() == iam.ErrCodeNoSuchEntityException
+	}
+	return strings.HasPrefix(err.Error(), iam.ErrCodeNoSuchEntityException+":")
+}
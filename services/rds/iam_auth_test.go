@@ -0,0 +1,184 @@
+package rds
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/aws/aws-sdk-go/service/iam/iamiface"
+	"github.com/aws/aws-sdk-go/service/rds"
+	"github.com/aws/aws-sdk-go/service/rds/rdsiface"
+	"github.com/go-test/deep"
+
+	"github.com/18F/aws-broker/awsiam"
+)
+
+type mockRDSClientForIAMAuth struct {
+	rdsiface.RDSAPI
+}
+
+func (m *mockRDSClientForIAMAuth) DescribeDBInstances(input *rds.DescribeDBInstancesInput) (*rds.DescribeDBInstancesOutput, error) {
+	return &rds.DescribeDBInstancesOutput{
+		DBInstances: []*rds.DBInstance{
+			{
+				DBInstanceArn: aws.String("arn:aws-us-gov:rds:us-gov-west-1:123456789012:db:" + aws.StringValue(input.DBInstanceIdentifier)),
+				DbiResourceId: aws.String("db-ABCDEFGHIJKL"),
+			},
+		},
+	}, nil
+}
+
+// mockIAMClientForIAMAuth keeps the IAM users, access keys, policies and
+// attachments it manages in memory.
+type mockIAMClientForIAMAuth struct {
+	iamiface.IAMAPI
+
+	createAccessKeyErr error
+
+	users       map[string]bool
+	accessKeys  map[string]string
+	policies    map[string]string
+	attachments map[string]string
+}
+
+func newMockIAMClientForIAMAuth() *mockIAMClientForIAMAuth {
+	return &mockIAMClientForIAMAuth{
+		users:       map[string]bool{},
+		accessKeys:  map[string]string{},
+		policies:    map[string]string{},
+		attachments: map[string]string{},
+	}
+}
+
+func noSuchEntity() error {
+	return awserr.New(iam.ErrCodeNoSuchEntityException, "not found", nil)
+}
+
+func (m *mockIAMClientForIAMAuth) CreateUser(input *iam.CreateUserInput) (*iam.CreateUserOutput, error) {
+	m.users[aws.StringValue(input.UserName)] = true
+	return &iam.CreateUserOutput{User: &iam.User{Arn: aws.String("arn:aws-us-gov:iam::123456789012:user/" + aws.StringValue(input.UserName))}}, nil
+}
+
+func (m *mockIAMClientForIAMAuth) DeleteUser(input *iam.DeleteUserInput) (*iam.DeleteUserOutput, error) {
+	if !m.users[aws.StringValue(input.UserName)] {
+		return nil, noSuchEntity()
+	}
+	delete(m.users, aws.StringValue(input.UserName))
+	return &iam.DeleteUserOutput{}, nil
+}
+
+func (m *mockIAMClientForIAMAuth) CreatePolicy(input *iam.CreatePolicyInput) (*iam.CreatePolicyOutput, error) {
+	policyARN := "arn:aws-us-gov:iam::123456789012:policy/" + aws.StringValue(input.PolicyName)
+	m.policies[policyARN] = aws.StringValue(input.PolicyDocument)
+	return &iam.CreatePolicyOutput{Policy: &iam.Policy{Arn: aws.String(policyARN)}}, nil
+}
+
+func (m *mockIAMClientForIAMAuth) DeletePolicy(input *iam.DeletePolicyInput) (*iam.DeletePolicyOutput, error) {
+	if _, ok := m.policies[aws.StringValue(input.PolicyArn)]; !ok {
+		return nil, noSuchEntity()
+	}
+	delete(m.policies, aws.StringValue(input.PolicyArn))
+	return &iam.DeletePolicyOutput{}, nil
+}
+
+func (m *mockIAMClientForIAMAuth) AttachUserPolicy(input *iam.AttachUserPolicyInput) (*iam.AttachUserPolicyOutput, error) {
+	m.attachments[aws.StringValue(input.UserName)] = aws.StringValue(input.PolicyArn)
+	return &iam.AttachUserPolicyOutput{}, nil
+}
+
+func (m *mockIAMClientForIAMAuth) DetachUserPolicy(input *iam.DetachUserPolicyInput) (*iam.DetachUserPolicyOutput, error) {
+	if _, ok := m.attachments[aws.StringValue(input.UserName)]; !ok {
+		return nil, noSuchEntity()
+	}
+	delete(m.attachments, aws.StringValue(input.UserName))
+	return &iam.DetachUserPolicyOutput{}, nil
+}
+
+func (m *mockIAMClientForIAMAuth) CreateAccessKey(input *iam.CreateAccessKeyInput) (*iam.CreateAccessKeyOutput, error) {
+	if m.createAccessKeyErr != nil {
+		return nil, m.createAccessKeyErr
+	}
+	m.accessKeys["access-key-id"] = aws.StringValue(input.UserName)
+	return &iam.CreateAccessKeyOutput{
+		AccessKey: &iam.AccessKey{
+			AccessKeyId:     aws.String("access-key-id"),
+			SecretAccessKey: aws.String("secret-access-key"),
+		},
+	}, nil
+}
+
+func (m *mockIAMClientForIAMAuth) DeleteAccessKey(input *iam.DeleteAccessKeyInput) (*iam.DeleteAccessKeyOutput, error) {
+	if _, ok := m.accessKeys[aws.StringValue(input.AccessKeyId)]; !ok {
+		return nil, noSuchEntity()
+	}
+	delete(m.accessKeys, aws.StringValue(input.AccessKeyId))
+	return &iam.DeleteAccessKeyOutput{}, nil
+}
+
+func TestCreateBindingUser(t *testing.T) {
+	iamClient := newMockIAMClientForIAMAuth()
+	client := newAWSIAMAuthClient(iamClient, &mockRDSClientForIAMAuth{})
+	instance := &RDSInstance{Database: "db1"}
+	binding := &RDSBinding{
+		BindingID:   "binding-1",
+		Username:    "u1",
+		IAMUserName: "db1-u1",
+	}
+
+	secretAccessKey, err := client.createBindingUser(instance, binding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secretAccessKey != "secret-access-key" || binding.AccessKeyID != "access-key-id" {
+		t.Errorf("unexpected access key %s/%s", binding.AccessKeyID, secretAccessKey)
+	}
+	if iamClient.attachments["db1-u1"] != binding.IAMPolicyARN {
+		t.Errorf("expected policy %s to be attached to the user", binding.IAMPolicyARN)
+	}
+
+	policy := awsiam.PolicyDocument{}
+	if err := json.Unmarshal([]byte(iamClient.policies[binding.IAMPolicyARN]), &policy); err != nil {
+		t.Fatal(err)
+	}
+	expectedStatements := []awsiam.PolicyStatementEntry{
+		{
+			Effect:   "Allow",
+			Action:   []string{"rds-db:connect"},
+			Resource: []string{"arn:aws-us-gov:rds-db:us-gov-west-1:123456789012:dbuser:db-ABCDEFGHIJKL/u1"},
+		},
+	}
+	if diff := deep.Equal(policy.Statement, expectedStatements); diff != nil {
+		t.Error(diff)
+	}
+
+	if err := client.deleteBindingUser(binding); err != nil {
+		t.Fatal(err)
+	}
+	if len(iamClient.users)+len(iamClient.accessKeys)+len(iamClient.policies)+len(iamClient.attachments) != 0 {
+		t.Error("expected the IAM user and its resources to be deleted")
+	}
+	// Deleting the user again is not an error.
+	if err := client.deleteBindingUser(binding); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateBindingUserCleansUpOnError(t *testing.T) {
+	iamClient := newMockIAMClientForIAMAuth()
+	iamClient.createAccessKeyErr = awserr.New(iam.ErrCodeLimitExceededException, "too many keys", nil)
+	client := newAWSIAMAuthClient(iamClient, &mockRDSClientForIAMAuth{})
+	binding := &RDSBinding{
+		BindingID:   "binding-1",
+		Username:    "u1",
+		IAMUserName: "db1-u1",
+	}
+
+	if _, err := client.createBindingUser(&RDSInstance{Database: "db1"}, binding); err == nil {
+		t.Fatal("expected an error")
+	}
+	if len(iamClient.users)+len(iamClient.policies)+len(iamClient.attachments) != 0 {
+		t.Error("expected the IAM user and its resources to be deleted")
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"log"
 	"regexp"
+	"slices"
+	"sort"
 	"strings"
 
 	"github.com/18F/aws-broker/config"
@@ -19,6 +21,7 @@ const sharedPreloadLibrariesParameterName = "shared_preload_libraries"
 
 type parameterGroupClient interface {
 	ProvisionCustomParameterGroupIfNecessary(i *RDSInstance, rdsTags []*rds.Tag) error
+	ProvisionUpgradeParameterGroup(i *RDSInstance, rdsTags []*rds.Tag) error
 	CleanupCustomParameterGroups()
 }
 
@@ -27,6 +30,9 @@ type awsParameterGroupClient struct {
 	rds                  rdsiface.RDSAPI
 	settings             config.Settings
 	parameterGroupPrefix string
+	// cluster is set for clients managing the cluster parameter groups of
+	// Aurora clusters rather than the parameter groups of instances.
+	cluster bool
 }
 
 type paramDetails struct {
@@ -42,6 +48,16 @@ func NewAwsParameterGroupClient(rds rdsiface.RDSAPI, settings config.Settings) *
 	}
 }
 
+// NewAwsClusterParameterGroupClient returns a client managing the cluster
+// parameter groups of Aurora clusters. The parameters of a cluster are set on
+// its cluster parameter group, so the instances of the cluster use the default
+// instance parameter group.
+func NewAwsClusterParameterGroupClient(rds rdsiface.RDSAPI, settings config.Settings) *awsParameterGroupClient {
+	client := NewAwsParameterGroupClient(rds, settings)
+	client.cluster = true
+	return client
+}
+
 // ProvisionCustomParameterGroupIfNecessary determines from the RDS instance struct whether
 // there needs to be a custom parameter group for the instance. If so, the method will either
 // create a new parameter group or modify an existing one with the correct parameters for the
@@ -67,8 +83,45 @@ func (p *awsParameterGroupClient) ProvisionCustomParameterGroupIfNecessary(i *RD
 	return nil
 }
 
+// ProvisionUpgradeParameterGroup sets up the parameter group of the instance for
+// the engine version it is being upgraded to, which is set as its DbVersion. A
+// parameter group cannot change families, so when the instance needs custom
+// parameters they are set on a new parameter group in the family of that
+// version. The group used before is left to CleanupCustomParameterGroups.
+func (p *awsParameterGroupClient) ProvisionUpgradeParameterGroup(i *RDSInstance, rdsTags []*rds.Tag) error {
+	i.ParameterGroupFamily = ""
+	i.ParameterGroupName = ""
+	err := p.getParameterGroupFamily(i)
+	if err != nil {
+		return fmt.Errorf("encountered error getting parameter group family: %w", err)
+	}
+	if !p.needCustomParameters(i) {
+		return nil
+	}
+
+	// Without a parameter group name, the current parameter values are the
+	// defaults of the new family.
+	customRDSParameters, err := p.getCustomParameters(i)
+	if err != nil {
+		return fmt.Errorf("encountered error getting custom parameters: %w", err)
+	}
+
+	i.ParameterGroupName = getParameterGroupName(i, p) + "-" + strings.ReplaceAll(i.ParameterGroupFamily, ".", "-")
+
+	err = p.createOrModifyCustomParameterGroup(i, rdsTags, customRDSParameters)
+	if err != nil {
+		log.Println(err.Error())
+		return fmt.Errorf("encountered error applying parameter group: %w", err)
+	}
+	return nil
+}
+
 // CleanupCustomParameterGroups searches out all the parameter groups that we created and tries to clean them up
 func (p *awsParameterGroupClient) CleanupCustomParameterGroups() {
+	if p.cluster {
+		p.cleanupCustomClusterParameterGroups()
+		return
+	}
 	input := &rds.DescribeDBParameterGroupsInput{}
 	err := p.rds.DescribeDBParameterGroupsPages(input, func(pgroups *rds.DescribeDBParameterGroupsOutput, lastPage bool) bool {
 		// If the pgroup matches the prefix, then try to delete it.
@@ -101,11 +154,52 @@ func (p *awsParameterGroupClient) CleanupCustomParameterGroups() {
 	}
 }
 
+// cleanupCustomClusterParameterGroups does the same as CleanupCustomParameterGroups for
+// the cluster parameter groups that we created.
+func (p *awsParameterGroupClient) cleanupCustomClusterParameterGroups() {
+	input := &rds.DescribeDBClusterParameterGroupsInput{}
+	err := p.rds.DescribeDBClusterParameterGroupsPages(input, func(pgroups *rds.DescribeDBClusterParameterGroupsOutput, lastPage bool) bool {
+		for _, pgroup := range pgroups.DBClusterParameterGroups {
+			name := aws.StringValue(pgroup.DBClusterParameterGroupName)
+			if !strings.HasPrefix(name, p.parameterGroupPrefix) {
+				continue
+			}
+			_, err := p.rds.DeleteDBClusterParameterGroup(&rds.DeleteDBClusterParameterGroupInput{
+				DBClusterParameterGroupName: aws.String(name),
+			})
+			if err == nil {
+				log.Printf("cleaned up %s cluster parameter group", name)
+			} else if awsErr, ok := err.(awserr.Error); !ok || awsErr.Code() != rds.ErrCodeInvalidDBParameterGroupStateFault {
+				// Groups in use by clusters that are still being deleted
+				// are cleaned up the next time this is called.
+				log.Printf("There was an error cleaning up the %s cluster parameter group.  The error was: %s", name, err.Error())
+			}
+		}
+		return true
+	})
+	if err != nil {
+		log.Printf("Could not retrieve list of cluster parameter groups while cleaning up: %s", err.Error())
+	}
+}
+
 func (p *awsParameterGroupClient) getDatabaseEngineVersion(i *RDSInstance) (string, error) {
 	if i.Database == "" {
 		return "", errors.New("database name is required to get database engine version")
 	}
 
+	if p.cluster {
+		dbClusterInfo, err := p.rds.DescribeDBClusters(&rds.DescribeDBClustersInput{
+			DBClusterIdentifier: aws.String(i.Database),
+		})
+		if err != nil {
+			return "", err
+		}
+		if len(dbClusterInfo.DBClusters) == 0 || aws.StringValue(dbClusterInfo.DBClusters[0].EngineVersion) == "" {
+			return "", errors.New("could not determine DB version to set parameter group family")
+		}
+		return aws.StringValue(dbClusterInfo.DBClusters[0].EngineVersion), nil
+	}
+
 	dbInstanceInfo, err := p.rds.DescribeDBInstances(&rds.DescribeDBInstancesInput{
 		DBInstanceIdentifier: aws.String(i.Database),
 	})
@@ -137,7 +231,7 @@ func (p *awsParameterGroupClient) getParameterGroupFamily(i *RDSInstance) error
 	}
 
 	dbEngineVersionsInput := &rds.DescribeDBEngineVersionsInput{
-		Engine:        aws.String(i.DbType),
+		Engine:        aws.String(i.engine()),
 		EngineVersion: aws.String(i.DbVersion),
 	}
 
@@ -157,6 +251,18 @@ func (p *awsParameterGroupClient) getParameterGroupFamily(i *RDSInstance) error
 }
 
 func (p *awsParameterGroupClient) checkIfParameterGroupExists(parameterGroupName string) bool {
+	if p.cluster {
+		_, err := p.rds.DescribeDBClusterParameters(&rds.DescribeDBClusterParametersInput{
+			DBClusterParameterGroupName: aws.String(parameterGroupName),
+			MaxRecords:                  aws.Int64(20),
+			Source:                      aws.String("system"),
+		})
+		if err == nil {
+			log.Printf("%s cluster parameter group already exists", parameterGroupName)
+		}
+		return err == nil
+	}
+
 	dbParametersInput := &rds.DescribeDBParametersInput{
 		DBParameterGroupName: aws.String(parameterGroupName),
 		MaxRecords:           aws.Int64(20),
@@ -188,14 +294,11 @@ func (p *awsParameterGroupClient) createOrModifyCustomParameterGroup(
 		}
 
 		log.Printf("creating a parameter group named %s in the family of %s", i.ParameterGroupName, i.ParameterGroupFamily)
-		createInput := &rds.CreateDBParameterGroupInput{
-			DBParameterGroupFamily: aws.String(i.ParameterGroupFamily),
-			DBParameterGroupName:   aws.String(i.ParameterGroupName),
-			Description:            aws.String("aws broker parameter group for " + i.FormatDBName()),
-			Tags:                   rdsTags,
+		if p.cluster {
+			err = p.createClusterParameterGroup(i, rdsTags)
+		} else {
+			err = p.createParameterGroup(i, rdsTags)
 		}
-
-		_, err = p.rds.CreateDBParameterGroup(createInput)
 		if err != nil {
 			return fmt.Errorf("encountered error when creating parameter group: %w", err)
 		}
@@ -211,6 +314,14 @@ func (p *awsParameterGroupClient) createOrModifyCustomParameterGroup(
 		})
 	}
 
+	if p.cluster {
+		_, err := p.rds.ModifyDBClusterParameterGroup(&rds.ModifyDBClusterParameterGroupInput{
+			DBClusterParameterGroupName: aws.String(i.ParameterGroupName),
+			Parameters:                  parameters,
+		})
+		return err
+	}
+
 	// modify the parameter group we just created with the parameter list
 	modifyinput := &rds.ModifyDBParameterGroupInput{
 		DBParameterGroupName: aws.String(i.ParameterGroupName),
@@ -224,6 +335,35 @@ func (p *awsParameterGroupClient) createOrModifyCustomParameterGroup(
 	return nil
 }
 
+func (p *awsParameterGroupClient) createParameterGroup(i *RDSInstance, rdsTags []*rds.Tag) error {
+	createInput := &rds.CreateDBParameterGroupInput{
+		DBParameterGroupFamily: aws.String(i.ParameterGroupFamily),
+		DBParameterGroupName:   aws.String(i.ParameterGroupName),
+		Description:            aws.String("aws broker parameter group for " + i.FormatDBName()),
+		Tags:                   rdsTags,
+	}
+	_, err := p.rds.CreateDBParameterGroup(createInput)
+	if err != nil {
+		return err
+	}
+	i.Provisioned.Add(dbParameterGroupResource, i.ParameterGroupName, "")
+	return nil
+}
+
+func (p *awsParameterGroupClient) createClusterParameterGroup(i *RDSInstance, rdsTags []*rds.Tag) error {
+	_, err := p.rds.CreateDBClusterParameterGroup(&rds.CreateDBClusterParameterGroupInput{
+		DBParameterGroupFamily:      aws.String(i.ParameterGroupFamily),
+		DBClusterParameterGroupName: aws.String(i.ParameterGroupName),
+		Description:                 aws.String("aws broker cluster parameter group for " + i.FormatDBName()),
+		Tags:                        rdsTags,
+	})
+	if err != nil {
+		return err
+	}
+	i.Provisioned.Add(dbClusterParameterGroupResource, i.ParameterGroupName, "")
+	return nil
+}
+
 func (p *awsParameterGroupClient) needCustomParameters(i *RDSInstance) bool {
 	if i.EnableFunctions &&
 		p.settings.EnableFunctionsFeature &&
@@ -238,6 +378,13 @@ func (p *awsParameterGroupClient) needCustomParameters(i *RDSInstance) bool {
 		(i.DbType == "postgres") {
 		return true
 	}
+	if (len(i.Extensions) > 0 || len(i.removedExtensions) > 0) &&
+		(i.DbType == "postgres") {
+		return true
+	}
+	if len(i.CustomParameters) > 0 {
+		return true
+	}
 
 	return false
 }
@@ -247,14 +394,11 @@ func (p *awsParameterGroupClient) getDefaultEngineParameterValue(i *RDSInstance,
 	if err != nil {
 		return "", err
 	}
-	describeEngDefaultParamsInput := &rds.DescribeEngineDefaultParametersInput{
-		DBParameterGroupFamily: &i.ParameterGroupFamily,
-	}
 	// We have to use a channel to get the parameter value from the anonymous function to DescribeEngineDefaultParametersPages
 	// because the code is executed asychronously
 	var parameterValueChannel = make(chan string, 1)
-	err = p.rds.DescribeEngineDefaultParametersPages(describeEngDefaultParamsInput, func(result *rds.DescribeEngineDefaultParametersOutput, lastPage bool) bool {
-		return handleParameterPage(parameterValueChannel, lastPage, result.EngineDefaults.Parameters, parameterName)
+	err = p.describeEngineDefaultParametersPages(i.ParameterGroupFamily, func(parameters []*rds.Parameter, lastPage bool) bool {
+		return handleParameterPage(parameterValueChannel, lastPage, parameters, parameterName)
 	})
 	if err != nil {
 		return "", err
@@ -263,7 +407,100 @@ func (p *awsParameterGroupClient) getDefaultEngineParameterValue(i *RDSInstance,
 	return parameterValue, err
 }
 
+// getParameterApplyMethods returns how changes to the given parameters are
+// applied: immediately for dynamic parameters, and at the next reboot for
+// static ones. Parameters that the engine does not have or that cannot be
+// modified are reported as errors.
+func (p *awsParameterGroupClient) getParameterApplyMethods(i *RDSInstance, parameterNames []string) (map[string]string, error) {
+	err := p.getParameterGroupFamily(i)
+	if err != nil {
+		return nil, err
+	}
+	wanted := map[string]bool{}
+	for _, name := range parameterNames {
+		wanted[name] = true
+	}
+
+	applyMethods := map[string]string{}
+	var notModifiable []string
+	err = p.describeEngineDefaultParametersPages(i.ParameterGroupFamily, func(parameters []*rds.Parameter, lastPage bool) bool {
+		for _, param := range parameters {
+			name := aws.StringValue(param.ParameterName)
+			if !wanted[name] {
+				continue
+			}
+			if !aws.BoolValue(param.IsModifiable) {
+				notModifiable = append(notModifiable, name)
+			}
+			if aws.StringValue(param.ApplyType) == "static" {
+				applyMethods[name] = "pending-reboot"
+			} else {
+				applyMethods[name] = "immediate"
+			}
+		}
+		return !lastPage && len(applyMethods) < len(wanted)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(notModifiable) > 0 {
+		return nil, fmt.Errorf("parameters cannot be modified: %s", strings.Join(notModifiable, ", "))
+	}
+	for _, name := range parameterNames {
+		if _, ok := applyMethods[name]; !ok {
+			return nil, fmt.Errorf("parameter %s does not exist in the %s parameter group family", name, i.ParameterGroupFamily)
+		}
+	}
+	return applyMethods, nil
+}
+
+// describeEngineDefaultParametersPages calls fn with each page of the default
+// parameters of a parameter group family until it returns false. The SDK has
+// no paginator for the defaults of cluster parameter groups, so their pages
+// are followed by marker.
+func (p *awsParameterGroupClient) describeEngineDefaultParametersPages(family string, fn func(parameters []*rds.Parameter, lastPage bool) bool) error {
+	if !p.cluster {
+		input := &rds.DescribeEngineDefaultParametersInput{
+			DBParameterGroupFamily: aws.String(family),
+		}
+		return p.rds.DescribeEngineDefaultParametersPages(input, func(result *rds.DescribeEngineDefaultParametersOutput, lastPage bool) bool {
+			return fn(result.EngineDefaults.Parameters, lastPage)
+		})
+	}
+
+	input := &rds.DescribeEngineDefaultClusterParametersInput{
+		DBParameterGroupFamily: aws.String(family),
+	}
+	for {
+		result, err := p.rds.DescribeEngineDefaultClusterParameters(input)
+		if err != nil {
+			return err
+		}
+		marker := result.EngineDefaults.Marker
+		lastPage := aws.StringValue(marker) == ""
+		if !fn(result.EngineDefaults.Parameters, lastPage) || lastPage {
+			return nil
+		}
+		input.Marker = marker
+	}
+}
+
 func (p *awsParameterGroupClient) getCustomParameterValue(i *RDSInstance, parameterName string) (string, error) {
+	if p.cluster {
+		var parameterValueChannel = make(chan string, 1)
+		err := p.rds.DescribeDBClusterParametersPages(&rds.DescribeDBClusterParametersInput{
+			DBClusterParameterGroupName: aws.String(i.ParameterGroupName),
+			Source:                      aws.String("user"),
+		}, func(result *rds.DescribeDBClusterParametersOutput, lastPage bool) bool {
+			return handleParameterPage(parameterValueChannel, lastPage, result.Parameters, parameterName)
+		})
+		if err != nil {
+			return "", err
+		}
+		return <-parameterValueChannel, nil
+	}
+
 	dbParametersInput := &rds.DescribeDBParametersInput{
 		DBParameterGroupName: aws.String(i.ParameterGroupName),
 		Source:               aws.String("user"),
@@ -295,9 +532,33 @@ func (p *awsParameterGroupClient) getParameterValue(i *RDSInstance, parameterNam
 func (p *awsParameterGroupClient) getCustomParameters(i *RDSInstance) (map[string]map[string]paramDetails, error) {
 	customRDSParameters := make(map[string]map[string]paramDetails)
 
+	// set the parameters chosen by the user first, so that the parameters
+	// managed by the broker take precedence
+	if len(i.CustomParameters) > 0 {
+		userParameters := i.customParameters()
+		names := make([]string, 0, len(userParameters))
+		for name := range userParameters {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		applyMethods, err := p.getParameterApplyMethods(i, names)
+		if err != nil {
+			return nil, err
+		}
+		customRDSParameters[i.DbType] = make(map[string]paramDetails)
+		for _, name := range names {
+			customRDSParameters[i.DbType][name] = paramDetails{
+				value:       userParameters[name],
+				applyMethod: applyMethods[name],
+			}
+		}
+	}
+
 	if i.DbType == "mysql" {
 		// enable functions
-		customRDSParameters["mysql"] = make(map[string]paramDetails)
+		if customRDSParameters["mysql"] == nil {
+			customRDSParameters["mysql"] = make(map[string]paramDetails)
+		}
 		if i.EnableFunctions && p.settings.EnableFunctionsFeature {
 			customRDSParameters["mysql"]["log_bin_trust_function_creators"] = paramDetails{
 				value:       "1",
@@ -321,17 +582,29 @@ func (p *awsParameterGroupClient) getCustomParameters(i *RDSInstance) (map[strin
 	}
 
 	if i.DbType == "postgres" {
-		customRDSParameters["postgres"] = make(map[string]paramDetails)
-		if i.EnablePgCron != nil {
+		if customRDSParameters["postgres"] == nil {
+			customRDSParameters["postgres"] = make(map[string]paramDetails)
+		}
+		if i.EnablePgCron != nil || len(i.Extensions) > 0 || len(i.removedExtensions) > 0 {
 			parameterValue, err := p.getParameterValue(i, sharedPreloadLibrariesParameterName)
 			if err != nil {
 				return nil, err
 			}
-			var sharedPreloadLibsParamValue string
-			if *i.EnablePgCron {
-				sharedPreloadLibsParamValue = addLibraryToSharedPreloadLibraries(parameterValue, pgCronLibraryName)
-			} else {
-				sharedPreloadLibsParamValue = removeLibraryFromSharedPreloadLibraries(parameterValue, pgCronLibraryName)
+			sharedPreloadLibsParamValue := parameterValue
+			if i.EnablePgCron != nil {
+				if *i.EnablePgCron {
+					sharedPreloadLibsParamValue = addLibraryToSharedPreloadLibraries(sharedPreloadLibsParamValue, pgCronLibraryName)
+				} else {
+					sharedPreloadLibsParamValue = removeLibraryFromSharedPreloadLibraries(sharedPreloadLibsParamValue, pgCronLibraryName)
+				}
+			}
+			for _, extension := range i.removedExtensions {
+				sharedPreloadLibsParamValue = removeLibraryFromSharedPreloadLibraries(sharedPreloadLibsParamValue, extension)
+			}
+			for _, extension := range i.Extensions {
+				if !slices.Contains(strings.Split(sharedPreloadLibsParamValue, ","), extension) {
+					sharedPreloadLibsParamValue = addLibraryToSharedPreloadLibraries(sharedPreloadLibsParamValue, extension)
+				}
 			}
 			customRDSParameters["postgres"][sharedPreloadLibrariesParameterName] = paramDetails{
 				value:       sharedPreloadLibsParamValue,
@@ -3,10 +3,13 @@ package rds
 import (
 	"errors"
 	"reflect"
+	"strconv"
 	"testing"
 
+	"github.com/18F/aws-broker/base"
 	"github.com/18F/aws-broker/config"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/rds"
 	"github.com/aws/aws-sdk-go/service/rds/rdsiface"
 )
@@ -922,6 +925,72 @@ func TestGetCustomParameters(t *testing.T) {
 				},
 			},
 		},
+		"load extensions, existing parameter group": {
+			dbInstance: &RDSInstance{
+				Extensions:         []string{"pg_stat_statements", "pgaudit"},
+				removedExtensions:  []string{"auto_explain"},
+				DbType:             "postgres",
+				DbVersion:          "12",
+				ParameterGroupName: "group1",
+			},
+			expectedParams: map[string]map[string]paramDetails{
+				"postgres": {
+					"shared_preload_libraries": paramDetails{
+						value:       "pgaudit,pg_stat_statements",
+						applyMethod: "pending-reboot",
+					},
+				},
+			},
+			parameterGroupAdapter: &awsParameterGroupClient{
+				settings: config.Settings{},
+				rds: &mockRDSClient{
+					describeDbParamsResults: []*rds.DescribeDBParametersOutput{
+						{
+							Parameters: []*rds.Parameter{
+								{
+									ParameterName:  aws.String("shared_preload_libraries"),
+									ParameterValue: aws.String("auto_explain,pg_stat_statements"),
+								},
+							},
+						},
+					},
+					describeDbParamsNumPages: 1,
+				},
+			},
+		},
+		"enable PG cron and load extensions": {
+			dbInstance: &RDSInstance{
+				EnablePgCron:       aws.Bool(true),
+				Extensions:         []string{"auto_explain"},
+				DbType:             "postgres",
+				DbVersion:          "12",
+				ParameterGroupName: "group1",
+			},
+			expectedParams: map[string]map[string]paramDetails{
+				"postgres": {
+					"shared_preload_libraries": paramDetails{
+						value:       "auto_explain,pg_cron,foo",
+						applyMethod: "pending-reboot",
+					},
+				},
+			},
+			parameterGroupAdapter: &awsParameterGroupClient{
+				settings: config.Settings{},
+				rds: &mockRDSClient{
+					describeDbParamsResults: []*rds.DescribeDBParametersOutput{
+						{
+							Parameters: []*rds.Parameter{
+								{
+									ParameterName:  aws.String("shared_preload_libraries"),
+									ParameterValue: aws.String("foo"),
+								},
+							},
+						},
+					},
+					describeDbParamsNumPages: 1,
+				},
+			},
+		},
 		"enable PG cron, describe db default params error": {
 			dbInstance: &RDSInstance{
 				EnablePgCron: aws.Bool(true),
@@ -978,6 +1047,60 @@ func TestGetCustomParameters(t *testing.T) {
 				},
 			},
 		},
+		"user parameters": {
+			dbInstance: &RDSInstance{
+				CustomParameters: []string{"max_connections=200", "work_mem=8192"},
+				DbType:           "postgres",
+				DbVersion:        "12",
+			},
+			expectedParams: map[string]map[string]paramDetails{
+				"postgres": {
+					"max_connections": paramDetails{
+						value:       "200",
+						applyMethod: "pending-reboot",
+					},
+					"work_mem": paramDetails{
+						value:       "8192",
+						applyMethod: "immediate",
+					},
+				},
+			},
+			parameterGroupAdapter: &awsParameterGroupClient{
+				settings: config.Settings{},
+				rds: &mockRDSClient{
+					describeEngineDefaultParamsResults: []*rds.DescribeEngineDefaultParametersOutput{
+						{
+							EngineDefaults: &rds.EngineDefaults{
+								Parameters: []*rds.Parameter{
+									{
+										ParameterName: aws.String("max_connections"),
+										ApplyType:     aws.String("static"),
+										IsModifiable:  aws.Bool(true),
+									},
+								},
+							},
+						},
+						{
+							EngineDefaults: &rds.EngineDefaults{
+								Parameters: []*rds.Parameter{
+									{
+										ParameterName: aws.String("work_mem"),
+										ApplyType:     aws.String("dynamic"),
+										IsModifiable:  aws.Bool(true),
+									},
+								},
+							},
+						},
+					},
+					dbEngineVersions: []*rds.DBEngineVersion{
+						{
+							DBParameterGroupFamily: aws.String("postgres12"),
+						},
+					},
+					describeEngineDefaultParamsNumPages: 2,
+				},
+			},
+		},
 		"disable PG cron, describe db params error": {
 			dbInstance: &RDSInstance{
 				EnablePgCron:       aws.Bool(false),
@@ -1011,6 +1134,55 @@ func TestGetCustomParameters(t *testing.T) {
 	}
 }
 
+func TestGetParameterApplyMethods(t *testing.T) {
+	testCases := map[string]struct {
+		parameters  []*rds.Parameter
+		names       []string
+		expectedErr string
+	}{
+		"parameter that cannot be modified": {
+			parameters: []*rds.Parameter{
+				{
+					ParameterName: aws.String("rds.extensions"),
+					ApplyType:     aws.String("static"),
+					IsModifiable:  aws.Bool(false),
+				},
+			},
+			names:       []string{"rds.extensions"},
+			expectedErr: "parameters cannot be modified: rds.extensions",
+		},
+		"unknown parameter": {
+			parameters:  []*rds.Parameter{},
+			names:       []string{"max_connection"},
+			expectedErr: "parameter max_connection does not exist in the postgres12 parameter group family",
+		},
+	}
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			p := &awsParameterGroupClient{
+				rds: &mockRDSClient{
+					describeEngineDefaultParamsResults: []*rds.DescribeEngineDefaultParametersOutput{
+						{
+							EngineDefaults: &rds.EngineDefaults{
+								Parameters: test.parameters,
+							},
+						},
+					},
+					describeEngineDefaultParamsNumPages: 1,
+				},
+			}
+			i := createTestRdsInstance(&RDSInstance{
+				DbType:               "postgres",
+				ParameterGroupFamily: "postgres12",
+			})
+			_, err := p.getParameterApplyMethods(i, test.names)
+			if err == nil || err.Error() != test.expectedErr {
+				t.Errorf("expected error: %s, got: %s", test.expectedErr, err)
+			}
+		})
+	}
+}
+
 func TestGetDatabaseEngineVersion(t *testing.T) {
 	testCases := map[string]struct {
 		dbInstance            *RDSInstance
@@ -1402,3 +1574,203 @@ func TestProvisionCustomParameterGroupIfNecessary(t *testing.T) {
 		})
 	}
 }
+
+func TestProvisionUpgradeParameterGroup(t *testing.T) {
+	testCases := map[string]struct {
+		dbInstance           *RDSInstance
+		dbEngineVersions     []*rds.DBEngineVersion
+		expectedPGroupName   string
+		expectedPGroupFamily string
+	}{
+		"does not need custom params": {
+			dbInstance: &RDSInstance{
+				DbType:               "mysql",
+				DbVersion:            "8.0",
+				Database:             "database1",
+				ParameterGroupName:   "prefix-database1",
+				ParameterGroupFamily: "mysql5.7",
+			},
+			dbEngineVersions: []*rds.DBEngineVersion{
+				{
+					DBParameterGroupFamily: aws.String("mysql8.0"),
+				},
+			},
+			expectedPGroupName:   "",
+			expectedPGroupFamily: "mysql8.0",
+		},
+		"new parameter group in the family of the version": {
+			dbInstance: &RDSInstance{
+				DbType:               "postgres",
+				DbVersion:            "15",
+				EnablePgCron:         aws.Bool(true),
+				Database:             "database2",
+				ParameterGroupName:   "prefix-database2",
+				ParameterGroupFamily: "postgres12",
+			},
+			dbEngineVersions: []*rds.DBEngineVersion{
+				{
+					DBParameterGroupFamily: aws.String("postgres15"),
+				},
+			},
+			expectedPGroupName:   "prefix-database2-postgres15",
+			expectedPGroupFamily: "postgres15",
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			p := &awsParameterGroupClient{
+				rds: &mockRDSClient{
+					dbEngineVersions: test.dbEngineVersions,
+					describeEngineDefaultParamsResults: []*rds.DescribeEngineDefaultParametersOutput{
+						{
+							EngineDefaults: &rds.EngineDefaults{
+								Parameters: []*rds.Parameter{},
+							},
+						},
+					},
+					describeEngineDefaultParamsNumPages: 1,
+				},
+				parameterGroupPrefix: "prefix-",
+			}
+			i := createTestRdsInstance(test.dbInstance)
+			err := p.ProvisionUpgradeParameterGroup(i, nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if i.ParameterGroupName != test.expectedPGroupName {
+				t.Errorf("expected parameter group name %s, got %s", test.expectedPGroupName, i.ParameterGroupName)
+			}
+			if i.ParameterGroupFamily != test.expectedPGroupFamily {
+				t.Errorf("expected parameter group family %s, got %s", test.expectedPGroupFamily, i.ParameterGroupFamily)
+			}
+		})
+	}
+}
+
+// mockRDSClientForClusterParameterGroups serves the calls made for the
+// cluster parameter groups of Aurora clusters, which do not exist yet.
+type mockRDSClientForClusterParameterGroups struct {
+	rdsiface.RDSAPI
+
+	engineDefaultsPages []*rds.EngineDefaults
+	parameterGroupNames []string
+
+	describeEngineVersionsInput *rds.DescribeDBEngineVersionsInput
+	createParamGroupInput       *rds.CreateDBClusterParameterGroupInput
+	modifyParamGroupInput       *rds.ModifyDBClusterParameterGroupInput
+	deletedParamGroups          []string
+}
+
+func (m *mockRDSClientForClusterParameterGroups) DescribeDBEngineVersions(input *rds.DescribeDBEngineVersionsInput) (*rds.DescribeDBEngineVersionsOutput, error) {
+	m.describeEngineVersionsInput = input
+	return &rds.DescribeDBEngineVersionsOutput{
+		DBEngineVersions: []*rds.DBEngineVersion{
+			{DBParameterGroupFamily: aws.String("aurora-postgresql15")},
+		},
+	}, nil
+}
+
+func (m *mockRDSClientForClusterParameterGroups) DescribeDBClusterParameters(*rds.DescribeDBClusterParametersInput) (*rds.DescribeDBClusterParametersOutput, error) {
+	return nil, awserr.New(rds.ErrCodeDBParameterGroupNotFoundFault, "not found", nil)
+}
+
+func (m *mockRDSClientForClusterParameterGroups) DescribeEngineDefaultClusterParameters(input *rds.DescribeEngineDefaultClusterParametersInput) (*rds.DescribeEngineDefaultClusterParametersOutput, error) {
+	page := 0
+	if input.Marker != nil {
+		page, _ = strconv.Atoi(aws.StringValue(input.Marker))
+	}
+	return &rds.DescribeEngineDefaultClusterParametersOutput{EngineDefaults: m.engineDefaultsPages[page]}, nil
+}
+
+func (m *mockRDSClientForClusterParameterGroups) CreateDBClusterParameterGroup(input *rds.CreateDBClusterParameterGroupInput) (*rds.CreateDBClusterParameterGroupOutput, error) {
+	m.createParamGroupInput = input
+	return &rds.CreateDBClusterParameterGroupOutput{}, nil
+}
+
+func (m *mockRDSClientForClusterParameterGroups) ModifyDBClusterParameterGroup(input *rds.ModifyDBClusterParameterGroupInput) (*rds.DBClusterParameterGroupNameMessage, error) {
+	m.modifyParamGroupInput = input
+	return &rds.DBClusterParameterGroupNameMessage{}, nil
+}
+
+func (m *mockRDSClientForClusterParameterGroups) DescribeDBClusterParameterGroupsPages(input *rds.DescribeDBClusterParameterGroupsInput, fn func(*rds.DescribeDBClusterParameterGroupsOutput, bool) bool) error {
+	output := &rds.DescribeDBClusterParameterGroupsOutput{}
+	for _, name := range m.parameterGroupNames {
+		output.DBClusterParameterGroups = append(output.DBClusterParameterGroups, &rds.DBClusterParameterGroup{
+			DBClusterParameterGroupName: aws.String(name),
+		})
+	}
+	fn(output, true)
+	return nil
+}
+
+func (m *mockRDSClientForClusterParameterGroups) DeleteDBClusterParameterGroup(input *rds.DeleteDBClusterParameterGroupInput) (*rds.DeleteDBClusterParameterGroupOutput, error) {
+	m.deletedParamGroups = append(m.deletedParamGroups, aws.StringValue(input.DBClusterParameterGroupName))
+	return &rds.DeleteDBClusterParameterGroupOutput{}, nil
+}
+
+func TestProvisionCustomClusterParameterGroup(t *testing.T) {
+	rdsClient := &mockRDSClientForClusterParameterGroups{
+		engineDefaultsPages: []*rds.EngineDefaults{
+			{
+				Marker: aws.String("1"),
+				Parameters: []*rds.Parameter{
+					{ParameterName: aws.String("max_connections"), ParameterValue: aws.String("100")},
+				},
+			},
+			{
+				Parameters: []*rds.Parameter{
+					{ParameterName: aws.String(sharedPreloadLibrariesParameterName), ParameterValue: aws.String("auto_explain")},
+				},
+			},
+		},
+	}
+	p := NewAwsClusterParameterGroupClient(rdsClient, config.Settings{})
+	i := createTestRdsInstance(&RDSInstance{
+		Database:   "database1",
+		DbType:     "postgres",
+		DbVersion:  "15",
+		Adapter:    "aurora",
+		Extensions: []string{"pg_stat_statements"},
+	})
+
+	err := p.ProvisionCustomParameterGroupIfNecessary(i, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if aws.StringValue(rdsClient.describeEngineVersionsInput.Engine) != "aurora-postgresql" {
+		t.Errorf("expected the aurora-postgresql engine, got %s", aws.StringValue(rdsClient.describeEngineVersionsInput.Engine))
+	}
+	if aws.StringValue(rdsClient.createParamGroupInput.DBClusterParameterGroupName) != "cg-aws-broker-database1" ||
+		aws.StringValue(rdsClient.createParamGroupInput.DBParameterGroupFamily) != "aurora-postgresql15" {
+		t.Errorf("unexpected cluster parameter group %v", rdsClient.createParamGroupInput)
+	}
+	expectedParameters := []*rds.Parameter{
+		{
+			ApplyMethod:    aws.String("pending-reboot"),
+			ParameterName:  aws.String(sharedPreloadLibrariesParameterName),
+			ParameterValue: aws.String("pg_stat_statements,auto_explain"),
+		},
+	}
+	if !reflect.DeepEqual(rdsClient.modifyParamGroupInput.Parameters, expectedParameters) {
+		t.Errorf("unexpected parameters %v", rdsClient.modifyParamGroupInput.Parameters)
+	}
+	expectedResources := base.ProvisionedResources{
+		{Type: dbClusterParameterGroupResource, Identifier: "cg-aws-broker-database1"},
+	}
+	if !reflect.DeepEqual(i.Provisioned, expectedResources) {
+		t.Errorf("unexpected provisioned resources %v", i.Provisioned)
+	}
+}
+
+func TestCleanupCustomClusterParameterGroups(t *testing.T) {
+	rdsClient := &mockRDSClientForClusterParameterGroups{
+		parameterGroupNames: []string{"cg-aws-broker-database1", "default.aurora-postgresql15"},
+	}
+	p := NewAwsClusterParameterGroupClient(rdsClient, config.Settings{})
+
+	p.CleanupCustomParameterGroups()
+	if !reflect.DeepEqual(rdsClient.deletedParamGroups, []string{"cg-aws-broker-database1"}) {
+		t.Errorf("unexpected deleted parameter groups %v", rdsClient.deletedParamGroups)
+	}
+}
@@ -12,16 +12,35 @@ import (
 
 	"errors"
 	"fmt"
+	"log"
+	"strings"
+	"time"
 )
 
 type dbAdapter interface {
 	createDB(i *RDSInstance, password string) (base.InstanceState, error)
 	modifyDB(i *RDSInstance, password string) (base.InstanceState, error)
 	checkDBStatus(i *RDSInstance) (base.InstanceState, error)
-	bindDBToApp(i *RDSInstance, password string) (map[string]string, error)
+	bindDBToApp(i *RDSInstance, password string, b *RDSBinding) (map[string]string, error)
+	refreshEndpoint(i *RDSInstance) error
+	unbindDBFromApp(i *RDSInstance, password string, b *RDSBinding) error
 	deleteDB(i *RDSInstance) (base.InstanceState, error)
+	checkDBDeletionStatus(i *RDSInstance) (base.InstanceState, error)
+	completeRestore(i *RDSInstance, password string) (base.InstanceState, error)
+	dropBindingUsers(i *RDSInstance, password string, bindings []RDSBinding) error
+	applyExtensions(i *RDSInstance, password string) (base.InstanceState, error)
+	upgradeDB(i *RDSInstance) (base.InstanceState, string, error)
+	deleteProvisionedResource(r base.ProvisionedResource) error
 }
 
+// The types of the resources recorded while provisioning instances.
+const (
+	dbInstanceResource              = "db-instance"
+	dbParameterGroupResource        = "db-parameter-group"
+	dbClusterResource               = "db-cluster"
+	dbClusterParameterGroupResource = "db-cluster-parameter-group"
+)
+
 // MockDBAdapter is a struct meant for testing.
 // It should only be used in *_test.go files.
 // It is only here because *_test.go files are only compiled during "go test"
@@ -31,6 +50,7 @@ type mockDBAdapter struct {
 
 func (d *mockDBAdapter) createDB(i *RDSInstance, password string) (base.InstanceState, error) {
 	// TODO
+	i.Provisioned.Add(dbInstanceResource, i.Database, "")
 	return base.InstanceReady, nil
 }
 
@@ -44,16 +64,59 @@ func (d *mockDBAdapter) checkDBStatus(i *RDSInstance) (base.InstanceState, error
 	return base.InstanceReady, nil
 }
 
-func (d *mockDBAdapter) bindDBToApp(i *RDSInstance, password string) (map[string]string, error) {
+func (d *mockDBAdapter) bindDBToApp(i *RDSInstance, password string, b *RDSBinding) (map[string]string, error) {
 	// TODO
+	if b != nil {
+		return i.getBindingCredentials(b, "")
+	}
 	return i.getCredentials(password)
 }
 
+func (d *mockDBAdapter) refreshEndpoint(i *RDSInstance) error {
+	// TODO
+	return nil
+}
+
+func (d *mockDBAdapter) unbindDBFromApp(i *RDSInstance, password string, b *RDSBinding) error {
+	// TODO
+	return nil
+}
+
 func (d *mockDBAdapter) deleteDB(i *RDSInstance) (base.InstanceState, error) {
 	// TODO
 	return base.InstanceGone, nil
 }
 
+func (d *mockDBAdapter) checkDBDeletionStatus(i *RDSInstance) (base.InstanceState, error) {
+	// TODO
+	return base.InstanceGone, nil
+}
+
+func (d *mockDBAdapter) completeRestore(i *RDSInstance, password string) (base.InstanceState, error) {
+	// TODO
+	return base.InstanceReady, nil
+}
+
+func (d *mockDBAdapter) dropBindingUsers(i *RDSInstance, password string, bindings []RDSBinding) error {
+	// TODO
+	return nil
+}
+
+func (d *mockDBAdapter) applyExtensions(i *RDSInstance, password string) (base.InstanceState, error) {
+	// TODO
+	return base.InstanceReady, nil
+}
+
+func (d *mockDBAdapter) upgradeDB(i *RDSInstance) (base.InstanceState, string, error) {
+	// TODO
+	i.DbVersion = i.UpgradeVersion
+	return base.InstanceReady, "", nil
+}
+
+func (d *mockDBAdapter) deleteProvisionedResource(r base.ProvisionedResource) error {
+	return nil
+}
+
 // END MockDBAdpater
 
 type dedicatedDBAdapter struct {
@@ -61,6 +124,9 @@ type dedicatedDBAdapter struct {
 	settings             config.Settings
 	rds                  rdsiface.RDSAPI
 	parameterGroupClient parameterGroupClient
+	dbUsers              dbUserClient
+	dbExtensions         dbExtensionClient
+	iamAuth              iamAuthClient
 }
 
 func (d *dedicatedDBAdapter) prepareCreateDbInput(
@@ -97,6 +163,9 @@ func (d *dedicatedDBAdapter) prepareCreateDbInput(
 	if i.LicenseModel != "" {
 		params.LicenseModel = aws.String(i.LicenseModel)
 	}
+	if i.IAMAuth != nil {
+		params.EnableIAMDatabaseAuthentication = i.IAMAuth
+	}
 
 	// If a custom parameter has been requested, and the feature is enabled,
 	// create/update a custom parameter group for our custom parameters.
@@ -111,6 +180,114 @@ func (d *dedicatedDBAdapter) prepareCreateDbInput(
 	return params, nil
 }
 
+func (d *dedicatedDBAdapter) prepareRestoreDbInput(
+	i *RDSInstance,
+) (*rds.RestoreDBInstanceFromDBSnapshotInput, error) {
+	rdsTags := ConvertTagsToRDSTags(i.Tags)
+
+	// The engine version, database name, master user and storage come from the snapshot.
+	params := &rds.RestoreDBInstanceFromDBSnapshotInput{
+		DBInstanceClass:         &d.Plan.InstanceClass,
+		DBInstanceIdentifier:    &i.Database,
+		DBSnapshotIdentifier:    aws.String(i.RestoredFromSnapshot),
+		Engine:                  aws.String(i.DbType),
+		AutoMinorVersionUpgrade: aws.Bool(true),
+		MultiAZ:                 aws.Bool(d.Plan.Redundant),
+		StorageType:             aws.String(i.StorageType),
+		Tags:                    rdsTags,
+		PubliclyAccessible:      aws.Bool(d.settings.PubliclyAccessibleFeature && i.PubliclyAccessible),
+		DBSubnetGroupName:       &i.DbSubnetGroup,
+		VpcSecurityGroupIds: []*string{
+			&i.SecGroup,
+		},
+	}
+	if i.LicenseModel != "" {
+		params.LicenseModel = aws.String(i.LicenseModel)
+	}
+	if i.IAMAuth != nil {
+		params.EnableIAMDatabaseAuthentication = i.IAMAuth
+	}
+
+	err := d.parameterGroupClient.ProvisionCustomParameterGroupIfNecessary(i, rdsTags)
+	if err != nil {
+		return nil, err
+	}
+	if i.ParameterGroupName != "" {
+		params.DBParameterGroupName = aws.String(i.ParameterGroupName)
+	}
+
+	return params, nil
+}
+
+func (d *dedicatedDBAdapter) prepareRestoreToPointInTimeInput(
+	i *RDSInstance,
+) (*rds.RestoreDBInstanceToPointInTimeInput, error) {
+	rdsTags := ConvertTagsToRDSTags(i.Tags)
+
+	// The clone uses the subnet and security groups of its own plan rather
+	// than the ones of the source instance.
+	params := &rds.RestoreDBInstanceToPointInTimeInput{
+		SourceDBInstanceIdentifier: aws.String(i.RestoredFromInstance),
+		TargetDBInstanceIdentifier: &i.Database,
+		DBInstanceClass:            &d.Plan.InstanceClass,
+		Engine:                     aws.String(i.DbType),
+		AutoMinorVersionUpgrade:    aws.Bool(true),
+		MultiAZ:                    aws.Bool(d.Plan.Redundant),
+		StorageType:                aws.String(i.StorageType),
+		Tags:                       rdsTags,
+		PubliclyAccessible:         aws.Bool(d.settings.PubliclyAccessibleFeature && i.PubliclyAccessible),
+		DBSubnetGroupName:          &i.DbSubnetGroup,
+		VpcSecurityGroupIds: []*string{
+			&i.SecGroup,
+		},
+	}
+	if i.RestoreTime != nil {
+		params.RestoreTime = i.RestoreTime
+	} else {
+		params.UseLatestRestorableTime = aws.Bool(true)
+	}
+	if i.LicenseModel != "" {
+		params.LicenseModel = aws.String(i.LicenseModel)
+	}
+	if i.IAMAuth != nil {
+		params.EnableIAMDatabaseAuthentication = i.IAMAuth
+	}
+
+	err := d.parameterGroupClient.ProvisionCustomParameterGroupIfNecessary(i, rdsTags)
+	if err != nil {
+		return nil, err
+	}
+	if i.ParameterGroupName != "" {
+		params.DBParameterGroupName = aws.String(i.ParameterGroupName)
+	}
+
+	return params, nil
+}
+
+func (d *dedicatedDBAdapter) prepareCreateReadReplicaInput(
+	i *RDSInstance,
+) *rds.CreateDBInstanceReadReplicaInput {
+	// The engine, database, master user and storage come from the primary.
+	params := &rds.CreateDBInstanceReadReplicaInput{
+		DBInstanceIdentifier:       &i.Database,
+		SourceDBInstanceIdentifier: aws.String(i.ReplicaSourceDatabase),
+		DBInstanceClass:            &d.Plan.InstanceClass,
+		AutoMinorVersionUpgrade:    aws.Bool(true),
+		MultiAZ:                    aws.Bool(d.Plan.Redundant),
+		StorageType:                aws.String(i.StorageType),
+		Tags:                       ConvertTagsToRDSTags(i.Tags),
+		PubliclyAccessible:         aws.Bool(d.settings.PubliclyAccessibleFeature && i.PubliclyAccessible),
+		DBSubnetGroupName:          &i.DbSubnetGroup,
+		VpcSecurityGroupIds: []*string{
+			&i.SecGroup,
+		},
+	}
+	if i.ParameterGroupName != "" {
+		params.DBParameterGroupName = aws.String(i.ParameterGroupName)
+	}
+	return params
+}
+
 func (d *dedicatedDBAdapter) prepareModifyDbInstanceInput(i *RDSInstance) (*rds.ModifyDBInstanceInput, error) {
 	// Standard parameters (https://docs.aws.amazon.com/sdk-for-go/api/service/rds/#RDS.ModifyDBInstance)
 	// These actions are applied immediately.
@@ -132,6 +309,10 @@ func (d *dedicatedDBAdapter) prepareModifyDbInstanceInput(i *RDSInstance) (*rds.
 		params.MasterUserPassword = aws.String(i.ClearPassword)
 	}
 
+	if i.IAMAuth != nil {
+		params.EnableIAMDatabaseAuthentication = i.IAMAuth
+	}
+
 	rdsTags := ConvertTagsToRDSTags(i.Tags)
 
 	// If a custom parameter has been requested, and the feature is enabled,
@@ -147,6 +328,16 @@ func (d *dedicatedDBAdapter) prepareModifyDbInstanceInput(i *RDSInstance) (*rds.
 }
 
 func (d *dedicatedDBAdapter) createDB(i *RDSInstance, password string) (base.InstanceState, error) {
+	if i.RestoredFromSnapshot != "" {
+		return d.restoreDB(i)
+	}
+	if i.RestoredFromInstance != "" {
+		return d.restoreDBToPointInTime(i)
+	}
+	if i.isReplica() {
+		return d.createReadReplica(i)
+	}
+
 	params, err := d.prepareCreateDbInput(i, password)
 	if err != nil {
 		return base.InstanceNotCreated, err
@@ -156,6 +347,7 @@ func (d *dedicatedDBAdapter) createDB(i *RDSInstance, password string) (base.Ins
 	if err != nil {
 		return base.InstanceNotCreated, err
 	}
+	i.Provisioned.Add(dbInstanceResource, i.Database, "")
 
 	// Decide if AWS service call was successful
 	if yes := d.didAwsCallSucceed(err); yes {
@@ -164,6 +356,259 @@ func (d *dedicatedDBAdapter) createDB(i *RDSInstance, password string) (base.Ins
 	return base.InstanceNotCreated, nil
 }
 
+func (d *dedicatedDBAdapter) restoreDB(i *RDSInstance) (base.InstanceState, error) {
+	params, err := d.prepareRestoreDbInput(i)
+	if err != nil {
+		return base.InstanceNotCreated, err
+	}
+
+	_, err = d.rds.RestoreDBInstanceFromDBSnapshot(params)
+	if err != nil {
+		return base.InstanceNotCreated, err
+	}
+	i.Provisioned.Add(dbInstanceResource, i.Database, "")
+	return base.InstanceInProgress, nil
+}
+
+func (d *dedicatedDBAdapter) restoreDBToPointInTime(i *RDSInstance) (base.InstanceState, error) {
+	params, err := d.prepareRestoreToPointInTimeInput(i)
+	if err != nil {
+		return base.InstanceNotCreated, err
+	}
+
+	_, err = d.rds.RestoreDBInstanceToPointInTime(params)
+	if err != nil {
+		return base.InstanceNotCreated, err
+	}
+	i.Provisioned.Add(dbInstanceResource, i.Database, "")
+	return base.InstanceInProgress, nil
+}
+
+func (d *dedicatedDBAdapter) createReadReplica(i *RDSInstance) (base.InstanceState, error) {
+	_, err := d.rds.CreateDBInstanceReadReplica(d.prepareCreateReadReplicaInput(i))
+	if err != nil {
+		return base.InstanceNotCreated, err
+	}
+	i.Provisioned.Add(dbInstanceResource, i.Database, "")
+	return base.InstanceInProgress, nil
+}
+
+// completeRestore applies the settings a restore cannot: the master password,
+// which is otherwise the one of the instance the snapshot was taken from, the
+// backup retention period, and more storage if more was requested than the
+// snapshot had. The instance is in progress until RDS has applied the new
+// password, so that bindings never get a password it does not accept yet.
+func (d *dedicatedDBAdapter) completeRestore(i *RDSInstance, password string) (base.InstanceState, error) {
+	if !i.MasterPasswordResetRequested {
+		params := &rds.ModifyDBInstanceInput{
+			DBInstanceIdentifier:  aws.String(i.Database),
+			MasterUserPassword:    aws.String(password),
+			AllocatedStorage:      aws.Int64(i.AllocatedStorage),
+			BackupRetentionPeriod: aws.Int64(i.BackupRetentionPeriod),
+			ApplyImmediately:      aws.Bool(true),
+		}
+		if _, err := d.rds.ModifyDBInstance(params); err != nil {
+			return base.InstanceNotModified, err
+		}
+		i.MasterPasswordResetRequested = true
+		return base.InstanceInProgress, nil
+	}
+
+	resp, err := d.rds.DescribeDBInstances(&rds.DescribeDBInstancesInput{
+		DBInstanceIdentifier: aws.String(i.Database),
+	})
+	if err != nil {
+		return base.InstanceNotModified, err
+	}
+	if len(resp.DBInstances) == 0 {
+		return base.InstanceNotModified, fmt.Errorf("database %s was not found", i.Database)
+	}
+	dbInstance := resp.DBInstances[0]
+	if aws.StringValue(dbInstance.DBInstanceStatus) != "available" {
+		return base.InstanceInProgress, nil
+	}
+	if dbInstance.PendingModifiedValues != nil && dbInstance.PendingModifiedValues.MasterUserPassword != nil {
+		return base.InstanceInProgress, nil
+	}
+	return base.InstanceReady, nil
+}
+
+// dropBindingUsers drops the database users of bindings from the instance,
+// leaving their IAM users alone. A clone has the users of the bindings of its
+// source, which are still in use there.
+func (d *dedicatedDBAdapter) dropBindingUsers(i *RDSInstance, password string, bindings []RDSBinding) error {
+	if err := d.refreshEndpoint(i); err != nil {
+		return err
+	}
+	for idx := range bindings {
+		if err := d.dbUsers.dropUser(i, password, &bindings[idx]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyExtensions reboots the instance if its parameter group has changes that
+// are pending a reboot, like a change to the libraries to load, and otherwise
+// creates the loaded extensions in the database if that was asked for. The
+// instance is in progress until both are done.
+func (d *dedicatedDBAdapter) applyExtensions(i *RDSInstance, password string) (base.InstanceState, error) {
+	resp, err := d.rds.DescribeDBInstances(&rds.DescribeDBInstancesInput{
+		DBInstanceIdentifier: aws.String(i.Database),
+	})
+	if err != nil {
+		return base.InstanceNotModified, err
+	}
+	if len(resp.DBInstances) == 0 {
+		return base.InstanceNotModified, fmt.Errorf("database %s was not found", i.Database)
+	}
+
+	for _, parameterGroup := range resp.DBInstances[0].DBParameterGroups {
+		if aws.StringValue(parameterGroup.DBParameterGroupName) != i.ParameterGroupName {
+			continue
+		}
+		switch aws.StringValue(parameterGroup.ParameterApplyStatus) {
+		case "in-sync":
+		case "pending-reboot":
+			log.Printf("rebooting %s to apply parameter group %s", i.Database, i.ParameterGroupName)
+			_, err := d.rds.RebootDBInstance(&rds.RebootDBInstanceInput{
+				DBInstanceIdentifier: aws.String(i.Database),
+			})
+			if err != nil {
+				return base.InstanceNotModified, err
+			}
+			return base.InstanceInProgress, nil
+		default:
+			return base.InstanceInProgress, nil
+		}
+	}
+
+	if !i.CreateExtensions {
+		return base.InstanceReady, nil
+	}
+	if err := d.refreshEndpoint(i); err != nil {
+		return base.InstanceNotModified, err
+	}
+	if err := d.dbExtensions.createExtensions(i, password); err != nil {
+		return base.InstanceNotModified, err
+	}
+	return base.InstanceReady, nil
+}
+
+// upgradeDB takes the next step of the major version upgrade of an instance,
+// and describes the step: a snapshot of the instance is taken first, and once
+// it is available, the instance is upgraded with a parameter group in the family
+// of the new version. The upgrade is done once the instance runs the new
+// version. DbVersion is set to the new version when the upgrade is requested.
+func (d *dedicatedDBAdapter) upgradeDB(i *RDSInstance) (base.InstanceState, string, error) {
+	resp, err := d.rds.DescribeDBInstances(&rds.DescribeDBInstancesInput{
+		DBInstanceIdentifier: aws.String(i.Database),
+	})
+	if err != nil {
+		return base.InstanceNotModified, "", err
+	}
+	if len(resp.DBInstances) == 0 {
+		return base.InstanceNotModified, "", fmt.Errorf("database %s was not found", i.Database)
+	}
+	dbInstance := resp.DBInstances[0]
+	upgradeRequested := i.DbVersion == i.UpgradeVersion
+
+	// Each step needs the instance to be available, and the instance reports
+	// another status while it is upgraded.
+	if aws.StringValue(dbInstance.DBInstanceStatus) != "available" {
+		if upgradeRequested {
+			i.UpgradeStarted = true
+			return base.InstanceInProgress, "upgrading to version " + i.UpgradeVersion, nil
+		}
+		if i.UpgradeSnapshotIdentifier != "" {
+			return base.InstanceInProgress, "taking snapshot " + i.UpgradeSnapshotIdentifier + " before upgrading", nil
+		}
+		return base.InstanceInProgress, "waiting for the instance to be available before upgrading", nil
+	}
+
+	engineVersion := aws.StringValue(dbInstance.EngineVersion)
+	if compareEngineVersions(engineVersion, i.UpgradeVersion) >= 0 {
+		i.DbVersion = i.UpgradeVersion
+		return base.InstanceReady, "upgraded to version " + engineVersion, nil
+	}
+	if dbInstance.PendingModifiedValues != nil && dbInstance.PendingModifiedValues.EngineVersion != nil {
+		i.UpgradeStarted = upgradeRequested
+		return base.InstanceInProgress, "upgrading to version " + i.UpgradeVersion, nil
+	}
+	if upgradeRequested {
+		// RDS can still report the instance available for a moment after the
+		// upgrade was requested, before it starts upgrading.
+		if !i.UpgradeStarted {
+			return base.InstanceInProgress, "upgrading to version " + i.UpgradeVersion, nil
+		}
+		// An instance that was upgrading and is available again, running the
+		// previous version, failed to upgrade and was left as it was.
+		i.DbVersion = engineVersion
+		i.ParameterGroupName = ""
+		for _, parameterGroup := range dbInstance.DBParameterGroups {
+			if name := aws.StringValue(parameterGroup.DBParameterGroupName); !strings.HasPrefix(name, "default.") {
+				i.ParameterGroupName = name
+			}
+		}
+		return base.InstanceNotModified, "the upgrade to version " + i.UpgradeVersion + " failed; please check the events of the instance", nil
+	}
+
+	if i.UpgradeSnapshotIdentifier == "" {
+		snapshotIdentifier := i.preUpgradeSnapshotIdentifier(time.Now())
+		log.Printf("taking snapshot %s of %s before upgrading to %s", snapshotIdentifier, i.Database, i.UpgradeVersion)
+		_, err := d.rds.CreateDBSnapshot(&rds.CreateDBSnapshotInput{
+			DBInstanceIdentifier: aws.String(i.Database),
+			DBSnapshotIdentifier: aws.String(snapshotIdentifier),
+			Tags:                 ConvertTagsToRDSTags(i.Tags),
+		})
+		if err != nil {
+			return base.InstanceNotModified, "", err
+		}
+		i.UpgradeSnapshotIdentifier = snapshotIdentifier
+		return base.InstanceInProgress, "taking snapshot " + snapshotIdentifier + " before upgrading", nil
+	}
+
+	snapshots, err := d.rds.DescribeDBSnapshots(&rds.DescribeDBSnapshotsInput{
+		DBSnapshotIdentifier: aws.String(i.UpgradeSnapshotIdentifier),
+	})
+	if err != nil {
+		return base.InstanceNotModified, "", err
+	}
+	if len(snapshots.DBSnapshots) == 0 {
+		return base.InstanceNotModified, "snapshot " + i.UpgradeSnapshotIdentifier + " was not found", nil
+	}
+	switch status := aws.StringValue(snapshots.DBSnapshots[0].Status); status {
+	case "available":
+	case "creating":
+		return base.InstanceInProgress, "taking snapshot " + i.UpgradeSnapshotIdentifier + " before upgrading", nil
+	default:
+		return base.InstanceNotModified, "snapshot " + i.UpgradeSnapshotIdentifier + " is " + status, nil
+	}
+
+	currentVersion, currentParameterGroupName := i.DbVersion, i.ParameterGroupName
+	i.DbVersion = i.UpgradeVersion
+	err = d.parameterGroupClient.ProvisionUpgradeParameterGroup(i, ConvertTagsToRDSTags(i.Tags))
+	if err == nil {
+		parameterGroupName := i.ParameterGroupName
+		if parameterGroupName == "" {
+			parameterGroupName = "default." + i.ParameterGroupFamily
+		}
+		log.Printf("upgrading %s to %s with parameter group %s", i.Database, i.UpgradeVersion, parameterGroupName)
+		_, err = d.rds.ModifyDBInstance(&rds.ModifyDBInstanceInput{
+			DBInstanceIdentifier:     aws.String(i.Database),
+			EngineVersion:            aws.String(i.UpgradeVersion),
+			AllowMajorVersionUpgrade: aws.Bool(true),
+			DBParameterGroupName:     aws.String(parameterGroupName),
+			ApplyImmediately:         aws.Bool(true),
+		})
+	}
+	if err != nil {
+		i.DbVersion, i.ParameterGroupName = currentVersion, currentParameterGroupName
+		return base.InstanceNotModified, "", err
+	}
+	return base.InstanceInProgress, "upgrading to version " + i.UpgradeVersion, nil
+}
+
 // This should ultimately get exposed as part of the "update-service" method for the broker:
 // cf update-service SERVICE_INSTANCE [-p NEW_PLAN] [-c PARAMETERS_AS_JSON] [-t TAGS] [--upgrade]
 func (d *dedicatedDBAdapter) modifyDB(i *RDSInstance, password string) (base.InstanceState, error) {
@@ -239,7 +684,48 @@ func (d *dedicatedDBAdapter) checkDBStatus(i *RDSInstance) (base.InstanceState,
 	return base.InstanceNotCreated, nil
 }
 
-func (d *dedicatedDBAdapter) bindDBToApp(i *RDSInstance, password string) (map[string]string, error) {
+// bindDBToApp waits for the instance endpoint to be known and returns the credentials
+// for the application. If a binding is given, a database user is created for it and
+// its credentials are returned instead of the master credentials. Bindings with IAM
+// database authentication also get an IAM user allowed to connect as that user.
+func (d *dedicatedDBAdapter) bindDBToApp(i *RDSInstance, password string, b *RDSBinding) (map[string]string, error) {
+	if err := d.refreshEndpoint(i); err != nil {
+		return nil, err
+	}
+	// If we get here that means the instance is up and we have the information for it.
+	if b == nil {
+		return i.getCredentials(password)
+	}
+	if b.isIAMAuth() {
+		secretAccessKey, err := d.iamAuth.createBindingUser(i, b)
+		if err != nil {
+			return nil, err
+		}
+		if err := b.setSecretAccessKey(secretAccessKey, &d.settings); err != nil {
+			d.deleteIAMBindingUser(b)
+			return nil, err
+		}
+	}
+	if err := d.dbUsers.createUser(i, password, b); err != nil {
+		if b.isIAMAuth() {
+			d.deleteIAMBindingUser(b)
+		}
+		return nil, err
+	}
+	return i.getBindingCredentials(b, d.settings.Region)
+}
+
+// deleteIAMBindingUser deletes the IAM user of a binding that could not be
+// created. Failures are only logged since the binding is not recorded.
+func (d *dedicatedDBAdapter) deleteIAMBindingUser(b *RDSBinding) {
+	if err := d.iamAuth.deleteBindingUser(b); err != nil {
+		log.Printf("unable to delete IAM user %s: %s", b.IAMUserName, err)
+	}
+}
+
+// refreshEndpoint looks up the host and port of an instance that is not known
+// to be ready yet, and marks it as ready once it is available.
+func (d *dedicatedDBAdapter) refreshEndpoint(i *RDSInstance) error {
 	// First, we need to check if the instance is up and available before binding.
 	// Only search for details if the instance was not indicated as ready.
 	if i.State != base.InstanceReady {
@@ -262,7 +748,7 @@ func (d *dedicatedDBAdapter) bindDBToApp(i *RDSInstance, password string) (map[s
 				// error which satisfies the awserr.Error interface.
 				fmt.Println(err.Error())
 			}
-			return nil, err
+			return err
 		}
 
 		// Get the details (host and port) for the instance.
@@ -280,38 +766,111 @@ func (d *dedicatedDBAdapter) bindDBToApp(i *RDSInstance, password string) (map[s
 						break
 					} else {
 						// Something went horribly wrong. Should never get here.
-						return nil, errors.New("Inavlid memory for endpoint and/or endpoint members.")
+						return errors.New("Inavlid memory for endpoint and/or endpoint members.")
 					}
 				} else {
 					// Instance not up yet.
-					return nil, errors.New("Instance not available yet. Please wait and try again..")
+					return errors.New("Instance not available yet. Please wait and try again..")
 				}
 			}
 		} else {
 			// Couldn't find any instances.
-			return nil, errors.New("Couldn't find any instances.")
+			return errors.New("Couldn't find any instances.")
 		}
 	}
-	// If we get here that means the instance is up and we have the information for it.
-	return i.getCredentials(password)
+	return nil
 }
 
+// unbindDBFromApp drops the database user of a binding and deletes its IAM
+// user. The IAM user is deleted even if the database user could not be
+// dropped, since its access key is what apps connect with.
+func (d *dedicatedDBAdapter) unbindDBFromApp(i *RDSInstance, password string, b *RDSBinding) error {
+	dropErr := d.dbUsers.dropUser(i, password, b)
+	if b.isIAMAuth() {
+		if err := d.iamAuth.deleteBindingUser(b); err != nil {
+			return err
+		}
+	}
+	return dropErr
+}
+
+// deleteDB starts deleting the instance, taking a final snapshot of it first so
+// that it can be restored, unless it is a read replica. Deletion completes
+// asynchronously.
 func (d *dedicatedDBAdapter) deleteDB(i *RDSInstance) (base.InstanceState, error) {
 	params := &rds.DeleteDBInstanceInput{
-		DBInstanceIdentifier: aws.String(i.Database), // Required
-		// FinalDBSnapshotIdentifier: aws.String("String"),
-		DeleteAutomatedBackups: aws.Bool(false),
-		SkipFinalSnapshot:      aws.Bool(true),
+		DBInstanceIdentifier:      aws.String(i.Database), // Required
+		FinalDBSnapshotIdentifier: aws.String(i.finalSnapshotIdentifier()),
+		DeleteAutomatedBackups:    aws.Bool(false),
+		SkipFinalSnapshot:         aws.Bool(false),
+	}
+	// Read replicas cannot be snapshotted; their data lives on in the primary.
+	if i.isReplica() {
+		params.FinalDBSnapshotIdentifier = nil
+		params.SkipFinalSnapshot = aws.Bool(true)
 	}
 	_, err := d.rds.DeleteDBInstance(params)
+	if err != nil {
+		// Instance no longer exists, so there is nothing to snapshot
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == rds.ErrCodeDBInstanceNotFoundFault {
+			return base.InstanceGone, nil
+		}
+		d.didAwsCallSucceed(err)
+		return base.InstanceNotGone, err
+	}
+	return base.InstanceInProgress, nil
+}
 
-	// Decide if AWS service call was successful
-	if yes := d.didAwsCallSucceed(err); yes {
-		// clean up custom parameter groups
-		d.parameterGroupClient.CleanupCustomParameterGroups()
-		return base.InstanceGone, nil
+// checkDBDeletionStatus reports whether an instance being deleted is gone, and
+// cleans up the custom parameter groups that were left unused once it is.
+func (d *dedicatedDBAdapter) checkDBDeletionStatus(i *RDSInstance) (base.InstanceState, error) {
+	params := &rds.DescribeDBInstancesInput{
+		DBInstanceIdentifier: aws.String(i.Database),
+	}
+	_, err := d.rds.DescribeDBInstances(params)
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == rds.ErrCodeDBInstanceNotFoundFault {
+			d.parameterGroupClient.CleanupCustomParameterGroups()
+			return base.InstanceGone, nil
+		}
+		d.didAwsCallSucceed(err)
+		return base.InstanceNotGone, err
+	}
+	return base.InstanceInProgress, nil
+}
+
+// deleteProvisionedResource deletes a resource created while provisioning an
+// instance that failed. Since the instance was never provisioned, it is
+// deleted without a final snapshot.
+func (d *dedicatedDBAdapter) deleteProvisionedResource(r base.ProvisionedResource) error {
+	switch r.Type {
+	case dbInstanceResource:
+		_, err := d.rds.DeleteDBInstance(&rds.DeleteDBInstanceInput{
+			DBInstanceIdentifier:   aws.String(r.Identifier),
+			DeleteAutomatedBackups: aws.Bool(true),
+			SkipFinalSnapshot:      aws.Bool(true),
+		})
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == rds.ErrCodeDBInstanceNotFoundFault {
+			return nil
+		}
+		return err
+	case dbParameterGroupResource:
+		_, err := d.rds.DeleteDBParameterGroup(&rds.DeleteDBParameterGroupInput{
+			DBParameterGroupName: aws.String(r.Identifier),
+		})
+		if awsErr, ok := err.(awserr.Error); ok {
+			switch awsErr.Code() {
+			case rds.ErrCodeDBParameterGroupNotFoundFault:
+				return nil
+			case rds.ErrCodeInvalidDBParameterGroupStateFault:
+				// The group is in use until the instance is deleted, after
+				// which CleanupCustomParameterGroups deletes it.
+				return nil
+			}
+		}
+		return err
 	}
-	return base.InstanceNotGone, nil
+	return fmt.Errorf("unknown resource type %s", r.Type)
 }
 
 func (d *dedicatedDBAdapter) didAwsCallSucceed(err error) bool {
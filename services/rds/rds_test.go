@@ -3,11 +3,13 @@ package rds
 import (
 	"errors"
 	"testing"
+	"time"
 
 	"github.com/18F/aws-broker/base"
 	"github.com/18F/aws-broker/catalog"
 	"github.com/18F/aws-broker/config"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/rds"
 	"github.com/aws/aws-sdk-go/service/rds/rdsiface"
 	"github.com/go-test/deep"
@@ -27,13 +29,35 @@ func (m *mockParameterGroupClient) ProvisionCustomParameterGroupIfNecessary(i *R
 	return nil
 }
 
+func (m *mockParameterGroupClient) ProvisionUpgradeParameterGroup(i *RDSInstance, rdsTags []*rds.Tag) error {
+	if m.returnErr != nil {
+		return m.returnErr
+	}
+	i.ParameterGroupFamily = "postgres15"
+	i.ParameterGroupName = m.customPgroupName
+	return nil
+}
+
 func (m *mockParameterGroupClient) CleanupCustomParameterGroups() {}
 
 type mockRdsClientForAdapterTests struct {
 	rdsiface.RDSAPI
 
-	createDbErr error
-	modifyDbErr error
+	createDbErr   error
+	modifyDbErr   error
+	deleteDbErr   error
+	describeDbErr error
+
+	deleteDbInput             *rds.DeleteDBInstanceInput
+	restoreDbInput            *rds.RestoreDBInstanceFromDBSnapshotInput
+	restoreToPointInTimeInput *rds.RestoreDBInstanceToPointInTimeInput
+	createReadReplicaInput    *rds.CreateDBInstanceReadReplicaInput
+	rebootDbInput             *rds.RebootDBInstanceInput
+	modifyDbInput             *rds.ModifyDBInstanceInput
+	createSnapshotInput       *rds.CreateDBSnapshotInput
+
+	describeDbOutput        *rds.DescribeDBInstancesOutput
+	describeSnapshotsOutput *rds.DescribeDBSnapshotsOutput
 }
 
 func (m mockRdsClientForAdapterTests) CreateDBInstance(*rds.CreateDBInstanceInput) (*rds.CreateDBInstanceOutput, error) {
@@ -43,13 +67,79 @@ func (m mockRdsClientForAdapterTests) CreateDBInstance(*rds.CreateDBInstanceInpu
 	return nil, nil
 }
 
-func (m mockRdsClientForAdapterTests) ModifyDBInstance(*rds.ModifyDBInstanceInput) (*rds.ModifyDBInstanceOutput, error) {
+func (m *mockRdsClientForAdapterTests) ModifyDBInstance(input *rds.ModifyDBInstanceInput) (*rds.ModifyDBInstanceOutput, error) {
+	m.modifyDbInput = input
 	if m.modifyDbErr != nil {
 		return nil, m.modifyDbErr
 	}
 	return nil, nil
 }
 
+func (m *mockRdsClientForAdapterTests) DeleteDBInstance(input *rds.DeleteDBInstanceInput) (*rds.DeleteDBInstanceOutput, error) {
+	m.deleteDbInput = input
+	if m.deleteDbErr != nil {
+		return nil, m.deleteDbErr
+	}
+	return nil, nil
+}
+
+func (m *mockRdsClientForAdapterTests) DescribeDBInstances(*rds.DescribeDBInstancesInput) (*rds.DescribeDBInstancesOutput, error) {
+	if m.describeDbErr != nil {
+		return nil, m.describeDbErr
+	}
+	if m.describeDbOutput != nil {
+		return m.describeDbOutput, nil
+	}
+	return &rds.DescribeDBInstancesOutput{}, nil
+}
+
+func (m *mockRdsClientForAdapterTests) RebootDBInstance(input *rds.RebootDBInstanceInput) (*rds.RebootDBInstanceOutput, error) {
+	m.rebootDbInput = input
+	return &rds.RebootDBInstanceOutput{}, nil
+}
+
+func (m *mockRdsClientForAdapterTests) CreateDBSnapshot(input *rds.CreateDBSnapshotInput) (*rds.CreateDBSnapshotOutput, error) {
+	m.createSnapshotInput = input
+	return &rds.CreateDBSnapshotOutput{}, nil
+}
+
+func (m *mockRdsClientForAdapterTests) DescribeDBSnapshots(*rds.DescribeDBSnapshotsInput) (*rds.DescribeDBSnapshotsOutput, error) {
+	return m.describeSnapshotsOutput, nil
+}
+
+type mockDBExtensionClient struct {
+	created []string
+}
+
+func (m *mockDBExtensionClient) createExtensions(i *RDSInstance, masterPassword string) error {
+	m.created = append(m.created, i.Extensions...)
+	return nil
+}
+
+func (m *mockRdsClientForAdapterTests) RestoreDBInstanceFromDBSnapshot(input *rds.RestoreDBInstanceFromDBSnapshotInput) (*rds.RestoreDBInstanceFromDBSnapshotOutput, error) {
+	m.restoreDbInput = input
+	if m.createDbErr != nil {
+		return nil, m.createDbErr
+	}
+	return nil, nil
+}
+
+func (m *mockRdsClientForAdapterTests) RestoreDBInstanceToPointInTime(input *rds.RestoreDBInstanceToPointInTimeInput) (*rds.RestoreDBInstanceToPointInTimeOutput, error) {
+	m.restoreToPointInTimeInput = input
+	if m.createDbErr != nil {
+		return nil, m.createDbErr
+	}
+	return nil, nil
+}
+
+func (m *mockRdsClientForAdapterTests) CreateDBInstanceReadReplica(input *rds.CreateDBInstanceReadReplicaInput) (*rds.CreateDBInstanceReadReplicaOutput, error) {
+	m.createReadReplicaInput = input
+	if m.createDbErr != nil {
+		return nil, m.createDbErr
+	}
+	return nil, nil
+}
+
 func TestPrepareCreateDbInstanceInput(t *testing.T) {
 	testErr := errors.New("fail")
 	testCases := map[string]struct {
@@ -191,6 +281,308 @@ func TestCreateDb(t *testing.T) {
 	}
 }
 
+func TestCreateDbFromSnapshot(t *testing.T) {
+	rdsClient := &mockRdsClientForAdapterTests{}
+	adapter := &dedicatedDBAdapter{
+		Plan: catalog.RDSPlan{
+			InstanceClass: "db.t3.small",
+		},
+		rds:                  rdsClient,
+		parameterGroupClient: &mockParameterGroupClient{customPgroupName: "foobar"},
+	}
+	instance := NewRDSInstance()
+	instance.Database = "db-name"
+	instance.DbType = "postgres"
+	instance.restoreFromSnapshot(&RDSSnapshot{
+		SnapshotIdentifier: "old-db-final-snapshot",
+		DbName:             "olddb",
+		Username:           "olduser",
+	})
+
+	state, err := adapter.createDB(instance, "fake-pw")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if state != base.InstanceInProgress {
+		t.Errorf("expected state %s, got %s", base.InstanceInProgress, state)
+	}
+	if rdsClient.restoreDbInput == nil {
+		t.Fatal("expected the instance to be restored from the snapshot")
+	}
+	if *rdsClient.restoreDbInput.DBSnapshotIdentifier != "old-db-final-snapshot" {
+		t.Errorf("unexpected snapshot identifier %s", *rdsClient.restoreDbInput.DBSnapshotIdentifier)
+	}
+	if *rdsClient.restoreDbInput.DBParameterGroupName != "foobar" {
+		t.Errorf("unexpected parameter group %s", *rdsClient.restoreDbInput.DBParameterGroupName)
+	}
+	if instance.FormatDBName() != "olddb" || instance.Username != "olduser" {
+		t.Error("expected the database and master user of the snapshot to be kept")
+	}
+}
+
+func TestCreateDbToPointInTime(t *testing.T) {
+	restoreTime := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	source := NewRDSInstance()
+	source.Database = "source-db"
+	source.DbType = "postgres"
+	source.Username = "sourceuser"
+
+	testCases := map[string]struct {
+		restoreTime *time.Time
+	}{
+		"at restore time": {
+			restoreTime: &restoreTime,
+		},
+		"at latest restorable time": {},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			rdsClient := &mockRdsClientForAdapterTests{}
+			adapter := &dedicatedDBAdapter{
+				Plan: catalog.RDSPlan{
+					InstanceClass: "db.t3.small",
+				},
+				rds:                  rdsClient,
+				parameterGroupClient: &mockParameterGroupClient{},
+			}
+			instance := NewRDSInstance()
+			instance.Database = "db-name"
+			instance.DbType = "postgres"
+			instance.DbSubnetGroup = "new-subnet-group"
+			instance.SecGroup = "new-sec-group"
+			instance.restoreFromInstance(source, test.restoreTime)
+
+			state, err := adapter.createDB(instance, "fake-pw")
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if state != base.InstanceInProgress {
+				t.Errorf("expected state %s, got %s", base.InstanceInProgress, state)
+			}
+			input := rdsClient.restoreToPointInTimeInput
+			if input == nil {
+				t.Fatal("expected the instance to be restored to a point in time")
+			}
+			if *input.SourceDBInstanceIdentifier != "source-db" || *input.TargetDBInstanceIdentifier != "db-name" {
+				t.Errorf("unexpected source %s or target %s", *input.SourceDBInstanceIdentifier, *input.TargetDBInstanceIdentifier)
+			}
+			if *input.DBSubnetGroupName != "new-subnet-group" || *input.VpcSecurityGroupIds[0] != "new-sec-group" {
+				t.Error("expected the subnet and security groups of the new plan")
+			}
+			if test.restoreTime != nil && !input.RestoreTime.Equal(restoreTime) {
+				t.Errorf("unexpected restore time %s", input.RestoreTime)
+			}
+			if test.restoreTime == nil && !*input.UseLatestRestorableTime {
+				t.Error("expected the latest restorable time to be used")
+			}
+		})
+	}
+}
+
+func TestCreateDbReadReplica(t *testing.T) {
+	primary := NewRDSInstance()
+	primary.Uuid = "primary-guid"
+	primary.Database = "primary-db"
+	primary.DbType = "postgres"
+	primary.Username = "primaryuser"
+	primary.Password = "encrypted-pw"
+	primary.Salt = "salt"
+	primary.ParameterGroupName = "primary-pgroup"
+
+	testCases := map[string]struct {
+		createDbErr   error
+		expectedState base.InstanceState
+	}{
+		"success": {
+			expectedState: base.InstanceInProgress,
+		},
+		"error": {
+			createDbErr:   errors.New("fail"),
+			expectedState: base.InstanceNotCreated,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			rdsClient := &mockRdsClientForAdapterTests{createDbErr: test.createDbErr}
+			adapter := &dedicatedDBAdapter{
+				Plan: catalog.RDSPlan{
+					InstanceClass: "db.t3.small",
+				},
+				rds:                  rdsClient,
+				parameterGroupClient: &mockParameterGroupClient{},
+			}
+			instance := NewRDSInstance()
+			instance.Database = "db-name"
+			instance.DbType = "postgres"
+			instance.replicate(primary)
+
+			state, _ := adapter.createDB(instance, "")
+			if state != test.expectedState {
+				t.Errorf("expected state %s, got %s", test.expectedState, state)
+			}
+			input := rdsClient.createReadReplicaInput
+			if input == nil {
+				t.Fatal("expected a read replica to be created")
+			}
+			if *input.SourceDBInstanceIdentifier != "primary-db" || *input.DBInstanceIdentifier != "db-name" {
+				t.Errorf("unexpected source %s or replica %s", *input.SourceDBInstanceIdentifier, *input.DBInstanceIdentifier)
+			}
+			if *input.DBParameterGroupName != "primary-pgroup" {
+				t.Errorf("unexpected parameter group %s", *input.DBParameterGroupName)
+			}
+			if instance.ReplicaOf != "primary-guid" || instance.Username != "primaryuser" || instance.Password != "encrypted-pw" {
+				t.Error("expected the replica to share the master credentials of the primary")
+			}
+		})
+	}
+}
+
+func TestDeleteDb(t *testing.T) {
+	testCases := map[string]struct {
+		deleteDbErr   error
+		expectedState base.InstanceState
+		expectErr     bool
+	}{
+		"takes a final snapshot": {
+			expectedState: base.InstanceInProgress,
+		},
+		"instance already gone": {
+			deleteDbErr:   awserr.New(rds.ErrCodeDBInstanceNotFoundFault, "not found", nil),
+			expectedState: base.InstanceGone,
+		},
+		"delete DB error": {
+			deleteDbErr:   errors.New("fail"),
+			expectedState: base.InstanceNotGone,
+			expectErr:     true,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			rdsClient := &mockRdsClientForAdapterTests{deleteDbErr: test.deleteDbErr}
+			adapter := &dedicatedDBAdapter{
+				rds:                  rdsClient,
+				parameterGroupClient: &mockParameterGroupClient{},
+			}
+			instance := NewRDSInstance()
+			instance.Database = "db-name"
+
+			state, err := adapter.deleteDB(instance)
+			if test.expectErr != (err != nil) {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if state != test.expectedState {
+				t.Errorf("expected state %s, got %s", test.expectedState, state)
+			}
+			if *rdsClient.deleteDbInput.SkipFinalSnapshot {
+				t.Error("expected a final snapshot to be taken")
+			}
+			if *rdsClient.deleteDbInput.FinalDBSnapshotIdentifier != "db-name-final-snapshot" {
+				t.Errorf("unexpected final snapshot identifier %s", *rdsClient.deleteDbInput.FinalDBSnapshotIdentifier)
+			}
+		})
+	}
+}
+
+func TestDeleteDbReadReplica(t *testing.T) {
+	rdsClient := &mockRdsClientForAdapterTests{}
+	adapter := &dedicatedDBAdapter{
+		rds:                  rdsClient,
+		parameterGroupClient: &mockParameterGroupClient{},
+	}
+	instance := NewRDSInstance()
+	instance.Database = "db-name"
+	instance.ReplicaOf = "primary-guid"
+
+	state, err := adapter.deleteDB(instance)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if state != base.InstanceInProgress {
+		t.Errorf("expected state %s, got %s", base.InstanceInProgress, state)
+	}
+	if !*rdsClient.deleteDbInput.SkipFinalSnapshot || rdsClient.deleteDbInput.FinalDBSnapshotIdentifier != nil {
+		t.Error("expected no final snapshot to be taken of a read replica")
+	}
+}
+
+func TestDeleteProvisionedResource(t *testing.T) {
+	testCases := map[string]struct {
+		resource    base.ProvisionedResource
+		deleteDbErr error
+		expectErr   bool
+	}{
+		"deletes the instance": {
+			resource: base.ProvisionedResource{Type: dbInstanceResource, Identifier: "db-name"},
+		},
+		"instance already gone": {
+			resource:    base.ProvisionedResource{Type: dbInstanceResource, Identifier: "db-name"},
+			deleteDbErr: awserr.New(rds.ErrCodeDBInstanceNotFoundFault, "not found", nil),
+		},
+		"delete DB error": {
+			resource:    base.ProvisionedResource{Type: dbInstanceResource, Identifier: "db-name"},
+			deleteDbErr: errors.New("fail"),
+			expectErr:   true,
+		},
+		"unknown resource": {
+			resource:  base.ProvisionedResource{Type: "other", Identifier: "db-name"},
+			expectErr: true,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			rdsClient := &mockRdsClientForAdapterTests{deleteDbErr: test.deleteDbErr}
+			adapter := &dedicatedDBAdapter{
+				rds:                  rdsClient,
+				parameterGroupClient: &mockParameterGroupClient{},
+			}
+
+			err := adapter.deleteProvisionedResource(test.resource)
+			if test.expectErr != (err != nil) {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if rdsClient.deleteDbInput != nil && !*rdsClient.deleteDbInput.SkipFinalSnapshot {
+				t.Error("expected no final snapshot to be taken of an instance that was never provisioned")
+			}
+		})
+	}
+}
+
+func TestCheckDBDeletionStatus(t *testing.T) {
+	testCases := map[string]struct {
+		describeDbErr error
+		expectedState base.InstanceState
+	}{
+		"still deleting": {
+			expectedState: base.InstanceInProgress,
+		},
+		"deleted": {
+			describeDbErr: awserr.New(rds.ErrCodeDBInstanceNotFoundFault, "not found", nil),
+			expectedState: base.InstanceGone,
+		},
+		"describe error": {
+			describeDbErr: errors.New("fail"),
+			expectedState: base.InstanceNotGone,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			adapter := &dedicatedDBAdapter{
+				rds:                  &mockRdsClientForAdapterTests{describeDbErr: test.describeDbErr},
+				parameterGroupClient: &mockParameterGroupClient{},
+			}
+			state, _ := adapter.checkDBDeletionStatus(NewRDSInstance())
+			if state != test.expectedState {
+				t.Errorf("expected state %s, got %s", test.expectedState, state)
+			}
+		})
+	}
+}
+
 func TestModifyDb(t *testing.T) {
 	modifyDbErr := errors.New("modify DB error")
 	testCases := map[string]struct {
@@ -351,6 +743,36 @@ func TestPrepareModifyDbInstanceInput(t *testing.T) {
 				StorageType:              aws.String("gp3"),
 			},
 		},
+		"disable IAM auth": {
+			dbInstance: &RDSInstance{
+				dbUtils:               &RDSDatabaseUtils{},
+				DbType:                "postgres",
+				AllocatedStorage:      20,
+				Database:              "db-name",
+				BackupRetentionPeriod: 14,
+				IAMAuth:               aws.Bool(false),
+			},
+			dbAdapter: &dedicatedDBAdapter{
+				Plan: catalog.RDSPlan{
+					InstanceClass: "class",
+					Redundant:     true,
+				},
+				parameterGroupClient: &mockParameterGroupClient{
+					rds: &mockRDSClient{},
+				},
+				rds: &mockRDSClient{},
+			},
+			expectedParams: &rds.ModifyDBInstanceInput{
+				AllocatedStorage:                aws.Int64(20),
+				ApplyImmediately:                aws.Bool(true),
+				DBInstanceClass:                 aws.String("class"),
+				MultiAZ:                         aws.Bool(true),
+				DBInstanceIdentifier:            aws.String("db-name"),
+				AllowMajorVersionUpgrade:        aws.Bool(false),
+				BackupRetentionPeriod:           aws.Int64(14),
+				EnableIAMDatabaseAuthentication: aws.Bool(false),
+			},
+		},
 	}
 
 	for name, test := range testCases {
@@ -367,3 +789,329 @@ func TestPrepareModifyDbInstanceInput(t *testing.T) {
 		})
 	}
 }
+
+func TestApplyExtensions(t *testing.T) {
+	testCases := map[string]struct {
+		parameterApplyStatus string
+		createExtensions     bool
+		expectedState        base.InstanceState
+		expectReboot         bool
+		expectedCreated      []string
+	}{
+		"pending reboot": {
+			parameterApplyStatus: "pending-reboot",
+			createExtensions:     true,
+			expectedState:        base.InstanceInProgress,
+			expectReboot:         true,
+		},
+		"applying": {
+			parameterApplyStatus: "applying",
+			createExtensions:     true,
+			expectedState:        base.InstanceInProgress,
+		},
+		"in sync, create extensions": {
+			parameterApplyStatus: "in-sync",
+			createExtensions:     true,
+			expectedState:        base.InstanceReady,
+			expectedCreated:      []string{"pg_stat_statements"},
+		},
+		"in sync, do not create extensions": {
+			parameterApplyStatus: "in-sync",
+			expectedState:        base.InstanceReady,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			rdsClient := &mockRdsClientForAdapterTests{
+				describeDbOutput: &rds.DescribeDBInstancesOutput{
+					DBInstances: []*rds.DBInstance{
+						{
+							DBInstanceStatus: aws.String("available"),
+							Endpoint: &rds.Endpoint{
+								Address: aws.String("db-name.example.com"),
+								Port:    aws.Int64(5432),
+							},
+							DBParameterGroups: []*rds.DBParameterGroupStatus{
+								{
+									DBParameterGroupName: aws.String("group1"),
+									ParameterApplyStatus: aws.String(test.parameterApplyStatus),
+								},
+							},
+						},
+					},
+				},
+			}
+			extensionClient := &mockDBExtensionClient{}
+			adapter := &dedicatedDBAdapter{
+				rds:          rdsClient,
+				dbExtensions: extensionClient,
+			}
+			instance := NewRDSInstance()
+			instance.Database = "db-name"
+			instance.ParameterGroupName = "group1"
+			instance.Extensions = []string{"pg_stat_statements"}
+			instance.CreateExtensions = test.createExtensions
+
+			state, err := adapter.applyExtensions(instance, "password")
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if state != test.expectedState {
+				t.Errorf("expected state %s, got %s", test.expectedState, state)
+			}
+			if test.expectReboot != (rdsClient.rebootDbInput != nil) {
+				t.Errorf("expected reboot: %t", test.expectReboot)
+			}
+			if diff := deep.Equal(extensionClient.created, test.expectedCreated); diff != nil {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestCompleteRestore(t *testing.T) {
+	testCases := map[string]struct {
+		requested       bool
+		status          string
+		pendingPassword bool
+		expectedState   base.InstanceState
+		expectReset     bool
+	}{
+		"resets the password": {
+			status:        "available",
+			expectedState: base.InstanceInProgress,
+			expectReset:   true,
+		},
+		"reset pending": {
+			requested:       true,
+			status:          "available",
+			pendingPassword: true,
+			expectedState:   base.InstanceInProgress,
+		},
+		"resetting": {
+			requested:     true,
+			status:        "resetting-master-credentials",
+			expectedState: base.InstanceInProgress,
+		},
+		"reset applied": {
+			requested:     true,
+			status:        "available",
+			expectedState: base.InstanceReady,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			dbInstance := &rds.DBInstance{
+				DBInstanceStatus:      aws.String(test.status),
+				PendingModifiedValues: &rds.PendingModifiedValues{},
+			}
+			if test.pendingPassword {
+				dbInstance.PendingModifiedValues.MasterUserPassword = aws.String("****")
+			}
+			rdsClient := &mockRdsClientForAdapterTests{
+				describeDbOutput: &rds.DescribeDBInstancesOutput{
+					DBInstances: []*rds.DBInstance{dbInstance},
+				},
+			}
+			adapter := &dedicatedDBAdapter{
+				rds: rdsClient,
+			}
+			instance := NewRDSInstance()
+			instance.Database = "db-name"
+			instance.MasterPasswordResetPending = true
+			instance.MasterPasswordResetRequested = test.requested
+
+			state, err := adapter.completeRestore(instance, "new-password")
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if state != test.expectedState {
+				t.Errorf("expected state %s, got %s", test.expectedState, state)
+			}
+			if test.expectReset != (rdsClient.modifyDbInput != nil) {
+				t.Errorf("expected reset: %t", test.expectReset)
+			}
+			if test.expectReset && aws.StringValue(rdsClient.modifyDbInput.MasterUserPassword) != "new-password" {
+				t.Error("expected the master password to be reset")
+			}
+			if !instance.MasterPasswordResetRequested {
+				t.Error("expected the reset to be recorded as requested")
+			}
+		})
+	}
+}
+
+func TestUpgradeDb(t *testing.T) {
+	testCases := map[string]struct {
+		engineVersion             string
+		pendingEngineVersion      string
+		status                    string
+		dbVersion                 string
+		upgradeSnapshotIdentifier string
+		upgradeStarted            bool
+		snapshotStatus            string
+		expectedState             base.InstanceState
+		expectSnapshot            bool
+		expectUpgrade             bool
+		expectedDbVersion         string
+		expectUpgradeStarted      bool
+	}{
+		"waits for the instance to be available": {
+			engineVersion:     "12.17",
+			status:            "modifying",
+			dbVersion:         "12",
+			expectedState:     base.InstanceInProgress,
+			expectedDbVersion: "12",
+		},
+		"takes a snapshot": {
+			engineVersion:     "12.17",
+			dbVersion:         "12",
+			expectedState:     base.InstanceInProgress,
+			expectSnapshot:    true,
+			expectedDbVersion: "12",
+		},
+		"waits for the snapshot": {
+			engineVersion:             "12.17",
+			dbVersion:                 "12",
+			upgradeSnapshotIdentifier: "db-name-pre-upgrade-20240102150405",
+			snapshotStatus:            "creating",
+			expectedState:             base.InstanceInProgress,
+			expectedDbVersion:         "12",
+		},
+		"snapshot failed": {
+			engineVersion:             "12.17",
+			dbVersion:                 "12",
+			upgradeSnapshotIdentifier: "db-name-pre-upgrade-20240102150405",
+			snapshotStatus:            "failed",
+			expectedState:             base.InstanceNotModified,
+			expectedDbVersion:         "12",
+		},
+		"upgrades once the snapshot is available": {
+			engineVersion:             "12.17",
+			dbVersion:                 "12",
+			upgradeSnapshotIdentifier: "db-name-pre-upgrade-20240102150405",
+			snapshotStatus:            "available",
+			expectedState:             base.InstanceInProgress,
+			expectUpgrade:             true,
+			expectedDbVersion:         "15",
+		},
+		"upgrade pending": {
+			engineVersion:             "12.17",
+			pendingEngineVersion:      "15.4",
+			dbVersion:                 "15",
+			upgradeSnapshotIdentifier: "db-name-pre-upgrade-20240102150405",
+			expectedState:             base.InstanceInProgress,
+			expectedDbVersion:         "15",
+			expectUpgradeStarted:      true,
+		},
+		"upgrade not started yet": {
+			engineVersion:             "12.17",
+			dbVersion:                 "15",
+			upgradeSnapshotIdentifier: "db-name-pre-upgrade-20240102150405",
+			expectedState:             base.InstanceInProgress,
+			expectedDbVersion:         "15",
+		},
+		"upgrading": {
+			engineVersion:             "12.17",
+			status:                    "upgrading",
+			dbVersion:                 "15",
+			upgradeSnapshotIdentifier: "db-name-pre-upgrade-20240102150405",
+			expectedState:             base.InstanceInProgress,
+			expectedDbVersion:         "15",
+			expectUpgradeStarted:      true,
+		},
+		"upgrade failed": {
+			engineVersion:             "12.17",
+			dbVersion:                 "15",
+			upgradeSnapshotIdentifier: "db-name-pre-upgrade-20240102150405",
+			upgradeStarted:            true,
+			expectUpgradeStarted:      true,
+			expectedState:             base.InstanceNotModified,
+			expectedDbVersion:         "12.17",
+		},
+		"upgraded": {
+			engineVersion:             "15.4",
+			dbVersion:                 "15",
+			upgradeSnapshotIdentifier: "db-name-pre-upgrade-20240102150405",
+			expectedState:             base.InstanceReady,
+			expectedDbVersion:         "15",
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			status := test.status
+			if status == "" {
+				status = "available"
+			}
+			dbInstance := &rds.DBInstance{
+				DBInstanceStatus:      aws.String(status),
+				EngineVersion:         aws.String(test.engineVersion),
+				PendingModifiedValues: &rds.PendingModifiedValues{},
+			}
+			if test.pendingEngineVersion != "" {
+				dbInstance.PendingModifiedValues.EngineVersion = aws.String(test.pendingEngineVersion)
+			}
+			rdsClient := &mockRdsClientForAdapterTests{
+				describeDbOutput: &rds.DescribeDBInstancesOutput{
+					DBInstances: []*rds.DBInstance{dbInstance},
+				},
+				describeSnapshotsOutput: &rds.DescribeDBSnapshotsOutput{
+					DBSnapshots: []*rds.DBSnapshot{
+						{Status: aws.String(test.snapshotStatus)},
+					},
+				},
+			}
+			adapter := &dedicatedDBAdapter{
+				rds: rdsClient,
+				parameterGroupClient: &mockParameterGroupClient{
+					customPgroupName: "cg-aws-broker-dbname-postgres15",
+				},
+			}
+			instance := NewRDSInstance()
+			instance.Database = "db-name"
+			instance.DbType = "postgres"
+			instance.DbVersion = test.dbVersion
+			instance.UpgradeVersion = "15"
+			instance.UpgradeSnapshotIdentifier = test.upgradeSnapshotIdentifier
+			instance.UpgradeStarted = test.upgradeStarted
+
+			state, description, err := adapter.upgradeDB(instance)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if state != test.expectedState {
+				t.Errorf("expected state %s, got %s: %s", test.expectedState, state, description)
+			}
+			if test.expectSnapshot != (rdsClient.createSnapshotInput != nil) {
+				t.Errorf("expected snapshot: %t", test.expectSnapshot)
+			}
+			if test.expectSnapshot && instance.UpgradeSnapshotIdentifier != *rdsClient.createSnapshotInput.DBSnapshotIdentifier {
+				t.Errorf("expected the snapshot identifier to be recorded, got %s", instance.UpgradeSnapshotIdentifier)
+			}
+			if instance.UpgradeStarted != test.expectUpgradeStarted {
+				t.Errorf("expected the upgrade to be seen started: %t", test.expectUpgradeStarted)
+			}
+			if test.expectUpgrade != (rdsClient.modifyDbInput != nil) {
+				t.Errorf("expected upgrade: %t", test.expectUpgrade)
+			}
+			if test.expectUpgrade {
+				expectedInput := &rds.ModifyDBInstanceInput{
+					DBInstanceIdentifier:     aws.String("db-name"),
+					EngineVersion:            aws.String("15"),
+					AllowMajorVersionUpgrade: aws.Bool(true),
+					DBParameterGroupName:     aws.String("cg-aws-broker-dbname-postgres15"),
+					ApplyImmediately:         aws.Bool(true),
+				}
+				if diff := deep.Equal(rdsClient.modifyDbInput, expectedInput); diff != nil {
+					t.Error(diff)
+				}
+			}
+			if instance.DbVersion != test.expectedDbVersion {
+				t.Errorf("expected version %s, got %s", test.expectedDbVersion, instance.DbVersion)
+			}
+		})
+	}
+}
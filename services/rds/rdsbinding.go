@@ -0,0 +1,126 @@
+package rds
+
+import (
+	"crypto/aes"
+	"encoding/base64"
+	"time"
+
+	"github.com/18F/aws-broker/config"
+	"github.com/18F/aws-broker/helpers"
+)
+
+// RDSBinding represents the database user issued to a single service binding.
+// Each binding gets its own user so that it can be revoked without rotating
+// the credentials for every other application bound to the same instance.
+// Bindings of engines without binding users, and of read replicas, are
+// recorded without a user and share the master credentials.
+type RDSBinding struct {
+	BindingID    string `gorm:"primary_key" sql:"type:varchar(255) PRIMARY KEY"`
+	InstanceUuid string `sql:"size(255)"`
+
+	Username        string `sql:"size(255)"`
+	Password        string `sql:"type:text"`
+	Salt            string `sql:"size(255)"`
+	EncryptionKeyID string `sql:"size(255)"`
+
+	ClearPassword string `sql:"-"`
+
+	// Bindings of instances with IAM database authentication get an IAM user
+	// allowed to connect as the database user instead of a password. The
+	// secret access key is encrypted like passwords.
+	IAMUserName          string `sql:"size(255)"`
+	IAMPolicyARN         string `sql:"size(2048)"`
+	AccessKeyID          string `sql:"size(255)"`
+	SecretAccessKey      string `sql:"type:text"`
+	ClearSecretAccessKey string `sql:"-"`
+
+	// CredentialsSecretARN is the secret holding the credentials of the
+	// binding when they are stored in Secrets Manager.
+	CredentialsSecretARN string `sql:"size(2048)"`
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func (b *RDSBinding) init(
+	bindingID string,
+	i *RDSInstance,
+	settings *config.Settings,
+) error {
+	b.BindingID = bindingID
+	b.InstanceUuid = i.Uuid
+	b.Username = i.dbUtils.buildUsername()
+
+	if i.iamAuthEnabled() {
+		b.IAMUserName = i.Database + "-" + b.Username
+		b.Salt = helpers.GenerateSalt(aes.BlockSize)
+		b.EncryptionKeyID = settings.CurrentEncryptionKeyID()
+		return nil
+	}
+
+	salt, encrypted, password, err := i.dbUtils.generateCredentials(settings)
+	if err != nil {
+		return err
+	}
+	b.Salt = salt
+	b.Password = encrypted
+	b.EncryptionKeyID = settings.CurrentEncryptionKeyID()
+	b.ClearPassword = password
+	return nil
+}
+
+// sharesMasterCredentials reports whether the binding was issued the master
+// credentials of the instance instead of a user of its own.
+func (b *RDSBinding) sharesMasterCredentials() bool {
+	return b.Username == ""
+}
+
+// isIAMAuth reports whether the binding connects with IAM database
+// authentication instead of a password.
+func (b *RDSBinding) isIAMAuth() bool {
+	return b.IAMUserName != ""
+}
+
+// setSecretAccessKey encrypts the secret access key of the IAM user of the
+// binding with the current encryption key.
+func (b *RDSBinding) setSecretAccessKey(secretAccessKey string, settings *config.Settings) error {
+	encrypter, err := settings.CurrentSecretEncrypter()
+	if err != nil {
+		return err
+	}
+	iv, _ := base64.StdEncoding.DecodeString(b.Salt)
+	encrypted, err := encrypter.Encrypt(secretAccessKey, iv)
+	if err != nil {
+		return err
+	}
+	b.SecretAccessKey = encrypted
+	b.EncryptionKeyID = settings.CurrentEncryptionKeyID()
+	b.ClearSecretAccessKey = secretAccessKey
+	return nil
+}
+
+// decryptSecrets decrypts the password of the binding, or the secret access key
+// of its IAM user.
+func (b *RDSBinding) decryptSecrets(utils DatabaseUtils, settings *config.Settings) error {
+	var err error
+	if b.isIAMAuth() {
+		b.ClearSecretAccessKey, err = decryptPassword(utils, b.Salt, b.SecretAccessKey, b.EncryptionKeyID, settings)
+		return err
+	}
+	b.ClearPassword, err = decryptPassword(utils, b.Salt, b.Password, b.EncryptionKeyID, settings)
+	return err
+}
+
+// RotateEncryptionKey re-encrypts the password of the binding, or the secret
+// access key of its IAM user, with the current encryption key, and reports
+// whether it did.
+func (b *RDSBinding) RotateEncryptionKey(settings *config.Settings) (bool, error) {
+	// Bindings sharing the master credentials have no secret of their own.
+	if b.Password == "" && b.SecretAccessKey == "" {
+		return false, nil
+	}
+	if b.isIAMAuth() {
+		return rotatePassword(&RDSDatabaseUtils{}, b.Salt, &b.SecretAccessKey, &b.EncryptionKeyID, settings)
+	}
+	return rotatePassword(&RDSDatabaseUtils{}, b.Salt, &b.Password, &b.EncryptionKeyID, settings)
+}
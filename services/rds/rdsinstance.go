@@ -9,7 +9,11 @@ import (
 	"errors"
 	"fmt"
 	"regexp"
+	"slices"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/18F/aws-broker/catalog"
 	"github.com/18F/aws-broker/config"
@@ -18,9 +22,9 @@ import (
 
 type DatabaseUtils interface {
 	FormatDBName(dbType string, database string) string
-	generatePassword(salt string, password string, key string) (string, string, error)
-	getPassword(salt string, password string, key string) (string, error)
-	getCredentials(i *RDSInstance, password string) (map[string]string, error)
+	generatePassword(salt string, password string, encrypter helpers.SecretEncrypter) (string, string, error)
+	getPassword(salt string, password string, encrypter helpers.SecretEncrypter) (string, error)
+	getCredentials(i *RDSInstance, username string, password string) (map[string]string, error)
 	generateCredentials(settings *config.Settings) (string, string, string, error)
 	generateDatabaseName(settings *config.Settings) string
 	buildUsername() string
@@ -35,13 +39,18 @@ type RDSInstance struct {
 
 	dbUtils DatabaseUtils `sql:"-"`
 
-	Database string `sql:"size(255)"`
-	Username string `sql:"size(255)"`
-	Password string `sql:"size(255)"`
-	Salt     string `sql:"size(255)"`
+	Database        string `sql:"size(255)"`
+	Username        string `sql:"size(255)"`
+	Password        string `sql:"type:text"`
+	Salt            string `sql:"size(255)"`
+	EncryptionKeyID string `sql:"size(255)"`
 
 	ClearPassword string `sql:"-"`
 
+	// ReaderHost is the reader endpoint of Aurora clusters, which balances
+	// connections across their reader instances.
+	ReaderHost string `sql:"size(255)"`
+
 	Tags                  map[string]string `sql:"-"`
 	BackupRetentionPeriod int64             `sql:"size(255)"`
 	DbSubnetGroup         string            `sql:"-"`
@@ -55,15 +64,62 @@ type RDSInstance struct {
 	DbType       string `sql:"size(255)"`
 	DbVersion    string `sql:"size(255)"`
 	LicenseModel string `sql:"size(255)"`
-
-	BinaryLogFormat      string `sql:"size(255)"`
-	EnablePgCron         *bool  `sql:"size(255)"`
+	// UpgradeVersion is the major version the instance is being upgraded to,
+	// and UpgradeSnapshotIdentifier the snapshot taken before the upgrade.
+	// UpgradeStarted is set once the instance was seen upgrading.
+	UpgradeVersion            string `sql:"size(255)"`
+	UpgradeSnapshotIdentifier string `sql:"size(255)"`
+	UpgradeStarted            bool
+
+	BinaryLogFormat string `sql:"size(255)"`
+	EnablePgCron    *bool  `sql:"size(255)"`
+	// IAMAuth enables IAM database authentication, which new bindings then
+	// use instead of passwords.
+	IAMAuth              *bool  `sql:"size(255)"`
 	ParameterGroupFamily string `sql:"-"`
 	ParameterGroupName   string `sql:"size(255)"`
+	// CustomParameters holds the database parameters set by the user as
+	// name=value entries.
+	CustomParameters pq.StringArray `sql:"type:text[]"`
+	// Extensions are the PostgreSQL extensions loaded with
+	// shared_preload_libraries, which are also created in the database when
+	// CreateExtensions is set. ExtensionsPending is set until a change to
+	// them has taken effect, which may take a reboot.
+	Extensions        pq.StringArray `sql:"type:text[]"`
+	CreateExtensions  bool
+	ExtensionsPending bool
+	// removedExtensions are unloaded from shared_preload_libraries when the
+	// parameter group is next updated.
+	removedExtensions []string `sql:"-"`
 
 	EnabledCloudwatchLogGroupExports pq.StringArray `sql:"type:text[]"`
 
 	StorageType string `sql:"size(255)"`
+
+	// DbName is the name of the database inside the instance when it was not
+	// derived from Database, e.g. for an instance restored from a snapshot.
+	DbName string `sql:"size(255)"`
+
+	RestoredFromSnapshot string `sql:"size(255)"`
+	// RestoredFromInstance is the identifier of the instance this one was cloned
+	// from at RestoreTime, or at the latest restorable time if it is not set.
+	RestoredFromInstance string     `sql:"size(255)"`
+	RestoreTime          *time.Time `sql:"size(255)"`
+	// Restored instances keep the master password of their source, so it is
+	// reset to the instance's own password once the instance is available.
+	// MasterPasswordResetRequested is set once the reset was requested, and the
+	// reset is done once RDS has applied the new password.
+	MasterPasswordResetPending   bool
+	MasterPasswordResetRequested bool
+
+	// ReplicaOf is the instance GUID of the primary when the instance is a read
+	// replica, and ReplicaSourceDatabase the identifier of that primary.
+	ReplicaOf             string `sql:"size(255)"`
+	ReplicaSourceDatabase string `sql:"-"`
+
+	// CredentialsSecretARN is the secret holding the master credentials when
+	// they are issued to bindings and stored in Secrets Manager.
+	CredentialsSecretARN string `sql:"size(2048)"`
 }
 
 func (u *RDSDatabaseUtils) FormatDBName(dbType string, database string) string {
@@ -76,14 +132,14 @@ func (u *RDSDatabaseUtils) FormatDBName(dbType string, database string) string {
 	}
 }
 
-func (u *RDSDatabaseUtils) generatePassword(salt string, password string, key string) (string, string, error) {
+func (u *RDSDatabaseUtils) generatePassword(salt string, password string, encrypter helpers.SecretEncrypter) (string, string, error) {
 	if salt == "" {
 		return "", "", errors.New("salt has to be set before writing the password")
 	}
 
 	iv, _ := base64.StdEncoding.DecodeString(salt)
 
-	encrypted, err := helpers.Encrypt(password, key, iv)
+	encrypted, err := encrypter.Encrypt(password, iv)
 	if err != nil {
 		return "", "", err
 	}
@@ -91,14 +147,14 @@ func (u *RDSDatabaseUtils) generatePassword(salt string, password string, key st
 	return encrypted, password, nil
 }
 
-func (u *RDSDatabaseUtils) getPassword(salt string, password string, key string) (string, error) {
+func (u *RDSDatabaseUtils) getPassword(salt string, password string, encrypter helpers.SecretEncrypter) (string, error) {
 	if salt == "" || password == "" {
 		return "", errors.New("salt and password has to be set before writing the password")
 	}
 
 	iv, _ := base64.StdEncoding.DecodeString(salt)
 
-	decrypted, err := helpers.Decrypt(password, key, iv)
+	decrypted, err := encrypter.Decrypt(password, iv)
 	if err != nil {
 		return "", err
 	}
@@ -106,7 +162,7 @@ func (u *RDSDatabaseUtils) getPassword(salt string, password string, key string)
 	return decrypted, nil
 }
 
-func (u *RDSDatabaseUtils) getCredentials(i *RDSInstance, password string) (map[string]string, error) {
+func (u *RDSDatabaseUtils) getCredentials(i *RDSInstance, username string, password string) (map[string]string, error) {
 	var dbScheme string
 	var credentials map[string]string
 
@@ -123,7 +179,7 @@ func (u *RDSDatabaseUtils) getCredentials(i *RDSInstance, password string) (map[
 	uri := fmt.Sprintf(
 		"%s://%s:%s@%s:%d/%s",
 		dbScheme,
-		i.Username,
+		username,
 		password,
 		i.Host,
 		i.Port,
@@ -132,13 +188,26 @@ func (u *RDSDatabaseUtils) getCredentials(i *RDSInstance, password string) (map[
 
 	credentials = map[string]string{
 		"uri":      uri,
-		"username": i.Username,
+		"username": username,
 		"password": password,
 		"host":     i.Host,
 		"port":     strconv.FormatInt(i.Port, 10),
 		"db_name":  dbName,
 		"name":     dbName,
 	}
+	// Aurora clusters also have a reader endpoint for read-only connections.
+	if i.ReaderHost != "" {
+		credentials["reader_host"] = i.ReaderHost
+		credentials["reader_uri"] = fmt.Sprintf(
+			"%s://%s:%s@%s:%d/%s",
+			dbScheme,
+			username,
+			password,
+			i.ReaderHost,
+			i.Port,
+			dbName,
+		)
+	}
 	return credentials, nil
 }
 
@@ -147,7 +216,11 @@ func (u *RDSDatabaseUtils) generateCredentials(
 ) (string, string, string, error) {
 	salt := helpers.GenerateSalt(aes.BlockSize)
 	password := helpers.RandStrNoCaps(25)
-	encrypted, password, err := u.generatePassword(salt, password, settings.EncryptionKey)
+	encrypter, err := settings.CurrentSecretEncrypter()
+	if err != nil {
+		return "", "", "", err
+	}
+	encrypted, password, err := u.generatePassword(salt, password, encrypter)
 	if err != nil {
 		return "", "", "", err
 	}
@@ -171,11 +244,269 @@ func NewRDSInstance() *RDSInstance {
 }
 
 func (i *RDSInstance) FormatDBName() string {
+	if i.DbName != "" {
+		return i.DbName
+	}
 	return i.dbUtils.FormatDBName(i.DbType, i.Database)
 }
 
+// finalSnapshotIdentifier is the identifier of the snapshot taken when the instance is deleted.
+func (i *RDSInstance) finalSnapshotIdentifier() string {
+	return i.Database + "-final-snapshot"
+}
+
+// preUpgradeSnapshotIdentifier is the identifier of the snapshot taken before
+// the instance is upgraded at the given time.
+func (i *RDSInstance) preUpgradeSnapshotIdentifier(t time.Time) string {
+	return i.Database + "-pre-upgrade-" + t.UTC().Format("20060102150405")
+}
+
+// compareEngineVersions compares the numeric parts two engine versions have in
+// common, so that a major version like 8.0 equals its minor versions like
+// 8.0.35. It returns -1, 0 or 1 like strings.Compare.
+func compareEngineVersions(a string, b string) int {
+	aParts := strings.Split(a, ".")
+	bParts := strings.Split(b, ".")
+	for n := 0; n < len(aParts) && n < len(bParts); n++ {
+		aPart, _ := strconv.Atoi(aParts[n])
+		bPart, _ := strconv.Atoi(bParts[n])
+		if aPart < bPart {
+			return -1
+		}
+		if aPart > bPart {
+			return 1
+		}
+	}
+	return 0
+}
+
+// setUpgradeVersion starts a major version upgrade of the instance when the
+// version differs from its current one. The upgrade itself is made once a
+// snapshot of the instance has been taken.
+func (i *RDSInstance) setUpgradeVersion(version string, plan catalog.RDSPlan) error {
+	if version == "" || (i.DbVersion != "" && compareEngineVersions(version, i.DbVersion) == 0) {
+		return nil
+	}
+	if i.DbType != "postgres" && i.DbType != "mysql" {
+		return fmt.Errorf("major version upgrades are not supported for %s databases", i.DbType)
+	}
+	if i.isAurora() {
+		return errors.New("major version upgrades are not supported for Aurora clusters")
+	}
+	if !plan.CheckVersion(version) {
+		return fmt.Errorf("%s is not a supported major version; major version must be one of: %s", version, strings.Join(plan.ApprovedMajorVersions, ", "))
+	}
+	if i.DbVersion != "" && compareEngineVersions(version, i.DbVersion) < 0 {
+		return fmt.Errorf("cannot downgrade the database from version %s to %s", i.DbVersion, version)
+	}
+	if i.isReplica() {
+		return errors.New("cannot upgrade a read replica; upgrade its primary instance instead")
+	}
+	i.UpgradeVersion = version
+	i.UpgradeSnapshotIdentifier = ""
+	i.UpgradeStarted = false
+	return nil
+}
+
+// restoreFromSnapshot sets up the instance to be created from the snapshot. The
+// database and master user inside the snapshot are kept, so they replace the
+// generated ones.
+func (i *RDSInstance) restoreFromSnapshot(snapshot *RDSSnapshot) {
+	i.RestoredFromSnapshot = snapshot.SnapshotIdentifier
+	i.DbName = snapshot.DbName
+	i.Username = snapshot.Username
+	i.DbVersion = snapshot.DbVersion
+	if i.AllocatedStorage < snapshot.AllocatedStorage {
+		i.AllocatedStorage = snapshot.AllocatedStorage
+	}
+	i.MasterPasswordResetPending = true
+}
+
+// restoreFromInstance sets up the instance to be created as a clone of the
+// source instance at the restore time. Like for a snapshot, the database and
+// master user of the source are kept, and the master password is reset to the
+// freshly generated one once the clone is available.
+func (i *RDSInstance) restoreFromInstance(source *RDSInstance, restoreTime *time.Time) {
+	i.RestoredFromInstance = source.Database
+	i.RestoreTime = restoreTime
+	i.DbName = source.FormatDBName()
+	i.Username = source.Username
+	i.DbVersion = source.DbVersion
+	if i.AllocatedStorage < source.AllocatedStorage {
+		i.AllocatedStorage = source.AllocatedStorage
+	}
+	i.MasterPasswordResetPending = true
+}
+
+// replicate sets up the instance to be created as a read replica of the
+// primary. A replica is a copy of its primary, so it has the same database,
+// engine version, storage, parameter group and master credentials.
+func (i *RDSInstance) replicate(primary *RDSInstance) {
+	i.ReplicaOf = primary.Uuid
+	i.ReplicaSourceDatabase = primary.Database
+	i.DbName = primary.FormatDBName()
+	i.Username = primary.Username
+	i.Password = primary.Password
+	i.Salt = primary.Salt
+	i.EncryptionKeyID = primary.EncryptionKeyID
+	i.ClearPassword = ""
+	i.DbVersion = primary.DbVersion
+	i.AllocatedStorage = primary.AllocatedStorage
+	i.ParameterGroupName = primary.ParameterGroupName
+}
+
+func (i *RDSInstance) isReplica() bool {
+	return i.ReplicaOf != ""
+}
+
+// isAurora reports whether the instance is an Aurora cluster rather than a
+// single DB instance.
+func (i *RDSInstance) isAurora() bool {
+	return i.Adapter == "aurora"
+}
+
+// engine returns the RDS engine of the instance. Aurora clusters run the
+// Aurora edition of their database type.
+func (i *RDSInstance) engine() string {
+	if !i.isAurora() {
+		return i.DbType
+	}
+	switch i.DbType {
+	case "postgres":
+		return "aurora-postgresql"
+	case "mysql":
+		return "aurora-mysql"
+	}
+	return i.DbType
+}
+
+// parameters returns the settings applied to the instance, keyed like the
+// options they can be set with.
+func (i *RDSInstance) parameters() map[string]interface{} {
+	parameters := map[string]interface{}{
+		"storage":                 i.AllocatedStorage,
+		"version":                 i.DbVersion,
+		"storage_type":            i.StorageType,
+		"backup_retention_period": i.BackupRetentionPeriod,
+	}
+	if i.BinaryLogFormat != "" {
+		parameters["binary_log_format"] = i.BinaryLogFormat
+	}
+	if i.EnablePgCron != nil {
+		parameters["enable_pg_cron"] = *i.EnablePgCron
+	}
+	if i.IAMAuth != nil {
+		parameters["iam_auth"] = *i.IAMAuth
+	}
+	if len(i.CustomParameters) > 0 {
+		parameters["parameters"] = i.customParameters()
+	}
+	if len(i.Extensions) > 0 {
+		parameters["extensions"] = []string(i.Extensions)
+		parameters["create_extensions"] = i.CreateExtensions
+	}
+	if len(i.EnabledCloudwatchLogGroupExports) > 0 {
+		parameters["enable_cloudwatch_log_groups_exports"] = []string(i.EnabledCloudwatchLogGroupExports)
+	}
+	if i.RestoredFromSnapshot != "" {
+		parameters["restore_from_snapshot"] = i.RestoredFromSnapshot
+	}
+	if i.isReplica() {
+		parameters["read_replica_of"] = i.ReplicaOf
+	}
+	return parameters
+}
+
 func (i *RDSInstance) getCredentials(password string) (map[string]string, error) {
-	return i.dbUtils.getCredentials(i, password)
+	return i.dbUtils.getCredentials(i, i.Username, password)
+}
+
+// getBindingCredentials returns the credentials for the user issued to a binding.
+// Bindings with IAM database authentication get the access keys of their IAM
+// user, which generate the tokens used to connect, instead of a password.
+func (i *RDSInstance) getBindingCredentials(b *RDSBinding, region string) (map[string]string, error) {
+	if !b.isIAMAuth() {
+		return i.dbUtils.getCredentials(i, b.Username, b.ClearPassword)
+	}
+	credentials, err := i.dbUtils.getCredentials(i, b.Username, "")
+	if err != nil {
+		return nil, err
+	}
+	delete(credentials, "uri")
+	delete(credentials, "reader_uri")
+	delete(credentials, "password")
+	credentials["access_key_id"] = b.AccessKeyID
+	credentials["secret_access_key"] = b.ClearSecretAccessKey
+	credentials["region"] = region
+	return credentials, nil
+}
+
+// customParameters returns the database parameters set by the user.
+func (i *RDSInstance) customParameters() map[string]string {
+	parameters := map[string]string{}
+	for _, parameter := range i.CustomParameters {
+		name, value, _ := strings.Cut(parameter, "=")
+		parameters[name] = value
+	}
+	return parameters
+}
+
+// setCustomParameters sets database parameters, keeping the other parameters
+// set by the user before.
+func (i *RDSInstance) setCustomParameters(parameters map[string]string) {
+	if len(parameters) == 0 {
+		return
+	}
+	merged := i.customParameters()
+	for name, value := range parameters {
+		merged[name] = value
+	}
+	names := make([]string, 0, len(merged))
+	for name := range merged {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	i.CustomParameters = pq.StringArray{}
+	for _, name := range names {
+		i.CustomParameters = append(i.CustomParameters, name+"="+merged[name])
+	}
+}
+
+// setExtensions sets the extensions to load, if given, and whether to create
+// them, and marks the instance for applying them when either changed.
+func (i *RDSInstance) setExtensions(extensions []string, createExtensions *bool) {
+	if createExtensions != nil && *createExtensions != i.CreateExtensions {
+		i.CreateExtensions = *createExtensions
+		i.ExtensionsPending = i.ExtensionsPending || (i.CreateExtensions && len(i.Extensions) > 0)
+	}
+	if extensions == nil {
+		return
+	}
+
+	updated := pq.StringArray{}
+	for _, name := range extensions {
+		if !slices.Contains(updated, name) {
+			updated = append(updated, name)
+		}
+	}
+	sort.Strings(updated)
+	if slices.Equal(updated, i.Extensions) {
+		return
+	}
+	for _, name := range i.Extensions {
+		if !slices.Contains(updated, name) {
+			i.removedExtensions = append(i.removedExtensions, name)
+		}
+	}
+	i.Extensions = updated
+	i.ExtensionsPending = true
+}
+
+// iamAuthEnabled reports whether the instance has IAM database authentication
+// enabled.
+func (i *RDSInstance) iamAuthEnabled() bool {
+	return i.IAMAuth != nil && *i.IAMAuth
 }
 
 func (i *RDSInstance) generateCredentials(settings *config.Settings) error {
@@ -185,10 +516,78 @@ func (i *RDSInstance) generateCredentials(settings *config.Settings) error {
 	}
 	i.Salt = salt
 	i.Password = encrypted
+	i.EncryptionKeyID = settings.CurrentEncryptionKeyID()
 	i.ClearPassword = password
 	return nil
 }
 
+// getPassword decrypts the master password of the instance.
+func (i *RDSInstance) getPassword(settings *config.Settings) (string, error) {
+	password, err := decryptPassword(i.dbUtils, i.Salt, i.Password, i.EncryptionKeyID, settings)
+	if err != nil {
+		return "", err
+	}
+
+	// Re-encrypt passwords encrypted by earlier versions of the broker, so
+	// that the next save stores them with authenticated encryption.
+	if helpers.IsLegacyEncryption(i.Password) {
+		encrypter, err := settings.CurrentSecretEncrypter()
+		if err != nil {
+			return "", err
+		}
+		encrypted, _, err := i.dbUtils.generatePassword(i.Salt, password, encrypter)
+		if err != nil {
+			return "", err
+		}
+		i.Password = encrypted
+		i.EncryptionKeyID = settings.CurrentEncryptionKeyID()
+	}
+
+	return password, nil
+}
+
+// RotateEncryptionKey re-encrypts the master password of the instance with the
+// current encryption key, and reports whether it did. Passwords already
+// encrypted with the current key and scheme are left unchanged.
+func (i *RDSInstance) RotateEncryptionKey(settings *config.Settings) (bool, error) {
+	if i.dbUtils == nil {
+		i.dbUtils = &RDSDatabaseUtils{}
+	}
+	return rotatePassword(i.dbUtils, i.Salt, &i.Password, &i.EncryptionKeyID, settings)
+}
+
+// decryptPassword decrypts a password with the key it was encrypted with.
+func decryptPassword(utils DatabaseUtils, salt string, password string, keyID string, settings *config.Settings) (string, error) {
+	encrypter, err := settings.SecretEncrypter(keyID)
+	if err != nil {
+		return "", err
+	}
+	return utils.getPassword(salt, password, encrypter)
+}
+
+// rotatePassword re-encrypts a password and its key ID with the current
+// encryption key and scheme, unless it is already encrypted with them.
+func rotatePassword(utils DatabaseUtils, salt string, password *string, keyID *string, settings *config.Settings) (bool, error) {
+	if *keyID == settings.CurrentEncryptionKeyID() && !helpers.IsLegacyEncryption(*password) {
+		return false, nil
+	}
+	clearPassword, err := decryptPassword(utils, salt, *password, *keyID, settings)
+	if err != nil {
+		return false, err
+	}
+	encrypter, err := settings.CurrentSecretEncrypter()
+	if err != nil {
+		return false, err
+	}
+	encrypted, _, err := utils.generatePassword(salt, clearPassword, encrypter)
+	if err != nil {
+		return false, err
+	}
+	*password = encrypted
+	*keyID = settings.CurrentEncryptionKeyID()
+	return true, nil
+}
+
 func (i *RDSInstance) modify(options Options, plan catalog.RDSPlan, settings *config.Settings) error {
 	// Check to see if there is a storage size change and if so, check to make sure it's a valid change.
 	if options.AllocatedStorage > 0 {
@@ -235,7 +634,28 @@ func (i *RDSInstance) modify(options Options, plan catalog.RDSPlan, settings *co
 		i.EnableFunctions = options.EnableFunctions
 	}
 
+	if options.IAMAuth != nil {
+		if err := validateIAMAuth(*options.IAMAuth, i.DbType, i.Adapter); err != nil {
+			return err
+		}
+		i.IAMAuth = options.IAMAuth
+	}
+
+	i.setCustomParameters(options.Parameters)
+
+	if err := validateExtensions(options.Extensions, i.DbType, i.DbVersion); err != nil {
+		return err
+	}
+	i.setExtensions(options.Extensions, options.CreateExtensions)
+
+	if err := i.setUpgradeVersion(options.Version, plan); err != nil {
+		return err
+	}
+
 	if options.RotateCredentials != nil && *options.RotateCredentials {
+		if i.isReplica() {
+			return errors.New("cannot rotate the credentials of a read replica; rotate the credentials of its primary instance instead")
+		}
 		err := i.generateCredentials(settings)
 		if err != nil {
 			return err
@@ -311,6 +731,20 @@ func (i *RDSInstance) init(
 	i.BinaryLogFormat = options.BinaryLogFormat
 	i.EnablePgCron = options.EnablePgCron
 
+	if options.IAMAuth != nil {
+		if err := validateIAMAuth(*options.IAMAuth, i.DbType, i.Adapter); err != nil {
+			return err
+		}
+		i.IAMAuth = options.IAMAuth
+	}
+
+	i.setCustomParameters(options.Parameters)
+
+	if err := validateExtensions(options.Extensions, i.DbType, i.DbVersion); err != nil {
+		return err
+	}
+	i.setExtensions(options.Extensions, options.CreateExtensions)
+
 	i.setEnabledCloudwatchLogGroupExports(options.EnableCloudWatchLogGroupExports)
 
 	return nil
@@ -26,7 +26,7 @@ func (m *MockDbUtils) FormatDBName(string, string) string {
 	return m.mockFormattedDbName
 }
 
-func (m *MockDbUtils) getCredentials(i *RDSInstance, password string) (map[string]string, error) {
+func (m *MockDbUtils) getCredentials(i *RDSInstance, username string, password string) (map[string]string, error) {
 	return nil, nil
 }
 
@@ -34,11 +34,11 @@ func (m *MockDbUtils) generateCredentials(settings *config.Settings) (string, st
 	return m.mockSalt, m.mockEncryptedPassword, m.mockClearPassword, nil
 }
 
-func (m *MockDbUtils) generatePassword(salt string, password string, key string) (string, string, error) {
+func (m *MockDbUtils) generatePassword(salt string, password string, encrypter helpers.SecretEncrypter) (string, string, error) {
 	return m.mockEncryptedPassword, m.mockClearPassword, nil
 }
 
-func (m *MockDbUtils) getPassword(salt string, password string, key string) (string, error) {
+func (m *MockDbUtils) getPassword(salt string, password string, encrypter helpers.SecretEncrypter) (string, error) {
 	return m.mockClearPassword, nil
 }
 
@@ -119,8 +119,9 @@ func TestInit(t *testing.T) {
 				},
 			},
 			expectedInstance: &RDSInstance{
-				Database: "db",
-				Username: "fake-user",
+				EncryptionKeyID: "default",
+				Database:        "db",
+				Username:        "fake-user",
 				Instance: base.Instance{
 					Uuid: "uuid-1",
 					Request: request.Request{
@@ -167,6 +168,7 @@ func TestInit(t *testing.T) {
 			spaceGUID: "space-1",
 			serviceID: "service-1",
 			expectedInstance: &RDSInstance{
+				EncryptionKeyID: "default",
 				Instance: base.Instance{
 					Uuid: "uuid-1",
 					Request: request.Request{
@@ -205,6 +207,7 @@ func TestInit(t *testing.T) {
 			spaceGUID: "space-1",
 			serviceID: "service-1",
 			expectedInstance: &RDSInstance{
+				EncryptionKeyID: "default",
 				Instance: base.Instance{
 					Uuid: "uuid-1",
 					Request: request.Request{
@@ -243,6 +246,7 @@ func TestInit(t *testing.T) {
 			spaceGUID: "space-1",
 			serviceID: "service-1",
 			expectedInstance: &RDSInstance{
+				EncryptionKeyID: "default",
 				Instance: base.Instance{
 					Uuid: "uuid-1",
 					Request: request.Request{
@@ -279,6 +283,7 @@ func TestInit(t *testing.T) {
 			spaceGUID: "space-1",
 			serviceID: "service-1",
 			expectedInstance: &RDSInstance{
+				EncryptionKeyID: "default",
 				Instance: base.Instance{
 					Uuid: "uuid-1",
 					Request: request.Request{
@@ -339,8 +344,9 @@ func TestInit(t *testing.T) {
 				},
 			},
 			expectedInstance: &RDSInstance{
-				Database: "db",
-				Username: "fake-user",
+				EncryptionKeyID: "default",
+				Database:        "db",
+				Username:        "fake-user",
 				Instance: base.Instance{
 					Uuid: "uuid-1",
 					Request: request.Request{
@@ -540,6 +546,155 @@ func TestModifyInstance(t *testing.T) {
 			plan:     catalog.RDSPlan{},
 			settings: &config.Settings{},
 		},
+		"change extensions": {
+			options: Options{
+				Extensions: []string{"pgaudit", "pg_stat_statements", "pg_stat_statements"},
+			},
+			existingInstance: &RDSInstance{
+				DbType:     "postgres",
+				Extensions: []string{"auto_explain", "pg_stat_statements"},
+			},
+			expectedInstance: &RDSInstance{
+				DbType:            "postgres",
+				Extensions:        []string{"pg_stat_statements", "pgaudit"},
+				ExtensionsPending: true,
+				removedExtensions: []string{"auto_explain"},
+			},
+			plan:     catalog.RDSPlan{},
+			settings: &config.Settings{},
+		},
+		"create existing extensions": {
+			options: Options{
+				CreateExtensions: aws.Bool(true),
+			},
+			existingInstance: &RDSInstance{
+				DbType:     "postgres",
+				Extensions: []string{"pg_stat_statements"},
+			},
+			expectedInstance: &RDSInstance{
+				DbType:            "postgres",
+				Extensions:        []string{"pg_stat_statements"},
+				CreateExtensions:  true,
+				ExtensionsPending: true,
+			},
+			plan:     catalog.RDSPlan{},
+			settings: &config.Settings{},
+		},
+		"extensions are not supported by MySQL": {
+			options: Options{
+				Extensions: []string{"pg_stat_statements"},
+			},
+			existingInstance: &RDSInstance{
+				DbType: "mysql",
+			},
+			expectedInstance: &RDSInstance{
+				DbType: "mysql",
+			},
+			expectErr: true,
+			plan:      catalog.RDSPlan{},
+			settings:  &config.Settings{},
+		},
+		"upgrade major version": {
+			options: Options{
+				Version: "15",
+			},
+			existingInstance: &RDSInstance{
+				DbType:    "postgres",
+				DbVersion: "12",
+			},
+			expectedInstance: &RDSInstance{
+				DbType:         "postgres",
+				DbVersion:      "12",
+				UpgradeVersion: "15",
+			},
+			plan: catalog.RDSPlan{
+				ApprovedMajorVersions: []string{"12", "15"},
+			},
+			settings: &config.Settings{},
+		},
+		"same major version does not upgrade": {
+			options: Options{
+				Version: "8.0",
+			},
+			existingInstance: &RDSInstance{
+				DbType:    "mysql",
+				DbVersion: "8.0.35",
+			},
+			expectedInstance: &RDSInstance{
+				DbType:    "mysql",
+				DbVersion: "8.0.35",
+			},
+			plan:     catalog.RDSPlan{},
+			settings: &config.Settings{},
+		},
+		"upgrade to version not approved by the plan": {
+			options: Options{
+				Version: "16",
+			},
+			existingInstance: &RDSInstance{
+				DbType:    "postgres",
+				DbVersion: "12",
+			},
+			expectedInstance: &RDSInstance{
+				DbType:    "postgres",
+				DbVersion: "12",
+			},
+			expectErr: true,
+			plan: catalog.RDSPlan{
+				ApprovedMajorVersions: []string{"12", "15"},
+			},
+			settings: &config.Settings{},
+		},
+		"downgrade major version": {
+			options: Options{
+				Version: "12",
+			},
+			existingInstance: &RDSInstance{
+				DbType:    "postgres",
+				DbVersion: "15.4",
+			},
+			expectedInstance: &RDSInstance{
+				DbType:    "postgres",
+				DbVersion: "15.4",
+			},
+			expectErr: true,
+			plan:      catalog.RDSPlan{},
+			settings:  &config.Settings{},
+		},
+		"upgrade of an Aurora cluster": {
+			options: Options{
+				Version: "16",
+			},
+			existingInstance: &RDSInstance{
+				DbType:    "postgres",
+				DbVersion: "15",
+				Adapter:   "aurora",
+			},
+			expectedInstance: &RDSInstance{
+				DbType:    "postgres",
+				DbVersion: "15",
+				Adapter:   "aurora",
+			},
+			expectErr: true,
+			plan:      catalog.RDSPlan{},
+			settings:  &config.Settings{},
+		},
+		"IAM database authentication on an Aurora cluster": {
+			options: Options{
+				IAMAuth: aws.Bool(true),
+			},
+			existingInstance: &RDSInstance{
+				DbType:  "postgres",
+				Adapter: "aurora",
+			},
+			expectedInstance: &RDSInstance{
+				DbType:  "postgres",
+				Adapter: "aurora",
+			},
+			expectErr: true,
+			plan:      catalog.RDSPlan{},
+			settings:  &config.Settings{},
+		},
 		"does not allow backup retention less than minimum backup retention": {
 			options: Options{},
 			existingInstance: &RDSInstance{
@@ -641,3 +796,81 @@ func TestModifyInstanceRotateCredentials(t *testing.T) {
 		})
 	}
 }
+
+func TestParameters(t *testing.T) {
+	testCases := map[string]struct {
+		instance           *RDSInstance
+		expectedParameters map[string]interface{}
+	}{
+		"defaults": {
+			instance: &RDSInstance{
+				AllocatedStorage:      20,
+				DbVersion:             "15",
+				StorageType:           "gp3",
+				BackupRetentionPeriod: 14,
+			},
+			expectedParameters: map[string]interface{}{
+				"storage":                 int64(20),
+				"version":                 "15",
+				"storage_type":            "gp3",
+				"backup_retention_period": int64(14),
+			},
+		},
+		"optional settings": {
+			instance: &RDSInstance{
+				AllocatedStorage:                 20,
+				DbVersion:                        "8.0",
+				StorageType:                      "gp3",
+				BackupRetentionPeriod:            14,
+				BinaryLogFormat:                  "ROW",
+				EnabledCloudwatchLogGroupExports: []string{"error"},
+				ReplicaOf:                        "primary-guid",
+			},
+			expectedParameters: map[string]interface{}{
+				"storage":                              int64(20),
+				"version":                              "8.0",
+				"storage_type":                         "gp3",
+				"backup_retention_period":              int64(14),
+				"binary_log_format":                    "ROW",
+				"enable_cloudwatch_log_groups_exports": []string{"error"},
+				"read_replica_of":                      "primary-guid",
+			},
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if diff := deep.Equal(test.instance.parameters(), test.expectedParameters); diff != nil {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestEngine(t *testing.T) {
+	testCases := map[string]struct {
+		instance       *RDSInstance
+		expectedEngine string
+	}{
+		"dedicated postgres": {
+			instance:       &RDSInstance{DbType: "postgres", Adapter: "dedicated"},
+			expectedEngine: "postgres",
+		},
+		"aurora postgres": {
+			instance:       &RDSInstance{DbType: "postgres", Adapter: "aurora"},
+			expectedEngine: "aurora-postgresql",
+		},
+		"aurora mysql": {
+			instance:       &RDSInstance{DbType: "mysql", Adapter: "aurora"},
+			expectedEngine: "aurora-mysql",
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if engine := test.instance.engine(); engine != test.expectedEngine {
+				t.Errorf("expected engine %s, got %s", test.expectedEngine, engine)
+			}
+		})
+	}
+}
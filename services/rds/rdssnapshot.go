@@ -0,0 +1,40 @@
+package rds
+
+import (
+	"time"
+)
+
+// RDSSnapshot records the final snapshot taken when an instance is deleted so
+// that the space which owned the instance can later restore it.
+type RDSSnapshot struct {
+	SnapshotIdentifier string `gorm:"primary_key" sql:"type:varchar(255) PRIMARY KEY"`
+
+	InstanceUuid     string `sql:"size(255)"`
+	OrganizationGUID string `sql:"size(255)"`
+	SpaceGUID        string `sql:"size(255)"`
+	PlanID           string `sql:"size(255)"`
+
+	DbType           string `sql:"size(255)"`
+	DbVersion        string `sql:"size(255)"`
+	DbName           string `sql:"size(255)"`
+	Username         string `sql:"size(255)"`
+	AllocatedStorage int64  `sql:"size(255)"`
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func newFinalSnapshot(i *RDSInstance) *RDSSnapshot {
+	return &RDSSnapshot{
+		SnapshotIdentifier: i.finalSnapshotIdentifier(),
+		InstanceUuid:       i.Uuid,
+		OrganizationGUID:   i.OrganizationGUID,
+		SpaceGUID:          i.SpaceGUID,
+		PlanID:             i.PlanID,
+		DbType:             i.DbType,
+		DbVersion:          i.DbVersion,
+		DbName:             i.FormatDBName(),
+		Username:           i.Username,
+		AllocatedStorage:   i.AllocatedStorage,
+	}
+}
@@ -1,6 +1,14 @@
 package rds
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/18F/aws-broker/catalog"
+)
 
 func validateBinaryLogFormat(format string) error {
 	switch format {
@@ -19,3 +27,58 @@ func validateStorageType(storageType string) error {
 		return fmt.Errorf("storage type is not supported: %s", storageType)
 	}
 }
+
+func validateIAMAuth(iamAuth bool, dbType string, adapter string) error {
+	if iamAuth && adapter == "aurora" {
+		return errors.New("IAM database authentication is not supported for Aurora clusters")
+	}
+	if iamAuth && !supportsBindingUsers(dbType) {
+		return fmt.Errorf("IAM database authentication is not supported for %s databases", dbType)
+	}
+	return nil
+}
+
+func validateExtensions(extensions []string, dbType string, dbVersion string) error {
+	if len(extensions) == 0 {
+		return nil
+	}
+	if dbType != "postgres" {
+		return fmt.Errorf("extensions are not supported for %s databases", dbType)
+	}
+	allowed := allowedExtensions(dbVersion)
+	for _, name := range extensions {
+		if !slices.Contains(allowed, name) {
+			return fmt.Errorf("%s is not a supported extension; extensions must be one of: %s", name, strings.Join(allowed, ", "))
+		}
+	}
+	return nil
+}
+
+// brokerManagedParameters are set by the broker from other options, so users
+// cannot set them directly.
+var brokerManagedParameters = map[string]bool{
+	"log_bin_trust_function_creators":   true,
+	"binlog_format":                     true,
+	sharedPreloadLibrariesParameterName: true,
+}
+
+func validateCustomParameters(parameters map[string]string, plan catalog.RDSPlan) error {
+	names := make([]string, 0, len(parameters))
+	for name := range parameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if brokerManagedParameters[name] || !plan.CheckParameter(name) {
+			if len(plan.AllowedParameters) == 0 {
+				return fmt.Errorf("the %s plan does not allow setting database parameters", plan.Name)
+			}
+			return fmt.Errorf("%s is not an allowed parameter; parameters must be one of: %s", name, strings.Join(plan.AllowedParameters, ", "))
+		}
+		if parameters[name] == "" {
+			return fmt.Errorf("a value is required for parameter %s", name)
+		}
+	}
+	return nil
+}
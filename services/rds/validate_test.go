@@ -3,6 +3,7 @@ package rds
 import (
 	"testing"
 
+	"github.com/18F/aws-broker/catalog"
 	"github.com/18F/aws-broker/config"
 	"github.com/aws/aws-sdk-go/aws"
 )
@@ -123,3 +124,119 @@ func TestValidateRetentionPeriod(t *testing.T) {
 		})
 	}
 }
+
+func TestValidateCustomParameters(t *testing.T) {
+	plan := catalog.RDSPlan{
+		AllowedParameters: []string{"max_connections", "work_mem"},
+	}
+	testCases := map[string]struct {
+		parameters  map[string]string
+		plan        catalog.RDSPlan
+		expectedErr bool
+	}{
+		"empty": {
+			parameters:  map[string]string{},
+			plan:        catalog.RDSPlan{},
+			expectedErr: false,
+		},
+		"allowed": {
+			parameters:  map[string]string{"max_connections": "200", "work_mem": "8192"},
+			plan:        plan,
+			expectedErr: false,
+		},
+		"not allowed": {
+			parameters:  map[string]string{"shared_buffers": "1024"},
+			plan:        plan,
+			expectedErr: true,
+		},
+		"plan without allowed parameters": {
+			parameters:  map[string]string{"max_connections": "200"},
+			plan:        catalog.RDSPlan{},
+			expectedErr: true,
+		},
+		"managed by the broker": {
+			parameters: map[string]string{"shared_preload_libraries": "pg_cron"},
+			plan: catalog.RDSPlan{
+				AllowedParameters: []string{"shared_preload_libraries"},
+			},
+			expectedErr: true,
+		},
+		"empty value": {
+			parameters:  map[string]string{"max_connections": ""},
+			plan:        plan,
+			expectedErr: true,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			err := validateCustomParameters(test.parameters, test.plan)
+			if test.expectedErr && err == nil {
+				t.Fatalf("expected error")
+			}
+			if !test.expectedErr && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		})
+	}
+}
+
+func TestValidateExtensions(t *testing.T) {
+	testCases := map[string]struct {
+		extensions  []string
+		dbType      string
+		dbVersion   string
+		expectedErr bool
+	}{
+		"empty": {
+			dbType:      "mysql",
+			expectedErr: false,
+		},
+		"allowed": {
+			extensions:  []string{"pg_stat_statements", "pgaudit", "auto_explain"},
+			dbType:      "postgres",
+			dbVersion:   "15.4",
+			expectedErr: false,
+		},
+		"default version": {
+			extensions:  []string{"pgaudit"},
+			dbType:      "postgres",
+			expectedErr: false,
+		},
+		"not supported by the version": {
+			extensions:  []string{"pgaudit"},
+			dbType:      "postgres",
+			dbVersion:   "9.6",
+			expectedErr: true,
+		},
+		"not allowed": {
+			extensions:  []string{"postgis"},
+			dbType:      "postgres",
+			dbVersion:   "15",
+			expectedErr: true,
+		},
+		"pg_cron has its own option": {
+			extensions:  []string{"pg_cron"},
+			dbType:      "postgres",
+			dbVersion:   "15",
+			expectedErr: true,
+		},
+		"not postgres": {
+			extensions:  []string{"pg_stat_statements"},
+			dbType:      "mysql",
+			expectedErr: true,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			err := validateExtensions(test.extensions, test.dbType, test.dbVersion)
+			if test.expectedErr && err == nil {
+				t.Fatalf("expected error")
+			}
+			if !test.expectedErr && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		})
+	}
+}
@@ -1,37 +1,63 @@
 package redis
 
 import (
-	"encoding/json"
+	"fmt"
 	"net/http"
 	"os"
+	"strings"
 
 	"code.cloudfoundry.org/lager"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/elasticache"
+	"github.com/aws/aws-sdk-go/service/s3"
 	brokertags "github.com/cloud-gov/go-broker-tags"
 	"github.com/jinzhu/gorm"
 
+	"github.com/18F/aws-broker/awssecrets"
 	"github.com/18F/aws-broker/base"
 	"github.com/18F/aws-broker/catalog"
 	"github.com/18F/aws-broker/config"
 	"github.com/18F/aws-broker/helpers/request"
 	"github.com/18F/aws-broker/helpers/response"
+	"github.com/18F/aws-broker/helpers/schema"
 )
 
+// maxCacheClusters is the most nodes a replication group can have: a primary
+// and five replicas.
+const maxCacheClusters = 6
+
 type RedisOptions struct {
-	EngineVersion string `json:"engineVersion"`
+	EngineVersion       string `json:"engineVersion" description:"Engine version approved by the plan"`
+	NumCacheClusters    int    `json:"numCacheClusters" description:"Number of nodes, a primary and up to five replicas; 0 or omitted uses the plan's number"`
+	RestoreFromInstance string `json:"restore_from_instance" description:"GUID of a deleted instance to seed the instance with"`
 }
 
 func (r RedisOptions) Validate(settings *config.Settings) error {
+	if r.NumCacheClusters < 0 || r.NumCacheClusters > maxCacheClusters {
+		return fmt.Errorf("Invalid numCacheClusters %d; must be between 1 and %d, or 0 to use the plan's number of nodes", r.NumCacheClusters, maxCacheClusters)
+	}
 	return nil
 }
 
+// ParameterSchemas returns the schemas of the parameters accepted by Redis plans.
+func ParameterSchemas() *catalog.Schemas {
+	options := schema.Generate(RedisOptions{})
+	return &catalog.Schemas{
+		ServiceInstance: catalog.ServiceInstanceSchema{
+			Create: catalog.InputParametersSchema{Parameters: options},
+			// Only new instances can be seeded with the data of a deleted one.
+			Update: catalog.InputParametersSchema{Parameters: options.Without("restore_from_instance")},
+		},
+	}
+}
+
 type redisBroker struct {
-	brokerDB   *gorm.DB
-	settings   *config.Settings
-	logger     lager.Logger
-	tagManager brokertags.TagManager
+	brokerDB         *gorm.DB
+	settings         *config.Settings
+	logger           lager.Logger
+	tagManager       brokertags.TagManager
+	credentialsStore awssecrets.CredentialsStore
 }
 
 // InitRedisBroker is the constructor for the redisBroker.
@@ -42,7 +68,13 @@ func InitRedisBroker(
 ) base.Broker {
 	logger := lager.NewLogger("aws-redis-broker")
 	logger.RegisterSink(lager.NewWriterSink(os.Stdout, lager.INFO))
-	return &redisBroker{brokerDB, settings, logger, tagManager}
+	return &redisBroker{
+		brokerDB:         brokerDB,
+		settings:         settings,
+		logger:           logger,
+		tagManager:       tagManager,
+		credentialsStore: awssecrets.NewCredentialsStore(settings),
+	}
 }
 
 // this helps the manager to respond appropriately depending on whether a service/plan needs an operation to be async
@@ -53,7 +85,7 @@ func (broker *redisBroker) AsyncOperationRequired(c *catalog.Catalog, i base.Ins
 	case base.CreateOp:
 		return true
 	case base.ModifyOp:
-		return false
+		return true
 	case base.BindOp:
 		return false
 	default:
@@ -71,12 +103,15 @@ func initializeAdapter(plan catalog.RedisPlan, s *config.Settings, c *catalog.Ca
 		return redisAdapter, nil
 	}
 
-	elasticacheClient := elasticache.New(session.New(), aws.NewConfig().WithRegion(s.Region))
+	awsSession := session.New()
+	elasticacheClient := elasticache.New(awsSession, aws.NewConfig().WithRegion(s.Region))
+	s3Client := s3.New(awsSession, aws.NewConfig().WithRegion(s.Region))
 	redisAdapter = &dedicatedRedisAdapter{
 		Plan:        plan,
 		settings:    *s,
 		logger:      logger,
 		elasticache: elasticacheClient,
+		s3:          s3Client,
 	}
 	return redisAdapter, nil
 }
@@ -86,7 +121,7 @@ func (broker *redisBroker) CreateInstance(c *catalog.Catalog, id string, createR
 
 	options := RedisOptions{}
 	if len(createRequest.RawParameters) > 0 {
-		err := json.Unmarshal(createRequest.RawParameters, &options)
+		err := request.DecodeParameters(createRequest.RawParameters, &options)
 		if err != nil {
 			return response.NewErrorResponse(http.StatusBadRequest, "Invalid parameters. Error: "+err.Error())
 		}
@@ -150,9 +185,17 @@ func (broker *redisBroker) CreateInstance(c *catalog.Catalog, id string, createR
 	if adapterErr != nil {
 		return adapterErr
 	}
+
+	if options.RestoreFromInstance != "" {
+		if errResp := broker.restoreFromInstance(adapter, &newInstance, options.RestoreFromInstance); errResp != nil {
+			return errResp
+		}
+	}
+
 	// Create the redis instance.
 	status, err := adapter.createRedis(&newInstance, newInstance.ClearPassword)
 	if status == base.InstanceNotCreated {
+		broker.cleanupProvision(adapter, &newInstance)
 		desc := "There was an error creating the instance."
 		if err != nil {
 			desc = desc + " Error: " + err.Error()
@@ -164,14 +207,148 @@ func (broker *redisBroker) CreateInstance(c *catalog.Catalog, id string, createR
 	broker.brokerDB.NewRecord(newInstance)
 	err = broker.brokerDB.Create(&newInstance).Error
 	if err != nil {
+		broker.cleanupProvision(adapter, &newInstance)
 		return response.NewErrorResponse(http.StatusBadRequest, err.Error())
 	}
+	// Keep track of the resources until the instance is saved by the manager.
+	err = base.SaveProvisionedResources(broker.brokerDB, id, createRequest.ServiceID, createRequest.PlanID, newInstance.Provisioned)
+	if err != nil {
+		broker.logger.Error("CreateInstance - unable to record the resources of instance "+id, err)
+	}
 	return response.SuccessAcceptedResponse
 }
 
-func (broker *redisBroker) ModifyInstance(c *catalog.Catalog, id string, updateRequest request.Request, baseInstance base.Instance) response.Response {
-	// Note:  This is not currently supported for Redis instances.
-	return response.NewErrorResponse(http.StatusBadRequest, "Updating Redis service instances is not supported at this time.")
+// cleanupProvision tears down the resources created for an instance whose
+// provisioning failed, and records those that could not be deleted so that the
+// platform's orphan-mitigation delete can try again.
+func (broker *redisBroker) cleanupProvision(adapter redisAdapter, i *RedisInstance) {
+	remaining, err := i.Provisioned.Teardown(adapter.deleteProvisionedResource)
+	if err != nil {
+		broker.logger.Error("cleanupProvision - instance "+i.Uuid, err)
+	}
+	if err := base.SaveProvisionedResources(broker.brokerDB, i.Uuid, i.ServiceID, i.PlanID, remaining); err != nil {
+		broker.logger.Error("cleanupProvision - unable to record the resources of instance "+i.Uuid, err)
+	}
+}
+
+// CleanupProvision tears down the recorded resources of an instance that the
+// broker did not save, e.g. when the platform deletes it to mitigate orphans,
+// along with the cluster row saved by CreateInstance.
+func (broker *redisBroker) CleanupProvision(c *catalog.Catalog, id string, resources base.ProvisionedResources) response.Response {
+	if err := broker.brokerDB.Unscoped().Where("uuid = ?", id).Delete(&RedisInstance{}).Error; err != nil {
+		return response.NewErrorResponse(http.StatusInternalServerError, "Unable to delete the instance. Error: "+err.Error())
+	}
+	if len(resources) == 0 {
+		return response.SuccessDeleteResponse
+	}
+	plan, planErr := c.RedisService.FetchPlan(resources[0].PlanID)
+	if planErr != nil {
+		return planErr
+	}
+	adapter, adapterErr := initializeAdapter(plan, broker.settings, c, broker.logger)
+	if adapterErr != nil {
+		return adapterErr
+	}
+
+	remaining, err := resources.Teardown(adapter.deleteProvisionedResource)
+	if saveErr := base.SaveProvisionedResources(broker.brokerDB, id, resources[0].ServiceID, resources[0].PlanID, remaining); saveErr != nil {
+		return response.NewErrorResponse(http.StatusInternalServerError, "Unable to record the resources of the instance. Error: "+saveErr.Error())
+	}
+	if err != nil {
+		return response.NewErrorResponse(http.StatusInternalServerError, "There was an error deleting the resources of the instance. Error: "+err.Error())
+	}
+	return response.SuccessDeleteResponse
+}
+
+// restoreFromInstance sets up the instance to be seeded with the snapshot that
+// was exported when the source instance was deleted.
+func (broker *redisBroker) restoreFromInstance(adapter redisAdapter, i *RedisInstance, sourceGUID string) response.Response {
+	var count int64
+	broker.brokerDB.Where("uuid = ?", sourceGUID).First(&RedisInstance{}).Count(&count)
+	if count != 0 {
+		return response.NewErrorResponse(http.StatusBadRequest, "Instance "+sourceGUID+" has not been deleted; only deleted instances can be restored.")
+	}
+
+	export, err := adapter.findSnapshotExport(i, sourceGUID)
+	if err != nil {
+		return response.NewErrorResponse(http.StatusBadRequest, "Unable to restore instance "+sourceGUID+". Error: "+err.Error())
+	}
+	if err := i.restoreFromSnapshotExport(sourceGUID, export); err != nil {
+		return response.NewErrorResponse(http.StatusBadRequest, "Unable to restore instance "+sourceGUID+". Error: "+err.Error())
+	}
+	return nil
+}
+
+func (broker *redisBroker) ModifyInstance(c *catalog.Catalog, id string, modifyRequest request.Request, baseInstance base.Instance) response.Response {
+	existingInstance := RedisInstance{}
+
+	var count int64
+	broker.brokerDB.Where("uuid = ?", id).First(&existingInstance).Count(&count)
+	if count == 0 {
+		return response.NewErrorResponse(http.StatusNotFound, "The instance does not exist.")
+	}
+
+	options := RedisOptions{}
+	if len(modifyRequest.RawParameters) > 0 {
+		err := request.DecodeParameters(modifyRequest.RawParameters, &options)
+		if err != nil {
+			return response.NewErrorResponse(http.StatusBadRequest, "Invalid parameters. Error: "+err.Error())
+		}
+		err = options.Validate(broker.settings)
+		if err != nil {
+			return response.NewErrorResponse(http.StatusBadRequest, "Invalid parameters. Error: "+err.Error())
+		}
+	}
+
+	// Fetch the new plan that has been requested.
+	newPlan, newPlanErr := c.RedisService.FetchPlan(modifyRequest.PlanID)
+	if newPlanErr != nil {
+		return newPlanErr
+	}
+
+	// Don't allow updating to a service plan that doesn't support updates.
+	if !newPlan.PlanUpdateable {
+		return response.NewErrorResponse(
+			http.StatusBadRequest,
+			"Cannot switch to "+newPlan.Name+" because the service plan does not allow updates or modification.",
+		)
+	}
+
+	if options.EngineVersion != "" && !newPlan.CheckVersion(options.EngineVersion) {
+		return response.NewErrorResponse(
+			http.StatusBadRequest,
+			options.EngineVersion+" is not a supported major version; major version must be one of: "+strings.Join(newPlan.ApprovedMajorVersions, ", ")+".",
+		)
+	}
+
+	err := existingInstance.modify(options, newPlan)
+	if err != nil {
+		return response.NewErrorResponse(http.StatusBadRequest, "Failed to modify instance. Error: "+err.Error())
+	}
+
+	adapter, adapterErr := initializeAdapter(newPlan, broker.settings, c, broker.logger)
+	if adapterErr != nil {
+		return adapterErr
+	}
+
+	// Start modifying the replication group; the remaining changes are applied
+	// as the last operation is polled.
+	status, err := adapter.modifyRedis(&existingInstance, "")
+	if status == base.InstanceNotModified {
+		desc := "There was an error modifying the instance."
+		if err != nil {
+			desc = desc + " Error: " + err.Error()
+		}
+		return response.NewErrorResponse(http.StatusBadRequest, desc)
+	}
+
+	existingInstance.State = status
+	err = broker.brokerDB.Save(&existingInstance).Error
+	if err != nil {
+		return response.NewErrorResponse(http.StatusBadRequest, err.Error())
+	}
+
+	return response.NewAsyncOperationResponse(base.ModifyOp.String())
 }
 
 func (broker *redisBroker) LastOperation(c *catalog.Catalog, id string, baseInstance base.Instance, operation string) response.Response {
@@ -196,6 +373,17 @@ func (broker *redisBroker) LastOperation(c *catalog.Catalog, id string, baseInst
 	var state string
 
 	status, _ := adapter.checkRedisStatus(&existingInstance)
+
+	// ElastiCache applies one change to a replication group at a time, so the
+	// next change of a modification is started once the previous one is done.
+	if operation == base.ModifyOp.String() && status == base.InstanceReady {
+		status, _ = adapter.modifyRedis(&existingInstance, "")
+		if status != base.InstanceInProgress {
+			existingInstance.State = status
+			broker.brokerDB.Save(&existingInstance)
+		}
+	}
+
 	switch status {
 	case base.InstanceInProgress:
 		state = "in progress"
@@ -203,6 +391,8 @@ func (broker *redisBroker) LastOperation(c *catalog.Catalog, id string, baseInst
 		state = "succeeded"
 	case base.InstanceNotCreated:
 		state = "failed"
+	case base.InstanceNotModified:
+		state = "failed"
 	case base.InstanceNotGone:
 		state = "failed"
 	default:
@@ -211,7 +401,7 @@ func (broker *redisBroker) LastOperation(c *catalog.Catalog, id string, baseInst
 	return response.NewSuccessLastOperation(state, "The service instance status is "+state)
 }
 
-func (broker *redisBroker) BindInstance(c *catalog.Catalog, id string, bindRequest request.Request, baseInstance base.Instance) response.Response {
+func (broker *redisBroker) BindInstance(c *catalog.Catalog, id string, bindingID string, bindRequest request.Request, baseInstance base.Instance) response.Response {
 	existingInstance := RedisInstance{}
 
 	var count int64
@@ -225,7 +415,7 @@ func (broker *redisBroker) BindInstance(c *catalog.Catalog, id string, bindReque
 		return planErr
 	}
 
-	password, err := existingInstance.getPassword(broker.settings.EncryptionKey)
+	password, err := existingInstance.getPassword(broker.settings)
 	if err != nil {
 		return response.NewErrorResponse(http.StatusInternalServerError, "Unable to get instance password.")
 	}
@@ -236,6 +426,13 @@ func (broker *redisBroker) BindInstance(c *catalog.Catalog, id string, bindReque
 		return adapterErr
 	}
 
+	var bindingCount int64
+	existingBinding := RedisBinding{}
+	broker.brokerDB.Where("binding_id = ?", bindingID).First(&existingBinding).Count(&bindingCount)
+	if bindingCount != 0 && existingBinding.InstanceUuid != id {
+		return response.NewErrorResponse(http.StatusConflict, "The binding already exists for another instance")
+	}
+
 	var credentials map[string]string
 	// Bind the database instance to the application.
 	originalInstanceState := existingInstance.State
@@ -252,9 +449,103 @@ func (broker *redisBroker) BindInstance(c *catalog.Catalog, id string, bindReque
 		broker.brokerDB.Save(&existingInstance)
 	}
 
+	if err := broker.storeCredentials(c, plan, &existingInstance, credentials); err != nil {
+		broker.logger.Error("BindInstance - unable to store credentials", err)
+		return response.NewErrorResponse(http.StatusInternalServerError, "There was an error storing the credentials. Error: "+err.Error())
+	}
+
+	if bindingCount == 0 {
+		if err := broker.brokerDB.Create(&RedisBinding{BindingID: bindingID, InstanceUuid: id}).Error; err != nil {
+			return response.NewErrorResponse(http.StatusInternalServerError, err.Error())
+		}
+	}
+
 	return response.NewSuccessBindResponse(credentials)
 }
 
+// storeCredentials writes the credentials shared by the bindings of an
+// instance to Secrets Manager, when credentials are stored there, and records
+// the ARN of the secret.
+func (broker *redisBroker) storeCredentials(c *catalog.Catalog, plan catalog.RedisPlan, i *RedisInstance, credentials map[string]string) error {
+	if broker.credentialsStore == nil {
+		return nil
+	}
+	tags, err := broker.tagManager.GenerateTags(
+		brokertags.Create,
+		c.RedisService.Name,
+		plan.Name,
+		brokertags.ResourceGUIDs{
+			InstanceGUID:     i.Uuid,
+			SpaceGUID:        i.SpaceGUID,
+			OrganizationGUID: i.OrganizationGUID,
+		},
+		false,
+	)
+	if err != nil {
+		return err
+	}
+	name := awssecrets.CredentialsSecretName(c.RedisService.Name, i.Uuid, "")
+	if err := awssecrets.StoreCredentials(broker.credentialsStore, name, credentials, tags); err != nil {
+		return err
+	}
+	if i.CredentialsSecretARN != credentials[awssecrets.SecretARNKey] {
+		i.CredentialsSecretARN = credentials[awssecrets.SecretARNKey]
+		return broker.brokerDB.Save(i).Error
+	}
+	return nil
+}
+
+// UnbindInstance has nothing to revoke since all bindings share the instance
+// credentials, so it only forgets the binding.
+func (broker *redisBroker) UnbindInstance(c *catalog.Catalog, id string, bindingID string, baseInstance base.Instance) response.Response {
+	if err := broker.brokerDB.Unscoped().Where("binding_id = ? AND instance_uuid = ?", bindingID, id).Delete(RedisBinding{}).Error; err != nil {
+		return response.NewErrorResponse(http.StatusInternalServerError, err.Error())
+	}
+	return response.SuccessUnbindResponse
+}
+
+// FetchBinding returns the instance credentials, which all bindings share.
+func (broker *redisBroker) FetchBinding(c *catalog.Catalog, id string, bindingID string, baseInstance base.Instance) response.Response {
+	existingInstance := RedisInstance{}
+
+	var count int64
+	broker.brokerDB.Where("uuid = ?", id).First(&existingInstance).Count(&count)
+	if count == 0 {
+		return response.NewErrorResponse(http.StatusNotFound, "Instance not found")
+	}
+
+	var bindingCount int64
+	broker.brokerDB.Model(&RedisBinding{}).Where("binding_id = ? AND instance_uuid = ?", bindingID, id).Count(&bindingCount)
+	if bindingCount == 0 {
+		return response.NewErrorResponse(http.StatusNotFound, "Binding not found")
+	}
+
+	password, err := existingInstance.getPassword(broker.settings)
+	if err != nil {
+		return response.NewErrorResponse(http.StatusInternalServerError, "Unable to get instance password.")
+	}
+	credentials, err := existingInstance.getCredentials(password)
+	if err != nil {
+		return response.NewErrorResponse(http.StatusInternalServerError, "Unable to get instance credentials.")
+	}
+	if existingInstance.CredentialsSecretARN != "" {
+		credentials[awssecrets.SecretARNKey] = existingInstance.CredentialsSecretARN
+	}
+	return response.NewSuccessFetchBindingResponse(credentials)
+}
+
+// FetchInstance returns the plan and the settings applied to the instance.
+func (broker *redisBroker) FetchInstance(c *catalog.Catalog, id string, baseInstance base.Instance) response.Response {
+	existingInstance := RedisInstance{}
+
+	var count int64
+	broker.brokerDB.Where("uuid = ?", id).First(&existingInstance).Count(&count)
+	if count == 0 {
+		return response.NewErrorResponse(http.StatusNotFound, "Instance not found")
+	}
+	return response.NewSuccessFetchInstanceResponse(existingInstance.ServiceID, existingInstance.PlanID, "", existingInstance.parameters())
+}
+
 func (broker *redisBroker) DeleteInstance(c *catalog.Catalog, id string, baseInstance base.Instance) response.Response {
 	existingInstance := RedisInstance{}
 	var count int64
@@ -280,6 +571,12 @@ func (broker *redisBroker) DeleteInstance(c *catalog.Catalog, id string, baseIns
 		}
 		return response.NewErrorResponse(http.StatusBadRequest, desc)
 	}
+	if broker.credentialsStore != nil && existingInstance.CredentialsSecretARN != "" {
+		if err := broker.credentialsStore.DeleteCredentials(existingInstance.CredentialsSecretARN); err != nil {
+			broker.logger.Error("DeleteInstance - unable to delete stored credentials", err)
+		}
+	}
+	broker.brokerDB.Unscoped().Where("instance_uuid = ?", existingInstance.Uuid).Delete(RedisBinding{})
 	broker.brokerDB.Unscoped().Delete(&existingInstance)
 	return response.SuccessDeleteResponse
 }
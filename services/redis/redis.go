@@ -16,11 +16,13 @@ import (
 	"github.com/aws/aws-sdk-go/service/elasticache"
 	"github.com/aws/aws-sdk-go/service/elasticache/elasticacheiface"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/jinzhu/gorm"
 
 	"bytes"
 	"fmt"
 	"log"
+	"strings"
 )
 
 type redisAdapter interface {
@@ -29,6 +31,18 @@ type redisAdapter interface {
 	checkRedisStatus(i *RedisInstance) (base.InstanceState, error)
 	bindRedisToApp(i *RedisInstance, password string) (map[string]string, error)
 	deleteRedis(i *RedisInstance) (base.InstanceState, error)
+	findSnapshotExport(i *RedisInstance, sourceGUID string) (*snapshotExport, error)
+	deleteProvisionedResource(r base.ProvisionedResource) error
+}
+
+// replicationGroupResource is the type of the replication groups recorded while provisioning instances.
+const replicationGroupResource = "replication-group"
+
+// snapshotExport is the final snapshot of a deleted instance that was exported
+// to the snapshots bucket, along with the manifest of the instance.
+type snapshotExport struct {
+	SnapshotArns []string
+	Manifest     RedisInstance
 }
 
 type mockRedisAdapter struct {
@@ -36,9 +50,14 @@ type mockRedisAdapter struct {
 
 func (d *mockRedisAdapter) createRedis(i *RedisInstance, password string) (base.InstanceState, error) {
 	// TODO
+	i.Provisioned.Add(replicationGroupResource, i.ClusterID, "")
 	return base.InstanceReady, nil
 }
 
+func (d *mockRedisAdapter) deleteProvisionedResource(r base.ProvisionedResource) error {
+	return nil
+}
+
 func (d *mockRedisAdapter) modifyRedis(i *RedisInstance, password string) (base.InstanceState, error) {
 	// TODO
 	return base.InstanceReady, nil
@@ -59,6 +78,13 @@ func (d *mockRedisAdapter) deleteRedis(i *RedisInstance) (base.InstanceState, er
 	return base.InstanceGone, nil
 }
 
+func (d *mockRedisAdapter) findSnapshotExport(i *RedisInstance, sourceGUID string) (*snapshotExport, error) {
+	// TODO
+	return &snapshotExport{
+		SnapshotArns: []string{"arn:aws:s3:::snapshots/" + sourceGUID + "-final-0001.rdb"},
+	}, nil
+}
+
 type sharedRedisAdapter struct {
 	SharedRedisConn *gorm.DB
 }
@@ -88,6 +114,7 @@ type dedicatedRedisAdapter struct {
 	settings    config.Settings
 	logger      lager.Logger
 	elasticache elasticacheiface.ElastiCacheAPI
+	s3          s3iface.S3API
 }
 
 // This is the prefix for all pgroups created by the broker.
@@ -103,13 +130,74 @@ func (d *dedicatedRedisAdapter) createRedis(i *RedisInstance, password string) (
 	log.Println(awsutil.StringValue(resp))
 	// Decide if AWS service call was successful
 	if yes := d.didAwsCallSucceed(err); yes {
+		i.Provisioned.Add(replicationGroupResource, i.ClusterID, "")
 		return base.InstanceInProgress, nil
 	}
 	return base.InstanceNotCreated, nil
 }
 
+// modifyRedis brings the replication group one step closer to the instance.
+// ElastiCache only allows one change at a time, so it returns InstanceInProgress
+// after starting a change and InstanceReady once there is nothing left to change.
+// Replicas are added before and removed after the other changes, so that there
+// are always enough nodes for automatic failover.
 func (d *dedicatedRedisAdapter) modifyRedis(i *RedisInstance, password string) (base.InstanceState, error) {
-	return base.InstanceNotModified, nil
+	group, cluster, err := d.describeReplicationGroup(i)
+	if err != nil {
+		return base.InstanceNotModified, err
+	}
+	currentClusters := len(group.MemberClusters)
+	modifyParams := prepareModifyReplicationGroupInput(i, group, cluster)
+
+	switch {
+	case i.NumCacheClusters > currentClusters:
+		_, err = d.elasticache.IncreaseReplicaCount(&elasticache.IncreaseReplicaCountInput{
+			ReplicationGroupId: aws.String(i.ClusterID),
+			NewReplicaCount:    aws.Int64(int64(i.NumCacheClusters - 1)),
+			ApplyImmediately:   aws.Bool(true),
+		})
+	case modifyParams != nil:
+		_, err = d.elasticache.ModifyReplicationGroup(modifyParams)
+	case i.NumCacheClusters < currentClusters:
+		_, err = d.elasticache.DecreaseReplicaCount(&elasticache.DecreaseReplicaCountInput{
+			ReplicationGroupId: aws.String(i.ClusterID),
+			NewReplicaCount:    aws.Int64(int64(i.NumCacheClusters - 1)),
+			ApplyImmediately:   aws.Bool(true),
+		})
+	default:
+		return base.InstanceReady, nil
+	}
+
+	if yes := d.didAwsCallSucceed(err); yes {
+		return base.InstanceInProgress, nil
+	}
+	return base.InstanceNotModified, err
+}
+
+// describeReplicationGroup returns the replication group of the instance and
+// its first cache cluster, which has the settings that apply to every node.
+func (d *dedicatedRedisAdapter) describeReplicationGroup(i *RedisInstance) (*elasticache.ReplicationGroup, *elasticache.CacheCluster, error) {
+	groups, err := d.elasticache.DescribeReplicationGroups(&elasticache.DescribeReplicationGroupsInput{
+		ReplicationGroupId: aws.String(i.ClusterID),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(groups.ReplicationGroups) == 0 || len(groups.ReplicationGroups[0].MemberClusters) == 0 {
+		return nil, nil, errors.New("Couldn't find any instances.")
+	}
+	group := groups.ReplicationGroups[0]
+
+	clusters, err := d.elasticache.DescribeCacheClusters(&elasticache.DescribeCacheClustersInput{
+		CacheClusterId: group.MemberClusters[0],
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(clusters.CacheClusters) == 0 {
+		return nil, nil, errors.New("Couldn't find any cache clusters.")
+	}
+	return group, clusters.CacheClusters[0], nil
 }
 
 func (d *dedicatedRedisAdapter) checkRedisStatus(i *RedisInstance) (base.InstanceState, error) {
@@ -230,6 +318,22 @@ func (d *dedicatedRedisAdapter) deleteRedis(i *RedisInstance) (base.InstanceStat
 	return base.InstanceNotGone, nil
 }
 
+// deleteProvisionedResource deletes a resource created while provisioning an
+// instance that failed. Since the instance was never provisioned, no final
+// snapshot is taken.
+func (d *dedicatedRedisAdapter) deleteProvisionedResource(r base.ProvisionedResource) error {
+	if r.Type != replicationGroupResource {
+		return fmt.Errorf("unknown resource type %s", r.Type)
+	}
+	_, err := d.elasticache.DeleteReplicationGroup(&elasticache.DeleteReplicationGroupInput{
+		ReplicationGroupId: aws.String(r.Identifier),
+	})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == elasticache.ErrCodeReplicationGroupNotFoundFault {
+		return nil
+	}
+	return err
+}
+
 func (d *dedicatedRedisAdapter) didAwsCallSucceed(err error) bool {
 	// TODO Eventually return a formatted error object.
 	if err != nil {
@@ -256,7 +360,7 @@ func (d *dedicatedRedisAdapter) exportRedisSnapshot(i *RedisInstance) {
 		d.logger.Error("exportRedisSnapshot: aws.NewSession Failed", err)
 		return
 	}
-	path := i.OrganizationGUID + "/" + i.SpaceGUID + "/" + i.ServiceID + "/" + i.Uuid
+	path := snapshotExportPath(i)
 	bucket := d.settings.SnapshotsBucketName
 	s3_svc := s3.New(aws_session)
 	snapshot_name := i.ClusterID + "-final"
@@ -341,6 +445,102 @@ func (d *dedicatedRedisAdapter) exportRedisSnapshot(i *RedisInstance) {
 	d.logger.Info("exportRedisSnapshot: Snapshot and Manifest backup to s3 Complete.", lager.Data{"uuid": i.Uuid})
 }
 
+// snapshotExportPath is where the final snapshot of the instance is exported to
+// in the snapshots bucket.
+func snapshotExportPath(i *RedisInstance) string {
+	return i.OrganizationGUID + "/" + i.SpaceGUID + "/" + i.ServiceID + "/" + i.Uuid
+}
+
+// findSnapshotExport locates the snapshot and manifest exported when the source
+// instance was deleted. Exports are stored under the org and space of their
+// instance, so only the exports of the space the instance is created in are found.
+func (d *dedicatedRedisAdapter) findSnapshotExport(i *RedisInstance, sourceGUID string) (*snapshotExport, error) {
+	source := &RedisInstance{}
+	source.Uuid = sourceGUID
+	source.OrganizationGUID = i.OrganizationGUID
+	source.SpaceGUID = i.SpaceGUID
+	source.ServiceID = i.ServiceID
+	path := snapshotExportPath(source)
+	bucket := d.settings.SnapshotsBucketName
+
+	objects, err := d.s3.ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(path + "/"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	export := &snapshotExport{}
+	for _, object := range objects.Contents {
+		key := aws.StringValue(object.Key)
+		if strings.HasSuffix(key, ".rdb") {
+			export.SnapshotArns = append(export.SnapshotArns, fmt.Sprintf("arn:aws:s3:::%s/%s", bucket, key))
+		}
+	}
+	if len(export.SnapshotArns) == 0 {
+		return nil, fmt.Errorf("no snapshot of instance %s was found in this space", sourceGUID)
+	}
+
+	manifest, err := d.s3.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(path + "/instance_manifest.json"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer manifest.Body.Close()
+	if err := json.NewDecoder(manifest.Body).Decode(&export.Manifest); err != nil {
+		return nil, fmt.Errorf("the manifest of instance %s could not be read: %s", sourceGUID, err)
+	}
+	return export, nil
+}
+
+// prepareModifyReplicationGroupInput returns the changes needed to bring the
+// replication group in line with the instance, or nil if there are none.
+func prepareModifyReplicationGroupInput(
+	i *RedisInstance,
+	group *elasticache.ReplicationGroup,
+	cluster *elasticache.CacheCluster,
+) *elasticache.ModifyReplicationGroupInput {
+	params := &elasticache.ModifyReplicationGroupInput{
+		ReplicationGroupId: aws.String(i.ClusterID),
+		ApplyImmediately:   aws.Bool(true),
+	}
+	modified := false
+
+	if aws.StringValue(group.CacheNodeType) != i.CacheNodeType {
+		params.CacheNodeType = aws.String(i.CacheNodeType)
+		modified = true
+	}
+	if i.EngineVersion != "" && compareEngineVersions(i.EngineVersion, aws.StringValue(cluster.EngineVersion)) > 0 {
+		params.EngineVersion = aws.String(i.EngineVersion)
+		modified = true
+	}
+	failoverEnabled := aws.StringValue(group.AutomaticFailover) == elasticache.AutomaticFailoverStatusEnabled
+	if failoverEnabled != i.AutomaticFailoverEnabled {
+		params.AutomaticFailoverEnabled = aws.Bool(i.AutomaticFailoverEnabled)
+		modified = true
+	}
+	if aws.StringValue(cluster.PreferredMaintenanceWindow) != i.PreferredMaintenanceWindow {
+		params.PreferredMaintenanceWindow = aws.String(i.PreferredMaintenanceWindow)
+		modified = true
+	}
+	if aws.StringValue(group.SnapshotWindow) != i.SnapshotWindow {
+		params.SnapshotWindow = aws.String(i.SnapshotWindow)
+		modified = true
+	}
+	if aws.Int64Value(group.SnapshotRetentionLimit) != int64(i.SnapshotRetentionLimit) {
+		params.SnapshotRetentionLimit = aws.Int64(int64(i.SnapshotRetentionLimit))
+		modified = true
+	}
+
+	if !modified {
+		return nil
+	}
+	return params
+}
+
 func prepareCreateReplicationGroupInput(
 	i *RedisInstance,
 	password string,
@@ -374,5 +574,8 @@ func prepareCreateReplicationGroupInput(
 	if i.EngineVersion != "" {
 		params.EngineVersion = aws.String(i.EngineVersion)
 	}
+	if len(i.SnapshotArns) > 0 {
+		params.SnapshotArns = aws.StringSlice(i.SnapshotArns)
+	}
 	return params
 }
@@ -1,10 +1,19 @@
 package redis
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
 	"testing"
 
+	"github.com/18F/aws-broker/base"
+	"github.com/18F/aws-broker/config"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/elasticache"
+	"github.com/aws/aws-sdk-go/service/elasticache/elasticacheiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/go-test/deep"
 )
 
@@ -101,6 +110,40 @@ func TestPrepareCreateReplicationGroupInput(t *testing.T) {
 				EngineVersion: aws.String("7.0"),
 			},
 		},
+		"sets snapshot arns": {
+			redisInstance: &RedisInstance{
+				Description:                "description",
+				ClusterID:                  "cluster-1",
+				CacheNodeType:              "node-type",
+				DbSubnetGroup:              "db-group-1",
+				SecGroup:                   "sec-group-1",
+				NumCacheClusters:           1,
+				PreferredMaintenanceWindow: "1AM",
+				SnapshotWindow:             "4AM",
+				SnapshotRetentionLimit:     14,
+				SnapshotArns:               []string{"arn:aws:s3:::bucket/snapshot-0001.rdb"},
+			},
+			password: "fake-password",
+			expectedParams: &elasticache.CreateReplicationGroupInput{
+				AtRestEncryptionEnabled:     aws.Bool(true),
+				TransitEncryptionEnabled:    aws.Bool(true),
+				AutoMinorVersionUpgrade:     aws.Bool(true),
+				ReplicationGroupDescription: aws.String("description"),
+				AuthToken:                   aws.String("fake-password"),
+				AutomaticFailoverEnabled:    aws.Bool(false),
+				ReplicationGroupId:          aws.String("cluster-1"),
+				CacheNodeType:               aws.String("node-type"),
+				CacheSubnetGroupName:        aws.String("db-group-1"),
+				SecurityGroupIds:            []*string{aws.String("sec-group-1")},
+				Engine:                      aws.String("redis"),
+				NumCacheClusters:            aws.Int64(int64(1)),
+				Port:                        aws.Int64(6379),
+				PreferredMaintenanceWindow:  aws.String("1AM"),
+				SnapshotWindow:              aws.String("4AM"),
+				SnapshotRetentionLimit:      aws.Int64(int64(14)),
+				SnapshotArns:                []*string{aws.String("arn:aws:s3:::bucket/snapshot-0001.rdb")},
+			},
+		},
 	}
 	for name, test := range testCases {
 		t.Run(name, func(t *testing.T) {
@@ -114,3 +157,281 @@ func TestPrepareCreateReplicationGroupInput(t *testing.T) {
 		})
 	}
 }
+
+type mockElasticacheClient struct {
+	elasticacheiface.ElastiCacheAPI
+
+	replicationGroup *elasticache.ReplicationGroup
+	cacheCluster     *elasticache.CacheCluster
+	describeErr      error
+	modifyErr        error
+
+	increaseReplicaCountInput *elasticache.IncreaseReplicaCountInput
+	decreaseReplicaCountInput *elasticache.DecreaseReplicaCountInput
+	modifyInput               *elasticache.ModifyReplicationGroupInput
+}
+
+func (m *mockElasticacheClient) DescribeReplicationGroups(*elasticache.DescribeReplicationGroupsInput) (*elasticache.DescribeReplicationGroupsOutput, error) {
+	if m.describeErr != nil {
+		return nil, m.describeErr
+	}
+	return &elasticache.DescribeReplicationGroupsOutput{
+		ReplicationGroups: []*elasticache.ReplicationGroup{m.replicationGroup},
+	}, nil
+}
+
+func (m *mockElasticacheClient) DescribeCacheClusters(*elasticache.DescribeCacheClustersInput) (*elasticache.DescribeCacheClustersOutput, error) {
+	return &elasticache.DescribeCacheClustersOutput{
+		CacheClusters: []*elasticache.CacheCluster{m.cacheCluster},
+	}, nil
+}
+
+func (m *mockElasticacheClient) IncreaseReplicaCount(input *elasticache.IncreaseReplicaCountInput) (*elasticache.IncreaseReplicaCountOutput, error) {
+	m.increaseReplicaCountInput = input
+	return nil, m.modifyErr
+}
+
+func (m *mockElasticacheClient) DecreaseReplicaCount(input *elasticache.DecreaseReplicaCountInput) (*elasticache.DecreaseReplicaCountOutput, error) {
+	m.decreaseReplicaCountInput = input
+	return nil, m.modifyErr
+}
+
+func (m *mockElasticacheClient) ModifyReplicationGroup(input *elasticache.ModifyReplicationGroupInput) (*elasticache.ModifyReplicationGroupOutput, error) {
+	m.modifyInput = input
+	return nil, m.modifyErr
+}
+
+func TestModifyRedis(t *testing.T) {
+	newReplicationGroup := func(clusters int, failover string) *elasticache.ReplicationGroup {
+		group := &elasticache.ReplicationGroup{
+			CacheNodeType:          aws.String("cache.t3.micro"),
+			AutomaticFailover:      aws.String(failover),
+			SnapshotWindow:         aws.String("06:00-07:00"),
+			SnapshotRetentionLimit: aws.Int64(1),
+		}
+		for n := 1; n <= clusters; n++ {
+			group.MemberClusters = append(group.MemberClusters, aws.String(fmt.Sprintf("cluster-1-00%d", n)))
+		}
+		return group
+	}
+	newInstance := func(clusters int, nodeType string, failover bool) *RedisInstance {
+		return &RedisInstance{
+			ClusterID:                  "cluster-1",
+			CacheNodeType:              nodeType,
+			NumCacheClusters:           clusters,
+			EngineVersion:              "6.2",
+			AutomaticFailoverEnabled:   failover,
+			PreferredMaintenanceWindow: "mon:07:00-mon:08:00",
+			SnapshotWindow:             "06:00-07:00",
+			SnapshotRetentionLimit:     1,
+		}
+	}
+
+	testCases := map[string]struct {
+		instance         *RedisInstance
+		replicationGroup *elasticache.ReplicationGroup
+		engineVersion    string
+		describeErr      error
+		modifyErr        error
+		expectedState    base.InstanceState
+		expectIncrease   bool
+		expectDecrease   bool
+		expectedModify   *elasticache.ModifyReplicationGroupInput
+	}{
+		"nothing to change": {
+			instance:         newInstance(1, "cache.t3.micro", false),
+			replicationGroup: newReplicationGroup(1, "disabled"),
+			engineVersion:    "6.2.6",
+			expectedState:    base.InstanceReady,
+		},
+		"replicas are added first": {
+			instance:         newInstance(3, "cache.t3.small", true),
+			replicationGroup: newReplicationGroup(1, "disabled"),
+			engineVersion:    "6.2.6",
+			expectedState:    base.InstanceInProgress,
+			expectIncrease:   true,
+		},
+		"node type and failover are modified": {
+			instance:         newInstance(3, "cache.t3.small", true),
+			replicationGroup: newReplicationGroup(3, "disabled"),
+			engineVersion:    "6.2.6",
+			expectedState:    base.InstanceInProgress,
+			expectedModify: &elasticache.ModifyReplicationGroupInput{
+				ReplicationGroupId:       aws.String("cluster-1"),
+				ApplyImmediately:         aws.Bool(true),
+				CacheNodeType:            aws.String("cache.t3.small"),
+				AutomaticFailoverEnabled: aws.Bool(true),
+			},
+		},
+		"engine is upgraded": {
+			instance:         newInstance(1, "cache.t3.micro", false),
+			replicationGroup: newReplicationGroup(1, "disabled"),
+			engineVersion:    "5.0.6",
+			expectedState:    base.InstanceInProgress,
+			expectedModify: &elasticache.ModifyReplicationGroupInput{
+				ReplicationGroupId: aws.String("cluster-1"),
+				ApplyImmediately:   aws.Bool(true),
+				EngineVersion:      aws.String("6.2"),
+			},
+		},
+		"failover is disabled before replicas are removed": {
+			instance:         newInstance(1, "cache.t3.micro", false),
+			replicationGroup: newReplicationGroup(3, "enabled"),
+			engineVersion:    "6.2.6",
+			expectedState:    base.InstanceInProgress,
+			expectedModify: &elasticache.ModifyReplicationGroupInput{
+				ReplicationGroupId:       aws.String("cluster-1"),
+				ApplyImmediately:         aws.Bool(true),
+				AutomaticFailoverEnabled: aws.Bool(false),
+			},
+		},
+		"replicas are removed last": {
+			instance:         newInstance(1, "cache.t3.micro", false),
+			replicationGroup: newReplicationGroup(3, "disabled"),
+			engineVersion:    "6.2.6",
+			expectedState:    base.InstanceInProgress,
+			expectDecrease:   true,
+		},
+		"describe error": {
+			instance:         newInstance(1, "cache.t3.micro", false),
+			replicationGroup: newReplicationGroup(1, "disabled"),
+			describeErr:      errors.New("fail"),
+			expectedState:    base.InstanceNotModified,
+		},
+		"modify error": {
+			instance:         newInstance(3, "cache.t3.micro", false),
+			replicationGroup: newReplicationGroup(1, "disabled"),
+			engineVersion:    "6.2.6",
+			modifyErr:        errors.New("fail"),
+			expectedState:    base.InstanceNotModified,
+			expectIncrease:   true,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			client := &mockElasticacheClient{
+				replicationGroup: test.replicationGroup,
+				cacheCluster: &elasticache.CacheCluster{
+					EngineVersion:              aws.String(test.engineVersion),
+					PreferredMaintenanceWindow: aws.String("mon:07:00-mon:08:00"),
+				},
+				describeErr: test.describeErr,
+				modifyErr:   test.modifyErr,
+			}
+			adapter := &dedicatedRedisAdapter{
+				elasticache: client,
+			}
+
+			state, _ := adapter.modifyRedis(test.instance, "")
+			if state != test.expectedState {
+				t.Errorf("expected state %s, got %s", test.expectedState, state)
+			}
+			if test.expectIncrease != (client.increaseReplicaCountInput != nil) {
+				t.Errorf("expected replicas to be added: %t", test.expectIncrease)
+			}
+			if test.expectIncrease && *client.increaseReplicaCountInput.NewReplicaCount != int64(test.instance.NumCacheClusters-1) {
+				t.Errorf("unexpected replica count %d", *client.increaseReplicaCountInput.NewReplicaCount)
+			}
+			if test.expectDecrease != (client.decreaseReplicaCountInput != nil) {
+				t.Errorf("expected replicas to be removed: %t", test.expectDecrease)
+			}
+			if diff := deep.Equal(client.modifyInput, test.expectedModify); diff != nil {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+type mockS3Client struct {
+	s3iface.S3API
+
+	objects  map[string]string
+	listErr  error
+	prefixes []string
+}
+
+func (m *mockS3Client) ListObjectsV2(input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	m.prefixes = append(m.prefixes, *input.Prefix)
+	if m.listErr != nil {
+		return nil, m.listErr
+	}
+	output := &s3.ListObjectsV2Output{}
+	for key := range m.objects {
+		if strings.HasPrefix(key, *input.Prefix) {
+			output.Contents = append(output.Contents, &s3.Object{Key: aws.String(key)})
+		}
+	}
+	return output, nil
+}
+
+func (m *mockS3Client) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	body, ok := m.objects[*input.Key]
+	if !ok {
+		return nil, errors.New("NoSuchKey")
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(body))}, nil
+}
+
+func TestFindSnapshotExport(t *testing.T) {
+	instance := &RedisInstance{}
+	instance.OrganizationGUID = "org-1"
+	instance.SpaceGUID = "space-1"
+	instance.ServiceID = "service-1"
+
+	testCases := map[string]struct {
+		objects              map[string]string
+		listErr              error
+		expectedSnapshotArns []string
+		expectedVersion      string
+		expectErr            bool
+	}{
+		"export found": {
+			objects: map[string]string{
+				"org-1/space-1/service-1/old-guid/cg-old-guid-final-0001.rdb": "",
+				"org-1/space-1/service-1/old-guid/instance_manifest.json":     `{"EngineVersion": "6.2"}`,
+			},
+			expectedSnapshotArns: []string{"arn:aws:s3:::snapshots/org-1/space-1/service-1/old-guid/cg-old-guid-final-0001.rdb"},
+			expectedVersion:      "6.2",
+		},
+		"export of another space": {
+			objects: map[string]string{
+				"org-1/space-2/service-1/old-guid/cg-old-guid-final-0001.rdb": "",
+				"org-1/space-2/service-1/old-guid/instance_manifest.json":     `{}`,
+			},
+			expectErr: true,
+		},
+		"missing manifest": {
+			objects: map[string]string{
+				"org-1/space-1/service-1/old-guid/cg-old-guid-final-0001.rdb": "",
+			},
+			expectErr: true,
+		},
+		"list error": {
+			listErr:   errors.New("fail"),
+			expectErr: true,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			adapter := &dedicatedRedisAdapter{
+				settings: config.Settings{SnapshotsBucketName: "snapshots"},
+				s3:       &mockS3Client{objects: test.objects, listErr: test.listErr},
+			}
+			export, err := adapter.findSnapshotExport(instance, "old-guid")
+			if test.expectErr != (err != nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if test.expectErr {
+				return
+			}
+			if diff := deep.Equal(export.SnapshotArns, test.expectedSnapshotArns); diff != nil {
+				t.Error(diff)
+			}
+			if export.Manifest.EngineVersion != test.expectedVersion {
+				t.Errorf("expected manifest engine version %s, got %s", test.expectedVersion, export.Manifest.EngineVersion)
+			}
+		})
+	}
+}
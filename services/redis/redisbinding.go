@@ -0,0 +1,16 @@
+package redis
+
+import (
+	"time"
+)
+
+// RedisBinding records a binding to an instance, so that the broker can tell
+// the bindings it made from unknown ones. All bindings share the credentials
+// of the instance.
+type RedisBinding struct {
+	BindingID    string `gorm:"primary_key" sql:"type:varchar(255) PRIMARY KEY"`
+	InstanceUuid string `sql:"size(255)"`
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 
 	"github.com/18F/aws-broker/base"
 	"github.com/18F/aws-broker/helpers"
@@ -20,8 +21,9 @@ type RedisInstance struct {
 
 	Description string `sql:"size(255)"`
 
-	Password string `sql:"size(255)"`
-	Salt     string `sql:"size(255)"`
+	Password        string `sql:"type:text"`
+	Salt            string `sql:"size(255)"`
+	EncryptionKeyID string `sql:"size(255)"`
 
 	ClearPassword string `sql:"-"`
 
@@ -44,41 +46,98 @@ type RedisInstance struct {
 
 	EngineLogsGroupName string `sql:"size(512)"`
 	SlowLogsGroupName   string `sql:"size(512)"`
+
+	// RestoredFromInstance is the GUID of the deleted instance whose exported
+	// snapshot, at SnapshotArns, the instance was seeded with.
+	RestoredFromInstance string   `sql:"size(255)"`
+	SnapshotArns         []string `sql:"-"`
+
+	// CredentialsSecretARN is the secret holding the credentials shared by the
+	// bindings when they are stored in Secrets Manager.
+	CredentialsSecretARN string `sql:"size(2048)"`
 }
 
-func (i *RedisInstance) setPassword(password, key string) error {
+func (i *RedisInstance) setPassword(password string, s *config.Settings) error {
 	if i.Salt == "" {
 		return errors.New("Salt has to be set before writing the password")
 	}
 
 	iv, _ := base64.StdEncoding.DecodeString(i.Salt)
 
-	encrypted, err := helpers.Encrypt(password, key, iv)
+	encrypter, err := s.CurrentSecretEncrypter()
+	if err != nil {
+		return err
+	}
+	encrypted, err := encrypter.Encrypt(password, iv)
 	if err != nil {
 		return err
 	}
 
 	i.Password = encrypted
+	i.EncryptionKeyID = s.CurrentEncryptionKeyID()
 	i.ClearPassword = password
 
 	return nil
 }
 
-func (i *RedisInstance) getPassword(key string) (string, error) {
+func (i *RedisInstance) getPassword(s *config.Settings) (string, error) {
 	if i.Salt == "" || i.Password == "" {
 		return "", errors.New("Salt and password has to be set before writing the password")
 	}
 
+	encrypter, err := s.SecretEncrypter(i.EncryptionKeyID)
+	if err != nil {
+		return "", err
+	}
+
 	iv, _ := base64.StdEncoding.DecodeString(i.Salt)
 
-	decrypted, err := helpers.Decrypt(i.Password, key, iv)
+	decrypted, err := encrypter.Decrypt(i.Password, iv)
 	if err != nil {
 		return "", err
 	}
 
+	// Re-encrypt passwords encrypted by earlier versions of the broker, so
+	// that the next save stores them with authenticated encryption.
+	if helpers.IsLegacyEncryption(i.Password) {
+		if err := i.setPassword(decrypted, s); err != nil {
+			return "", err
+		}
+	}
+
 	return decrypted, nil
 }
 
+// RotateEncryptionKey re-encrypts the password of the instance with the current
+// encryption key, and reports whether it did. Passwords already encrypted with
+// the current key and scheme are left unchanged.
+func (i *RedisInstance) RotateEncryptionKey(s *config.Settings) (bool, error) {
+	if i.EncryptionKeyID == s.CurrentEncryptionKeyID() && !helpers.IsLegacyEncryption(i.Password) {
+		return false, nil
+	}
+	password, err := i.getPassword(s)
+	if err != nil {
+		return false, err
+	}
+	if err := i.setPassword(password, s); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// parameters returns the settings applied to the instance, keyed like the
+// options they can be set with.
+func (i *RedisInstance) parameters() map[string]interface{} {
+	parameters := map[string]interface{}{
+		"engineVersion":    i.EngineVersion,
+		"numCacheClusters": i.NumCacheClusters,
+	}
+	if i.RestoredFromInstance != "" {
+		parameters["restore_from_instance"] = i.RestoredFromInstance
+	}
+	return parameters
+}
+
 func (i *RedisInstance) getCredentials(password string) (map[string]string, error) {
 	var credentials map[string]string
 
@@ -124,7 +183,7 @@ func (i *RedisInstance) init(
 	i.ClusterID = s.DbShorthandPrefix + "-" + uuid
 	i.Salt = helpers.GenerateSalt(aes.BlockSize)
 	password := helpers.RandStr(25)
-	if err := i.setPassword(password, s.EncryptionKey); err != nil {
+	if err := i.setPassword(password, s); err != nil {
 		return err
 	}
 	// Set the DB Version
@@ -147,6 +206,70 @@ func (i *RedisInstance) init(
 	return nil
 }
 
+// restoreFromSnapshotExport sets up the instance to be seeded with the exported
+// snapshot. A snapshot can only be loaded by the engine version it was taken with
+// or a newer one.
+func (i *RedisInstance) restoreFromSnapshotExport(sourceGUID string, export *snapshotExport) error {
+	if export.Manifest.Uuid != "" && export.Manifest.Uuid != sourceGUID {
+		return fmt.Errorf("the manifest is for instance %s", export.Manifest.Uuid)
+	}
+	if i.EngineVersion != "" && export.Manifest.EngineVersion != "" && compareEngineVersions(i.EngineVersion, export.Manifest.EngineVersion) < 0 {
+		return fmt.Errorf("the snapshot was taken with engine version %s; please select engine version %s or newer", export.Manifest.EngineVersion, export.Manifest.EngineVersion)
+	}
+	i.RestoredFromInstance = sourceGUID
+	i.SnapshotArns = export.SnapshotArns
+	return nil
+}
+
+// modify applies the new plan and options to the instance. The replication
+// group is brought in line with it by modifyRedis.
+func (i *RedisInstance) modify(options RedisOptions, plan catalog.RedisPlan) error {
+	if options.EngineVersion != "" {
+		if compareEngineVersions(options.EngineVersion, i.EngineVersion) < 0 {
+			return fmt.Errorf("cannot downgrade the engine version from %s to %s", i.EngineVersion, options.EngineVersion)
+		}
+		i.EngineVersion = options.EngineVersion
+	}
+
+	i.PlanID = plan.ID
+	i.CacheNodeType = plan.CacheNodeType
+	i.NumCacheClusters = plan.NumCacheClusters
+	if options.NumCacheClusters > 0 {
+		i.NumCacheClusters = options.NumCacheClusters
+	}
+	i.AutomaticFailoverEnabled = plan.AutomaticFailoverEnabled
+	if i.AutomaticFailoverEnabled && i.NumCacheClusters < 2 {
+		return errors.New("automatic failover requires at least 2 nodes; please set numCacheClusters to 2 or more")
+	}
+	i.PreferredMaintenanceWindow = plan.PreferredMaintenanceWindow
+	i.SnapshotWindow = plan.SnapshotWindow
+	i.SnapshotRetentionLimit = plan.SnapshotRetentionLimit
+
+	return nil
+}
+
+// compareEngineVersions compares two dotted engine versions, returning -1, 0
+// or 1. Only the parts present in both are compared, so that e.g. 6.2 and the
+// 6.2.6 that ElastiCache reports for it are equal.
+func compareEngineVersions(a, b string) int {
+	aParts := strings.Split(a, ".")
+	bParts := strings.Split(b, ".")
+	for n := 0; n < len(aParts) && n < len(bParts); n++ {
+		aPart, aErr := strconv.Atoi(aParts[n])
+		bPart, bErr := strconv.Atoi(bParts[n])
+		if aErr != nil || bErr != nil {
+			return strings.Compare(aParts[n], bParts[n])
+		}
+		if aPart < bPart {
+			return -1
+		}
+		if aPart > bPart {
+			return 1
+		}
+	}
+	return 0
+}
+
 func (i *RedisInstance) setTags(
 	plan catalog.RedisPlan,
 	tags map[string]string,
@@ -1,6 +1,9 @@
 package redis
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
 	"testing"
 
 	"github.com/18F/aws-broker/catalog"
@@ -42,3 +45,219 @@ func TestInitInstanceTags(t *testing.T) {
 		t.Error(diff)
 	}
 }
+
+func TestModifyInstance(t *testing.T) {
+	plan := catalog.RedisPlan{
+		Plan:                     catalog.Plan{ID: "new-plan"},
+		CacheNodeType:            "cache.t3.small",
+		NumCacheClusters:         2,
+		AutomaticFailoverEnabled: true,
+	}
+
+	testCases := map[string]struct {
+		options                  RedisOptions
+		expectedEngineVersion    string
+		expectedNumCacheClusters int
+		expectErr                bool
+	}{
+		"applies the plan": {
+			options:                  RedisOptions{},
+			expectedEngineVersion:    "6.0",
+			expectedNumCacheClusters: 2,
+		},
+		"upgrades the engine and adds replicas": {
+			options: RedisOptions{
+				EngineVersion:    "7.0",
+				NumCacheClusters: 4,
+			},
+			expectedEngineVersion:    "7.0",
+			expectedNumCacheClusters: 4,
+		},
+		"cannot downgrade the engine": {
+			options: RedisOptions{
+				EngineVersion: "5.0.6",
+			},
+			expectErr: true,
+		},
+		"failover needs a replica": {
+			options: RedisOptions{
+				NumCacheClusters: 1,
+			},
+			expectErr: true,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			instance := &RedisInstance{
+				EngineVersion:    "6.0",
+				CacheNodeType:    "cache.t3.micro",
+				NumCacheClusters: 1,
+			}
+			err := instance.modify(test.options, plan)
+			if test.expectErr != (err != nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if test.expectErr {
+				return
+			}
+			if instance.PlanID != "new-plan" || instance.CacheNodeType != "cache.t3.small" || !instance.AutomaticFailoverEnabled {
+				t.Error("expected the instance to have the settings of the new plan")
+			}
+			if instance.EngineVersion != test.expectedEngineVersion {
+				t.Errorf("expected engine version %s, got %s", test.expectedEngineVersion, instance.EngineVersion)
+			}
+			if instance.NumCacheClusters != test.expectedNumCacheClusters {
+				t.Errorf("expected %d nodes, got %d", test.expectedNumCacheClusters, instance.NumCacheClusters)
+			}
+		})
+	}
+}
+
+func TestCompareEngineVersions(t *testing.T) {
+	testCases := map[string]struct {
+		a, b     string
+		expected int
+	}{
+		"older major":     {a: "5.0.6", b: "6.2", expected: -1},
+		"newer minor":     {a: "6.2", b: "6.0", expected: 1},
+		"reported patch":  {a: "6.2", b: "6.2.6", expected: 0},
+		"same version":    {a: "7.0", b: "7.0", expected: 0},
+		"newer patch":     {a: "5.0.6", b: "5.0.3", expected: 1},
+		"two digit minor": {a: "6.10", b: "6.2", expected: 1},
+	}
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if result := compareEngineVersions(test.a, test.b); result != test.expected {
+				t.Errorf("expected %d, got %d", test.expected, result)
+			}
+		})
+	}
+}
+
+func TestRestoreFromSnapshotExport(t *testing.T) {
+	testCases := map[string]struct {
+		engineVersion string
+		manifest      RedisInstance
+		expectErr     bool
+	}{
+		"same engine version": {
+			engineVersion: "6.2",
+			manifest:      RedisInstance{EngineVersion: "6.2.6"},
+		},
+		"newer engine version": {
+			engineVersion: "7.0",
+			manifest:      RedisInstance{EngineVersion: "6.2"},
+		},
+		"older engine version": {
+			engineVersion: "5.0.6",
+			manifest:      RedisInstance{EngineVersion: "6.2"},
+			expectErr:     true,
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			instance := &RedisInstance{EngineVersion: test.engineVersion}
+			export := &snapshotExport{
+				SnapshotArns: []string{"arn:aws:s3:::bucket/snapshot-0001.rdb"},
+				Manifest:     test.manifest,
+			}
+			err := instance.restoreFromSnapshotExport("old-guid", export)
+			if test.expectErr != (err != nil) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if test.expectErr {
+				return
+			}
+			if instance.RestoredFromInstance != "old-guid" || len(instance.SnapshotArns) != 1 {
+				t.Error("expected the instance to be seeded with the exported snapshot")
+			}
+		})
+	}
+}
+
+func TestRotateEncryptionKey(t *testing.T) {
+	oldSettings := &config.Settings{
+		EncryptionKey: helpers.RandStr(32),
+	}
+	newSettings := &config.Settings{
+		EncryptionKey:   helpers.RandStr(32),
+		EncryptionKeyID: "new-key",
+		DecryptionKeys: map[string]string{
+			config.DefaultEncryptionKeyID: oldSettings.EncryptionKey,
+		},
+	}
+
+	instance := &RedisInstance{Salt: helpers.GenerateSalt(aes.BlockSize)}
+	if err := instance.setPassword("the-password", oldSettings); err != nil {
+		t.Fatal(err)
+	}
+	// instances saved before key IDs were recorded
+	instance.EncryptionKeyID = ""
+
+	rotated, err := instance.RotateEncryptionKey(newSettings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rotated {
+		t.Fatal("expected the password to be re-encrypted")
+	}
+	if instance.EncryptionKeyID != "new-key" {
+		t.Errorf("unexpected key ID %s", instance.EncryptionKeyID)
+	}
+	password, err := instance.getPassword(&config.Settings{EncryptionKey: newSettings.EncryptionKey, EncryptionKeyID: "new-key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if password != "the-password" {
+		t.Errorf("expected the password to be decrypted with the new key, got %s", password)
+	}
+
+	rotated, err = instance.RotateEncryptionKey(newSettings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated {
+		t.Error("expected a password encrypted with the current key to be left unchanged")
+	}
+
+	instance.EncryptionKeyID = "unknown-key"
+	if _, err := instance.RotateEncryptionKey(newSettings); err == nil {
+		t.Error("expected an error for an unknown key")
+	}
+}
+
+func TestGetPasswordUpgradesLegacyEncryption(t *testing.T) {
+	settings := &config.Settings{EncryptionKey: helpers.RandStr(32)}
+	instance := &RedisInstance{Salt: helpers.GenerateSalt(aes.BlockSize)}
+
+	// passwords encrypted with AES-CFB by earlier versions of the broker
+	block, err := aes.NewCipher([]byte(settings.EncryptionKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	iv, _ := base64.StdEncoding.DecodeString(instance.Salt)
+	encrypted := make([]byte, len("the-password"))
+	cipher.NewCFBEncrypter(block, iv).XORKeyStream(encrypted, []byte("the-password"))
+	instance.Password = base64.StdEncoding.EncodeToString(encrypted)
+
+	password, err := instance.getPassword(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if password != "the-password" {
+		t.Errorf("unexpected password %s", password)
+	}
+	if helpers.IsLegacyEncryption(instance.Password) {
+		t.Error("expected the password to be re-encrypted")
+	}
+
+	password, err = instance.getPassword(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if password != "the-password" {
+		t.Errorf("expected the re-encrypted password to decrypt, got %s", password)
+	}
+}
@@ -2,10 +2,15 @@ package taskqueue
 
 import (
 	"fmt"
+	"log"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/18F/aws-broker/base"
 	"github.com/go-co-op/gocron"
+	"github.com/google/uuid"
+	"github.com/jinzhu/gorm"
 )
 
 // job state object persisted for brokers to access
@@ -30,43 +35,101 @@ type AsyncJobQueueKey struct {
 	Operation  base.Operation
 }
 
+// AsyncJob is the persisted record of an async job so that its state survives
+// a broker restart and is visible to every broker process sharing the database.
+// A job is owned by the broker process holding its lease, which is renewed while
+// the job runs. Unfinished jobs whose lease has expired are resumed by any broker
+// that has a handler registered for them.
+type AsyncJob struct {
+	ID             uint           `gorm:"primary_key"`
+	BrokerId       string         `gorm:"unique_index:idx_async_job_key" sql:"size(255)"`
+	InstanceId     string         `gorm:"unique_index:idx_async_job_key" sql:"size(255)"`
+	Operation      base.Operation `gorm:"unique_index:idx_async_job_key"`
+	State          base.InstanceState
+	Message        string `sql:"type:text"`
+	Owner          string `sql:"size(255)"`
+	LeaseExpiresAt time.Time
+	Finished       bool
+	FinishedAt     time.Time
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// JobHandler resumes an unfinished job for an instance. It must report state on
+// the channel and close it once the job is done, like any other job.
+type JobHandler func(instanceID string, jobchan chan AsyncJobMsg)
+
+type jobHandlerKey struct {
+	BrokerId  string
+	Operation base.Operation
+}
+
 // QueueManager maintains:
 //	 	A set of open channels for active jobs
-// 		A list of jobstates for requested job
-//		A task scheduler for cleanup of jobstates
-// 		A list of jobstates that need cleanup
+// 		The persisted jobstates for requested jobs
+//		A task scheduler for cleanup of jobstates, lease renewal and resuming jobs
+// 		A set of handlers used to resume unfinished jobs
+//
+// It is safe for concurrent use by HTTP handlers, the scheduler and the job
+// monitors: the maps are guarded by mu, and job state lives in the database.
 type QueueManager struct {
-	jobStates    map[AsyncJobQueueKey]AsyncJobState
+	db           *gorm.DB
+	owner        string
+	mu           sync.Mutex
 	brokerQueues map[AsyncJobQueueKey]chan AsyncJobMsg
-	cleanup      map[AsyncJobQueueKey]time.Time
+	handlers     map[jobHandlerKey]JobHandler
 	scheduler    *gocron.Scheduler
 	expiration   time.Duration
 	check        time.Duration
+	lease        time.Duration
 }
 
 // can be called to initialize the manager
-// defaults to do clean-up of jobstates after an hour.
-// runs clean up check every 15 minutes
-func NewQueueManager() *QueueManager {
+// defaults to do clean-up of jobstates 5 minutes after a job finishes.
+// runs clean up check every 2 minutes
+func NewQueueManager(db *gorm.DB) *QueueManager {
 	mgr := &QueueManager{
-		jobStates:    make(map[AsyncJobQueueKey]AsyncJobState),
+		db:           db,
+		owner:        newOwnerID(),
 		brokerQueues: make(map[AsyncJobQueueKey]chan AsyncJobMsg),
-		cleanup:      make(map[AsyncJobQueueKey]time.Time),
+		handlers:     make(map[jobHandlerKey]JobHandler),
 		scheduler:    gocron.NewScheduler(time.Local),
 		expiration:   5 * time.Minute, //platform issues last-operation calls every 2 minutes
 		check:        2 * time.Minute,
+		lease:        time.Minute,
 	}
 	return mgr
 }
 
-// must be called to activate cleanup mechanism
+// identifies this broker process as the owner of the jobs it runs
+func newOwnerID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s-%d-%s", hostname, os.Getpid(), uuid.NewString())
+}
+
+// must be called to activate cleanup, lease renewal and job resume mechanisms
 // separated from constructor to allow config and testing
 func (q *QueueManager) Init() {
 	q.scheduler.TagsUnique()
-	q.scheduler.Every(q.check).Tag("QueueCleaner").Do(q.cleanupJobStates)
+	// singleton mode keeps a slow run from overlapping with the next one
+	q.scheduler.Every(q.check).Tag("QueueCleaner").SingletonMode().Do(q.cleanupJobStates)
+	q.scheduler.Every(q.lease / 3).Tag("QueueLeaseRenewer").SingletonMode().Do(q.renewLeases)
+	q.scheduler.Every(q.check).Tag("QueueResumer").SingletonMode().Do(q.ResumeJobs)
 	q.scheduler.StartAsync()
 }
 
+// Allow brokers to register a handler to resume their unfinished jobs,
+// e.g. after the broker process that owned them was restarted.
+func (q *QueueManager) RegisterJobHandler(brokerid string, operation base.Operation, handler JobHandler) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.handlers[jobHandlerKey{BrokerId: brokerid, Operation: operation}] = handler
+}
+
 // Allow Jobs to be scheduled by brokers
 func (q *QueueManager) ScheduleTask(cronExpression string, id string, task interface{}) (*gocron.Job, error) {
 	return q.scheduler.Cron(cronExpression).Tag(id).Do(task)
@@ -90,14 +153,31 @@ func (q *QueueManager) IsTaskScheduled(id string) bool {
 	return false
 }
 
-// update the state list for the unique job
+// scopes a query to the job identified by key
+func (q *QueueManager) jobQuery(key *AsyncJobQueueKey) *gorm.DB {
+	return q.db.Model(&AsyncJob{}).Where(
+		"broker_id = ? AND instance_id = ? AND operation = ?",
+		key.BrokerId,
+		key.InstanceId,
+		key.Operation,
+	)
+}
+
+// update the persisted state for the unique job
 func (q *QueueManager) processMsg(msg AsyncJobMsg) {
 	key := &AsyncJobQueueKey{
 		BrokerId:   msg.BrokerId,
 		InstanceId: msg.InstanceId,
 		Operation:  msg.JobType,
 	}
-	q.jobStates[*key] = msg.JobState
+	// once another process has taken over the job, only its new owner reports state
+	err := q.jobQuery(key).Where("owner = ?", q.owner).Updates(map[string]interface{}{
+		"state":   msg.JobState.State,
+		"message": msg.JobState.Message,
+	}).Error
+	if err != nil {
+		log.Printf("taskqueue: unable to save state for %v: %s", key, err)
+	}
 }
 
 // async job monitor will process any messages
@@ -107,10 +187,26 @@ func (q *QueueManager) msgProcessor(jobChan chan AsyncJobMsg, key *AsyncJobQueue
 	for job := range jobChan {
 		q.processMsg(job)
 	}
-	// channel is closed so remove key from chan queue and mark state queue for cleanup
+	// channel is closed so mark the job finished, which releases it and
+	// schedules clean up of its state in the future
+	err := q.jobQuery(key).Where("owner = ?", q.owner).Updates(map[string]interface{}{
+		"finished":    true,
+		"finished_at": time.Now(),
+	}).Error
+	if err != nil {
+		log.Printf("taskqueue: unable to finish job %v: %s", key, err)
+	}
+	// remove key from chan queue
+	q.mu.Lock()
 	delete(q.brokerQueues, *key)
-	// schedule clean up of this job's state in the future
-	q.cleanup[*key] = time.Now().Add(q.expiration)
+	q.mu.Unlock()
+}
+
+// the number of jobs with an open channel in this process
+func (q *QueueManager) activeQueues() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.brokerQueues)
 }
 
 // async cron job to remove expired jobstates
@@ -119,19 +215,94 @@ func (q *QueueManager) msgProcessor(jobChan chan AsyncJobMsg, key *AsyncJobQueue
 // Create,Delete clean-up can be lazy,
 // TODO: Bind,Unbind,Modify operations should be cleaned quickly ?
 func (q *QueueManager) cleanupJobStates() {
+	err := q.db.Where("finished = ? AND finished_at < ?", true, time.Now().Add(-q.expiration)).Delete(AsyncJob{}).Error
+	if err != nil {
+		log.Printf("taskqueue: unable to clean up job states: %s", err)
+	}
+}
+
+// async cron job to extend the lease on the jobs this process is running
+// so that other broker processes do not resume them
+func (q *QueueManager) renewLeases() {
+	err := q.db.Model(&AsyncJob{}).
+		Where("owner = ? AND finished = ?", q.owner, false).
+		Update("lease_expires_at", time.Now().Add(q.lease)).Error
+	if err != nil {
+		log.Printf("taskqueue: unable to renew job leases: %s", err)
+	}
+}
+
+// ResumeJobs takes over unfinished jobs whose lease has expired, i.e. whose owner
+// stopped running, and restarts them with the handler registered by their broker.
+// It is run at startup and periodically thereafter by the scheduler.
+func (q *QueueManager) ResumeJobs() {
+	jobs := []AsyncJob{}
+	err := q.db.Where("finished = ? AND lease_expires_at < ?", false, time.Now()).Find(&jobs).Error
+	if err != nil {
+		log.Printf("taskqueue: unable to find unfinished jobs: %s", err)
+		return
+	}
+	for _, job := range jobs {
+		q.mu.Lock()
+		handler, present := q.handlers[jobHandlerKey{BrokerId: job.BrokerId, Operation: job.Operation}]
+		q.mu.Unlock()
+		if !present {
+			continue
+		}
+		// another broker process may have claimed the job first
+		jobchan, err := q.RequestTaskQueue(job.BrokerId, job.InstanceId, job.Operation)
+		if err != nil {
+			continue
+		}
+		log.Printf("taskqueue: resuming %s job for instance %s", job.Operation.String(), job.InstanceId)
+		go handler(job.InstanceId, jobchan)
+	}
+}
+
+// claims the persisted job for this process. A job can be claimed when it is new,
+// when its previous run finished, or when its owner's lease expired.
+func (q *QueueManager) claimJob(key *AsyncJobQueueKey) error {
 	now := time.Now()
-	for key, due := range q.cleanup {
-		if now.After(due) {
-			delete(q.jobStates, key)
-			delete(q.cleanup, key)
+	job := AsyncJob{}
+	err := q.jobQuery(key).First(&job).Error
+	if gorm.IsRecordNotFoundError(err) {
+		job = AsyncJob{
+			BrokerId:       key.BrokerId,
+			InstanceId:     key.InstanceId,
+			Operation:      key.Operation,
+			State:          base.InstanceInProgress,
+			Owner:          q.owner,
+			LeaseExpiresAt: now.Add(q.lease),
 		}
+		// the unique index on the key rejects concurrent claims from other processes
+		return q.db.Create(&job).Error
+	}
+	if err != nil {
+		return err
 	}
 
+	res := q.db.Model(&AsyncJob{}).
+		Where("id = ? AND (finished = ? OR lease_expires_at < ?)", job.ID, true, now).
+		Updates(map[string]interface{}{
+			"state":            base.InstanceInProgress,
+			"message":          "",
+			"owner":            q.owner,
+			"lease_expires_at": now.Add(q.lease),
+			"finished":         false,
+		})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("job is owned by %s", job.Owner)
+	}
+	return nil
 }
 
 // a broker or adapter can request a channel to communicate state of async processes.
 // the queue manager will launch a channel monitor to recieve messages and update the state of that async operation.
-// will return an error if a channel has already been launched. Channels must be closed by the recipient after use.
+// will return an error if a channel has already been launched, here or by another broker process holding the job's lease.
+// Channels must be closed by the recipient after use.
 // job state will be persisted and retained for a period of time before being cleaned up.
 func (q *QueueManager) RequestTaskQueue(brokerid string, instanceid string, operation base.Operation) (chan AsyncJobMsg, error) {
 	key := &AsyncJobQueueKey{
@@ -139,13 +310,25 @@ func (q *QueueManager) RequestTaskQueue(brokerid string, instanceid string, oper
 		InstanceId: instanceid,
 		Operation:  operation,
 	}
-	if _, present := q.brokerQueues[*key]; !present {
-		jobchan := make(chan AsyncJobMsg)
-		q.brokerQueues[*key] = jobchan
-		go q.msgProcessor(jobchan, key)
-		return jobchan, nil
+	// reserve the key before claiming the job so that concurrent requests
+	// in this process do not have to hold the lock during database calls
+	q.mu.Lock()
+	if _, present := q.brokerQueues[*key]; present {
+		q.mu.Unlock()
+		return nil, fmt.Errorf("taskqueue: a job queue already exists for that key: %v ", key)
+	}
+	jobchan := make(chan AsyncJobMsg)
+	q.brokerQueues[*key] = jobchan
+	q.mu.Unlock()
+
+	if err := q.claimJob(key); err != nil {
+		q.mu.Lock()
+		delete(q.brokerQueues, *key)
+		q.mu.Unlock()
+		return nil, fmt.Errorf("taskqueue: unable to claim job for that key: %v: %s", key, err)
 	}
-	return nil, fmt.Errorf("taskqueue: a job queue already exists for that key: %v ", key)
+	go q.msgProcessor(jobchan, key)
+	return jobchan, nil
 }
 
 // a broker or adapter can query the state of a job, will return an error if there is no known state.
@@ -157,8 +340,9 @@ func (q *QueueManager) GetTaskState(brokerid string, instanceid string, operatio
 		InstanceId: instanceid,
 		Operation:  operation,
 	}
-	if state, present := q.jobStates[*key]; present {
-		return &state, nil
+	job := AsyncJob{}
+	if err := q.jobQuery(key).First(&job).Error; err == nil {
+		return &AsyncJobState{State: job.State, Message: job.Message}, nil
 	}
 	return &AsyncJobState{}, fmt.Errorf("taskqueue: no state found for that key: %v", key)
 }
@@ -1,10 +1,14 @@
 package taskqueue
 
 import (
+	"fmt"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/18F/aws-broker/base"
+	"github.com/18F/aws-broker/common"
+	"github.com/jinzhu/gorm"
 )
 
 var brokerid string = "mybroker"
@@ -19,8 +23,55 @@ var testAsyncJobKey AsyncJobQueueKey = AsyncJobQueueKey{
 	Operation:  jobop,
 }
 
+func newTestDB(t *testing.T) *gorm.DB {
+	db, err := common.DBInit(&common.DBConfig{DbType: "sqlite3", DbName: ":memory:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every connection to an in-memory sqlite database gets its own database
+	db.DB().SetMaxOpenConns(1)
+	db.AutoMigrate(&AsyncJob{})
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func newTestQueueManager(t *testing.T) *QueueManager {
+	return NewQueueManager(newTestDB(t))
+}
+
+// waits for the persisted job to match the condition
+func waitForJob(t *testing.T, quemgr *QueueManager, condition func(job AsyncJob) bool) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		job := AsyncJob{}
+		if quemgr.jobQuery(&testAsyncJobKey).First(&job).Error == nil && condition(job) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("job did not reach the expected condition")
+}
+
+// waits for every job monitor of the manager to exit
+func waitForQueues(t *testing.T, quemgr *QueueManager) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		if quemgr.activeQueues() == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("job queues were not closed")
+}
+
+func countJobs(quemgr *QueueManager) int {
+	var count int
+	quemgr.db.Model(&AsyncJob{}).Count(&count)
+	return count
+}
+
 func TestRequestJobQueue(t *testing.T) {
-	quemgr := NewQueueManager()
+	quemgr := newTestQueueManager(t)
 	quemgr.expiration = 10 * time.Millisecond
 	jobchan, err := quemgr.RequestTaskQueue(brokerid, instanceid, jobop)
 	if err != nil {
@@ -35,18 +86,18 @@ func TestRequestJobQueue(t *testing.T) {
 			Message: jobmsg,
 		},
 	}
-	if len(quemgr.brokerQueues) != 1 {
+	if quemgr.activeQueues() != 1 {
 		t.Error("BrokerQueue has more than one channel registered!")
 	}
 	close(jobchan)
 	time.Sleep(100 * time.Millisecond)
-	if len(quemgr.brokerQueues) != 0 {
+	if quemgr.activeQueues() != 0 {
 		t.Error("BrokerQueue has more than zero channels registered!")
 	}
 }
 
 func TestGetJobState(t *testing.T) {
-	quemgr := NewQueueManager()
+	quemgr := newTestQueueManager(t)
 	quemgr.expiration = 10 * time.Millisecond
 	jobchan, err := quemgr.RequestTaskQueue(brokerid, instanceid, jobop)
 	if err != nil {
@@ -61,7 +112,7 @@ func TestGetJobState(t *testing.T) {
 			Message: jobmsg,
 		},
 	}
-	if len(quemgr.brokerQueues) != 1 {
+	if quemgr.activeQueues() != 1 {
 		t.Error("BrokerQueue has more than one channel registered!")
 	}
 	close(jobchan)
@@ -75,7 +126,7 @@ func TestGetJobState(t *testing.T) {
 }
 
 func TestCleanUpJobState(t *testing.T) {
-	quemgr := NewQueueManager()
+	quemgr := newTestQueueManager(t)
 	quemgr.expiration = 10 * time.Millisecond
 	jobchan, err := quemgr.RequestTaskQueue(brokerid, instanceid, jobop)
 	if err != nil {
@@ -90,22 +141,23 @@ func TestCleanUpJobState(t *testing.T) {
 			Message: jobmsg,
 		},
 	}
-	if len(quemgr.brokerQueues) != 1 {
+	if quemgr.activeQueues() != 1 {
 		t.Error("BrokerQueue has more than one channel registered!")
 	}
 	close(jobchan)
-	if len(quemgr.jobStates) != 1 {
+	if countJobs(quemgr) != 1 {
 		t.Error("Jobstates failed to initialize")
 	}
+	waitForJob(t, quemgr, func(job AsyncJob) bool { return job.Finished })
 	time.Sleep(100 * time.Millisecond)
 	quemgr.cleanupJobStates()
-	if len(quemgr.jobStates) > 0 {
+	if countJobs(quemgr) > 0 {
 		t.Error("Jobstates failed to cleanup")
 	}
 }
 
 func TestScheduleTask(t *testing.T) {
-	quemgr := NewQueueManager()
+	quemgr := newTestQueueManager(t)
 	quemgr.scheduler.StartAsync()
 	_, err := quemgr.ScheduleTask("*/1 * * * *", "test", quemgr.cleanupJobStates)
 	if err != nil {
@@ -118,7 +170,7 @@ func TestScheduleTask(t *testing.T) {
 }
 
 func TestUnScheduleTask(t *testing.T) {
-	quemgr := NewQueueManager()
+	quemgr := newTestQueueManager(t)
 	quemgr.scheduler.StartAsync()
 	_, err := quemgr.ScheduleTask("*/1 * * * *", "test", quemgr.cleanupJobStates)
 	if err != nil {
@@ -135,7 +187,7 @@ func TestUnScheduleTask(t *testing.T) {
 }
 
 func TestIsTaskScheduled(t *testing.T) {
-	quemgr := NewQueueManager()
+	quemgr := newTestQueueManager(t)
 	quemgr.scheduler.StartAsync()
 	_, err := quemgr.ScheduleTask("*/1 * * * *", "test", quemgr.cleanupJobStates)
 	if err != nil {
@@ -150,3 +202,270 @@ func TestIsTaskScheduled(t *testing.T) {
 	quemgr.scheduler.Stop()
 
 }
+
+func TestJobStateIsPersisted(t *testing.T) {
+	db := newTestDB(t)
+	quemgr := NewQueueManager(db)
+	jobchan, err := quemgr.RequestTaskQueue(brokerid, instanceid, jobop)
+	if err != nil {
+		t.Fatalf("RequestQueue failed! %v", err)
+	}
+	jobchan <- AsyncJobMsg{
+		BrokerId:   brokerid,
+		InstanceId: instanceid,
+		JobType:    jobop,
+		JobState: AsyncJobState{
+			State:   base.InstanceGone,
+			Message: jobmsg,
+		},
+	}
+	close(jobchan)
+	waitForJob(t, quemgr, func(job AsyncJob) bool { return job.Finished })
+
+	// a restarted or different broker process can still read the state
+	other := NewQueueManager(db)
+	state, err := other.GetTaskState(brokerid, instanceid, jobop)
+	if err != nil {
+		t.Fatalf("RequestJobState failed! %v", err)
+	}
+	if state.State != base.InstanceGone || state.Message != jobmsg {
+		t.Errorf("Jobstate is unexpected: %s %s", state.State.String(), state.Message)
+	}
+}
+
+func TestRequestJobQueueLeased(t *testing.T) {
+	db := newTestDB(t)
+	owner := NewQueueManager(db)
+	ownerchan, err := owner.RequestTaskQueue(brokerid, instanceid, jobop)
+	if err != nil {
+		t.Fatalf("RequestQueue failed! %v", err)
+	}
+
+	other := NewQueueManager(db)
+	if _, err := other.RequestTaskQueue(brokerid, instanceid, jobop); err == nil {
+		t.Fatal("expected an error requesting a job leased by another broker")
+	}
+
+	// the owner stopped renewing its lease
+	owner.jobQuery(&testAsyncJobKey).Update("lease_expires_at", time.Now().Add(-time.Second))
+	otherchan, err := other.RequestTaskQueue(brokerid, instanceid, jobop)
+	if err != nil {
+		t.Fatalf("expected the expired job to be claimed: %v", err)
+	}
+	job := AsyncJob{}
+	other.jobQuery(&testAsyncJobKey).First(&job)
+	if job.Owner != other.owner {
+		t.Errorf("expected job to be owned by %s, got %s", other.owner, job.Owner)
+	}
+
+	// the previous owner can no longer report state or finish the job
+	ownerchan <- AsyncJobMsg{
+		BrokerId:   brokerid,
+		InstanceId: instanceid,
+		JobType:    jobop,
+		JobState:   AsyncJobState{State: base.InstanceNotGone, Message: "stale owner"},
+	}
+	close(ownerchan)
+	waitForQueues(t, owner)
+	other.jobQuery(&testAsyncJobKey).First(&job)
+	if job.State != base.InstanceInProgress || job.Message != "" {
+		t.Errorf("job state should only be reported by its owner, got %s %s", job.State.String(), job.Message)
+	}
+	if job.Finished {
+		t.Error("job should only be finished by its owner")
+	}
+	close(otherchan)
+	waitForQueues(t, other)
+}
+
+func TestRenewLeases(t *testing.T) {
+	quemgr := newTestQueueManager(t)
+	jobchan, err := quemgr.RequestTaskQueue(brokerid, instanceid, jobop)
+	if err != nil {
+		t.Fatalf("RequestQueue failed! %v", err)
+	}
+	quemgr.jobQuery(&testAsyncJobKey).Update("lease_expires_at", time.Now().Add(-time.Second))
+	quemgr.renewLeases()
+
+	job := AsyncJob{}
+	quemgr.jobQuery(&testAsyncJobKey).First(&job)
+	if !job.LeaseExpiresAt.After(time.Now()) {
+		t.Error("expected the lease to be renewed")
+	}
+	close(jobchan)
+	waitForQueues(t, quemgr)
+}
+
+func TestResumeJobs(t *testing.T) {
+	testCases := map[string]struct {
+		leaseExpiresAt time.Time
+		registered     bool
+		expectResumed  bool
+	}{
+		"expired lease": {
+			leaseExpiresAt: time.Now().Add(-time.Second),
+			registered:     true,
+			expectResumed:  true,
+		},
+		"active lease": {
+			leaseExpiresAt: time.Now().Add(time.Hour),
+			registered:     true,
+		},
+		"no handler": {
+			leaseExpiresAt: time.Now().Add(-time.Second),
+		},
+	}
+
+	for name, test := range testCases {
+		t.Run(name, func(t *testing.T) {
+			quemgr := newTestQueueManager(t)
+			quemgr.db.Create(&AsyncJob{
+				BrokerId:       brokerid,
+				InstanceId:     instanceid,
+				Operation:      jobop,
+				State:          jobstate,
+				Owner:          "a-stopped-broker",
+				LeaseExpiresAt: test.leaseExpiresAt,
+			})
+
+			resumed := make(chan string, 1)
+			if test.registered {
+				quemgr.RegisterJobHandler(brokerid, jobop, func(id string, jobchan chan AsyncJobMsg) {
+					jobchan <- AsyncJobMsg{
+						BrokerId:   brokerid,
+						InstanceId: id,
+						JobType:    jobop,
+						JobState:   AsyncJobState{State: base.InstanceGone},
+					}
+					close(jobchan)
+					resumed <- id
+				})
+			}
+			quemgr.ResumeJobs()
+
+			if !test.expectResumed {
+				time.Sleep(50 * time.Millisecond)
+				if len(resumed) != 0 {
+					t.Fatal("job should not have been resumed")
+				}
+				return
+			}
+			select {
+			case id := <-resumed:
+				if id != instanceid {
+					t.Errorf("expected job for %s to be resumed, got %s", instanceid, id)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("job was not resumed")
+			}
+			waitForJob(t, quemgr, func(job AsyncJob) bool {
+				return job.Finished && job.State == base.InstanceGone && job.Owner == quemgr.owner
+			})
+		})
+	}
+}
+
+func TestConcurrentRequestsForSameJob(t *testing.T) {
+	quemgr := newTestQueueManager(t)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	jobchans := []chan AsyncJobMsg{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			jobchan, err := quemgr.RequestTaskQueue(brokerid, instanceid, jobop)
+			if err == nil {
+				mu.Lock()
+				jobchans = append(jobchans, jobchan)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(jobchans) != 1 {
+		t.Fatalf("expected exactly one job queue to be granted, got %d", len(jobchans))
+	}
+	close(jobchans[0])
+	waitForQueues(t, quemgr)
+}
+
+func TestConcurrentUse(t *testing.T) {
+	quemgr := newTestQueueManager(t)
+	quemgr.expiration = 0
+	quemgr.RegisterJobHandler(brokerid, base.ModifyOp, func(id string, jobchan chan AsyncJobMsg) {
+		close(jobchan)
+	})
+
+	instances := []string{}
+	for i := 0; i < 10; i++ {
+		instances = append(instances, fmt.Sprintf("instance-%d", i))
+	}
+
+	done := make(chan struct{})
+	var background sync.WaitGroup
+	// pollers, like the last-operation handlers, and the scheduled tasks
+	for _, task := range []func(){
+		func() {
+			for _, id := range instances {
+				quemgr.GetTaskState(brokerid, id, jobop)
+			}
+		},
+		quemgr.cleanupJobStates,
+		quemgr.renewLeases,
+		quemgr.ResumeJobs,
+		func() {
+			quemgr.RegisterJobHandler(brokerid, base.BindOp, func(id string, jobchan chan AsyncJobMsg) {
+				close(jobchan)
+			})
+		},
+	} {
+		background.Add(1)
+		go func(task func()) {
+			defer background.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					task()
+				}
+			}
+		}(task)
+	}
+
+	// jobs, like the async operations of the brokers
+	var jobs sync.WaitGroup
+	for _, id := range instances {
+		jobs.Add(1)
+		go func(id string) {
+			defer jobs.Done()
+			jobchan, err := quemgr.RequestTaskQueue(brokerid, id, jobop)
+			if err != nil {
+				t.Errorf("RequestQueue failed! %v", err)
+				return
+			}
+			for _, state := range []base.InstanceState{base.InstanceInProgress, base.InstanceInProgress, base.InstanceGone} {
+				jobchan <- AsyncJobMsg{
+					BrokerId:   brokerid,
+					InstanceId: id,
+					JobType:    jobop,
+					JobState:   AsyncJobState{State: state, Message: jobmsg},
+				}
+			}
+			close(jobchan)
+		}(id)
+	}
+	jobs.Wait()
+	waitForQueues(t, quemgr)
+	close(done)
+	background.Wait()
+
+	// every job finished and was then cleaned up
+	quemgr.cleanupJobStates()
+	if count := countJobs(quemgr); count != 0 {
+		t.Errorf("expected all jobs to be cleaned up, %d remain", count)
+	}
+}